@@ -0,0 +1,71 @@
+package admin
+
+// Servers exposing administrative endpoints, over HTTP and, optionally, as
+// a gRPC service. They listen on their own addresses, which should not be
+// reachable from the internet.
+
+import (
+	"errors"
+	"log"
+	"net"
+	"net/http"
+
+	"github.com/neubot/botticelli/common"
+	"google.golang.org/grpc"
+)
+
+// Address is the endpoint where the admin server listens. When empty,
+// the admin server is not started.
+var Address = ""
+
+// GRPCAddress is the endpoint where the gRPC admin server listens. When
+// empty, the gRPC admin server is not started.
+var GRPCAddress = ""
+
+var kv_mux = http.NewServeMux()
+
+var kv_grpc_server = grpc.NewServer()
+
+// HandleFunc registers `handler` for `pattern` on the admin server.
+func HandleFunc(pattern string, handler func(http.ResponseWriter,
+	*http.Request)) {
+	kv_mux.HandleFunc(pattern, handler)
+}
+
+// RegisterService registers `impl`, the implementation of the service
+// described by `desc`, on the gRPC admin server.
+func RegisterService(desc *grpc.ServiceDesc, impl interface{}) {
+	kv_grpc_server.RegisterService(desc, impl)
+}
+
+// Start starts the admin servers in the background.
+func Start() {
+	if Address != "" {
+		listener, err := common.Listen(Address)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			log.Printf("admin: listening on %s", Address)
+			server := &http.Server{Handler: kv_mux}
+			err := server.Serve(listener)
+			if err != nil && !errors.Is(err, net.ErrClosed) {
+				log.Fatal(err)
+			}
+		}()
+	}
+	if GRPCAddress != "" {
+		listener, err := common.Listen(GRPCAddress)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			log.Printf("admin: gRPC listening on %s", GRPCAddress)
+			err := kv_grpc_server.Serve(listener)
+			if err != nil && !errors.Is(err, net.ErrClosed) &&
+				!errors.Is(err, grpc.ErrServerStopped) {
+				log.Fatal(err)
+			}
+		}()
+	}
+}
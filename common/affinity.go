@@ -0,0 +1,15 @@
+package common
+
+// CPU affinity of the threads, which the data path may use to keep its
+// goroutines on given CPUs, such that the scheduler does not migrate them.
+
+// The largest CPU number we can pin to, as in the cpu_set_t of glibc.
+const kv_max_cpus = 1024
+
+// PinThread pins the calling thread to `cpu` and returns the function that
+// restores its previous affinity. The caller must have locked its goroutine
+// to the thread with runtime.LockOSThread and must restore the affinity
+// before unlocking it.
+func PinThread(cpu int) (func(), error) {
+	return pin_thread(cpu)
+}
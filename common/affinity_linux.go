@@ -0,0 +1,43 @@
+//go:build linux
+// +build linux
+
+package common
+
+import (
+	"errors"
+	"syscall"
+	"unsafe"
+)
+
+type cpu_set_t [kv_max_cpus / 64]uint64
+
+func sched_affinity(trap uintptr, set *cpu_set_t) error {
+	_, _, errno := syscall.RawSyscall(trap, 0, unsafe.Sizeof(*set),
+		uintptr(unsafe.Pointer(set)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// Pin_thread pins the calling thread to `cpu` and returns the function
+// restoring its previous affinity.
+func pin_thread(cpu int) (func(), error) {
+	if cpu < 0 || cpu >= kv_max_cpus {
+		return nil, errors.New("common: invalid CPU number")
+	}
+	previous := &cpu_set_t{}
+	err := sched_affinity(syscall.SYS_SCHED_GETAFFINITY, previous)
+	if err != nil {
+		return nil, err
+	}
+	set := &cpu_set_t{}
+	set[cpu/64] = 1 << uint(cpu%64)
+	err = sched_affinity(syscall.SYS_SCHED_SETAFFINITY, set)
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		sched_affinity(syscall.SYS_SCHED_SETAFFINITY, previous)
+	}, nil
+}
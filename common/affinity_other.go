@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package common
+
+import (
+	"errors"
+)
+
+// Pin_thread pins the calling thread to `cpu` and returns the function
+// restoring its previous affinity.
+func pin_thread(cpu int) (func(), error) {
+	return nil, errors.New("common: CPU pinning is not supported")
+}
@@ -0,0 +1,25 @@
+package common
+
+import (
+	"net"
+)
+
+// AnonymizeAddresses controls whether client addresses are truncated
+// before being written to logs or stored results.
+var AnonymizeAddresses = false
+
+// AnonymizeIP returns `ip` truncated to its /24 (IPv4) or /48 (IPv6)
+// network when AnonymizeAddresses is true, and `ip` otherwise.
+func AnonymizeIP(ip string) string {
+	if !AnonymizeAddresses {
+		return ip
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return "invalid"
+	}
+	if v4 := parsed.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return parsed.Mask(net.CIDRMask(48, 128)).String()
+}
@@ -0,0 +1,141 @@
+package asn
+
+// Mapping of IP addresses to their origin autonomous system, using the
+// prefix to AS dumps derived from RouteViews (e.g. the CAIDA pfx2as
+// datasets), where each line contains a prefix, its length and its origin
+// AS, separated by tabs. For multi-origin prefixes (`AS1_AS2`) and for AS
+// sets (`AS1,AS2`) we use the first AS.
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// File is the path of the prefix to AS dump, possibly gzip compressed.
+// When empty, ASN lookups are disabled.
+var File = ""
+
+// Prefixes indexed by prefix length and then by network address.
+type table_t map[int]map[string]uint32
+
+var kv_table table_t
+var kv_mutex sync.RWMutex
+
+// Load loads File, if configured.
+func Load() error {
+	if File == "" {
+		return nil
+	}
+	file, err := os.Open(File)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	var reader io.Reader = file
+	if strings.HasSuffix(File, ".gz") {
+		zipper, err := gzip.NewReader(file)
+		if err != nil {
+			return err
+		}
+		defer zipper.Close()
+		reader = zipper
+	}
+	table, count, err := parse(reader)
+	if err != nil {
+		return err
+	}
+	kv_mutex.Lock()
+	kv_table = table
+	kv_mutex.Unlock()
+	log.Printf("asn: loaded %d prefixes from %s", count, File)
+	return nil
+}
+
+func parse(reader io.Reader) (table_t, int, error) {
+	table := make(table_t)
+	count := 0
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 {
+			continue
+		}
+		ip := net.ParseIP(fields[0])
+		length, err := strconv.Atoi(fields[1])
+		if ip == nil || err != nil {
+			continue
+		}
+		origin := strings.FieldsFunc(fields[2], func(c rune) bool {
+			return c == '_' || c == ','
+		})
+		if len(origin) < 1 {
+			continue
+		}
+		number, err := strconv.ParseUint(origin[0], 10, 32)
+		if err != nil {
+			continue
+		}
+		bits := 128
+		if v4 := ip.To4(); v4 != nil {
+			ip, bits = v4, 32
+		}
+		if length < 0 || length > bits {
+			continue
+		}
+		network := ip.Mask(net.CIDRMask(length, bits)).String()
+		key := length
+		if bits == 32 {
+			key += 128 // IPv4 and IPv6 lengths must not collide
+		}
+		if table[key] == nil {
+			table[key] = make(map[string]uint32)
+		}
+		table[key][network] = uint32(number)
+		count += 1
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, 0, err
+	}
+	if count == 0 {
+		return nil, 0, errors.New("asn: no prefixes found")
+	}
+	return table, count, nil
+}
+
+// Lookup returns the origin AS of the longest prefix containing `ip`,
+// or zero if it is unknown or lookups are disabled.
+func Lookup(ip string) uint32 {
+	kv_mutex.RLock()
+	table := kv_table
+	kv_mutex.RUnlock()
+	if table == nil {
+		return 0
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return 0
+	}
+	bits, offset := 128, 0
+	if v4 := parsed.To4(); v4 != nil {
+		parsed, bits, offset = v4, 32, 128
+	}
+	for length := bits; length >= 0; length -= 1 {
+		networks := table[length+offset]
+		if networks == nil {
+			continue
+		}
+		network := parsed.Mask(net.CIDRMask(length, bits)).String()
+		if number, found := networks[network]; found {
+			return number
+		}
+	}
+	return 0
+}
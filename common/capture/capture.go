@@ -0,0 +1,146 @@
+package capture
+
+// Packet capture of some TCP flows into a pcap file, without libpcap. On
+// Linux, we read the packets from a packet socket, which requires the
+// CAP_NET_RAW capability, filtered in the kernel by a BPF program matching
+// the ports of the flows, and we check the addresses when we read them. We
+// only save the headers of the packets, and we stop when the file reaches
+// its maximum size. On other systems, Start fails with ErrUnsupported.
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+// ErrUnsupported is returned on systems where we cannot capture packets.
+var ErrUnsupported = errors.New("capture: not supported on this system")
+
+// Flow is a TCP connection whose packets we capture.
+type Flow struct {
+	Local  *net.TCPAddr
+	Remote *net.TCPAddr
+}
+
+// NewFlow returns the flow of `conn`, or nil if it is not a TCP connection.
+func NewFlow(conn net.Conn) *Flow {
+	local, ok := conn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return nil
+	}
+	remote, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return nil
+	}
+	return &Flow{Local: local, Remote: remote}
+}
+
+// Capture is a running packet capture.
+type Capture struct {
+	stop chan bool
+	done chan error
+	file io.WriteCloser
+}
+
+// Stop stops the capture and closes the file.
+func (capture *Capture) Stop() error {
+	close(capture.stop)
+	err := <-capture.done
+	close_err := capture.file.Close()
+	if err != nil {
+		return err
+	}
+	return close_err
+}
+
+// We save the IP and TCP headers, with options.
+const kv_snaplen = 128
+
+const kv_linktype_raw = 101
+
+var kv_error_full = errors.New("capture: the file is full")
+
+type pcap_writer_t struct {
+	writer   *bufio.Writer
+	size     int64
+	max_size int64
+}
+
+func new_pcap_writer(file io.Writer, max_size int64) (*pcap_writer_t,
+	error) {
+	writer := &pcap_writer_t{writer: bufio.NewWriter(file),
+		max_size: max_size}
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:4], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(header[4:6], 2)
+	binary.LittleEndian.PutUint16(header[6:8], 4)
+	binary.LittleEndian.PutUint32(header[16:20], kv_snaplen)
+	binary.LittleEndian.PutUint32(header[20:24], kv_linktype_raw)
+	_, err := writer.writer.Write(header)
+	writer.size = int64(len(header))
+	return writer, err
+}
+
+// Write_packet writes the captured `data` of a packet of `length` bytes
+// received at `when`. It fails with kv_error_full if the packet does not
+// fit in the file.
+func (writer *pcap_writer_t) write_packet(when time.Time, data []byte,
+	length int) error {
+	record := make([]byte, 16, 16+len(data))
+	if writer.size+int64(cap(record)) > writer.max_size {
+		return kv_error_full
+	}
+	binary.LittleEndian.PutUint32(record[0:4], uint32(when.Unix()))
+	binary.LittleEndian.PutUint32(record[4:8],
+		uint32(when.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(record[8:12], uint32(len(data)))
+	binary.LittleEndian.PutUint32(record[12:16], uint32(length))
+	record = append(record, data...)
+	_, err := writer.writer.Write(record)
+	writer.size += int64(len(record))
+	return err
+}
+
+func (writer *pcap_writer_t) flush() error {
+	return writer.writer.Flush()
+}
+
+// Match returns true if `packet`, starting from the IP header, belongs to
+// any of `flows`.
+func match(flows []*Flow, packet []byte) bool {
+	var source, destination net.IP
+	var header int
+	switch {
+	case len(packet) >= 20 && packet[0]>>4 == 4:
+		source, destination = packet[12:16], packet[16:20]
+		header = int(packet[0]&0x0f) * 4
+	case len(packet) >= 40 && packet[0]>>4 == 6:
+		source, destination = packet[8:24], packet[24:40]
+		header = 40
+	default:
+		return false
+	}
+	if len(packet) < header+4 {
+		return false
+	}
+	source_port := int(binary.BigEndian.Uint16(packet[header:]))
+	destination_port := int(binary.BigEndian.Uint16(packet[header+2:]))
+	for _, flow := range flows {
+		if flow.Local.IP.Equal(source) &&
+			flow.Local.Port == source_port &&
+			flow.Remote.IP.Equal(destination) &&
+			flow.Remote.Port == destination_port {
+			return true
+		}
+		if flow.Remote.IP.Equal(source) &&
+			flow.Remote.Port == source_port &&
+			flow.Local.IP.Equal(destination) &&
+			flow.Local.Port == destination_port {
+			return true
+		}
+	}
+	return false
+}
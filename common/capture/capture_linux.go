@@ -0,0 +1,193 @@
+//go:build linux
+// +build linux
+
+package capture
+
+import (
+	"errors"
+	"io"
+	"math"
+	"net"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// How often the capture loop checks whether it should stop.
+const kv_poll_interval = 100 * time.Millisecond
+
+// The BPF program needs 7 instructions per flow, and its jumps cannot be
+// longer than 255 instructions.
+const kv_max_flows = 32
+
+// Start starts capturing the packets of `flows` into `file`, which it
+// closes when the capture is stopped, writing up to `max_size` bytes. On
+// failure, the caller still owns `file`.
+func Start(flows []*Flow, file io.WriteCloser, max_size int64) (*Capture,
+	error) {
+	if len(flows) == 0 || len(flows) > kv_max_flows {
+		return nil, errors.New("capture: invalid number of flows")
+	}
+	// We do not bind the socket to a protocol until the filter is
+	// attached, such that it does not receive unfiltered packets.
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		return nil, err
+	}
+	err = syscall.AttachLsf(fd, filter(flows))
+	if err == nil {
+		timeout := syscall.NsecToTimeval(int64(kv_poll_interval))
+		err = syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET,
+			syscall.SO_RCVTIMEO, &timeout)
+	}
+	if err == nil {
+		err = syscall.Bind(fd, &syscall.SockaddrLinklayer{
+			Protocol: htons(syscall.ETH_P_ALL),
+		})
+	}
+	if err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	writer, err := new_pcap_writer(file, max_size)
+	if err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	capture := &Capture{
+		stop: make(chan bool),
+		done: make(chan error, 1),
+		file: file,
+	}
+	go capture.loop(fd, flows, writer)
+	return capture, nil
+}
+
+func htons(value uint16) uint16 {
+	bytes := [2]byte{byte(value >> 8), byte(value)}
+	return *(*uint16)(unsafe.Pointer(&bytes[0]))
+}
+
+func (capture *Capture) loop(fd int, flows []*Flow, writer *pcap_writer_t) {
+	defer syscall.Close(fd)
+	buffer := make([]byte, kv_snaplen)
+	loopback := make(map[int]bool)
+	var err error
+	for err == nil {
+		select {
+		case <-capture.stop:
+			capture.done <- writer.flush()
+			return
+		default:
+		}
+		var length int
+		var from syscall.Sockaddr
+		length, from, err = syscall.Recvfrom(fd, buffer, syscall.MSG_TRUNC)
+		if err == syscall.EAGAIN || err == syscall.EINTR {
+			err = nil
+			continue
+		}
+		if err != nil {
+			break
+		}
+		when := time.Now()
+		// On the loopback interface, we see each packet twice, when it
+		// is sent and when it is received
+		link, ok := from.(*syscall.SockaddrLinklayer)
+		if ok && link.Pkttype == syscall.PACKET_OUTGOING &&
+			is_loopback(loopback, link.Ifindex) {
+			continue
+		}
+		captured := buffer
+		if length < len(buffer) {
+			captured = buffer[:length]
+		}
+		if !match(flows, captured) {
+			continue
+		}
+		err = writer.write_packet(when, captured, length)
+	}
+	if err == kv_error_full {
+		err = nil
+	}
+	flush_err := writer.flush()
+	if err == nil {
+		err = flush_err
+	}
+	<-capture.stop
+	capture.done <- err
+}
+
+// Is_loopback returns whether the interface with `index` is the loopback
+// one, caching the answers in `cache`.
+func is_loopback(cache map[int]bool, index int) bool {
+	loopback, found := cache[index]
+	if !found {
+		iface, err := net.InterfaceByIndex(index)
+		loopback = err == nil && iface.Flags&net.FlagLoopback != 0
+		cache[index] = loopback
+	}
+	return loopback
+}
+
+func jump(from int, to int) uint8 {
+	return uint8(to - from - 1)
+}
+
+// Filter returns the BPF program accepting the TCP segments, over IPv4 or
+// IPv6 without extension headers, whose ports match those of any of
+// `flows`. The packets start with the IP header, since the socket is a
+// SOCK_DGRAM one. We accept whole packets, since the kernel would report
+// the truncated length otherwise, and truncate them when reading.
+func filter(flows []*Flow) []syscall.SockFilter {
+	const prologue = 11
+	accept := prologue + 7*len(flows)
+	drop := accept + 1
+	stmt := func(code int, k uint32) syscall.SockFilter {
+		return syscall.SockFilter{Code: uint16(code), K: k}
+	}
+	jeq := func(at int, k uint32, jt int, jf int) syscall.SockFilter {
+		return syscall.SockFilter{
+			Code: syscall.BPF_JMP | syscall.BPF_JEQ | syscall.BPF_K,
+			Jt:   jump(at, jt),
+			Jf:   jump(at, jf),
+			K:    k,
+		}
+	}
+	ldh_port := func(offset uint32) syscall.SockFilter {
+		return stmt(syscall.BPF_LD|syscall.BPF_H|syscall.BPF_IND, offset)
+	}
+	// Load the IP version, and the offset of the TCP header into X
+	program := []syscall.SockFilter{
+		stmt(syscall.BPF_LD|syscall.BPF_B|syscall.BPF_ABS, 0),
+		stmt(syscall.BPF_ALU|syscall.BPF_RSH|syscall.BPF_K, 4),
+		jeq(2, 4, 3, 7),
+		stmt(syscall.BPF_LD|syscall.BPF_B|syscall.BPF_ABS, 9),
+		jeq(4, syscall.IPPROTO_TCP, 5, drop),
+		stmt(syscall.BPF_LDX|syscall.BPF_B|syscall.BPF_MSH, 0),
+		stmt(syscall.BPF_JMP|syscall.BPF_JA, uint32(jump(6, prologue))),
+		jeq(7, 6, 8, drop),
+		stmt(syscall.BPF_LD|syscall.BPF_B|syscall.BPF_ABS, 6),
+		jeq(9, syscall.IPPROTO_TCP, 10, drop),
+		stmt(syscall.BPF_LDX|syscall.BPF_W|syscall.BPF_IMM, 40),
+	}
+	// Match the ports in both directions
+	for _, flow := range flows {
+		at := len(program)
+		next := at + 7
+		local, remote := uint32(flow.Local.Port), uint32(flow.Remote.Port)
+		program = append(program,
+			ldh_port(0),
+			jeq(at+1, local, at+2, at+4),
+			ldh_port(2),
+			jeq(at+3, remote, accept, next),
+			jeq(at+4, remote, at+5, next),
+			ldh_port(2),
+			jeq(at+6, local, accept, next),
+		)
+	}
+	return append(program,
+		stmt(syscall.BPF_RET|syscall.BPF_K, math.MaxUint32),
+		stmt(syscall.BPF_RET|syscall.BPF_K, 0),
+	)
+}
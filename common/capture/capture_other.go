@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package capture
+
+import (
+	"io"
+)
+
+// Start starts capturing the packets of `flows` into `file`, which it
+// closes when the capture is stopped, writing up to `max_size` bytes.
+func Start(flows []*Flow, file io.WriteCloser, max_size int64) (*Capture,
+	error) {
+	return nil, ErrUnsupported
+}
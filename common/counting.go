@@ -0,0 +1,105 @@
+package common
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// CountingConn is a net.Conn that atomically counts the bytes read and
+// written, the number of reads and writes, and the time of the last I/O,
+// such that throughput, interval sampling and metrics all come from the
+// same implementation.
+type CountingConn struct {
+	bytes_read    int64
+	bytes_written int64
+	reads         int64
+	writes        int64
+	last_io       int64 // nanoseconds since the epoch
+	net.Conn
+}
+
+// NewCountingConn wraps `conn` with a CountingConn.
+func NewCountingConn(conn net.Conn) *CountingConn {
+	return &CountingConn{Conn: conn}
+}
+
+func (conn *CountingConn) Read(data []byte) (int, error) {
+	count, err := conn.Conn.Read(data)
+	atomic.AddInt64(&conn.bytes_read, int64(count))
+	atomic.AddInt64(&conn.reads, 1)
+	atomic.StoreInt64(&conn.last_io, time.Now().UnixNano())
+	return count, err
+}
+
+func (conn *CountingConn) Write(data []byte) (int, error) {
+	count, err := conn.Conn.Write(data)
+	atomic.AddInt64(&conn.bytes_written, int64(count))
+	atomic.AddInt64(&conn.writes, 1)
+	atomic.StoreInt64(&conn.last_io, time.Now().UnixNano())
+	return count, err
+}
+
+// WriteBuffers writes and consumes `buffers` as a single write, which is
+// a single writev system call if the wrapped connection supports it.
+func (conn *CountingConn) WriteBuffers(buffers *net.Buffers) (int64, error) {
+	count, err := buffers.WriteTo(conn.Conn)
+	atomic.AddInt64(&conn.bytes_written, count)
+	atomic.AddInt64(&conn.writes, 1)
+	atomic.StoreInt64(&conn.last_io, time.Now().UnixNano())
+	return count, err
+}
+
+// BytesRead returns the number of bytes read so far.
+func (conn *CountingConn) BytesRead() int64 {
+	return atomic.LoadInt64(&conn.bytes_read)
+}
+
+// BytesWritten returns the number of bytes written so far.
+func (conn *CountingConn) BytesWritten() int64 {
+	return atomic.LoadInt64(&conn.bytes_written)
+}
+
+// Reads returns the number of reads so far.
+func (conn *CountingConn) Reads() int64 {
+	return atomic.LoadInt64(&conn.reads)
+}
+
+// Writes returns the number of writes so far.
+func (conn *CountingConn) Writes() int64 {
+	return atomic.LoadInt64(&conn.writes)
+}
+
+// LastIO returns the time of the last read or write, if any.
+func (conn *CountingConn) LastIO() time.Time {
+	last_io := atomic.LoadInt64(&conn.last_io)
+	if last_io == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, last_io)
+}
+
+// SyscallConn exposes the wrapped socket, e.g. to read its TCP_INFO.
+func (conn *CountingConn) SyscallConn() (syscall.RawConn, error) {
+	sysconn, ok := conn.Conn.(syscall.Conn)
+	if !ok {
+		return nil, errors.New("common: not a syscall.Conn")
+	}
+	return sysconn.SyscallConn()
+}
+
+// CountingListener is a net.Listener returning CountingConns.
+type CountingListener struct {
+	net.Listener
+}
+
+// Accept accepts a connection and wraps it with a CountingConn.
+func (listener *CountingListener) Accept() (net.Conn, error) {
+	conn, err := listener.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return NewCountingConn(conn), nil
+}
@@ -0,0 +1,114 @@
+package common
+
+// Selection of the source address, and hence of the uplink, of listeners
+// on multi-homed hosts. The host part of a listening address may be an
+// interface name, e.g. "eth1:3007", meaning the first address of that
+// interface, preferring IPv4. Replies use the address the client reached,
+// so, given a matching policy routing, they leave through that uplink.
+// Sessions accepting data connections should listen on PinnedAddress,
+// such that these use the same address as the control connection. When
+// the source address is not enough, e.g. with policy routing based on the
+// device, BindDevice binds all our sockets to a device (Linux only).
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"syscall"
+)
+
+// BindDevice is the name of the device to which we bind the listeners of
+// the tests, and hence the connections they accept. When empty, we do not
+// bind. The admin listener is not affected.
+var BindDevice = ""
+
+var kv_pinned = make(map[string]bool)
+var kv_pinned_mutex sync.Mutex
+
+// ResolveAddress replaces the interface name in `address`, if any, with
+// its first address.
+func ResolveAddress(address string) (string, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || host == "" || net.ParseIP(host) != nil {
+		return address, err
+	}
+	iface, err := net.InterfaceByName(host)
+	if err != nil {
+		return address, nil // a hostname
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return "", err
+	}
+	var found net.IP
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || ipnet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if found == nil || (found.To4() == nil && ipnet.IP.To4() != nil) {
+			found = ipnet.IP
+		}
+	}
+	if found == nil {
+		return "", errors.New("common: no usable address on " + host)
+	}
+	return net.JoinHostPort(found.String(), port), nil
+}
+
+// Pin records that we listen on the specific IP of `address`, if any, so
+// the data connections of its sessions should use the same IP.
+func pin(address string) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsUnspecified() {
+		return
+	}
+	kv_pinned_mutex.Lock()
+	defer kv_pinned_mutex.Unlock()
+	kv_pinned[ip.String()] = true
+}
+
+// PinnedAddress returns where to listen on `port` for the data connections
+// of the session of `conn`: on its local IP, if the listener that accepted
+// it is bound to a specific IP, and on all addresses otherwise.
+func PinnedAddress(conn net.Conn, port string) string {
+	addr, ok := conn.LocalAddr().(*net.TCPAddr)
+	if ok {
+		kv_pinned_mutex.Lock()
+		defer kv_pinned_mutex.Unlock()
+		if kv_pinned[addr.IP.String()] {
+			return net.JoinHostPort(addr.IP.String(), port)
+		}
+	}
+	return ":" + port
+}
+
+// ListenConfig returns the configuration to create listeners with, which
+// binds them to BindDevice, if set.
+func ListenConfig() *net.ListenConfig {
+	config := &net.ListenConfig{}
+	if BindDevice != "" {
+		config.Control = func(_, _ string, rawconn syscall.RawConn) error {
+			var err error
+			control_err := rawconn.Control(func(fd uintptr) {
+				err = bind_device(fd, BindDevice)
+			})
+			if control_err != nil {
+				return control_err
+			}
+			return err
+		}
+	}
+	return config
+}
+
+// ListenTCP is like net.Listen, using ListenConfig, for the listeners of
+// the data connections.
+func ListenTCP(address string) (net.Listener, error) {
+	return ListenConfig().Listen(context.Background(), "tcp", address)
+}
@@ -0,0 +1,13 @@
+//go:build linux
+// +build linux
+
+package common
+
+import (
+	"syscall"
+)
+
+// Bind_device binds the socket `fd` to the device `name`.
+func bind_device(fd uintptr, name string) error {
+	return syscall.BindToDevice(int(fd), name)
+}
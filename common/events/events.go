@@ -0,0 +1,152 @@
+package events
+
+// Publication of compact per-test events onto a NATS message bus, so that
+// real-time consumers can see measurements as they happen. Events are
+// queued in memory and dropped when the queue is full or the bus is down,
+// because we never want the message bus to slow down the tests.
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// NatsURL is the URL of the NATS server, e.g., `nats://127.0.0.1:4222`.
+// When empty, events are not published.
+var NatsURL = ""
+
+// Subject is the prefix of the subjects on which events are published.
+var Subject = "botticelli"
+
+const kv_queue_size = 1024
+const kv_reconnect_interval = 5 * time.Second
+const kv_io_timeout = 10 * time.Second
+
+type event_t struct {
+	subject string
+	payload []byte
+}
+
+var kv_queue = make(chan event_t, kv_queue_size)
+
+// Publish enqueues `event` for publication on `Subject.subject`.
+func Publish(subject string, event interface{}) {
+	if NatsURL == "" {
+		return
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("events: cannot marshal event: %s", err)
+		return
+	}
+	select {
+	case kv_queue <- event_t{subject: Subject + "." + subject,
+		payload: payload}:
+	default:
+		log.Println("events: queue full; dropping event")
+	}
+}
+
+// Start starts the goroutine that publishes queued events.
+func Start() {
+	if NatsURL == "" {
+		return
+	}
+	go func() {
+		for {
+			err := publish_loop()
+			log.Printf("events: connection to NATS lost: %s", err)
+			time.Sleep(kv_reconnect_interval)
+		}
+	}()
+}
+
+func publish_loop() error {
+	parsed, err := url.Parse(NatsURL)
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialTimeout("tcp", parsed.Host, kv_io_timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+
+	// The server greets us with INFO, then we send CONNECT
+
+	conn.SetReadDeadline(time.Now().Add(kv_io_timeout))
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		return fmt.Errorf("events: unexpected greeting: %q", line)
+	}
+	conn.SetReadDeadline(time.Time{})
+	options := map[string]interface{}{"verbose": false, "pedantic": false,
+		"name": "botticelli"}
+	if parsed.User != nil {
+		options["user"] = parsed.User.Username()
+		options["pass"], _ = parsed.User.Password()
+	}
+	data, err := json.Marshal(options)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(writer, "CONNECT %s\r\n", data)
+	if err = writer.Flush(); err != nil {
+		return err
+	}
+
+	// The reader goroutine answers PINGs and reports errors; the writer
+	// (this goroutine) publishes events. They share the writer, hence
+	// all writes happen here and the reader just asks for PONGs.
+
+	pings := make(chan bool, 1)
+	failure := make(chan error, 1)
+	go func() {
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				failure <- err
+				return
+			}
+			switch {
+			case strings.HasPrefix(line, "PING"):
+				select {
+				case pings <- true:
+				default:
+				}
+			case strings.HasPrefix(line, "-ERR"):
+				failure <- fmt.Errorf("events: %s", strings.TrimSpace(line))
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case event := <-kv_queue:
+			conn.SetWriteDeadline(time.Now().Add(kv_io_timeout))
+			fmt.Fprintf(writer, "PUB %s %d\r\n", event.subject,
+				len(event.payload))
+			writer.Write(event.payload)
+			writer.WriteString("\r\n")
+		case <-pings:
+			conn.SetWriteDeadline(time.Now().Add(kv_io_timeout))
+			writer.WriteString("PONG\r\n")
+		case err := <-failure:
+			return err
+		}
+		if err = writer.Flush(); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package events
+
+// Live progress of the running tests, streamed to subscribers using
+// server-sent events, e.g., `curl -N http://admin/progress?uuid=...`.
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Progress describes either a phase change ("phase") or a measurement
+// taken during a test ("interval").
+type Progress struct {
+	UUID       string    `json:"uuid"`
+	Kind       string    `json:"kind"`
+	Phase      string    `json:"phase"`
+	Elapsed    float64   `json:"elapsed,omitempty"`
+	Bytes      int       `json:"bytes,omitempty"`
+	SpeedKbits float64   `json:"speed_kbits,omitempty"`
+	Time       time.Time `json:"time"`
+}
+
+const kv_subscriber_queue_size = 64
+
+var kv_subscribers = make(map[chan *Progress]string)
+var kv_subscribers_mutex sync.Mutex
+
+// PublishProgress sends `progress` to the interested subscribers. Slow
+// subscribers lose messages rather than slowing down the tests.
+func PublishProgress(progress *Progress) {
+	progress.Time = time.Now()
+	kv_subscribers_mutex.Lock()
+	defer kv_subscribers_mutex.Unlock()
+	for channel, uuid := range kv_subscribers {
+		if uuid != "" && uuid != progress.UUID {
+			continue
+		}
+		select {
+		case channel <- progress:
+		default:
+		}
+	}
+}
+
+// ServeProgress streams progress as server-sent events. The optional
+// `uuid` query parameter restricts the stream to a single session.
+func ServeProgress(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", 500)
+		return
+	}
+	channel := make(chan *Progress, kv_subscriber_queue_size)
+	kv_subscribers_mutex.Lock()
+	kv_subscribers[channel] = r.URL.Query().Get("uuid")
+	kv_subscribers_mutex.Unlock()
+	defer func() {
+		kv_subscribers_mutex.Lock()
+		delete(kv_subscribers, channel)
+		kv_subscribers_mutex.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(200)
+	flusher.Flush()
+	for {
+		select {
+		case progress := <-channel:
+			data, err := json.Marshal(progress)
+			if err != nil {
+				continue
+			}
+			_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n",
+				progress.Kind, data)
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package events
+
+// HTTP webhooks fired when a session completes. The body is the JSON
+// result and, when a secret is configured, the `X-Botticelli-Signature`
+// header contains `sha256=<hex HMAC-SHA256 of the body>`.
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// WebhookURLs is a comma separated list of URLs to which results are
+// POSTed when sessions complete. The HMAC secret is read from the
+// BOTTICELLI_WEBHOOK_SECRET environment variable.
+var WebhookURLs = ""
+
+const kv_webhook_attempts = 3
+const kv_webhook_timeout = 10 * time.Second
+
+// Webhook asynchronously POSTs `result` to all the configured webhooks.
+func Webhook(result interface{}) {
+	if WebhookURLs == "" {
+		return
+	}
+	body, err := json.Marshal(result)
+	if err != nil {
+		log.Printf("events: cannot marshal webhook body: %s", err)
+		return
+	}
+	signature := ""
+	if secret := os.Getenv("BOTTICELLI_WEBHOOK_SECRET"); secret != "" {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+		signature = "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	}
+	for _, target := range strings.Split(WebhookURLs, ",") {
+		go post_webhook(strings.TrimSpace(target), body, signature)
+	}
+}
+
+func post_webhook(target string, body []byte, signature string) {
+	client := &http.Client{Timeout: kv_webhook_timeout}
+	for attempt := 1; attempt <= kv_webhook_attempts; attempt += 1 {
+		request, err := http.NewRequest("POST", target, bytes.NewReader(body))
+		if err != nil {
+			log.Printf("events: invalid webhook %s: %s", target, err)
+			return
+		}
+		request.Header.Set("Content-Type", "application/json")
+		if signature != "" {
+			request.Header.Set("X-Botticelli-Signature", signature)
+		}
+		response, err := client.Do(request)
+		if err == nil {
+			ioutil.ReadAll(response.Body)
+			response.Body.Close()
+			if response.StatusCode/100 == 2 {
+				return
+			}
+			log.Printf("events: webhook %s: %s", target, response.Status)
+		} else {
+			log.Printf("events: webhook %s: %s", target, err)
+		}
+		time.Sleep(time.Duration(attempt) * time.Second)
+	}
+	log.Printf("events: giving up on webhook %s", target)
+}
@@ -0,0 +1,46 @@
+package flowstats
+
+// Per-flow TCP statistics collected by eBPF programs attached to the tcp
+// tracepoints of the kernel, which run on every segment received and on
+// every retransmission, such that we see every RTT sample and we can read
+// the statistics without a getsockopt for each connection. The programs
+// only update the flows that we track, which we identify by their ports.
+// We assemble the programs ourselves, using the field offsets published
+// by tracefs, to avoid depending on a compiler or on kernel headers. Only
+// Linux on amd64 and arm64 is supported, and loading the programs requires
+// the CAP_BPF and CAP_PERFMON capabilities, or root.
+
+import (
+	"errors"
+)
+
+// ErrUnsupported is returned on systems where we cannot collect statistics.
+var ErrUnsupported = errors.New("flowstats: not supported on this system")
+
+// ErrNotStarted is returned when the collector has not been started.
+var ErrNotStarted = errors.New("flowstats: collector not started")
+
+// Stats are the statistics of a flow. Times are in microseconds, except
+// First and Last, which are in nanoseconds of the monotonic clock of the
+// kernel. MinSRTT and MaxSRTT are the extremes of the smoothed RTT.
+type Stats struct {
+	Samples     uint64 // segments received
+	SRTT        uint32
+	MinSRTT     uint32
+	MaxSRTT     uint32
+	SndCwnd     uint32
+	Acked       uint64 // bytes acknowledged by the peer
+	Received    uint64 // payload bytes received
+	Retransmits uint64
+	First       uint64 // when the first sample was taken
+	Last        uint64 // when the last sample was taken
+}
+
+// DeliveryRate returns the rate, in bytes per second, at which the peer
+// acknowledged data between `before` and `after`.
+func DeliveryRate(before, after *Stats) uint64 {
+	if after.Last <= before.Last || after.Acked < before.Acked {
+		return 0
+	}
+	return (after.Acked - before.Acked) * 1e09 / (after.Last - before.Last)
+}
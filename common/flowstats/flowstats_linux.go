@@ -0,0 +1,496 @@
+//go:build linux && (amd64 || arm64)
+// +build linux
+// +build amd64 arm64
+
+package flowstats
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// Commands and types of the bpf system call.
+const (
+	kv_bpf_map_create       = 0
+	kv_bpf_map_lookup_elem  = 1
+	kv_bpf_map_update_elem  = 2
+	kv_bpf_map_delete_elem  = 3
+	kv_bpf_prog_load        = 5
+	kv_bpf_map_type_hash    = 1
+	kv_bpf_prog_tracepoint  = 5
+	kv_bpf_noexist          = 1
+	kv_bpf_pseudo_map_fd    = 1
+	kv_bpf_map_lookup_fn    = 1
+	kv_bpf_ktime_get_ns_fn  = 5
+	kv_perf_type_tracepoint = 2
+	kv_perf_sample_raw      = 1 << 10
+	kv_perf_flag_cloexec    = 8
+	kv_perf_ioc_enable      = 0x2400
+	kv_perf_ioc_set_bpf     = 0x40042408
+)
+
+// Opcodes of the eBPF instructions we use.
+const (
+	kv_ldx_w   = 0x61
+	kv_ldx_h   = 0x69
+	kv_ldx_dw  = 0x79
+	kv_stx_w   = 0x63
+	kv_stx_dw  = 0x7b
+	kv_ld_dw   = 0x18
+	kv_add_k   = 0x07
+	kv_add_x   = 0x0f
+	kv_sub32_x = 0x1c
+	kv_or_x    = 0x4f
+	kv_lsh_k   = 0x67
+	kv_mov_k   = 0xb7
+	kv_mov_x   = 0xbf
+	kv_jeq_k   = 0x15
+	kv_jne_k   = 0x55
+	kv_jge_x   = 0x3d
+	kv_jle_x   = 0xbd
+	kv_call    = 0x85
+	kv_exit    = 0x95
+)
+
+// Offsets of the fields of the map values, which are 64 bit each.
+const (
+	kv_value_samples     = 0
+	kv_value_srtt        = 8
+	kv_value_min_srtt    = 16
+	kv_value_max_srtt    = 24
+	kv_value_snd_cwnd    = 32
+	kv_value_snd_una     = 40
+	kv_value_acked       = 48
+	kv_value_received    = 56
+	kv_value_retransmits = 64
+	kv_value_first       = 72
+	kv_value_last        = 80
+	kv_value_size        = 88
+)
+
+const kv_max_flows = 4096
+
+var kv_tracefs = []string{"/sys/kernel/tracing", "/sys/kernel/debug/tracing"}
+
+var kv_license = []byte("Dual BSD/GPL\x00")
+
+var kv_error_busy = errors.New("flowstats: flow already tracked")
+
+type insn_t struct {
+	code uint8
+	regs uint8 // src << 4 | dst
+	off  int16
+	imm  int32
+}
+
+func insn(code, dst, src uint8, off int16, imm int32) insn_t {
+	return insn_t{code: code, regs: src<<4 | dst, off: off, imm: imm}
+}
+
+type bpf_map_create_attr struct {
+	map_type    uint32
+	key_size    uint32
+	value_size  uint32
+	max_entries uint32
+	map_flags   uint32
+}
+
+type bpf_map_elem_attr struct {
+	map_fd uint32
+	_      uint32
+	key    unsafe.Pointer
+	value  unsafe.Pointer
+	flags  uint64
+}
+
+type bpf_prog_load_attr struct {
+	prog_type    uint32
+	insn_cnt     uint32
+	insns        unsafe.Pointer
+	license      unsafe.Pointer
+	log_level    uint32
+	log_size     uint32
+	log_buf      unsafe.Pointer
+	kern_version uint32
+	prog_flags   uint32
+}
+
+// First 64 bytes of struct perf_event_attr, which the kernel accepts.
+type perf_event_attr struct {
+	kind          uint32
+	size          uint32
+	config        uint64
+	sample_period uint64
+	sample_type   uint64
+	read_format   uint64
+	flags         uint64
+	wakeup_events uint32
+	bp_type       uint32
+	config1       uint64
+}
+
+var kv_collector = struct {
+	mutex   sync.Mutex
+	map_fd  int
+	started bool
+}{}
+
+func bpf(cmd uintptr, attr unsafe.Pointer, size uintptr) (int, error) {
+	fd, _, errno := syscall.Syscall(kv_sys_bpf, cmd, uintptr(attr), size)
+	if errno != 0 {
+		return -1, errno
+	}
+	return int(fd), nil
+}
+
+// Start loads and attaches the eBPF programs.
+func Start() error {
+	kv_collector.mutex.Lock()
+	defer kv_collector.mutex.Unlock()
+	if kv_collector.started {
+		return nil
+	}
+	probe, err := read_format("tcp/tcp_probe", map[string]int{
+		"sport": 2, "dport": 2, "data_len": 2, "snd_una": 4,
+		"snd_cwnd": 4, "srtt": 4,
+	})
+	if err != nil {
+		return err
+	}
+	retransmit, err := read_format("tcp/tcp_retransmit_skb", map[string]int{
+		"sport": 2, "dport": 2,
+	})
+	if err != nil {
+		return err
+	}
+	map_attr := bpf_map_create_attr{
+		map_type:    kv_bpf_map_type_hash,
+		key_size:    4,
+		value_size:  kv_value_size,
+		max_entries: kv_max_flows,
+	}
+	map_fd, err := bpf(kv_bpf_map_create, unsafe.Pointer(&map_attr),
+		unsafe.Sizeof(map_attr))
+	if err != nil {
+		return errors.New("flowstats: cannot create map: " + err.Error())
+	}
+	// We do not close the programs and the events, which must stay
+	// attached until we exit.
+	err = attach(probe, probe_program(map_fd, probe.offsets))
+	if err == nil {
+		err = attach(retransmit,
+			retransmit_program(map_fd, retransmit.offsets))
+	}
+	if err != nil {
+		syscall.Close(map_fd)
+		return err
+	}
+	kv_collector.map_fd, kv_collector.started = map_fd, true
+	return nil
+}
+
+type tracepoint_t struct {
+	id      uint64
+	offsets map[string]int16
+}
+
+// Read_format reads the ID of the tracepoint `name` and the offsets of
+// its `fields`, checking that they have the expected size.
+func read_format(name string, fields map[string]int) (*tracepoint_t, error) {
+	var file *os.File
+	var dir string
+	var err error
+	for _, root := range kv_tracefs {
+		dir = root + "/events/" + name
+		file, err = os.Open(dir + "/format")
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, errors.New("flowstats: cannot find tracepoint " + name)
+	}
+	defer file.Close()
+	tracepoint := &tracepoint_t{offsets: make(map[string]int16)}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// E.g. "field:__u16 sport;	offset:64;	size:2;	signed:0;"
+		parts := strings.Split(strings.TrimSpace(scanner.Text()), ";")
+		if len(parts) < 3 || !strings.HasPrefix(parts[0], "field:") {
+			continue
+		}
+		words := strings.Fields(parts[0])
+		field := words[len(words)-1]
+		size, found := fields[field]
+		if !found {
+			continue
+		}
+		offset, err := strconv.Atoi(strings.TrimPrefix(
+			strings.TrimSpace(parts[1]), "offset:"))
+		if err != nil {
+			continue
+		}
+		actual, err := strconv.Atoi(strings.TrimPrefix(
+			strings.TrimSpace(parts[2]), "size:"))
+		if err != nil || actual != size || offset%size != 0 {
+			return nil, errors.New("flowstats: unexpected field " +
+				field + " in " + name)
+		}
+		tracepoint.offsets[field] = int16(offset)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(tracepoint.offsets) != len(fields) {
+		return nil, errors.New("flowstats: missing fields in " + name)
+	}
+	data, err := os.ReadFile(dir + "/id")
+	if err != nil {
+		return nil, err
+	}
+	tracepoint.id, err = strconv.ParseUint(strings.TrimSpace(string(data)),
+		10, 64)
+	if err != nil {
+		return nil, err
+	}
+	return tracepoint, nil
+}
+
+// Lookup returns the instructions looking up the flow of the event in the
+// map, leaving the context in r6 and the value in r0.
+func lookup(map_fd int, offsets map[string]int16) []insn_t {
+	return []insn_t{
+		insn(kv_mov_x, 6, 1, 0, 0),
+		insn(kv_ldx_h, 1, 6, offsets["sport"], 0),
+		insn(kv_lsh_k, 1, 0, 0, 16),
+		insn(kv_ldx_h, 2, 6, offsets["dport"], 0),
+		insn(kv_or_x, 1, 2, 0, 0),
+		insn(kv_stx_w, 10, 1, -4, 0),
+		insn(kv_ld_dw, 1, kv_bpf_pseudo_map_fd, 0, int32(map_fd)),
+		insn(0, 0, 0, 0, 0),
+		insn(kv_mov_x, 2, 10, 0, 0),
+		insn(kv_add_k, 2, 0, 0, -4),
+		insn(kv_call, 0, 0, 0, kv_bpf_map_lookup_fn),
+	}
+}
+
+// Probe_program returns the program run on each segment received, which
+// updates the statistics of the flow, if tracked.
+func probe_program(map_fd int, offsets map[string]int16) []insn_t {
+	program := lookup(map_fd, offsets)
+	return append(program,
+		insn(kv_jeq_k, 0, 0, 34, 0),
+		insn(kv_mov_x, 9, 0, 0, 0),
+		insn(kv_call, 0, 0, 0, kv_bpf_ktime_get_ns_fn),
+		insn(kv_mov_x, 8, 0, 0, 0),
+		// Timestamps
+		insn(kv_ldx_dw, 1, 9, kv_value_last, 0),
+		insn(kv_jne_k, 1, 0, 1, 0),
+		insn(kv_stx_dw, 9, 8, kv_value_first, 0),
+		insn(kv_stx_dw, 9, 8, kv_value_last, 0),
+		// Samples
+		insn(kv_ldx_dw, 1, 9, kv_value_samples, 0),
+		insn(kv_add_k, 1, 0, 0, 1),
+		insn(kv_stx_dw, 9, 1, kv_value_samples, 0),
+		// Smoothed RTT and its extremes, where zero means unset
+		insn(kv_ldx_w, 1, 6, offsets["srtt"], 0),
+		insn(kv_stx_dw, 9, 1, kv_value_srtt, 0),
+		insn(kv_ldx_dw, 2, 9, kv_value_min_srtt, 0),
+		insn(kv_jeq_k, 2, 0, 1, 0),
+		insn(kv_jge_x, 1, 2, 1, 0),
+		insn(kv_stx_dw, 9, 1, kv_value_min_srtt, 0),
+		insn(kv_ldx_dw, 2, 9, kv_value_max_srtt, 0),
+		insn(kv_jle_x, 1, 2, 1, 0),
+		insn(kv_stx_dw, 9, 1, kv_value_max_srtt, 0),
+		// Congestion window
+		insn(kv_ldx_w, 1, 6, offsets["snd_cwnd"], 0),
+		insn(kv_stx_dw, 9, 1, kv_value_snd_cwnd, 0),
+		// Bytes acknowledged since the first sample, with the 32 bit
+		// sequence numbers wrapping around
+		insn(kv_ldx_w, 1, 6, offsets["snd_una"], 0),
+		insn(kv_ldx_dw, 2, 9, kv_value_snd_una, 0),
+		insn(kv_stx_dw, 9, 1, kv_value_snd_una, 0),
+		insn(kv_ldx_dw, 3, 9, kv_value_samples, 0),
+		insn(kv_jeq_k, 3, 0, 4, 1),
+		insn(kv_sub32_x, 1, 2, 0, 0),
+		insn(kv_ldx_dw, 2, 9, kv_value_acked, 0),
+		insn(kv_add_x, 2, 1, 0, 0),
+		insn(kv_stx_dw, 9, 2, kv_value_acked, 0),
+		// Payload received
+		insn(kv_ldx_h, 1, 6, offsets["data_len"], 0),
+		insn(kv_ldx_dw, 2, 9, kv_value_received, 0),
+		insn(kv_add_x, 2, 1, 0, 0),
+		insn(kv_stx_dw, 9, 2, kv_value_received, 0),
+		insn(kv_mov_k, 0, 0, 0, 0),
+		insn(kv_exit, 0, 0, 0, 0),
+	)
+}
+
+// Retransmit_program returns the program run on each retransmission, which
+// counts it for the flow, if tracked.
+func retransmit_program(map_fd int, offsets map[string]int16) []insn_t {
+	program := lookup(map_fd, offsets)
+	return append(program,
+		insn(kv_jeq_k, 0, 0, 3, 0),
+		insn(kv_ldx_dw, 1, 0, kv_value_retransmits, 0),
+		insn(kv_add_k, 1, 0, 0, 1),
+		insn(kv_stx_dw, 0, 1, kv_value_retransmits, 0),
+		insn(kv_mov_k, 0, 0, 0, 0),
+		insn(kv_exit, 0, 0, 0, 0),
+	)
+}
+
+// Attach loads `program` and attaches it to `tracepoint`.
+func attach(tracepoint *tracepoint_t, program []insn_t) error {
+	prog_attr := bpf_prog_load_attr{
+		prog_type: kv_bpf_prog_tracepoint,
+		insn_cnt:  uint32(len(program)),
+		insns:     unsafe.Pointer(&program[0]),
+		license:   unsafe.Pointer(&kv_license[0]),
+	}
+	prog_fd, err := bpf(kv_bpf_prog_load, unsafe.Pointer(&prog_attr),
+		unsafe.Sizeof(prog_attr))
+	if err != nil {
+		// Load again with the verifier log, which tells why
+		log := make([]byte, 1<<16)
+		prog_attr.log_level, prog_attr.log_size = 1, uint32(len(log))
+		prog_attr.log_buf = unsafe.Pointer(&log[0])
+		bpf(kv_bpf_prog_load, unsafe.Pointer(&prog_attr),
+			unsafe.Sizeof(prog_attr))
+		lines := strings.Split(strings.TrimRight(
+			strings.TrimRight(string(log), "\x00"), "\n"), "\n")
+		return errors.New("flowstats: cannot load program: " +
+			err.Error() + ": " + lines[len(lines)-1])
+	}
+	event_attr := perf_event_attr{
+		kind:          kv_perf_type_tracepoint,
+		size:          uint32(unsafe.Sizeof(perf_event_attr{})),
+		config:        tracepoint.id,
+		sample_period: 1,
+		sample_type:   kv_perf_sample_raw,
+		wakeup_events: 1,
+	}
+	// Tracepoints fire on every CPU, regardless of the CPU we choose.
+	event_fd, _, errno := syscall.Syscall6(syscall.SYS_PERF_EVENT_OPEN,
+		uintptr(unsafe.Pointer(&event_attr)), ^uintptr(0), 0, ^uintptr(0),
+		kv_perf_flag_cloexec, 0)
+	if errno != 0 {
+		syscall.Close(prog_fd)
+		return errors.New("flowstats: cannot open event: " + errno.Error())
+	}
+	for _, request := range []struct{ cmd, arg uintptr }{
+		{kv_perf_ioc_set_bpf, uintptr(prog_fd)},
+		{kv_perf_ioc_enable, 0},
+	} {
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, event_fd,
+			request.cmd, request.arg)
+		if errno != 0 {
+			syscall.Close(int(event_fd))
+			syscall.Close(prog_fd)
+			return errors.New("flowstats: cannot attach program: " +
+				errno.Error())
+		}
+	}
+	return nil
+}
+
+// Flow_key returns the key of `conn`, with its ports as seen by the kernel.
+func flow_key(conn net.Conn) (uint32, error) {
+	local, ok := conn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return 0, ErrUnsupported
+	}
+	remote, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return 0, ErrUnsupported
+	}
+	return uint32(local.Port)<<16 | uint32(remote.Port), nil
+}
+
+func map_fd() (int, error) {
+	kv_collector.mutex.Lock()
+	defer kv_collector.mutex.Unlock()
+	if !kv_collector.started {
+		return -1, ErrNotStarted
+	}
+	return kv_collector.map_fd, nil
+}
+
+func map_elem(cmd uintptr, fd int, key uint32, value []byte,
+	flags uint64) error {
+	attr := bpf_map_elem_attr{
+		map_fd: uint32(fd),
+		key:    unsafe.Pointer(&key),
+		flags:  flags,
+	}
+	if value != nil {
+		attr.value = unsafe.Pointer(&value[0])
+	}
+	_, err := bpf(cmd, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	return err
+}
+
+// Track starts collecting the statistics of `conn` and returns the
+// function to be called to stop. Since we identify flows by their ports,
+// it fails if another flow with the same ports is already tracked.
+func Track(conn net.Conn) (func(), error) {
+	fd, err := map_fd()
+	if err != nil {
+		return nil, err
+	}
+	key, err := flow_key(conn)
+	if err != nil {
+		return nil, err
+	}
+	err = map_elem(kv_bpf_map_update_elem, fd, key,
+		make([]byte, kv_value_size), kv_bpf_noexist)
+	if err == syscall.EEXIST {
+		return nil, kv_error_busy
+	}
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		map_elem(kv_bpf_map_delete_elem, fd, key, nil, 0)
+	}, nil
+}
+
+// Get returns the statistics of `conn`, which must be tracked.
+func Get(conn net.Conn) (*Stats, error) {
+	fd, err := map_fd()
+	if err != nil {
+		return nil, err
+	}
+	key, err := flow_key(conn)
+	if err != nil {
+		return nil, err
+	}
+	value := make([]byte, kv_value_size)
+	err = map_elem(kv_bpf_map_lookup_elem, fd, key, value, 0)
+	if err != nil {
+		return nil, err
+	}
+	field := func(offset int) uint64 {
+		return binary.LittleEndian.Uint64(value[offset:])
+	}
+	return &Stats{
+		Samples:     field(kv_value_samples),
+		SRTT:        uint32(field(kv_value_srtt)),
+		MinSRTT:     uint32(field(kv_value_min_srtt)),
+		MaxSRTT:     uint32(field(kv_value_max_srtt)),
+		SndCwnd:     uint32(field(kv_value_snd_cwnd)),
+		Acked:       field(kv_value_acked),
+		Received:    field(kv_value_received),
+		Retransmits: field(kv_value_retransmits),
+		First:       field(kv_value_first),
+		Last:        field(kv_value_last),
+	}, nil
+}
@@ -0,0 +1,24 @@
+//go:build !linux || !(amd64 || arm64)
+// +build !linux !amd64,!arm64
+
+package flowstats
+
+import (
+	"net"
+)
+
+// Start loads and attaches the eBPF programs.
+func Start() error {
+	return ErrUnsupported
+}
+
+// Track starts collecting the statistics of `conn` and returns the
+// function to be called to stop.
+func Track(conn net.Conn) (func(), error) {
+	return nil, ErrUnsupported
+}
+
+// Get returns the statistics of `conn`, which must be tracked.
+func Get(conn net.Conn) (*Stats, error) {
+	return nil, ErrUnsupported
+}
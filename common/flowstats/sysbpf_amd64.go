@@ -0,0 +1,6 @@
+//go:build linux
+// +build linux
+
+package flowstats
+
+const kv_sys_bpf = 321
@@ -0,0 +1,10 @@
+//go:build linux
+// +build linux
+
+package flowstats
+
+import (
+	"syscall"
+)
+
+const kv_sys_bpf = syscall.SYS_BPF
@@ -0,0 +1,99 @@
+package gso
+
+// Generic segmentation offload for UDP, i.e., passing the kernel a buffer
+// holding many datagrams of the same size, all to the same destination,
+// which it splits into datagrams as late as possible, possibly in the NIC,
+// such that we can send packet trains at line rate with one system call
+// every kv_max_segments datagrams, rather than with one each. Where GSO is
+// not available, we send each datagram with its own system call.
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+)
+
+// ErrUnsupported indicates that GSO is not available.
+var ErrUnsupported = errors.New("gso: not supported")
+
+// The kernel accepts up to 64 segments, of up to 64 KiB in total.
+const kv_max_segments = 64
+const kv_max_bytes = 65000
+
+// Writer sends trains of datagrams on a UDP socket.
+type Writer struct {
+	conn    *net.UDPConn
+	enabled int32 // atomically, 1 when GSO is enabled
+}
+
+// NewWriter returns a Writer sending on `conn`, with GSO if available.
+func NewWriter(conn *net.UDPConn) *Writer {
+	writer := &Writer{conn: conn}
+	if supported(conn) {
+		writer.enabled = 1
+	}
+	return writer
+}
+
+// GSO returns whether the Writer uses GSO.
+func (writer *Writer) GSO() bool {
+	return atomic.LoadInt32(&writer.enabled) != 0
+}
+
+// DisableGSO makes the Writer send each datagram with its own system call.
+func (writer *Writer) DisableGSO() {
+	atomic.StoreInt32(&writer.enabled, 0)
+}
+
+// WriteTrain sends to `addr` the datagrams in `train`, all of `size` bytes
+// but the last, which may be shorter, and returns the bytes sent.
+func (writer *Writer) WriteTrain(train []byte, size int,
+	addr *net.UDPAddr) (int, error) {
+	if size <= 0 || size > kv_max_bytes {
+		return 0, errors.New("gso: invalid datagram size")
+	}
+	batch := kv_max_bytes / size
+	if batch > kv_max_segments {
+		batch = kv_max_segments
+	}
+	sent := 0
+	for sent < len(train) {
+		end := sent + batch*size
+		if end > len(train) {
+			end = len(train)
+		}
+		count, err := writer.write(train[sent:end], size, addr)
+		sent += count
+		if err != nil {
+			return sent, err
+		}
+	}
+	return sent, nil
+}
+
+// Write sends the datagrams of `segments` with a single system call, if
+// GSO is enabled, and with a system call each otherwise.
+func (writer *Writer) write(segments []byte, size int,
+	addr *net.UDPAddr) (int, error) {
+	if writer.GSO() && len(segments) > size {
+		count, err := write_segments(writer.conn, segments, size, addr)
+		if err != ErrUnsupported {
+			return count, err
+		}
+		// E.g. the device cannot compute the checksums
+		writer.DisableGSO()
+	}
+	sent := 0
+	for sent < len(segments) {
+		end := sent + size
+		if end > len(segments) {
+			end = len(segments)
+		}
+		count, err := writer.conn.WriteToUDP(segments[sent:end], addr)
+		sent += count
+		if err != nil {
+			return sent, err
+		}
+	}
+	return sent, nil
+}
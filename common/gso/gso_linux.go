@@ -0,0 +1,46 @@
+//go:build linux
+// +build linux
+
+package gso
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+const kv_sol_udp = 17
+const kv_udp_segment = 103
+
+// Supported returns whether the kernel supports GSO on `conn`.
+func supported(conn *net.UDPConn) bool {
+	rawconn, err := conn.SyscallConn()
+	if err != nil {
+		return false
+	}
+	var opt_err error
+	err = rawconn.Control(func(fd uintptr) {
+		_, opt_err = syscall.GetsockoptInt(int(fd), kv_sol_udp,
+			kv_udp_segment)
+	})
+	return err == nil && opt_err == nil
+}
+
+// Write_segments sends `segments` with a single system call, asking the
+// kernel to split it into datagrams of `size` bytes.
+func write_segments(conn *net.UDPConn, segments []byte, size int,
+	addr *net.UDPAddr) (int, error) {
+	oob := make([]byte, syscall.CmsgSpace(2))
+	header := (*syscall.Cmsghdr)(unsafe.Pointer(&oob[0]))
+	header.Level = kv_sol_udp
+	header.Type = kv_udp_segment
+	header.SetLen(syscall.CmsgLen(2))
+	binary.NativeEndian.PutUint16(oob[syscall.CmsgLen(0):], uint16(size))
+	count, _, err := conn.WriteMsgUDP(segments, oob, addr)
+	if errors.Is(err, syscall.EIO) {
+		return 0, ErrUnsupported
+	}
+	return count, err
+}
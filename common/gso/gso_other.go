@@ -0,0 +1,20 @@
+//go:build !linux
+// +build !linux
+
+package gso
+
+import (
+	"net"
+)
+
+// Supported returns whether the kernel supports GSO on `conn`.
+func supported(conn *net.UDPConn) bool {
+	return false
+}
+
+// Write_segments sends `segments` with a single system call, asking the
+// kernel to split it into datagrams of `size` bytes.
+func write_segments(conn *net.UDPConn, segments []byte, size int,
+	addr *net.UDPAddr) (int, error) {
+	return 0, ErrUnsupported
+}
@@ -0,0 +1,292 @@
+package common
+
+// Zero-downtime upgrades. When asked to upgrade, we start a new instance of
+// the (possibly replaced) executable, passing it our listening sockets, UDP
+// included, as inherited file descriptors, and wait for it to tell us,
+// using a pipe, that it is ready. Then we stop accepting, such that the new
+// instance receives all the new clients, while we drain the live sessions.
+// Because both instances share the same sockets, no client is rejected
+// meanwhile. Since only one test may run at a time, and the tests of the
+// legacy protocol listen on a fixed port, the new instance must not start
+// any test until we are done: we also pass it a pipe, which we keep open
+// until we drained (see ReleaseSuccessor) or exited, and until which the
+// new instance is busy (see PredecessorBusy), such that it queues its
+// clients meanwhile. If the new instance fails to start, we keep serving
+// as before. A UDP
+// socket, unlike a TCP listener, also carries the datagrams of the live
+// sessions, and cannot be shared, since each datagram reaches only one of
+// the instances. Hence we close our UDP sockets as well, which ends the
+// live QUIC and WebTransport sessions, and the clients must retry.
+//
+// Note that the new instance is a child of the old one, hence the service
+// manager must not kill the service when the old one exits (e.g., with
+// systemd, use KillMode=process or a PIDFile).
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Environment variables telling the new instance which sockets it
+// inherited (as `address=fd` pairs, where the address of UDP sockets has
+// the kv_udp_prefix), where to signal readiness and which pipe tells it
+// that we are done with our tests.
+const kv_listen_fds_env = "BOTTICELLI_LISTEN_FDS"
+const kv_ready_fd_env = "BOTTICELLI_READY_FD"
+const kv_busy_fd_env = "BOTTICELLI_BUSY_FD"
+const kv_udp_prefix = "udp/"
+
+// How long we wait for the new instance to become ready.
+const kv_handoff_timeout = 60 * time.Second
+
+var kv_inherited = make(map[string]*os.File)
+var kv_listeners = make(map[string]*net.TCPListener)
+var kv_packet_conns = make(map[string]*net.UDPConn)
+var kv_handed_off bool
+var kv_handoff_mutex sync.Mutex
+
+// The write end of the pipe telling the new instance we are still busy,
+// and whether the previous instance is still busy.
+var kv_successor_busy *os.File
+var kv_predecessor_busy int32
+
+func init() {
+	for _, pair := range strings.Split(os.Getenv(kv_listen_fds_env), ",") {
+		fields := strings.SplitN(pair, "=", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		fd, err := strconv.Atoi(fields[1])
+		if err != nil {
+			continue
+		}
+		kv_inherited[fields[0]] = os.NewFile(uintptr(fd), fields[0])
+	}
+	os.Unsetenv(kv_listen_fds_env)
+	fd, err := strconv.Atoi(os.Getenv(kv_busy_fd_env))
+	os.Unsetenv(kv_busy_fd_env)
+	if err == nil {
+		atomic.StoreInt32(&kv_predecessor_busy, 1)
+		go wait_predecessor(os.NewFile(uintptr(fd), "busy"))
+	}
+}
+
+// Wait_predecessor waits for the previous instance to close the other end
+// of `pipe`, i.e., to be done with its tests.
+func wait_predecessor(pipe *os.File) {
+	io.Copy(io.Discard, pipe)
+	pipe.Close()
+	atomic.StoreInt32(&kv_predecessor_busy, 0)
+	log.Printf("common: the previous instance is done with its tests")
+}
+
+// PredecessorBusy returns whether the previous instance, which handed off
+// its sockets to us, may still be running tests.
+func PredecessorBusy() bool {
+	return atomic.LoadInt32(&kv_predecessor_busy) != 0
+}
+
+// ReleaseSuccessor tells the new instance, if any, that we are done with
+// our tests, which we otherwise do when exiting.
+func ReleaseSuccessor() {
+	kv_handoff_mutex.Lock()
+	defer kv_handoff_mutex.Unlock()
+	if kv_successor_busy != nil {
+		kv_successor_busy.Close()
+		kv_successor_busy = nil
+	}
+}
+
+// Listen returns a TCP listener for `address`, which is inherited from the
+// previous instance, if any, and may be handed off to the next one. The
+// host part of `address` may be an interface name (see ResolveAddress).
+func Listen(address string) (net.Listener, error) {
+	return listen(address, &net.ListenConfig{})
+}
+
+// ListenTest is like Listen, for the listeners accepting the clients of
+// the tests, which we bind to BindDevice and whose address we pin.
+func ListenTest(address string) (net.Listener, error) {
+	listener, err := listen(address, ListenConfig())
+	if err != nil {
+		return nil, err
+	}
+	pin(listener.Addr().String())
+	return listener, nil
+}
+
+// ListenUDP is like net.ListenPacket, using ListenConfig, for the UDP
+// sockets of the tests, which are inherited and handed off like those
+// returned by Listen.
+func ListenUDP(address string) (net.PacketConn, error) {
+	kv_handoff_mutex.Lock()
+	defer kv_handoff_mutex.Unlock()
+	var conn net.PacketConn
+	var err error
+	if file, found := kv_inherited[kv_udp_prefix+address]; found {
+		delete(kv_inherited, kv_udp_prefix+address)
+		conn, err = net.FilePacketConn(file)
+		file.Close()
+		if err == nil {
+			log.Printf("common: inherited UDP socket for %s", address)
+		}
+	} else {
+		conn, err = ListenConfig().ListenPacket(context.Background(), "udp",
+			address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	udp_conn, ok := conn.(*net.UDPConn)
+	if !ok {
+		conn.Close()
+		return nil, errors.New("common: not a UDP socket: " + address)
+	}
+	kv_packet_conns[address] = udp_conn
+	return udp_conn, nil
+}
+
+func listen(address string, config *net.ListenConfig) (net.Listener, error) {
+	kv_handoff_mutex.Lock()
+	defer kv_handoff_mutex.Unlock()
+	var listener net.Listener
+	var err error
+	if file, found := kv_inherited[address]; found {
+		delete(kv_inherited, address)
+		listener, err = net.FileListener(file)
+		file.Close()
+		if err == nil {
+			log.Printf("common: inherited listener for %s", address)
+		}
+	} else {
+		var resolved string
+		resolved, err = ResolveAddress(address)
+		if err == nil {
+			listener, err = config.Listen(context.Background(), "tcp",
+				resolved)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	tcp_listener, ok := listener.(*net.TCPListener)
+	if !ok {
+		listener.Close()
+		return nil, errors.New("common: not a TCP listener: " + address)
+	}
+	kv_listeners[address] = tcp_listener
+	return tcp_listener, nil
+}
+
+// Ready tells the previous instance, if any, that we are listening on all
+// our addresses, and closes the inherited sockets we did not use.
+func Ready() {
+	kv_handoff_mutex.Lock()
+	defer kv_handoff_mutex.Unlock()
+	for address, file := range kv_inherited {
+		log.Printf("common: closing unused inherited socket for %s",
+			address)
+		file.Close()
+	}
+	kv_inherited = make(map[string]*os.File)
+	fd, err := strconv.Atoi(os.Getenv(kv_ready_fd_env))
+	os.Unsetenv(kv_ready_fd_env)
+	if err != nil {
+		return
+	}
+	pipe := os.NewFile(uintptr(fd), "ready")
+	pipe.Write([]byte{1})
+	pipe.Close()
+}
+
+// Upgrade starts a new instance of the server, hands off the listeners and
+// the UDP sockets to it, and, once it is ready, stops accepting. On
+// success, the caller should drain the live sessions, call
+// ReleaseSuccessor and exit.
+func Upgrade() error {
+	kv_handoff_mutex.Lock()
+	defer kv_handoff_mutex.Unlock()
+	if kv_handed_off {
+		return errors.New("common: listeners already handed off")
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	ready_reader, ready_writer, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer ready_reader.Close()
+	defer ready_writer.Close()
+	busy_reader, busy_writer, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer busy_reader.Close()
+	defer func() {
+		if kv_successor_busy != busy_writer {
+			busy_writer.Close()
+		}
+	}()
+	files := []*os.File{ready_writer, busy_reader}
+	pairs := []string{}
+	for address, listener := range kv_listeners {
+		file, err := listener.File()
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		pairs = append(pairs, address+"="+strconv.Itoa(3+len(files)))
+		files = append(files, file)
+	}
+	for address, conn := range kv_packet_conns {
+		file, err := conn.File()
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		pairs = append(pairs, kv_udp_prefix+address+"="+
+			strconv.Itoa(3+len(files)))
+		files = append(files, file)
+	}
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(os.Environ(), kv_ready_fd_env+"=3",
+		kv_busy_fd_env+"=4", kv_listen_fds_env+"="+strings.Join(pairs, ","))
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+	ready_writer.Close() // otherwise we do not see EOF if the child dies
+	go cmd.Wait()
+	ready_reader.SetReadDeadline(time.Now().Add(kv_handoff_timeout))
+	_, err = ready_reader.Read(make([]byte, 1))
+	if err != nil {
+		cmd.Process.Kill()
+		return errors.New("common: new instance not ready: " + err.Error())
+	}
+	log.Printf("common: new instance %d is ready; handing off",
+		cmd.Process.Pid)
+	kv_handed_off = true
+	kv_successor_busy = busy_writer
+	for _, listener := range kv_listeners {
+		listener.Close()
+	}
+	for _, conn := range kv_packet_conns {
+		conn.Close()
+	}
+	return nil
+}
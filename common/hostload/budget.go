@@ -0,0 +1,167 @@
+package hostload
+
+// Egress budget. Volunteer-run nodes often have capped transit, hence the
+// operator may configure how many bytes the host may send each day and
+// each month (in UTC). We measure what Interface sends, which includes
+// all the traffic of the host, like transit bills do. When any budget is
+// exceeded, data-heavy tests should not be admitted until the next period
+// starts. The bytes sent so far are saved to BudgetFile, if configured,
+// such that restarting the server does not reset them.
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/neubot/botticelli/common/metrics"
+)
+
+// DailyBudget and MonthlyBudget are the maximum number of bytes the host
+// may send each day and each month. Zero means no limit.
+var DailyBudget int64 = 0
+var MonthlyBudget int64 = 0
+
+// BudgetFile is where we save the bytes sent in the current periods.
+// When empty, they are only kept in memory.
+var BudgetFile = ""
+
+const kv_budget_interval = 10 * time.Second
+const kv_budget_save_interval = time.Minute
+
+var kv_budget_exceeded int32
+
+var kv_budget_used = metrics.NewGaugeVec("host_egress_budget_used_bytes",
+	"Bytes sent by the host in the current budget period.", "period")
+
+var kv_budget_limit = metrics.NewGaugeVec("host_egress_budget_bytes",
+	"Bytes the host may send in each budget period.", "period")
+
+var kv_budget_exceeded_gauge = metrics.NewGaugeVec(
+	"host_egress_budget_exceeded",
+	"Whether the host has exceeded its egress budget.")
+
+type budget_state_t struct {
+	Day        string `json:"day"`
+	DayBytes   int64  `json:"day_bytes"`
+	Month      string `json:"month"`
+	MonthBytes int64  `json:"month_bytes"`
+}
+
+// BudgetExceeded returns true if the host sent more than its budget.
+func BudgetExceeded() bool {
+	return atomic.LoadInt32(&kv_budget_exceeded) != 0
+}
+
+// StartBudget starts accounting the egress budget in the background, if
+// any budget is configured.
+func StartBudget() {
+	if DailyBudget <= 0 && MonthlyBudget <= 0 {
+		return
+	}
+	if Interface == "" {
+		log.Printf("hostload: no interface; cannot enforce egress budget")
+		return
+	}
+	kv_budget_limit.Set(float64(DailyBudget), "day")
+	kv_budget_limit.Set(float64(MonthlyBudget), "month")
+	go run_budget(load_budget())
+}
+
+func load_budget() *budget_state_t {
+	state := &budget_state_t{}
+	if BudgetFile == "" {
+		return state
+	}
+	data, err := ioutil.ReadFile(BudgetFile)
+	if os.IsNotExist(err) {
+		return state
+	}
+	if err != nil {
+		log.Printf("hostload: cannot read budget state: %s", err)
+		return state
+	}
+	err = json.Unmarshal(data, state)
+	if err != nil {
+		log.Printf("hostload: cannot parse budget state: %s", err)
+		return &budget_state_t{}
+	}
+	return state
+}
+
+func save_budget(state *budget_state_t) {
+	if BudgetFile == "" {
+		return
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return
+	}
+	err = ioutil.WriteFile(BudgetFile+".tmp", data, 0644)
+	if err == nil {
+		err = os.Rename(BudgetFile+".tmp", BudgetFile)
+	}
+	if err != nil {
+		log.Printf("hostload: cannot save budget state: %s", err)
+	}
+}
+
+// Update_budget adds `count` bytes sent at `now` to `state`, starting
+// new periods when needed, and returns whether the budget is exceeded.
+func update_budget(state *budget_state_t, now time.Time, count int64) bool {
+	now = now.UTC()
+	if day := now.Format("2006-01-02"); day != state.Day {
+		state.Day, state.DayBytes = day, 0
+	}
+	if month := now.Format("2006-01"); month != state.Month {
+		state.Month, state.MonthBytes = month, 0
+	}
+	state.DayBytes += count
+	state.MonthBytes += count
+	kv_budget_used.Set(float64(state.DayBytes), "day")
+	kv_budget_used.Set(float64(state.MonthBytes), "month")
+	return (DailyBudget > 0 && state.DayBytes > DailyBudget) ||
+		(MonthlyBudget > 0 && state.MonthBytes > MonthlyBudget)
+}
+
+func run_budget(state *budget_state_t) {
+	_, prev_tx, err := read_nic_bytes(Interface)
+	if err != nil {
+		log.Printf("hostload: cannot read %s counters: %s", Interface, err)
+	}
+	have_prev := err == nil
+	last_save := time.Now()
+	for {
+		count := int64(0)
+		_, tx, err := read_nic_bytes(Interface)
+		if err != nil {
+			log.Printf("hostload: cannot read %s counters: %s", Interface,
+				err)
+		} else {
+			if have_prev && tx >= prev_tx {
+				count = int64(tx - prev_tx) // otherwise, counters reset
+			}
+			prev_tx, have_prev = tx, true
+		}
+		exceeded := update_budget(state, time.Now(), count)
+		if exceeded != BudgetExceeded() {
+			log.Printf("hostload: egress budget exceeded: %t", exceeded)
+			save_budget(state)
+			last_save = time.Now()
+		}
+		if exceeded {
+			atomic.StoreInt32(&kv_budget_exceeded, 1)
+			kv_budget_exceeded_gauge.Set(1)
+		} else {
+			atomic.StoreInt32(&kv_budget_exceeded, 0)
+			kv_budget_exceeded_gauge.Set(0)
+		}
+		if time.Since(last_save) >= kv_budget_save_interval {
+			save_budget(state)
+			last_save = time.Now()
+		}
+		time.Sleep(kv_budget_interval)
+	}
+}
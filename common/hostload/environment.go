@@ -0,0 +1,208 @@
+package hostload
+
+// Detection of the environment where we run, since containers often limit
+// the CPU and the memory, and put the server behind a veth, with a reduced
+// MTU, and behind NAT, all of which may bias high-speed measurements. We
+// include what we detect in results, such that analysts can tell, and warn
+// at startup about what makes the measurements unreliable.
+
+import (
+	"bufio"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/neubot/botticelli/common/results"
+)
+
+// Environment is what DetectEnvironment detected, nil until it runs.
+var Environment *results.Environment
+
+// Below these, we warn that measurements may be unreliable.
+const kv_min_cpu_limit = 2.0
+const kv_min_memory_limit = 512 << 20
+const kv_min_mtu = 1500
+
+// Memory limits above this are cgroup v1's way of saying unlimited.
+const kv_unlimited_memory = 1 << 62
+
+var kv_private_networks = []string{
+	"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "100.64.0.0/10",
+	"fc00::/7",
+}
+
+// Detect_container returns the container runtime we run in, if any.
+func detect_container() string {
+	if _, err := os.Stat("/.dockerenv"); err == nil {
+		return "docker"
+	}
+	if _, err := os.Stat("/run/.containerenv"); err == nil {
+		return "podman"
+	}
+	if os.Getenv("KUBERNETES_SERVICE_HOST") != "" {
+		return "kubernetes"
+	}
+	data, err := ioutil.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return ""
+	}
+	for _, runtime := range []string{"kubepods", "docker", "containerd",
+		"lxc"} {
+		if strings.Contains(string(data), runtime) {
+			return runtime
+		}
+	}
+	return ""
+}
+
+// Read_cgroup_paths returns the paths of our cgroups, by controller, where
+// the empty controller is the unified hierarchy of cgroup v2.
+func read_cgroup_paths() map[string]string {
+	paths := make(map[string]string)
+	file, err := os.Open("/proc/self/cgroup")
+	if err != nil {
+		return paths
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// E.g. "4:memory:/docker/ID" or "0::/user.slice"
+		fields := strings.SplitN(scanner.Text(), ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		for _, controller := range strings.Split(fields[1], ",") {
+			paths[controller] = fields[2]
+		}
+	}
+	return paths
+}
+
+// Read_cgroup_file reads `name` in the cgroup at `path` of the hierarchy
+// mounted at `root`. Within a cgroup namespace, or when the hierarchy is
+// mounted from within a container, our cgroup is the root.
+func read_cgroup_file(root, path, name string) (string, error) {
+	data, err := ioutil.ReadFile(root + path + "/" + name)
+	if err != nil {
+		data, err = ioutil.ReadFile(root + "/" + name)
+	}
+	return strings.TrimSpace(string(data)), err
+}
+
+// Detect_cgroup_limits returns the CPU limit in cores and the memory limit
+// in bytes of our cgroups, zero when unlimited or unknown.
+func detect_cgroup_limits() (float64, int64) {
+	paths := read_cgroup_paths()
+	var cpu float64
+	var memory int64
+	if path, found := paths[""]; found {
+		// E.g. "max 100000" or "200000 100000"
+		data, err := read_cgroup_file("/sys/fs/cgroup", path, "cpu.max")
+		fields := strings.Fields(data)
+		if err == nil && len(fields) == 2 {
+			quota, quota_err := strconv.ParseFloat(fields[0], 64)
+			period, period_err := strconv.ParseFloat(fields[1], 64)
+			if quota_err == nil && period_err == nil && period > 0 {
+				cpu = quota / period
+			}
+		}
+		data, err = read_cgroup_file("/sys/fs/cgroup", path, "memory.max")
+		if err == nil {
+			memory, _ = strconv.ParseInt(data, 10, 64)
+		}
+	}
+	if path, found := paths["cpu"]; found && cpu == 0 {
+		data, err := read_cgroup_file("/sys/fs/cgroup/cpu", path,
+			"cpu.cfs_quota_us")
+		quota, quota_err := strconv.ParseFloat(data, 64)
+		data, period_err := read_cgroup_file("/sys/fs/cgroup/cpu", path,
+			"cpu.cfs_period_us")
+		period, parse_err := strconv.ParseFloat(data, 64)
+		if err == nil && quota_err == nil && period_err == nil &&
+			parse_err == nil && quota > 0 && period > 0 {
+			cpu = quota / period
+		}
+	}
+	if path, found := paths["memory"]; found && memory == 0 {
+		data, err := read_cgroup_file("/sys/fs/cgroup/memory", path,
+			"memory.limit_in_bytes")
+		if err == nil {
+			memory, _ = strconv.ParseInt(data, 10, 64)
+		}
+	}
+	if memory >= kv_unlimited_memory {
+		memory = 0
+	}
+	return cpu, memory
+}
+
+// Detect_nat returns true if the addresses of `iface` are all private.
+func detect_nat(iface *net.Interface) bool {
+	addrs, err := iface.Addrs()
+	if err != nil || len(addrs) == 0 {
+		return false
+	}
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || ipnet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		private := false
+		for _, network := range kv_private_networks {
+			_, cidr, err := net.ParseCIDR(network)
+			if err == nil && cidr.Contains(ipnet.IP) {
+				private = true
+				break
+			}
+		}
+		if !private {
+			return false
+		}
+	}
+	return true
+}
+
+// DetectEnvironment fills Environment and logs warnings about what makes
+// high-speed measurements unreliable. Call it after DetectInterface.
+func DetectEnvironment() {
+	environment := &results.Environment{Container: detect_container()}
+	environment.CPULimit, environment.MemoryLimit = detect_cgroup_limits()
+	if iface, err := net.InterfaceByName(Interface); err == nil {
+		environment.MTU = iface.MTU
+		environment.NAT = detect_nat(iface)
+		// Physical interfaces have a device in sysfs, while veths,
+		// bridges, and tunnels do not
+		_, err := os.Stat("/sys/class/net/" + Interface + "/device")
+		environment.Virtual = os.IsNotExist(err)
+	}
+	Environment = environment
+	if environment.Container != "" {
+		log.Printf("hostload: running in a %s container",
+			environment.Container)
+	}
+	if environment.CPULimit > 0 && environment.CPULimit < kv_min_cpu_limit {
+		log.Printf("hostload: warning: CPU limited to %.2f cores, which may"+
+			" limit high-speed measurements", environment.CPULimit)
+	}
+	if environment.MemoryLimit > 0 &&
+		environment.MemoryLimit < kv_min_memory_limit {
+		log.Printf("hostload: warning: memory limited to %d bytes, which"+
+			" may not be enough for concurrent tests",
+			environment.MemoryLimit)
+	}
+	if environment.MTU > 0 && environment.MTU < kv_min_mtu {
+		log.Printf("hostload: warning: %s has MTU %d, which reduces the"+
+			" goodput and may fragment", Interface, environment.MTU)
+	}
+	if environment.Virtual {
+		log.Printf("hostload: warning: %s is a virtual interface, whose"+
+			" overhead may limit high-speed measurements", Interface)
+	}
+	if environment.NAT {
+		log.Printf("hostload: warning: %s has only private addresses, so"+
+			" we are probably behind NAT", Interface)
+	}
+}
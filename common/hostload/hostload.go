@@ -0,0 +1,278 @@
+package hostload
+
+// Watchdog monitoring the CPU and NIC utilization of the host. When any
+// of them exceeds its threshold the host is degraded, and new tests should
+// not be admitted, because tests run on an overloaded host produce
+// garbage data. Our own tests are expected to load the NIC, hence we only
+// count the traffic that is not theirs, i.e., the cross traffic.
+
+import (
+	"bufio"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/neubot/botticelli/common/metrics"
+)
+
+// MaxCPU is the CPU utilization, between zero and one, above which the
+// host is degraded. Zero means that CPU utilization is not monitored.
+var MaxCPU = 0.0
+
+// Interface is the name of the network interface used by tests. When
+// empty, NIC utilization is not monitored.
+var Interface = ""
+
+// InterfaceSpeed is the capacity of Interface in Mbit/s.
+var InterfaceSpeed = 0.0
+
+// MaxNIC is the utilization of Interface, between zero and one, above
+// which the host is degraded. Zero means that it is not monitored.
+var MaxNIC = 0.0
+
+// OwnTraffic, when set, returns the bytes received and sent by our own
+// tests since we started, which we subtract from the NIC counters.
+var OwnTraffic func() (int64, int64)
+
+const kv_interval = time.Second
+
+var kv_degraded int32
+var kv_draining int32
+var kv_drain_mode int32
+
+var kv_cpu_utilization = metrics.NewGaugeVec("host_cpu_utilization",
+	"Fraction of CPU time not spent idle.")
+
+var kv_nic_utilization = metrics.NewGaugeVec("host_nic_utilization",
+	"Fraction of the interface capacity in use.", "direction")
+
+var kv_degraded_gauge = metrics.NewGaugeVec("host_degraded",
+	"Whether the host is too loaded to admit new tests.")
+
+// Degraded returns true if the host is too loaded to admit new tests.
+func Degraded() bool {
+	return atomic.LoadInt32(&kv_degraded) != 0
+}
+
+// StartDraining marks the host as draining, i.e., about to shut down,
+// such that it is not ready and new tests should not be admitted.
+func StartDraining() {
+	atomic.StoreInt32(&kv_draining, 1)
+}
+
+// SetDrainMode enables or disables the drain mode requested by the
+// operator, which is independent of shutting down.
+func SetDrainMode(enabled bool) {
+	value := int32(0)
+	if enabled {
+		value = 1
+	}
+	if atomic.SwapInt32(&kv_drain_mode, value) != value {
+		log.Printf("hostload: drain mode: %t", enabled)
+	}
+}
+
+// Draining returns true if the host is draining, because it is about to
+// shut down, the operator asked so, or of a scheduled maintenance window.
+func Draining() bool {
+	return atomic.LoadInt32(&kv_draining) != 0 ||
+		atomic.LoadInt32(&kv_drain_mode) != 0 || in_maintenance(time.Now())
+}
+
+// ServeDrain is an HTTP handler exporting whether the host is draining.
+// POSTing the `enabled` parameter (true or false) toggles the drain mode.
+func ServeDrain(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" {
+		enabled, err := strconv.ParseBool(r.FormValue("enabled"))
+		if err != nil {
+			http.Error(w, "invalid enabled parameter",
+				http.StatusBadRequest)
+			return
+		}
+		SetDrainMode(enabled)
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(strconv.FormatBool(Draining()) + "\n"))
+}
+
+// ServeReady is an HTTP handler exporting the readiness state.
+func ServeReady(w http.ResponseWriter, r *http.Request) {
+	if Draining() {
+		http.Error(w, "draining", http.StatusServiceUnavailable)
+		return
+	}
+	if Degraded() {
+		http.Error(w, "degraded", http.StatusServiceUnavailable)
+		return
+	}
+	if BudgetExceeded() {
+		http.Error(w, "egress budget exceeded",
+			http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
+
+// Start starts monitoring the host load in the background.
+func Start() {
+	if MaxCPU <= 0 && (MaxNIC <= 0 || Interface == "" ||
+		InterfaceSpeed <= 0) {
+		return
+	}
+	go run_watchdog()
+}
+
+// Run_watchdog samples the CPU and NIC counters every kv_interval. When we
+// cannot read them, we log it and retry at the next interval. When they
+// go backwards (e.g., because the NIC counters were reset or wrapped), we
+// skip the sample, since the difference would be meaningless. Since the
+// sleep may take longer than kv_interval, the NIC capacity is computed
+// over the actual time between the samples.
+func run_watchdog() {
+	var prev_busy, prev_total, prev_rx, prev_tx uint64
+	var prev_own_rx, prev_own_tx int64
+	var prev_time time.Time
+	cpu_ok, nic_ok := false, false
+	cpu_failing, nic_failing := false, false
+	for {
+		degraded := false
+
+		if MaxCPU > 0 {
+			busy, total, err := read_cpu_times()
+			if err != nil && !cpu_failing {
+				log.Printf("hostload: cannot read CPU times: %s", err)
+			}
+			cpu_failing = err != nil
+			if err == nil && cpu_ok && total > prev_total &&
+				busy >= prev_busy {
+				utilization := float64(busy-prev_busy) /
+					float64(total-prev_total)
+				kv_cpu_utilization.Set(utilization)
+				degraded = degraded || utilization > MaxCPU
+			}
+			cpu_ok = err == nil
+			prev_busy, prev_total = busy, total
+		}
+
+		if MaxNIC > 0 && Interface != "" && InterfaceSpeed > 0 {
+			rx, tx, err := read_nic_bytes(Interface)
+			now := time.Now()
+			var own_rx, own_tx int64
+			if OwnTraffic != nil {
+				own_rx, own_tx = OwnTraffic()
+			}
+			if err != nil && !nic_failing {
+				log.Printf("hostload: cannot read %s counters: %s",
+					Interface, err)
+			}
+			nic_failing = err != nil
+			if err == nil && nic_ok && rx >= prev_rx && tx >= prev_tx &&
+				now.After(prev_time) {
+				capacity := InterfaceSpeed * 1e06 / 8 *
+					now.Sub(prev_time).Seconds()
+				rx_utilization := cross_traffic(rx-prev_rx,
+					own_rx-prev_own_rx) / capacity
+				tx_utilization := cross_traffic(tx-prev_tx,
+					own_tx-prev_own_tx) / capacity
+				kv_nic_utilization.Set(rx_utilization, "rx")
+				kv_nic_utilization.Set(tx_utilization, "tx")
+				degraded = degraded || rx_utilization > MaxNIC ||
+					tx_utilization > MaxNIC
+			}
+			nic_ok = err == nil
+			prev_rx, prev_tx = rx, tx
+			prev_own_rx, prev_own_tx = own_rx, own_tx
+			prev_time = now
+		}
+
+		if degraded != Degraded() {
+			log.Printf("hostload: degraded: %t", degraded)
+		}
+		if degraded {
+			atomic.StoreInt32(&kv_degraded, 1)
+			kv_degraded_gauge.Set(1)
+		} else {
+			atomic.StoreInt32(&kv_degraded, 0)
+			kv_degraded_gauge.Set(0)
+		}
+		time.Sleep(kv_interval)
+	}
+}
+
+// Cross_traffic returns the bytes that the NIC counted in `total` that
+// are not among the `own` bytes of our tests. Since our bytes are counted
+// above the kernel, which may still be buffering them, and without the
+// headers, this is an estimate, which never goes below zero.
+func cross_traffic(total uint64, own int64) float64 {
+	if own <= 0 {
+		return float64(total)
+	}
+	if uint64(own) >= total {
+		return 0
+	}
+	return float64(total - uint64(own))
+}
+
+// Read_cpu_times returns the busy and total CPU time from /proc/stat.
+func read_cpu_times() (uint64, uint64, error) {
+	file, err := os.Open("/proc/stat")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 || fields[0] != "cpu" {
+			continue
+		}
+		var busy, total uint64
+		for idx, field := range fields[1:] {
+			value, err := strconv.ParseUint(field, 10, 64)
+			if err != nil {
+				return 0, 0, err
+			}
+			total += value
+			if idx != 3 && idx != 4 { // idle and iowait
+				busy += value
+			}
+		}
+		return busy, total, nil
+	}
+	return 0, 0, errors.New("hostload: no cpu line in /proc/stat")
+}
+
+// Read_nic_bytes returns the bytes received and sent by `name`.
+func read_nic_bytes(name string) (uint64, uint64, error) {
+	file, err := os.Open("/proc/net/dev")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		pair := strings.SplitN(scanner.Text(), ":", 2)
+		if len(pair) != 2 || strings.TrimSpace(pair[0]) != name {
+			continue
+		}
+		fields := strings.Fields(pair[1])
+		if len(fields) < 9 {
+			break
+		}
+		rx, err := strconv.ParseUint(fields[0], 10, 64)
+		if err != nil {
+			return 0, 0, err
+		}
+		tx, err := strconv.ParseUint(fields[8], 10, 64)
+		if err != nil {
+			return 0, 0, err
+		}
+		return rx, tx, nil
+	}
+	return 0, 0, errors.New("hostload: no such interface: " + name)
+}
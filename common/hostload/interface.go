@@ -0,0 +1,93 @@
+package hostload
+
+// Detection of the egress interface and of its link speed, which we
+// include in results and advertise, so that analysts can discard results
+// that were bottlenecked by the server NIC.
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/neubot/botticelli/common"
+)
+
+// Detect_interface returns the name of the interface of the default route.
+func detect_interface() (string, error) {
+	file, err := os.Open("/proc/net/route")
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[1] == "00000000" {
+			return fields[0], nil
+		}
+	}
+	return "", errors.New("hostload: no default route")
+}
+
+// Detect_speed returns the link speed of `name` in Mbit/s.
+func detect_speed(name string) (float64, error) {
+	data, err := ioutil.ReadFile("/sys/class/net/" + name + "/speed")
+	if err != nil {
+		return 0, err
+	}
+	speed, err := strconv.ParseFloat(strings.TrimSpace(string(data)), 64)
+	if err != nil {
+		return 0, err
+	}
+	if speed <= 0 {
+		return 0, errors.New("hostload: link speed unknown")
+	}
+	return speed, nil
+}
+
+// DetectInterface fills Interface and InterfaceSpeed, unless they have
+// been configured, by looking at the default route and at sysfs.
+func DetectInterface() {
+	if Interface == "" {
+		name, err := detect_interface()
+		if err != nil {
+			log.Printf("hostload: cannot detect interface: %s", err)
+			return
+		}
+		Interface = name
+	}
+	if InterfaceSpeed <= 0 {
+		speed, err := detect_speed(Interface)
+		if err != nil {
+			log.Printf("hostload: cannot detect %s speed: %s", Interface, err)
+			return
+		}
+		InterfaceSpeed = speed
+	}
+	common.Infof("hostload: interface %s at %.0f Mbit/s", Interface,
+		InterfaceSpeed)
+}
+
+// ServeCapabilities is an HTTP handler advertising what this server
+// is capable of, including the interface speed.
+func ServeCapabilities(w http.ResponseWriter, r *http.Request) {
+	data, err := json.Marshal(map[string]interface{}{
+		"server_version":        common.Version,
+		"interface":             Interface,
+		"interface_speed_mbits": InterfaceSpeed,
+		"degraded":              Degraded(),
+		"draining":              Draining(),
+	})
+	if err != nil {
+		w.WriteHeader(500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
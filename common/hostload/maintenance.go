@@ -0,0 +1,118 @@
+package hostload
+
+// Scheduled maintenance windows. During them the host is draining, hence
+// new tests are refused and the readiness endpoint fails, such that the
+// operator can automate fleet maintenance (e.g. kernel upgrades) without
+// interrupting tests.
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/neubot/botticelli/common/metrics"
+)
+
+// MaintenanceWindows is a comma separated list of windows, in UTC, each
+// in the `[day] HH:MM-HH:MM` format, where day is the three letters name
+// of a weekday (e.g. `mon`). Windows without day apply every day. Windows
+// ending before they start extend past midnight.
+var MaintenanceWindows = ""
+
+type window_t struct {
+	weekday time.Weekday
+	daily   bool
+	start   time.Duration // since midnight
+	end     time.Duration
+}
+
+var kv_windows []window_t
+
+var kv_weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday,
+	"wed": time.Wednesday, "thu": time.Thursday, "fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+func init() {
+	metrics.NewGaugeFunc("host_draining",
+		"Whether the host is draining and refuses new tests.",
+		func() float64 {
+			if Draining() {
+				return 1
+			}
+			return 0
+		})
+}
+
+func parse_clock(clock string) (time.Duration, bool) {
+	parsed, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, false
+	}
+	return time.Duration(parsed.Hour())*time.Hour +
+		time.Duration(parsed.Minute())*time.Minute, true
+}
+
+// LoadMaintenanceWindows parses MaintenanceWindows.
+func LoadMaintenanceWindows() error {
+	windows := []window_t{}
+	for _, spec := range strings.Split(MaintenanceWindows, ",") {
+		fields := strings.Fields(strings.ToLower(spec))
+		if len(fields) == 0 {
+			continue
+		}
+		window := window_t{daily: true}
+		if len(fields) == 2 {
+			weekday, found := kv_weekdays[fields[0]]
+			if !found {
+				return errors.New("hostload: invalid weekday: " + spec)
+			}
+			window.weekday, window.daily = weekday, false
+			fields = fields[1:]
+		}
+		clocks := strings.Split(fields[0], "-")
+		if len(fields) != 1 || len(clocks) != 2 {
+			return errors.New("hostload: invalid maintenance window: " +
+				spec)
+		}
+		var ok_start, ok_end bool
+		window.start, ok_start = parse_clock(clocks[0])
+		window.end, ok_end = parse_clock(clocks[1])
+		if !ok_start || !ok_end || window.start == window.end {
+			return errors.New("hostload: invalid maintenance window: " +
+				spec)
+		}
+		windows = append(windows, window)
+	}
+	kv_windows = windows
+	return nil
+}
+
+// In_maintenance returns true if `now` is within any maintenance window.
+func in_maintenance(now time.Time) bool {
+	now = now.UTC()
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0,
+		time.UTC)
+	clock := now.Sub(midnight)
+	yesterday := (now.Weekday() + 6) % 7
+	for _, window := range kv_windows {
+		if window.start < window.end {
+			if (window.daily || window.weekday == now.Weekday()) &&
+				clock >= window.start && clock < window.end {
+				return true
+			}
+			continue
+		}
+		// The window starts on its day and ends on the next one
+		if (window.daily || window.weekday == now.Weekday()) &&
+			clock >= window.start {
+			return true
+		}
+		if (window.daily || window.weekday == yesterday) &&
+			clock < window.end {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,84 @@
+package hostload
+
+// Tuning of the Go runtime. Since the pauses of the garbage collector
+// during a saturating transfer show up directly in the measurements, by
+// default we collect garbage less often than Go does, trading memory for
+// fewer collections, and, in containers, we set a soft memory limit below
+// the limit of the container, such that the collector runs more often only
+// when memory is about to run out, rather than the kernel killing us. The
+// operator's GOGC and GOMEMLIMIT, when set, take precedence over these
+// defaults, but not over our options.
+
+import (
+	"errors"
+	"log"
+	"os"
+	"runtime"
+	"runtime/debug"
+)
+
+// GOMAXPROCS is the number of threads running Go code at the same time.
+// Zero means Go's default, i.e. the number of CPUs we may use.
+var GOMAXPROCS = 0
+
+// GCPercent is the heap growth, in percent of the live heap, triggering
+// a garbage collection, as in GOGC, where -1 turns the collector off. Zero
+// means GOGC, if set, and kv_gc_percent otherwise.
+var GCPercent = 0
+
+// MemoryLimit is the soft memory limit in bytes, as in GOMEMLIMIT. Zero
+// means GOMEMLIMIT, if set, then kv_memory_limit_share of the memory limit
+// of the container, if any, and Go's setting otherwise.
+var MemoryLimit int64 = 0
+
+const kv_gc_percent = 400
+const kv_memory_limit_share = 0.9
+
+// LoadRuntimeTuning validates GOMAXPROCS, GCPercent and MemoryLimit.
+func LoadRuntimeTuning() error {
+	if GOMAXPROCS < 0 {
+		return errors.New("hostload: GOMAXPROCS must not be negative")
+	}
+	if GCPercent < -1 {
+		return errors.New("hostload: GC percent must be -1 (off) or more")
+	}
+	if MemoryLimit < 0 {
+		return errors.New("hostload: memory limit must not be negative")
+	}
+	return nil
+}
+
+// TuneRuntime applies the tuning of the Go runtime. Call it after
+// DetectEnvironment.
+func TuneRuntime() {
+	if GOMAXPROCS > 0 {
+		runtime.GOMAXPROCS(GOMAXPROCS)
+	}
+	log.Printf("hostload: GOMAXPROCS is %d", runtime.GOMAXPROCS(0))
+	percent := GCPercent
+	if percent == 0 && os.Getenv("GOGC") == "" {
+		percent = kv_gc_percent
+	}
+	if percent == -1 {
+		debug.SetGCPercent(-1)
+		log.Printf("hostload: GC is off")
+	} else if percent > 0 {
+		debug.SetGCPercent(percent)
+		log.Printf("hostload: GC percent is %d", percent)
+	} else {
+		log.Printf("hostload: GOGC is %s", os.Getenv("GOGC"))
+	}
+	limit := MemoryLimit
+	if limit == 0 && os.Getenv("GOMEMLIMIT") != "" {
+		log.Printf("hostload: GOMEMLIMIT is %s", os.Getenv("GOMEMLIMIT"))
+		return
+	}
+	if limit == 0 && Environment != nil && Environment.MemoryLimit > 0 {
+		limit = int64(kv_memory_limit_share *
+			float64(Environment.MemoryLimit))
+	}
+	if limit > 0 {
+		debug.SetMemoryLimit(limit)
+		log.Printf("hostload: memory limit is %d bytes", limit)
+	}
+}
@@ -0,0 +1,161 @@
+package jwt
+
+// Verification of JSON Web Tokens signed using Ed25519 (i.e. JWS with the
+// "EdDSA" algorithm), as issued by locate-like schedulers.
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+// Tolerated clock skew when checking the validity period.
+const kv_leeway = 1 * time.Minute
+
+var (
+	ErrMalformed   = errors.New("jwt: malformed token")
+	ErrAlgorithm   = errors.New("jwt: unsupported algorithm")
+	ErrSignature   = errors.New("jwt: invalid signature")
+	ErrExpired     = errors.New("jwt: token expired")
+	ErrNoExpiry    = errors.New("jwt: token without expiration time")
+	ErrLifetime    = errors.New("jwt: token lifetime too long")
+	ErrNotYetValid = errors.New("jwt: token not yet valid")
+	ErrAudience    = errors.New("jwt: invalid audience")
+)
+
+// Audience is the `aud` claim, which may be a string or a list of strings.
+type Audience []string
+
+func (audience *Audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if json.Unmarshal(data, &single) == nil {
+		*audience = Audience{single}
+		return nil
+	}
+	var multiple []string
+	err := json.Unmarshal(data, &multiple)
+	*audience = Audience(multiple)
+	return err
+}
+
+// NumericDate is a JSON number of seconds since the epoch, which may have
+// a fractional part.
+type NumericDate float64
+
+// Time returns the time represented by `date`.
+func (date NumericDate) Time() time.Time {
+	return time.Unix(0, int64(float64(date)*float64(time.Second)))
+}
+
+// Claims contains the registered claims we care about. Payload contains
+// the whole JSON payload, for processing custom claims.
+type Claims struct {
+	Issuer    string      `json:"iss"`
+	Subject   string      `json:"sub"`
+	Audience  Audience    `json:"aud"`
+	Expiry    NumericDate `json:"exp"`
+	NotBefore NumericDate `json:"nbf"`
+	IssuedAt  NumericDate `json:"iat"`
+	Payload   []byte      `json:"-"`
+}
+
+type header_t struct {
+	Algorithm string `json:"alg"`
+}
+
+// Verify verifies `token` using `key` and returns its claims. When
+// `audience` is not empty, the token must be intended for it. The token
+// must expire, no later than `max_lifetime` after `now`.
+func Verify(token string, key ed25519.PublicKey, audience string,
+	max_lifetime time.Duration, now time.Time) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformed
+	}
+	header_data, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	header := &header_t{}
+	if json.Unmarshal(header_data, header) != nil {
+		return nil, ErrMalformed
+	}
+	if header.Algorithm != "EdDSA" {
+		return nil, ErrAlgorithm
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	if !ed25519.Verify(key, []byte(parts[0]+"."+parts[1]), signature) {
+		return nil, ErrSignature
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	claims := &Claims{Payload: payload}
+	if json.Unmarshal(payload, claims) != nil {
+		return nil, ErrMalformed
+	}
+	if claims.Expiry == 0 {
+		return nil, ErrNoExpiry
+	}
+	if now.After(claims.Expiry.Time().Add(kv_leeway)) {
+		return nil, ErrExpired
+	}
+	if claims.Expiry.Time().Sub(now) > max_lifetime+kv_leeway {
+		return nil, ErrLifetime
+	}
+	if claims.NotBefore != 0 &&
+		now.Before(claims.NotBefore.Time().Add(-kv_leeway)) {
+		return nil, ErrNotYetValid
+	}
+	if audience != "" && !claims.Audience.contains(audience) {
+		return nil, ErrAudience
+	}
+	return claims, nil
+}
+
+func (audience Audience) contains(value string) bool {
+	for _, entry := range audience {
+		if entry == value {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadPublicKey loads an Ed25519 public key from `path`, which contains
+// either a PEM encoded PKIX public key or the base64 of the raw key.
+func LoadPublicKey(path string) (ed25519.PublicKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if block, _ := pem.Decode(data); block != nil {
+		parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		key, ok := parsed.(ed25519.PublicKey)
+		if !ok {
+			return nil, errors.New("jwt: not an Ed25519 public key")
+		}
+		return key, nil
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) != ed25519.PublicKeySize {
+		return nil, errors.New("jwt: invalid Ed25519 public key size")
+	}
+	return ed25519.PublicKey(raw), nil
+}
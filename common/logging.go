@@ -0,0 +1,123 @@
+package common
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Log levels, from the least to the most verbose.
+const (
+	LogQuiet = iota // only errors and session summaries
+	LogInfo         // also the main events of sessions
+	LogDebug        // also protocol details, rate limited
+	LogTrace        // also protocol details, not rate limited
+)
+
+// LogLevel is the current log level. Errors and session summaries are
+// logged with the standard logger regardless of it. Once the server is
+// running, use SetLogLevel and GetLogLevel to access it.
+var LogLevel int32 = LogInfo
+
+var kv_log_level_names = []string{"quiet", "info", "debug", "trace"}
+
+// GetLogLevel returns the current log level.
+func GetLogLevel() int32 {
+	return atomic.LoadInt32(&LogLevel)
+}
+
+// SetLogLevel changes the current log level, clamping it to the valid
+// range, and returns the new level.
+func SetLogLevel(level int32) int32 {
+	if level < LogQuiet {
+		level = LogQuiet
+	}
+	if level > LogTrace {
+		level = LogTrace
+	}
+	if atomic.SwapInt32(&LogLevel, level) != level {
+		log.Printf("common: log level is now %s", kv_log_level_names[level])
+	}
+	return level
+}
+
+// ServeLogLevel is an HTTP handler exporting the current log level. It
+// changes it when POSTed the `level` parameter (quiet, info, debug or
+// trace), such that we can debug a production node without restarting.
+func ServeLogLevel(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" {
+		level := int32(-1)
+		for idx, name := range kv_log_level_names {
+			if name == r.FormValue("level") {
+				level = int32(idx)
+			}
+		}
+		if level < 0 {
+			http.Error(w, "invalid log level", http.StatusBadRequest)
+			return
+		}
+		SetLogLevel(level)
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(kv_log_level_names[GetLogLevel()] + "\n"))
+}
+
+// At most this number of debug messages per second is logged for each
+// key, unless we are tracing.
+const kv_debug_burst = 16
+
+type debug_limiter_t struct {
+	second     int64
+	count      int
+	suppressed int
+}
+
+var kv_debug_limiters = make(map[string]*debug_limiter_t)
+var kv_debug_mutex sync.Mutex
+
+// Infof logs an informational message.
+func Infof(format string, args ...interface{}) {
+	if GetLogLevel() >= LogInfo {
+		log.Printf(format, args...)
+	}
+}
+
+// Debugf logs a debug message, typically from a hot path. To avoid
+// flooding the logs, only kv_debug_burst messages per second with the
+// same `key` are logged and the others are counted as suppressed.
+func Debugf(key string, format string, args ...interface{}) {
+	level := GetLogLevel()
+	if level < LogDebug {
+		return
+	}
+	if level >= LogTrace {
+		log.Printf(format, args...)
+		return
+	}
+	now := time.Now().Unix()
+	kv_debug_mutex.Lock()
+	limiter := kv_debug_limiters[key]
+	if limiter == nil {
+		limiter = &debug_limiter_t{}
+		kv_debug_limiters[key] = limiter
+	}
+	if limiter.second != now {
+		if limiter.suppressed > 0 {
+			log.Printf("%s: suppressed %d debug messages", key,
+				limiter.suppressed)
+		}
+		limiter.second = now
+		limiter.count = 0
+		limiter.suppressed = 0
+	}
+	if limiter.count >= kv_debug_burst {
+		limiter.suppressed += 1
+		kv_debug_mutex.Unlock()
+		return
+	}
+	limiter.count += 1
+	kv_debug_mutex.Unlock()
+	log.Printf(format, args...)
+}
@@ -0,0 +1,72 @@
+package common
+
+// Static metadata describing this server (e.g. the site code, the machine
+// name or the uplink provider), configured by the operator, added to every
+// result and exported by the botticelli_server_info metric.
+
+import (
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/neubot/botticelli/common/metrics"
+)
+
+// ServerMetadata is a comma separated list of `key=value` pairs. Keys
+// must be valid metric label names.
+var ServerMetadata = ""
+
+var kv_server_meta map[string]string
+
+// Valid_label returns true if `name` is a valid metric label name.
+func valid_label(name string) bool {
+	if name == "" || strings.HasPrefix(name, "__") {
+		return false
+	}
+	for idx, c := range name {
+		if !(c >= 'a' && c <= 'z') && !(c >= 'A' && c <= 'Z') && c != '_' &&
+			!(idx > 0 && c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// LoadServerMetadata parses ServerMetadata and exports it as metric.
+func LoadServerMetadata() error {
+	meta := make(map[string]string)
+	for _, pair := range strings.Split(ServerMetadata, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		fields := strings.SplitN(pair, "=", 2)
+		if len(fields) != 2 || !valid_label(fields[0]) {
+			return errors.New("common: invalid server metadata: " + pair)
+		}
+		meta[fields[0]] = fields[1]
+	}
+	if len(meta) == 0 {
+		return nil
+	}
+	keys := []string{}
+	for key := range meta {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	values := []string{}
+	for _, key := range keys {
+		values = append(values, meta[key])
+	}
+	metrics.NewGaugeVec("botticelli_server_info",
+		"Always one; labels carry the server metadata.",
+		keys...).Set(1, values...)
+	kv_server_meta = meta
+	return nil
+}
+
+// ServerMeta returns the server metadata, which must not be modified, or
+// nil if there is none.
+func ServerMeta() map[string]string {
+	return kv_server_meta
+}
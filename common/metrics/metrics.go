@@ -0,0 +1,314 @@
+package metrics
+
+// Minimal implementation of Prometheus metrics (counters, gauges and
+// histograms with labels) exported using the text exposition format.
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type metric_t interface {
+	write(w http.ResponseWriter)
+}
+
+var kv_registry = []metric_t{}
+var kv_registry_mutex sync.Mutex
+
+func register(metric metric_t) {
+	kv_registry_mutex.Lock()
+	kv_registry = append(kv_registry, metric)
+	kv_registry_mutex.Unlock()
+}
+
+// Handler serves all the registered metrics.
+func Handler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	kv_registry_mutex.Lock()
+	registry := append([]metric_t{}, kv_registry...)
+	kv_registry_mutex.Unlock()
+	for _, metric := range registry {
+		metric.write(w)
+	}
+}
+
+// Common part of all metrics with labels.
+type vec_t struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+	mutex  sync.Mutex
+}
+
+func (vec *vec_t) key(values []string) string {
+	if len(values) != len(vec.labels) {
+		panic("metrics: " + vec.name + ": wrong number of label values")
+	}
+	return strings.Join(values, "\x00")
+}
+
+// The text format only allows escaping backslashes, double quotes and line
+// feeds in label values, which are otherwise UTF-8, hence strconv.Quote,
+// which also escapes other characters, does not fit.
+var kv_label_escaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Quote_label returns the label value `value`, quoted and escaped.
+func quote_label(value string) string {
+	return `"` + kv_label_escaper.Replace(value) + `"`
+}
+
+// Format_labels formats the labels encoded in `key` plus `extra`, which
+// is an already formatted label (or the empty string).
+func (vec *vec_t) format_labels(key string, extra string) string {
+	pairs := []string{}
+	if len(vec.labels) > 0 {
+		for idx, value := range strings.Split(key, "\x00") {
+			pairs = append(pairs, vec.labels[idx]+"="+quote_label(value))
+		}
+	}
+	if extra != "" {
+		pairs = append(pairs, extra)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (vec *vec_t) write_header(w http.ResponseWriter) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", vec.name, vec.help,
+		vec.name, vec.kind)
+}
+
+func sorted_keys(values map[string]float64) []string {
+	keys := []string{}
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func format_float(value float64) string {
+	if math.IsInf(value, +1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+/*
+  ____                  _
+ / ___|___  _   _ _ __ | |_ ___ _ __ ___
+| |   / _ \| | | | '_ \| __/ _ \ '__/ __|
+| |__| (_) | |_| | | | | ||  __/ |  \__ \
+ \____\___/ \__,_|_| |_|\__\___|_|  |___/
+
+*/
+
+// CounterVec is a set of counters partitioned by labels.
+type CounterVec struct {
+	vec_t
+	values map[string]float64
+}
+
+// NewCounterVec creates and registers a new CounterVec.
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	counter := &CounterVec{
+		vec_t:  vec_t{name: name, help: help, kind: "counter", labels: labels},
+		values: make(map[string]float64),
+	}
+	register(counter)
+	return counter
+}
+
+// Add adds `value` to the counter identified by `label_values`.
+func (counter *CounterVec) Add(value float64, label_values ...string) {
+	key := counter.key(label_values)
+	counter.mutex.Lock()
+	counter.values[key] += value
+	counter.mutex.Unlock()
+}
+
+// Inc increments by one the counter identified by `label_values`.
+func (counter *CounterVec) Inc(label_values ...string) {
+	counter.Add(1, label_values...)
+}
+
+func (counter *CounterVec) write(w http.ResponseWriter) {
+	counter.mutex.Lock()
+	defer counter.mutex.Unlock()
+	counter.write_header(w)
+	for _, key := range sorted_keys(counter.values) {
+		fmt.Fprintf(w, "%s%s %s\n", counter.name,
+			counter.format_labels(key, ""),
+			format_float(counter.values[key]))
+	}
+}
+
+/*
+  ____
+ / ___| __ _ _   _  __ _  ___  ___
+| |  _ / _` | | | |/ _` |/ _ \/ __|
+| |_| | (_| | |_| | (_| |  __/\__ \
+ \____|\__,_|\__,_|\__, |\___||___/
+                   |___/
+*/
+
+// GaugeVec is a set of gauges partitioned by labels.
+type GaugeVec struct {
+	vec_t
+	values map[string]float64
+}
+
+// NewGaugeVec creates and registers a new GaugeVec.
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	gauge := &GaugeVec{
+		vec_t:  vec_t{name: name, help: help, kind: "gauge", labels: labels},
+		values: make(map[string]float64),
+	}
+	register(gauge)
+	return gauge
+}
+
+// Set sets the gauge identified by `label_values` to `value`.
+func (gauge *GaugeVec) Set(value float64, label_values ...string) {
+	key := gauge.key(label_values)
+	gauge.mutex.Lock()
+	gauge.values[key] = value
+	gauge.mutex.Unlock()
+}
+
+// Add adds `value` (possibly negative) to the gauge identified by
+// `label_values`.
+func (gauge *GaugeVec) Add(value float64, label_values ...string) {
+	key := gauge.key(label_values)
+	gauge.mutex.Lock()
+	gauge.values[key] += value
+	gauge.mutex.Unlock()
+}
+
+func (gauge *GaugeVec) write(w http.ResponseWriter) {
+	gauge.mutex.Lock()
+	defer gauge.mutex.Unlock()
+	gauge.write_header(w)
+	for _, key := range sorted_keys(gauge.values) {
+		fmt.Fprintf(w, "%s%s %s\n", gauge.name, gauge.format_labels(key, ""),
+			format_float(gauge.values[key]))
+	}
+}
+
+type gauge_func_t struct {
+	vec_t
+	function func() float64
+}
+
+// NewGaugeFunc creates and registers a gauge whose value is computed by
+// calling `function` whenever metrics are collected.
+func NewGaugeFunc(name, help string, function func() float64) {
+	register(&gauge_func_t{
+		vec_t:    vec_t{name: name, help: help, kind: "gauge"},
+		function: function,
+	})
+}
+
+func (gauge *gauge_func_t) write(w http.ResponseWriter) {
+	gauge.write_header(w)
+	fmt.Fprintf(w, "%s %s\n", gauge.name, format_float(gauge.function()))
+}
+
+/*
+ _   _ _     _
+| | | (_)___| |_ ___   __ _ _ __ __ _ _ __ ___  ___
+| |_| | / __| __/ _ \ / _` | '__/ _` | '_ ` _ \/ __|
+|  _  | \__ \ || (_) | (_| | | | (_| | | | | | \__ \
+|_| |_|_|___/\__\___/ \__, |_|  \__,_|_| |_| |_|___/
+                      |___/
+*/
+
+type histogram_t struct {
+	counts []float64
+	sum    float64
+	count  float64
+}
+
+// HistogramVec is a set of histograms partitioned by labels.
+type HistogramVec struct {
+	vec_t
+	buckets []float64
+	values  map[string]*histogram_t
+}
+
+// NewHistogramVec creates and registers a new HistogramVec using the
+// upper bounds `buckets`, which must be sorted in increasing order.
+func NewHistogramVec(name, help string, buckets []float64,
+	labels ...string) *HistogramVec {
+	histogram := &HistogramVec{
+		vec_t: vec_t{name: name, help: help, kind: "histogram",
+			labels: labels},
+		buckets: append(append([]float64{}, buckets...), math.Inf(+1)),
+		values:  make(map[string]*histogram_t),
+	}
+	register(histogram)
+	return histogram
+}
+
+// ExponentialBuckets returns `count` buckets starting at `start`, each
+// of which is `factor` times the previous one.
+func ExponentialBuckets(start, factor float64, count int) []float64 {
+	buckets := []float64{}
+	for idx := 0; idx < count; idx += 1 {
+		buckets = append(buckets, start)
+		start *= factor
+	}
+	return buckets
+}
+
+// Observe adds `value` to the histogram identified by `label_values`.
+func (histogram *HistogramVec) Observe(value float64,
+	label_values ...string) {
+	key := histogram.key(label_values)
+	histogram.mutex.Lock()
+	defer histogram.mutex.Unlock()
+	entry, found := histogram.values[key]
+	if !found {
+		entry = &histogram_t{counts: make([]float64, len(histogram.buckets))}
+		histogram.values[key] = entry
+	}
+	for idx, bound := range histogram.buckets {
+		if value <= bound {
+			entry.counts[idx] += 1
+		}
+	}
+	entry.sum += value
+	entry.count += 1
+}
+
+func (histogram *HistogramVec) write(w http.ResponseWriter) {
+	histogram.mutex.Lock()
+	defer histogram.mutex.Unlock()
+	histogram.write_header(w)
+	keys := []string{}
+	for key := range histogram.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		entry := histogram.values[key]
+		for idx, bound := range histogram.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %s\n", histogram.name,
+				histogram.format_labels(key, "le="+
+					quote_label(format_float(bound))),
+				format_float(entry.counts[idx]))
+		}
+		fmt.Fprintf(w, "%s_sum%s %s\n", histogram.name,
+			histogram.format_labels(key, ""), format_float(entry.sum))
+		fmt.Fprintf(w, "%s_count%s %s\n", histogram.name,
+			histogram.format_labels(key, ""), format_float(entry.count))
+	}
+}
@@ -0,0 +1,292 @@
+package ocsp
+
+// Minimal OCSP client (RFC 6960), sufficient for fetching the response
+// about our own certificate, such that the TLS server can staple it. We
+// only implement requests for a single certificate, using SHA-1 to hash
+// the issuer, as required by most responders, and verify the responses
+// signed by the issuer or by a responder it delegated.
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"time"
+)
+
+const kv_timeout = 10 * time.Second
+const kv_max_response_size = 1 << 20
+
+// Certificate status, as reported by the responder.
+const (
+	Good    = 0
+	Revoked = 1
+	Unknown = 2
+)
+
+var (
+	ErrMalformed = errors.New("ocsp: malformed response")
+	ErrStatus    = errors.New("ocsp: responder returned an error")
+	ErrMismatch  = errors.New("ocsp: response is about another certificate")
+	ErrSignature = errors.New("ocsp: invalid signature")
+	ErrAlgorithm = errors.New("ocsp: unsupported signature algorithm")
+)
+
+// Response is a verified OCSP response. Raw is what the server staples.
+type Response struct {
+	Status     int
+	ThisUpdate time.Time
+	NextUpdate time.Time
+	Raw        []byte
+}
+
+var kv_oid_sha1 = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+var kv_oid_basic = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 1}
+
+var kv_signature_algorithms = []struct {
+	oid       asn1.ObjectIdentifier
+	algorithm x509.SignatureAlgorithm
+}{
+	{asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 5}, x509.SHA1WithRSA},
+	{asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 11}, x509.SHA256WithRSA},
+	{asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 12}, x509.SHA384WithRSA},
+	{asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 13}, x509.SHA512WithRSA},
+	{asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 1}, x509.ECDSAWithSHA1},
+	{asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}, x509.ECDSAWithSHA256},
+	{asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 3}, x509.ECDSAWithSHA384},
+	{asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 4}, x509.ECDSAWithSHA512},
+	{asn1.ObjectIdentifier{1, 3, 101, 112}, x509.PureEd25519},
+}
+
+/*
+    _    ____  _   _   _
+   / \  / ___|| \ | | / |
+  / _ \ \___ \|  \| | | |
+ / ___ \ ___) | |\  | | |
+/_/   \_\____/|_| \_| |_|
+
+*/
+
+type cert_id_t struct {
+	HashAlgorithm  pkix.AlgorithmIdentifier
+	IssuerNameHash []byte
+	IssuerKeyHash  []byte
+	SerialNumber   *big.Int
+}
+
+type request_t struct {
+	CertID cert_id_t
+}
+
+type tbs_request_t struct {
+	RequestList []request_t
+}
+
+type ocsp_request_t struct {
+	TBSRequest tbs_request_t
+}
+
+type response_bytes_t struct {
+	ResponseType asn1.ObjectIdentifier
+	Response     []byte
+}
+
+type ocsp_response_t struct {
+	Status        asn1.Enumerated
+	ResponseBytes response_bytes_t `asn1:"explicit,tag:0,optional"`
+}
+
+type single_response_t struct {
+	CertID     cert_id_t
+	CertStatus asn1.RawValue
+	ThisUpdate time.Time        `asn1:"generalized"`
+	NextUpdate time.Time        `asn1:"generalized,explicit,tag:0,optional"`
+	Extensions []pkix.Extension `asn1:"explicit,tag:1,optional"`
+}
+
+type response_data_t struct {
+	Raw         asn1.RawContent
+	Version     int `asn1:"optional,default:0,explicit,tag:0"`
+	ResponderID asn1.RawValue
+	ProducedAt  time.Time `asn1:"generalized"`
+	Responses   []single_response_t
+	Extensions  []pkix.Extension `asn1:"explicit,tag:1,optional"`
+}
+
+type basic_response_t struct {
+	TBSResponseData    response_data_t
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          asn1.BitString
+	Certificates       []asn1.RawValue `asn1:"explicit,tag:0,optional"`
+}
+
+type public_key_info_t struct {
+	Algorithm pkix.AlgorithmIdentifier
+	PublicKey asn1.BitString
+}
+
+// New_cert_id returns the identifier of `cert`, issued by `issuer`.
+func new_cert_id(cert *x509.Certificate, issuer *x509.Certificate) (
+	cert_id_t, error) {
+	var key_info public_key_info_t
+	_, err := asn1.Unmarshal(issuer.RawSubjectPublicKeyInfo, &key_info)
+	if err != nil {
+		return cert_id_t{}, err
+	}
+	name_hash := sha1.Sum(issuer.RawSubject)
+	key_hash := sha1.Sum(key_info.PublicKey.RightAlign())
+	return cert_id_t{
+		HashAlgorithm: pkix.AlgorithmIdentifier{
+			Algorithm:  kv_oid_sha1,
+			Parameters: asn1.NullRawValue,
+		},
+		IssuerNameHash: name_hash[:],
+		IssuerKeyHash:  key_hash[:],
+		SerialNumber:   cert.SerialNumber,
+	}, nil
+}
+
+/*
+ ____
+|  _ \ _ __ ___ _ __   ___  ___  ___
+| |_) | '__/ _ \ '_ \ / _ \/ __|/ _ \
+|  _ <| | |  __/ |_) | (_) \__ \  __/
+|_| \_\_|  \___| .__/ \___/|___/\___|
+               |_|
+*/
+
+// Fetch queries the OCSP responder of `cert`, issued by `issuer`, and
+// returns its verified response.
+func Fetch(cert *x509.Certificate, issuer *x509.Certificate) (
+	*Response, error) {
+	if len(cert.OCSPServer) < 1 {
+		return nil, errors.New("ocsp: certificate has no OCSP responder")
+	}
+	id, err := new_cert_id(cert, issuer)
+	if err != nil {
+		return nil, err
+	}
+	request, err := asn1.Marshal(ocsp_request_t{
+		TBSRequest: tbs_request_t{RequestList: []request_t{{CertID: id}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Timeout: kv_timeout}
+	response, err := client.Post(cert.OCSPServer[0],
+		"application/ocsp-request", bytes.NewReader(request))
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != 200 {
+		return nil, errors.New("ocsp: responder returned HTTP status " +
+			response.Status)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(response.Body,
+		kv_max_response_size))
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data, cert, issuer)
+}
+
+// Parse parses and verifies `data`, the response about `cert`, issued by
+// `issuer`.
+func Parse(data []byte, cert *x509.Certificate, issuer *x509.Certificate) (
+	*Response, error) {
+	var envelope ocsp_response_t
+	rest, err := asn1.Unmarshal(data, &envelope)
+	if err != nil || len(rest) > 0 {
+		return nil, ErrMalformed
+	}
+	if envelope.Status != 0 {
+		return nil, ErrStatus
+	}
+	if !envelope.ResponseBytes.ResponseType.Equal(kv_oid_basic) {
+		return nil, ErrMalformed
+	}
+	var basic basic_response_t
+	rest, err = asn1.Unmarshal(envelope.ResponseBytes.Response, &basic)
+	if err != nil || len(rest) > 0 {
+		return nil, ErrMalformed
+	}
+	err = verify(&basic, issuer)
+	if err != nil {
+		return nil, err
+	}
+	id, err := new_cert_id(cert, issuer)
+	if err != nil {
+		return nil, err
+	}
+	for _, single := range basic.TBSResponseData.Responses {
+		if !bytes.Equal(single.CertID.IssuerNameHash, id.IssuerNameHash) ||
+			!bytes.Equal(single.CertID.IssuerKeyHash, id.IssuerKeyHash) ||
+			single.CertID.SerialNumber == nil ||
+			single.CertID.SerialNumber.Cmp(id.SerialNumber) != 0 {
+			continue
+		}
+		status := single.CertStatus
+		if status.Class != asn1.ClassContextSpecific || status.Tag > Unknown {
+			return nil, ErrMalformed
+		}
+		return &Response{
+			Status:     status.Tag,
+			ThisUpdate: single.ThisUpdate,
+			NextUpdate: single.NextUpdate,
+			Raw:        data,
+		}, nil
+	}
+	return nil, ErrMismatch
+}
+
+// Verify checks the signature of `basic`, which must be made either by
+// `issuer` or by a responder certificate issued by `issuer` for signing
+// OCSP responses.
+func verify(basic *basic_response_t, issuer *x509.Certificate) error {
+	algorithm := x509.UnknownSignatureAlgorithm
+	for _, entry := range kv_signature_algorithms {
+		if entry.oid.Equal(basic.SignatureAlgorithm.Algorithm) {
+			algorithm = entry.algorithm
+		}
+	}
+	if algorithm == x509.UnknownSignatureAlgorithm {
+		return ErrAlgorithm
+	}
+	signer := issuer
+	if len(basic.Certificates) > 0 {
+		responder, err := x509.ParseCertificate(
+			basic.Certificates[0].FullBytes)
+		if err != nil {
+			return ErrMalformed
+		}
+		if !bytes.Equal(responder.Raw, issuer.Raw) {
+			if responder.CheckSignatureFrom(issuer) != nil ||
+				!has_ocsp_signing(responder) {
+				return ErrSignature
+			}
+		}
+		signer = responder
+	}
+	err := signer.CheckSignature(algorithm, basic.TBSResponseData.Raw,
+		basic.Signature.RightAlign())
+	if err != nil {
+		return ErrSignature
+	}
+	return nil
+}
+
+func has_ocsp_signing(cert *x509.Certificate) bool {
+	for _, usage := range cert.ExtKeyUsage {
+		if usage == x509.ExtKeyUsageOCSPSigning {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,71 @@
+package common
+
+// Origin policy for browser clients. Operators can restrict which sites
+// may embed tests against this server: WebSocket upgrades carrying a
+// disallowed Origin are refused, and HTTP endpoints only send the CORS
+// headers that let browsers read their responses to allowed origins.
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// AllowedOrigins is a comma separated list of origins (e.g. the value
+// `https://example.com`) allowed to run tests, where `*` allows any
+// origin. When empty, only same origin requests are allowed.
+var AllowedOrigins = ""
+
+// OriginAllowed returns true if the origin of `r`, if any, is allowed.
+// Requests without an Origin header do not come from browsers, hence we
+// always allow them.
+func OriginAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if AllowedOrigins == "" {
+		parsed, err := url.Parse(origin)
+		return err == nil && strings.EqualFold(parsed.Host, r.Host)
+	}
+	for _, allowed := range strings.Split(AllowedOrigins, ",") {
+		allowed = strings.TrimSpace(allowed)
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	Infof("common: refusing request from origin %q", origin)
+	return false
+}
+
+// CORS wraps `handler` such that it sends the CORS headers to allowed
+// origins and answers their preflight requests.
+func CORS(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" || AllowedOrigins == "" {
+			handler(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Origin")
+		if !OriginAllowed(r) {
+			if r.Method == "OPTIONS" {
+				w.WriteHeader(403)
+				return
+			}
+			handler(w, r)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		if r.Method == "OPTIONS" &&
+			r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods",
+				"GET, POST, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+			w.Header().Set("Access-Control-Max-Age", "86400")
+			w.WriteHeader(204)
+			return
+		}
+		handler(w, r)
+	}
+}
@@ -0,0 +1,137 @@
+package common
+
+// Protocol trace log, i.e. a dedicated file containing the full trace of
+// the protocol messages, such that verbose interop debugging does not
+// pollute the operational log. The file is rotated by size. If we cannot
+// open the new file, we drop the trace until kv_protolog_retry elapses and
+// then try opening it again, rather than rotating, and hence destroying
+// the backups, at each write.
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// ProtocolLogFile is the path of the protocol trace log. When empty, the
+// protocol trace is part of the operational log at debug level.
+var ProtocolLogFile = ""
+
+// ProtocolLogMaxSize is the size in bytes above which the protocol trace
+// log is rotated.
+var ProtocolLogMaxSize int64 = 64 << 20
+
+// Number of rotated protocol trace logs we keep.
+const kv_protolog_backups = 4
+
+// How long we wait before opening the file again after failing to.
+const kv_protolog_retry = 10 * time.Second
+
+// Writer rotating the protocol trace log.
+type protolog_t struct {
+	file  *os.File // nil after failing to open it
+	size  int64
+	retry time.Time // when to try opening the file again
+	mutex sync.Mutex
+}
+
+var kv_protolog_logger *log.Logger
+
+// OpenProtocolLog opens ProtocolLogFile, if configured.
+func OpenProtocolLog() error {
+	if ProtocolLogFile == "" {
+		return nil
+	}
+	protolog := &protolog_t{}
+	err := protolog.open()
+	if err != nil {
+		return err
+	}
+	kv_protolog_logger = log.New(protolog, "", log.LstdFlags|log.Lmicroseconds)
+	return nil
+}
+
+func (protolog *protolog_t) open() error {
+	file, err := os.OpenFile(ProtocolLogFile,
+		os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	protolog.file = file
+	protolog.size = info.Size()
+	return nil
+}
+
+// Rotate_locked renames the current file to `<path>.1`, shifting the
+// older ones, and opens a new file.
+func (protolog *protolog_t) rotate_locked() error {
+	protolog.file.Close()
+	protolog.file = nil
+	for idx := kv_protolog_backups - 1; idx > 0; idx -= 1 {
+		os.Rename(fmt.Sprintf("%s.%d", ProtocolLogFile, idx),
+			fmt.Sprintf("%s.%d", ProtocolLogFile, idx+1))
+	}
+	os.Rename(ProtocolLogFile, ProtocolLogFile+".1")
+	return protolog.reopen_locked()
+}
+
+// Reopen_locked opens the file and, if that fails, schedules the next
+// attempt after kv_protolog_retry.
+func (protolog *protolog_t) reopen_locked() error {
+	err := protolog.open()
+	if err != nil {
+		protolog.retry = time.Now().Add(kv_protolog_retry)
+	}
+	return err
+}
+
+func (protolog *protolog_t) Write(data []byte) (int, error) {
+	protolog.mutex.Lock()
+	defer protolog.mutex.Unlock()
+	if protolog.file == nil {
+		if time.Now().Before(protolog.retry) {
+			return 0, os.ErrClosed
+		}
+		err := protolog.reopen_locked()
+		if err != nil {
+			return 0, err
+		}
+	}
+	if protolog.size >= ProtocolLogMaxSize {
+		err := protolog.rotate_locked()
+		if err != nil {
+			return 0, err
+		}
+	}
+	count, err := protolog.file.Write(data)
+	protolog.size += int64(count)
+	return count, err
+}
+
+// Tracef logs a protocol message. It is always written to the protocol
+// trace log, if configured, and otherwise it is logged using Debugf.
+func Tracef(key string, format string, args ...interface{}) {
+	if kv_protolog_logger != nil {
+		kv_protolog_logger.Printf(format, args...)
+		return
+	}
+	Debugf(key, format, args...)
+}
+
+// Protocolf logs a protocol message that was explicitly requested (e.g.
+// a hexdump), to the protocol trace log, if configured, and otherwise to
+// the operational log, regardless of the log level.
+func Protocolf(format string, args ...interface{}) {
+	if kv_protolog_logger != nil {
+		kv_protolog_logger.Printf(format, args...)
+		return
+	}
+	log.Printf(format, args...)
+}
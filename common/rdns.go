@@ -0,0 +1,77 @@
+package common
+
+// Reverse DNS lookups of client addresses. Lookups are bounded both in
+// time and in number of concurrent queries, and results (including the
+// failures) are cached, such that a slow resolver cannot pile up work.
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ReverseDNS controls whether stored results are enriched with the PTR
+// record of the client address. It has no effect when AnonymizeAddresses
+// is true, since the PTR record would reveal the full address.
+var ReverseDNS = false
+
+const kv_rdns_timeout = 2 * time.Second
+const kv_rdns_ttl = 1 * time.Hour
+const kv_rdns_max_pending = 16
+const kv_rdns_cache_size = 4096
+
+type rdns_entry_t struct {
+	name    string
+	expires time.Time
+}
+
+var kv_rdns_cache = make(map[string]rdns_entry_t)
+var kv_rdns_mutex sync.Mutex
+var kv_rdns_pending = make(chan bool, kv_rdns_max_pending)
+
+// ReverseLookup returns the PTR name of `ip`, or the empty string when
+// disabled, when the lookup fails, or when too many are pending.
+func ReverseLookup(ip string) string {
+	if !ReverseDNS || AnonymizeAddresses {
+		return ""
+	}
+	now := time.Now()
+	kv_rdns_mutex.Lock()
+	entry, found := kv_rdns_cache[ip]
+	kv_rdns_mutex.Unlock()
+	if found && now.Before(entry.expires) {
+		return entry.name
+	}
+
+	select {
+	case kv_rdns_pending <- true:
+	default:
+		Debugf("rdns: busy", "rdns: too many pending lookups")
+		return ""
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), kv_rdns_timeout)
+	names, err := net.DefaultResolver.LookupAddr(ctx, ip)
+	cancel()
+	<-kv_rdns_pending
+
+	name := ""
+	if err == nil && len(names) > 0 {
+		name = strings.TrimSuffix(names[0], ".")
+	}
+	kv_rdns_mutex.Lock()
+	defer kv_rdns_mutex.Unlock()
+	if len(kv_rdns_cache) >= kv_rdns_cache_size {
+		for key, entry := range kv_rdns_cache {
+			if !now.Before(entry.expires) {
+				delete(kv_rdns_cache, key)
+			}
+		}
+	}
+	if len(kv_rdns_cache) < kv_rdns_cache_size {
+		kv_rdns_cache[ip] = rdns_entry_t{name: name,
+			expires: now.Add(kv_rdns_ttl)}
+	}
+	return name
+}
@@ -0,0 +1,160 @@
+package redis
+
+// Minimal Redis client speaking RESP, sufficient for sending commands
+// and reading their replies. A client owns a single connection, which
+// it establishes lazily and drops on any error, such that the next
+// command reconnects.
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const kv_timeout = 2 * time.Second
+
+// Client is a Redis client. It is safe for concurrent use, in which case
+// commands are serialized on the same connection.
+type Client struct {
+	Address  string
+	Password string
+	conn     net.Conn
+	reader   *bufio.Reader
+	mutex    sync.Mutex
+}
+
+// Error is an error reply sent by the server.
+type Error string
+
+func (e Error) Error() string {
+	return "redis: " + string(e)
+}
+
+// NewClient returns a client connecting to `address`, authenticating
+// with `password` unless it is empty.
+func NewClient(address string, password string) *Client {
+	return &Client{Address: address, Password: password}
+}
+
+func (client *Client) connect_locked() error {
+	conn, err := net.DialTimeout("tcp", client.Address, kv_timeout)
+	if err != nil {
+		return err
+	}
+	client.conn = conn
+	client.reader = bufio.NewReader(conn)
+	if client.Password != "" {
+		_, err = client.do_locked("AUTH", client.Password)
+		if err != nil {
+			client.close_locked()
+			return err
+		}
+	}
+	return nil
+}
+
+func (client *Client) close_locked() {
+	if client.conn != nil {
+		client.conn.Close()
+		client.conn = nil
+		client.reader = nil
+	}
+}
+
+// Do sends the command made of `args` and returns its reply, which is
+// either nil, a string, an int64 or a []interface{}. Error replies are
+// returned as Error.
+func (client *Client) Do(args ...string) (interface{}, error) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	if client.conn == nil {
+		err := client.connect_locked()
+		if err != nil {
+			return nil, err
+		}
+	}
+	reply, err := client.do_locked(args...)
+	if _, ok := err.(Error); err != nil && !ok {
+		client.close_locked()
+	}
+	return reply, err
+}
+
+func (client *Client) do_locked(args ...string) (interface{}, error) {
+	err := client.conn.SetDeadline(time.Now().Add(kv_timeout))
+	if err != nil {
+		return nil, err
+	}
+	request := []byte("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		request = append(request, "$"+strconv.Itoa(len(arg))+"\r\n"...)
+		request = append(request, arg+"\r\n"...)
+	}
+	_, err = client.conn.Write(request)
+	if err != nil {
+		return nil, err
+	}
+	return read_reply(client.reader)
+}
+
+func read_line(reader *bufio.Reader) (string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return "", errors.New("redis: malformed reply")
+	}
+	return line[:len(line)-2], nil
+}
+
+func read_reply(reader *bufio.Reader) (interface{}, error) {
+	line, err := read_line(reader)
+	if err != nil {
+		return nil, err
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, Error(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		length, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if length < 0 {
+			return nil, nil
+		}
+		data := make([]byte, length+2)
+		_, err = io.ReadFull(reader, data)
+		if err != nil {
+			return nil, err
+		}
+		return string(data[:length]), nil
+	case '*':
+		count, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if count < 0 {
+			return nil, nil
+		}
+		values := make([]interface{}, 0, count)
+		for idx := 0; idx < count; idx += 1 {
+			value, err := read_reply(reader)
+			if _, ok := err.(Error); err != nil && !ok {
+				return nil, err
+			}
+			values = append(values, value)
+		}
+		return values, nil
+	}
+	return nil, errors.New("redis: unexpected reply type")
+}
@@ -0,0 +1,166 @@
+package results
+
+// Hourly rotated, gzip compressed JSONL archives of results. We close the
+// archive of the previous hour, and schedule it for upload, within
+// kv_archive_check_interval from the end of the hour, even when there are
+// no new results, and close all archives when shutting down (see Close).
+// We never append to an existing file, which may be truncated, if we
+// crashed, or already scheduled for upload, if we restarted, or written
+// by the previous instance, if we upgraded. In such cases, we create the
+// next free `PREFIX-YYYYMMDDTHH.N.jsonl.gz` file instead.
+
+import (
+	"compress/gzip"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const kv_archive_check_interval = 1 * time.Minute
+
+type archive_t struct {
+	prefix string
+	tenant string
+	hour   string
+	file   *os.File
+	zipper *gzip.Writer
+	mutex  sync.Mutex
+}
+
+// Archives are separate for each tenant, such that results of different
+// tenants never end up in the same file.
+var kv_archives = make(map[string]*archive_t)
+var kv_archives_mutex sync.Mutex
+var kv_archives_once sync.Once
+
+// Get_archive returns the archive with `prefix` of `tenant`.
+func get_archive(prefix string, tenant string) *archive_t {
+	key := prefix + "/" + tenant
+	kv_archives_mutex.Lock()
+	defer kv_archives_mutex.Unlock()
+	archive, found := kv_archives[key]
+	if !found {
+		archive = &archive_t{prefix: prefix, tenant: tenant}
+		kv_archives[key] = archive
+	}
+	kv_archives_once.Do(func() { go run_rotation() })
+	return archive
+}
+
+// All_archives returns all the archives.
+func all_archives() []*archive_t {
+	kv_archives_mutex.Lock()
+	defer kv_archives_mutex.Unlock()
+	archives := []*archive_t{}
+	for _, archive := range kv_archives {
+		archives = append(archives, archive)
+	}
+	return archives
+}
+
+// Run_rotation closes the archives of the previous hours every
+// kv_archive_check_interval.
+func run_rotation() {
+	for {
+		time.Sleep(kv_archive_check_interval)
+		hour := archive_hour(time.Now())
+		for _, archive := range all_archives() {
+			archive.mutex.Lock()
+			if archive.file != nil && archive.hour != hour {
+				err := archive.close_locked()
+				if err != nil {
+					log.Printf("results: cannot close archive: %s", err)
+				}
+			}
+			archive.mutex.Unlock()
+		}
+	}
+}
+
+// Close closes all the archives, such that they are complete, and
+// schedules them for upload. Call it when shutting down.
+func Close() {
+	for _, archive := range all_archives() {
+		archive.mutex.Lock()
+		err := archive.close_locked()
+		if err != nil {
+			log.Printf("results: cannot close archive: %s", err)
+		}
+		archive.mutex.Unlock()
+	}
+}
+
+// Archive_hour returns the hour of `now`, which names the archives.
+func archive_hour(now time.Time) string {
+	return now.UTC().Format("20060102T15")
+}
+
+// Close_locked closes the current archive. Must be called with the
+// archive mutex held.
+func (archive *archive_t) close_locked() error {
+	if archive.file == nil {
+		return nil
+	}
+	err := archive.zipper.Close()
+	if err2 := archive.file.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		spool(archive.file.Name())
+	}
+	archive.file = nil
+	archive.zipper = nil
+	archive.hour = ""
+	return err
+}
+
+// Rotate_locked makes sure the archive for the current hour is open. Must
+// be called with the archive mutex held.
+func (archive *archive_t) rotate_locked(now time.Time) error {
+	hour := archive_hour(now)
+	if archive.file != nil && archive.hour == hour {
+		return nil
+	}
+	archive.close_locked()
+	dirpath, err := partition(archive.tenant, now)
+	if err != nil {
+		return err
+	}
+	name := archive.prefix + "-" + hour
+	path := filepath.Join(dirpath, name+".jsonl.gz")
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	for count := 1; errors.Is(err, os.ErrExist); count += 1 {
+		path = filepath.Join(dirpath, name+"."+strconv.Itoa(count)+
+			".jsonl.gz")
+		file, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL,
+			0644)
+	}
+	if err != nil {
+		return err
+	}
+	archive.file = file
+	archive.zipper = gzip.NewWriter(file)
+	archive.hour = hour
+	return nil
+}
+
+// Append appends the JSON encoded `data` as a line of the archive for
+// the current hour. We flush after each line such that we lose at most
+// a partial line if we crash.
+func (archive *archive_t) append(data []byte) error {
+	archive.mutex.Lock()
+	defer archive.mutex.Unlock()
+	err := archive.rotate_locked(time.Now())
+	if err != nil {
+		return err
+	}
+	_, err = archive.zipper.Write(append(data, '\n'))
+	if err != nil {
+		return err
+	}
+	return archive.zipper.Flush()
+}
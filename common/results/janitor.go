@@ -0,0 +1,113 @@
+package results
+
+// Background janitor that enforces the results retention policy
+
+import (
+	"compress/gzip"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Retention is the age after which result files are deleted. Zero means
+// that results are kept forever.
+var Retention time.Duration = 0
+
+// CompressAfter is the age after which result files are gzip compressed.
+// Zero means that results are never compressed.
+var CompressAfter time.Duration = 0
+
+const kv_janitor_interval = 1 * time.Hour
+
+// StartJanitor starts the background goroutine that periodically deletes
+// or compresses old results, according to Retention and CompressAfter.
+func StartJanitor() {
+	if Datadir == "" || (Retention <= 0 && CompressAfter <= 0) {
+		return
+	}
+	go func() {
+		for {
+			run_janitor()
+			time.Sleep(kv_janitor_interval)
+		}
+	}()
+}
+
+func run_janitor() {
+	now := time.Now()
+	dirs := []string{}
+	filepath.Walk(Datadir, func(path string, info os.FileInfo,
+		err error) error {
+		if err != nil {
+			log.Printf("results: janitor: %s", err)
+			return nil
+		}
+		if info.IsDir() {
+			if info.Name() == kv_spool_dir {
+				return filepath.SkipDir
+			}
+			if path != Datadir && now.Sub(info.ModTime()) > 24*time.Hour {
+				dirs = append(dirs, path)
+			}
+			return nil
+		}
+		age := now.Sub(info.ModTime())
+		if Retention > 0 && age > Retention {
+			err = os.Remove(path)
+			if err != nil {
+				log.Printf("results: janitor: %s", err)
+			}
+			return nil
+		}
+		if CompressAfter > 0 && age > CompressAfter &&
+			strings.HasSuffix(path, ".json") {
+			err = compress_file(path, info.ModTime())
+			if err != nil {
+				log.Printf("results: janitor: %s", err)
+			}
+		}
+		return nil
+	})
+
+	// Remove the old day partitions that became empty, deepest first. Removing
+	// a non-empty directory fails, which is what we want.
+	for idx := len(dirs) - 1; idx >= 0; idx -= 1 {
+		os.Remove(dirs[idx])
+	}
+}
+
+// Compress_file replaces `path` with `path`.gz preserving its mtime, so
+// that the retention policy keeps working on the compressed file.
+func compress_file(path string, mtime time.Time) error {
+	input, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+	output, err := os.Create(path + ".gz")
+	if err != nil {
+		return err
+	}
+	zipper := gzip.NewWriter(output)
+	_, err = io.Copy(zipper, input)
+	if err == nil {
+		err = zipper.Close()
+	}
+	if err == nil {
+		err = output.Close()
+	} else {
+		output.Close()
+	}
+	if err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+	err = os.Chtimes(path+".gz", mtime, mtime)
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
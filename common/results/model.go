@@ -0,0 +1,181 @@
+package results
+
+// Protocol independent model of the results of a session. All the protocol
+// front-ends fill this model, such that storage, metrics and exporters do
+// not need any protocol specific code.
+
+import (
+	"time"
+)
+
+// Measurement is a single throughput measurement within a session. The
+// client difference is the difference between the speed measured by the
+// client and ours, relative to ours. Duplex measurements ran while the
+// other direction was loaded too, by a non-standard test, and are not
+// comparable with the standard ones.
+type Measurement struct {
+	Name               string  `json:"name"`
+	Direction          string  `json:"direction"`
+	NumStreams         int     `json:"num_streams"`
+	Bytes              int     `json:"bytes"`
+	Elapsed            float64 `json:"elapsed"`
+	SpeedKbits         float64 `json:"speed_kbits"`
+	ClientSpeed        string  `json:"client_speed,omitempty"`
+	ClientSpeedUnknown bool    `json:"client_speed_unknown,omitempty"`
+	ClientDifference   float64 `json:"client_speed_difference,omitempty"`
+	ClientDivergent    bool    `json:"client_speed_divergent,omitempty"`
+	KernelSpeedKbits   float64 `json:"kernel_speed_kbits,omitempty"`
+	RateDivergent      bool    `json:"rate_divergent,omitempty"`
+	Fidelity           string  `json:"fidelity,omitempty"`
+	SteadySpeedKbits   float64 `json:"steady_speed_kbits,omitempty"`
+	MinRTT             float64 `json:"min_rtt_ms,omitempty"`
+	LoadedRTT          float64 `json:"loaded_rtt_ms,omitempty"`
+	LoadedRTTP95       float64 `json:"loaded_rtt_p95_ms,omitempty"`
+	BaselineRTT        float64 `json:"baseline_rtt_ms,omitempty"`
+	BloatRatio         float64 `json:"bloat_ratio,omitempty"`
+	Losses             *Losses `json:"losses,omitempty"`
+	Duplex             bool    `json:"duplex,omitempty"`
+}
+
+// Losses are the retransmissions and losses during a measurement, according
+// to the kernel. The server only sees retransmissions when it sends, i.e.,
+// in downloads, where the loss rate is the fraction of bytes retransmitted.
+// In uploads, the out-of-order segments received hint at losses.
+type Losses struct {
+	SegmentsOut int64    `json:"segments_out"`
+	SegmentsIn  int64    `json:"segments_in"`
+	Retransmits int64    `json:"retransmits"`
+	OutOfOrder  int64    `json:"out_of_order"`
+	LossRate    *float64 `json:"loss_rate,omitempty"`
+}
+
+// Fidelity of measurements: whether the kernel TCP statistics allowed us
+// to cross check them or we only had application level counters.
+const (
+	FidelityKernel      = "kernel"
+	FidelityApplication = "application"
+)
+
+// Directions of measurements, from the point of view of the client.
+const (
+	Download = "download"
+	Upload   = "upload"
+)
+
+// Traffic is the number of bytes exchanged by a session, from the point
+// of view of the server, as seen by the transport layer.
+type Traffic struct {
+	ControlSent     int64 `json:"control_sent"`
+	ControlReceived int64 `json:"control_received"`
+	DataSent        int64 `json:"data_sent"`
+	DataReceived    int64 `json:"data_received"`
+}
+
+// UDP summarizes the UDP probes that the client sent during the session.
+// The loss rate only accounts for the path from the client, since the
+// client sees the echoed probes. The clocks are not synchronized, hence
+// the delay is the mean one-way delay above the minimum one. Times are in
+// milliseconds.
+type UDP struct {
+	Packets  int64   `json:"packets"`
+	Expected int64   `json:"expected"`
+	LossRate float64 `json:"loss_rate"`
+	Jitter   float64 `json:"jitter_ms"`
+	Delay    float64 `json:"delay_ms"`
+}
+
+// Hop is a router along the path to the client, or the client itself,
+// that replied to the traceroute probe sent with TTL. Address is empty if
+// no one replied. RTT is in milliseconds.
+type Hop struct {
+	TTL     int     `json:"ttl"`
+	Address string  `json:"address,omitempty"`
+	RTT     float64 `json:"rtt_ms,omitempty"`
+}
+
+// Environment describes where the server runs, when it may affect the
+// measurements. Container is the detected runtime, if any. CPULimit is in
+// cores and MemoryLimit in bytes, both zero when unlimited. MTU is that of
+// the egress interface, which is Virtual if it has no device behind it,
+// e.g. a veth. NAT is true when the interface has only private addresses.
+type Environment struct {
+	Container   string  `json:"container,omitempty"`
+	CPULimit    float64 `json:"cpu_limit,omitempty"`
+	MemoryLimit int64   `json:"memory_limit_bytes,omitempty"`
+	MTU         int     `json:"mtu,omitempty"`
+	Virtual     bool    `json:"virtual_interface,omitempty"`
+	NAT         bool    `json:"nat,omitempty"`
+}
+
+// Timing records when an event of the protocol happened, in seconds since
+// the start of the session. Test is empty for session wide events.
+type Timing struct {
+	Event   string  `json:"event"`
+	Test    string  `json:"test,omitempty"`
+	Elapsed float64 `json:"elapsed"`
+}
+
+// Events of the protocol whose timing we record.
+const (
+	EventLogin        = "login"
+	EventQueue        = "queue"
+	EventAdmitted     = "admitted"
+	EventTestPrepare  = "test_prepare"
+	EventTestStart    = "test_start"
+	EventTestFinalize = "test_finalize"
+	EventLogout       = "logout"
+)
+
+// Result is the result of a session.
+type Result struct {
+	UUID            string            `json:"uuid"`
+	Tenant          string            `json:"tenant,omitempty"`
+	ServerVersion   string            `json:"server_version"`
+	ServerCommit    string            `json:"server_commit,omitempty"`
+	ServerBuildDate string            `json:"server_build_date,omitempty"`
+	ServerMeta      map[string]string `json:"server_meta,omitempty"`
+	Protocol        string            `json:"protocol"`
+	Transport       string            `json:"transport"`
+	ClientAddress   string            `json:"client_address"`
+	ClientVersion   string            `json:"client_version"`
+	ClientHostname  string            `json:"client_hostname,omitempty"`
+	ClientASN       uint32            `json:"client_asn,omitempty"`
+	ServerSpeed     float64           `json:"server_speed_mbits,omitempty"`
+	Environment     *Environment      `json:"environment,omitempty"`
+	Tests           int               `json:"tests,omitempty"`
+	StartTime       time.Time         `json:"start_time"`
+	EndTime         time.Time         `json:"end_time"`
+	Measurements    []*Measurement    `json:"results"`
+	Traffic         *Traffic          `json:"traffic,omitempty"`
+	Timings         []*Timing         `json:"timings,omitempty"`
+	IdleRTT         float64           `json:"idle_rtt_ms,omitempty"`
+	UDP             *UDP              `json:"udp,omitempty"`
+	Traceroute      []*Hop            `json:"traceroute,omitempty"`
+	Meta            map[string]string `json:"meta,omitempty"`
+	Variables       map[string]string `json:"variables,omitempty"`
+	Outcome         string            `json:"outcome"`
+	FailureStage    string            `json:"failure_stage,omitempty"`
+	FailureReason   string            `json:"failure_reason,omitempty"`
+}
+
+// Timing returns when `event` of `test` happened, if it did.
+func (result *Result) Timing(event string, test string) (float64, bool) {
+	for _, timing := range result.Timings {
+		if timing.Event == event && timing.Test == test {
+			return timing.Elapsed, true
+		}
+	}
+	return 0, false
+}
+
+// Interval returns the seconds between `first` and `second`, both about
+// `test`, if both happened.
+func (result *Result) Interval(first string, second string,
+	test string) (float64, bool) {
+	begin, found_begin := result.Timing(first, test)
+	end, found_end := result.Timing(second, test)
+	if !found_begin || !found_end {
+		return 0, false
+	}
+	return end - begin, true
+}
@@ -0,0 +1,114 @@
+package results
+
+// Storage of the results of the tests on disk
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Datadir is the directory where results are saved. When empty, results
+// are not saved at all.
+var Datadir = ""
+
+// Format is the format used to save results: "json" saves one file per
+// result, while "jsonl.gz" appends results to hourly rotated archives.
+var Format = "json"
+
+// Save saves `result` as JSON into Datadir using the configured Format.
+func Save(result *Result) error {
+	if Datadir == "" {
+		return nil
+	}
+	data, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	switch Format {
+	case "json":
+		err = save_file(result.Tenant, result.UUID, data)
+	case "jsonl.gz":
+		err = get_archive("results", result.Tenant).append(data)
+	default:
+		err = errors.New("results: unknown format: " + Format)
+	}
+	if err != nil {
+		return err
+	}
+	if ExportRows {
+		err = export_rows(result)
+	}
+	return err
+}
+
+// ValidTenant returns true if `tenant` can be used to namespace results,
+// i.e., if it is empty or only contains letters, digits, dots, dashes and
+// underscores, without starting with a dot, such that it is neither a
+// relative path component nor a hidden directory, like the spool of the
+// uploader. It must not only contain digits either, lest it could be
+// mistaken for the year of the partitions of the results without tenant.
+func ValidTenant(tenant string) bool {
+	if strings.HasPrefix(tenant, ".") {
+		return false
+	}
+	digits := true
+	for _, c := range tenant {
+		if !(c >= 'a' && c <= 'z') && !(c >= 'A' && c <= 'Z') &&
+			!(c >= '0' && c <= '9') && c != '.' && c != '-' && c != '_' {
+			return false
+		}
+		digits = digits && c >= '0' && c <= '9'
+	}
+	return tenant == "" || !digits
+}
+
+// Partition returns the directory inside Datadir where results of `tenant`
+// created at `when` are saved, i.e., `Datadir/[TENANT/]YYYY/MM/DD`, creating
+// it if needed.
+func partition(tenant string, when time.Time) (string, error) {
+	if !ValidTenant(tenant) {
+		return "", errors.New("results: invalid tenant: " + tenant)
+	}
+	dirpath := filepath.Join(Datadir, tenant,
+		when.UTC().Format("2006/01/02"))
+	return dirpath, os.MkdirAll(dirpath, 0755)
+}
+
+func save_file(tenant string, uuid string, data []byte) error {
+	dirpath, err := partition(tenant, time.Now())
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dirpath, uuid+".json")
+	err = ioutil.WriteFile(path+".tmp", data, 0644)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(path+".tmp", path)
+	if err != nil {
+		os.Remove(path + ".tmp")
+		return err
+	}
+	spool(path)
+	return nil
+}
+
+// CreateAttachment creates the file where to save `name`, which belongs to
+// the results of the session of `tenant` with `uuid`, next to them, i.e.,
+// `Datadir/[TENANT/]YYYY/MM/DD/UUID.NAME`.
+func CreateAttachment(tenant string, uuid string, name string) (*os.File,
+	error) {
+	if Datadir == "" {
+		return nil, errors.New("results: no data directory")
+	}
+	dirpath, err := partition(tenant, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return os.Create(filepath.Join(dirpath, uuid+"."+name))
+}
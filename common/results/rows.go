@@ -0,0 +1,322 @@
+package results
+
+// Export of results as flat rows suitable for loading into BigQuery (or
+// ClickHouse) as newline delimited JSON. Rows are appended to hourly
+// rotated `rows-YYYYMMDDTHH.jsonl.gz` archives, and the corresponding
+// table schema is derived from the row struct itself, such that the code
+// is the single source of truth for the schema.
+
+import (
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ExportRows controls whether flattened rows are exported along with
+// the results.
+var ExportRows = false
+
+// Version of the row schema. Bump it whenever columns are changed or
+// removed; adding NULLABLE columns does not require a bump.
+const kv_row_schema_version = 2
+
+// Row is the flat representation of a measurement, which also repeats
+// the fields of the session it belongs to; sessions without measurements
+// produce a single row where the measurement columns are NULL. Speeds are
+// in kbit/s, except the server interface speed which is in Mbit/s, times
+// are in seconds, `meta` and `server_meta` contain the JSON encoded
+// client and server metadata, and `variables` the JSON encoded variables
+// sent in MSG_RESULTS. The login time is since the start of the
+// session, the queue time is the time spent waiting in the queue, and the
+// setup time is between TEST_PREPARE and TEST_START. RTTs are in
+// milliseconds: the idle RTT is measured on the control channel before
+// the tests, the loaded RTT while the test saturates the path, and the
+// bloat ratio is the loaded RTT divided by the baseline RTT. The loss
+// columns are NULL without kernel statistics (see Losses).
+type Row struct {
+	SchemaVersion    int       `json:"schema_version"`
+	UUID             string    `json:"uuid"`
+	Tenant           *string   `json:"tenant"`
+	ServerVersion    string    `json:"server_version"`
+	ServerCommit     *string   `json:"server_commit"`
+	ServerBuildDate  *string   `json:"server_build_date"`
+	ServerMeta       *string   `json:"server_meta"`
+	Protocol         string    `json:"protocol"`
+	Transport        string    `json:"transport"`
+	ClientAddress    string    `json:"client_address"`
+	ClientVersion    string    `json:"client_version"`
+	ClientHostname   *string   `json:"client_hostname"`
+	ClientASN        *uint32   `json:"client_asn"`
+	StartTime        time.Time `json:"start_time"`
+	EndTime          time.Time `json:"end_time"`
+	Outcome          string    `json:"outcome"`
+	ServerSpeedMbits *float64  `json:"server_speed_mbits"`
+	Environment      *string   `json:"environment"`
+	ControlSent      *int64    `json:"control_bytes_sent"`
+	ControlReceived  *int64    `json:"control_bytes_received"`
+	DataSent         *int64    `json:"data_bytes_sent"`
+	DataReceived     *int64    `json:"data_bytes_received"`
+	LoginTime        *float64  `json:"login_time"`
+	QueueTime        *float64  `json:"queue_time"`
+	IdleRTTMs        *float64  `json:"idle_rtt_ms"`
+	UDPPackets       *int64    `json:"udp_packets"`
+	UDPLossRate      *float64  `json:"udp_loss_rate"`
+	UDPJitterMs      *float64  `json:"udp_jitter_ms"`
+	UDPDelayMs       *float64  `json:"udp_delay_ms"`
+	Traceroute       *string   `json:"traceroute"`
+	Test             *string   `json:"test"`
+	Direction        *string   `json:"direction"`
+	NumStreams       *int      `json:"num_streams"`
+	Bytes            *int      `json:"bytes"`
+	Elapsed          *float64  `json:"elapsed"`
+	SpeedKbits       *float64  `json:"speed_kbits"`
+	ClientSpeedKbits *float64  `json:"client_speed_kbits"`
+	ClientDivergent  *bool     `json:"client_speed_divergent"`
+	KernelSpeedKbits *float64  `json:"kernel_speed_kbits"`
+	RateDivergent    *bool     `json:"rate_divergent"`
+	SetupTime        *float64  `json:"setup_time"`
+	Fidelity         *string   `json:"fidelity"`
+	SteadySpeedKbits *float64  `json:"steady_speed_kbits"`
+	MinRTTMs         *float64  `json:"min_rtt_ms"`
+	LoadedRTTMs      *float64  `json:"loaded_rtt_ms"`
+	LoadedRTTP95Ms   *float64  `json:"loaded_rtt_p95_ms"`
+	BaselineRTTMs    *float64  `json:"baseline_rtt_ms"`
+	BloatRatio       *float64  `json:"bloat_ratio"`
+	SegmentsOut      *int64    `json:"segments_out"`
+	SegmentsIn       *int64    `json:"segments_in"`
+	Retransmits      *int64    `json:"retransmits"`
+	OutOfOrder       *int64    `json:"out_of_order"`
+	LossRate         *float64  `json:"loss_rate"`
+	Duplex           *bool     `json:"duplex"`
+	Meta             *string   `json:"meta"`
+	Variables        *string   `json:"variables"`
+}
+
+// SchemaField describes a column of the exported rows using the same
+// JSON format used by BigQuery's `bq load --schema`.
+type SchemaField struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	Mode string `json:"mode"`
+}
+
+func parse_speed(speed string) *float64 {
+	value, err := strconv.ParseFloat(speed, 64)
+	if err != nil {
+		return nil
+	}
+	return &value
+}
+
+// Rows flattens `result` into rows.
+func (result *Result) Rows() []*Row {
+	session := Row{
+		SchemaVersion: kv_row_schema_version,
+		UUID:          result.UUID,
+		ServerVersion: result.ServerVersion,
+		Protocol:      result.Protocol,
+		Transport:     result.Transport,
+		ClientAddress: result.ClientAddress,
+		ClientVersion: result.ClientVersion,
+		StartTime:     result.StartTime,
+		EndTime:       result.EndTime,
+		Outcome:       result.Outcome,
+	}
+	if result.Tenant != "" {
+		tenant := result.Tenant
+		session.Tenant = &tenant
+	}
+	if result.ClientHostname != "" {
+		hostname := result.ClientHostname
+		session.ClientHostname = &hostname
+	}
+	if result.ClientASN != 0 {
+		number := result.ClientASN
+		session.ClientASN = &number
+	}
+	if result.ServerCommit != "" {
+		commit := result.ServerCommit
+		session.ServerCommit = &commit
+	}
+	if result.ServerBuildDate != "" {
+		built := result.ServerBuildDate
+		session.ServerBuildDate = &built
+	}
+	if result.ServerSpeed > 0 {
+		speed := result.ServerSpeed
+		session.ServerSpeedMbits = &speed
+	}
+	if result.Environment != nil {
+		data, err := json.Marshal(result.Environment)
+		if err == nil {
+			environment := string(data)
+			session.Environment = &environment
+		}
+	}
+	if result.Traffic != nil {
+		traffic := *result.Traffic
+		session.ControlSent = &traffic.ControlSent
+		session.ControlReceived = &traffic.ControlReceived
+		session.DataSent = &traffic.DataSent
+		session.DataReceived = &traffic.DataReceived
+	}
+	if login, found := result.Timing(EventLogin, ""); found {
+		session.LoginTime = &login
+	}
+	if queue, found := result.Interval(EventQueue, EventAdmitted,
+		""); found {
+		session.QueueTime = &queue
+	}
+	if result.IdleRTT > 0 {
+		idle := result.IdleRTT
+		session.IdleRTTMs = &idle
+	}
+	if result.UDP != nil {
+		udp := *result.UDP
+		session.UDPPackets = &udp.Packets
+		session.UDPLossRate = &udp.LossRate
+		session.UDPJitterMs = &udp.Jitter
+		session.UDPDelayMs = &udp.Delay
+	}
+	if len(result.Traceroute) > 0 {
+		data, err := json.Marshal(result.Traceroute)
+		if err == nil {
+			traceroute := string(data)
+			session.Traceroute = &traceroute
+		}
+	}
+	if len(result.ServerMeta) > 0 {
+		data, err := json.Marshal(result.ServerMeta)
+		if err == nil {
+			meta := string(data)
+			session.ServerMeta = &meta
+		}
+	}
+	if len(result.Meta) > 0 {
+		data, err := json.Marshal(result.Meta)
+		if err == nil {
+			meta := string(data)
+			session.Meta = &meta
+		}
+	}
+	if len(result.Variables) > 0 {
+		data, err := json.Marshal(result.Variables)
+		if err == nil {
+			variables := string(data)
+			session.Variables = &variables
+		}
+	}
+	if len(result.Measurements) == 0 {
+		return []*Row{&session}
+	}
+	rows := []*Row{}
+	for _, measurement := range result.Measurements {
+		row := session
+		measurement := *measurement
+		row.Test = &measurement.Name
+		row.Direction = &measurement.Direction
+		row.NumStreams = &measurement.NumStreams
+		row.Bytes = &measurement.Bytes
+		row.Elapsed = &measurement.Elapsed
+		row.SpeedKbits = &measurement.SpeedKbits
+		row.ClientSpeedKbits = parse_speed(measurement.ClientSpeed)
+		if row.ClientSpeedKbits != nil {
+			row.ClientDivergent = &measurement.ClientDivergent
+		}
+		if measurement.KernelSpeedKbits > 0 {
+			row.KernelSpeedKbits = &measurement.KernelSpeedKbits
+			row.RateDivergent = &measurement.RateDivergent
+		}
+		if setup, found := result.Interval(EventTestPrepare, EventTestStart,
+			measurement.Name); found {
+			row.SetupTime = &setup
+		}
+		if measurement.Fidelity != "" {
+			row.Fidelity = &measurement.Fidelity
+		}
+		if measurement.SteadySpeedKbits > 0 {
+			row.SteadySpeedKbits = &measurement.SteadySpeedKbits
+		}
+		if measurement.MinRTT > 0 {
+			row.MinRTTMs = &measurement.MinRTT
+		}
+		if measurement.LoadedRTT > 0 {
+			row.LoadedRTTMs = &measurement.LoadedRTT
+			row.LoadedRTTP95Ms = &measurement.LoadedRTTP95
+		}
+		if measurement.BloatRatio > 0 {
+			row.BaselineRTTMs = &measurement.BaselineRTT
+			row.BloatRatio = &measurement.BloatRatio
+		}
+		if measurement.Losses != nil {
+			losses := *measurement.Losses
+			row.SegmentsOut = &losses.SegmentsOut
+			row.SegmentsIn = &losses.SegmentsIn
+			row.Retransmits = &losses.Retransmits
+			row.OutOfOrder = &losses.OutOfOrder
+			row.LossRate = losses.LossRate
+		}
+		if measurement.Duplex {
+			row.Duplex = &measurement.Duplex
+		}
+		rows = append(rows, &row)
+	}
+	return rows
+}
+
+func export_rows(result *Result) error {
+	for _, row := range result.Rows() {
+		data, err := json.Marshal(row)
+		if err != nil {
+			return err
+		}
+		err = get_archive("rows", result.Tenant).append(data)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RowSchema returns the schema of the exported rows.
+func RowSchema() []SchemaField {
+	schema := []SchemaField{}
+	rowtype := reflect.TypeOf(Row{})
+	for idx := 0; idx < rowtype.NumField(); idx += 1 {
+		field := rowtype.Field(idx)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		mode := "REQUIRED"
+		fieldtype := field.Type
+		if fieldtype.Kind() == reflect.Ptr {
+			mode = "NULLABLE"
+			fieldtype = fieldtype.Elem()
+		}
+		schema = append(schema, SchemaField{
+			Name: name,
+			Type: schema_type(fieldtype),
+			Mode: mode,
+		})
+	}
+	return schema
+}
+
+func schema_type(fieldtype reflect.Type) string {
+	if fieldtype == reflect.TypeOf(time.Time{}) {
+		return "TIMESTAMP"
+	}
+	switch fieldtype.Kind() {
+	case reflect.Bool:
+		return "BOOLEAN"
+	case reflect.Int, reflect.Int32, reflect.Int64, reflect.Uint32:
+		return "INTEGER"
+	case reflect.Float32, reflect.Float64:
+		return "FLOAT"
+	default:
+		return "STRING"
+	}
+}
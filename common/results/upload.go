@@ -0,0 +1,191 @@
+package results
+
+// Upload of finished results to a S3 compatible object storage (this
+// includes GCS using its XML API and HMAC keys). Finished results are
+// hard linked into a spool directory inside Datadir and removed from it
+// once they have been successfully uploaded.
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/neubot/botticelli/common"
+)
+
+// UploadURL is the path-style URL of the bucket where to upload results,
+// e.g., `https://storage.googleapis.com/my-bucket`. When empty, results
+// are not uploaded. Credentials are read from the AWS_ACCESS_KEY_ID and
+// AWS_SECRET_ACCESS_KEY environment variables.
+var UploadURL = ""
+
+// UploadRegion is the region used to sign upload requests.
+var UploadRegion = "us-east-1"
+
+const kv_spool_dir = ".spool"
+const kv_upload_interval = 1 * time.Minute
+const kv_upload_max_backoff = 30 * time.Minute
+
+// Spool schedules the result file at `path` for upload, if enabled.
+func spool(path string) {
+	if UploadURL == "" {
+		return
+	}
+	relpath, err := filepath.Rel(Datadir, path)
+	if err != nil {
+		log.Printf("results: cannot spool %s: %s", path, err)
+		return
+	}
+	spoolpath := filepath.Join(Datadir, kv_spool_dir, relpath)
+	err = os.MkdirAll(filepath.Dir(spoolpath), 0755)
+	if err == nil {
+		err = os.Link(path, spoolpath)
+	}
+	if err != nil {
+		log.Printf("results: cannot spool %s: %s", path, err)
+	}
+}
+
+// StartUploader starts the background goroutine that uploads spooled
+// results, retrying with exponential backoff on failure.
+func StartUploader() {
+	if Datadir == "" || UploadURL == "" {
+		return
+	}
+	go func() {
+		backoff := kv_upload_interval
+		for {
+			err := upload_spool()
+			if err != nil {
+				log.Printf("results: upload failed: %s", err)
+				backoff *= 2
+				if backoff > kv_upload_max_backoff {
+					backoff = kv_upload_max_backoff
+				}
+			} else {
+				backoff = kv_upload_interval
+			}
+			time.Sleep(backoff)
+		}
+	}()
+}
+
+func upload_spool() error {
+	spooldir := filepath.Join(Datadir, kv_spool_dir)
+	return filepath.Walk(spooldir, func(path string, info os.FileInfo,
+		err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() || strings.HasSuffix(path, ".tmp") {
+			return nil
+		}
+		key, err := filepath.Rel(spooldir, path)
+		if err != nil {
+			return err
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		err = upload_object(filepath.ToSlash(key), data)
+		if err != nil {
+			return err
+		}
+		common.Infof("results: uploaded %s", key)
+		return os.Remove(path)
+	})
+}
+
+func upload_object(key string, data []byte) error {
+	access_key := os.Getenv("AWS_ACCESS_KEY_ID")
+	secret_key := os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if access_key == "" || secret_key == "" {
+		return errors.New("results: missing upload credentials")
+	}
+	target, err := url.Parse(strings.TrimSuffix(UploadURL, "/") + "/" + key)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequest("PUT", target.String(),
+		bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	sign_request_v4(request, data, access_key, secret_key, time.Now())
+	client := &http.Client{Timeout: 60 * time.Second}
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	ioutil.ReadAll(response.Body)
+	if response.StatusCode != 200 {
+		return errors.New("results: upload: " + response.Status)
+	}
+	return nil
+}
+
+func hmac_sha256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func sha256_hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Sign_request_v4 signs `request` using AWS signature version 4.
+func sign_request_v4(request *http.Request, body []byte, access_key,
+	secret_key string, now time.Time) {
+	amzdate := now.UTC().Format("20060102T150405Z")
+	datestamp := now.UTC().Format("20060102")
+	payload_hash := sha256_hex(body)
+	request.Header.Set("X-Amz-Date", amzdate)
+	request.Header.Set("X-Amz-Content-Sha256", payload_hash)
+
+	signed_headers := "host;x-amz-content-sha256;x-amz-date"
+	canonical_request := strings.Join([]string{
+		request.Method,
+		request.URL.EscapedPath(),
+		request.URL.RawQuery,
+		"host:" + request.URL.Host + "\n" +
+			"x-amz-content-sha256:" + payload_hash + "\n" +
+			"x-amz-date:" + amzdate + "\n",
+		signed_headers,
+		payload_hash,
+	}, "\n")
+
+	scope := datestamp + "/" + UploadRegion + "/s3/aws4_request"
+	string_to_sign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzdate,
+		scope,
+		sha256_hex([]byte(canonical_request)),
+	}, "\n")
+
+	key := hmac_sha256([]byte("AWS4"+secret_key), datestamp)
+	key = hmac_sha256(key, UploadRegion)
+	key = hmac_sha256(key, "s3")
+	key = hmac_sha256(key, "aws4_request")
+	signature := hex.EncodeToString(hmac_sha256(key, string_to_sign))
+
+	request.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+
+		access_key+"/"+scope+", SignedHeaders="+signed_headers+
+		", Signature="+signature)
+}
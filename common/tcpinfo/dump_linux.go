@@ -0,0 +1,141 @@
+//go:build linux
+// +build linux
+
+package tcpinfo
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+const kv_netlink_inet_diag = 4
+const kv_sock_diag_by_family = 20
+const kv_inet_diag_info = 2
+
+// Struct inet_diag_msg, which precedes the attributes of each socket.
+const kv_diag_msg_size = 72
+
+// We are not interested in listening sockets and in those that are gone.
+const kv_states = 1<<kv_state_established | 1<<kv_state_syn_recv |
+	1<<kv_state_fin_wait1 | 1<<kv_state_fin_wait2 |
+	1<<kv_state_close_wait | 1<<kv_state_last_ack | 1<<kv_state_closing
+
+// Struct nlmsghdr followed by struct inet_diag_req_v2.
+type diag_request_t struct {
+	header   syscall.NlMsghdr
+	family   uint8
+	protocol uint8
+	ext      uint8
+	pad      uint8
+	states   uint32
+	id       [48]byte
+}
+
+// Dump returns the TCP_INFO of all the TCP connections, by Key.
+func Dump() (map[string]*TCPInfo, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK,
+		syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, kv_netlink_inet_diag)
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.Close(fd)
+	infos := make(map[string]*TCPInfo)
+	for seq, family := range []uint8{syscall.AF_INET, syscall.AF_INET6} {
+		err = dump_family(fd, family, uint32(seq+1), infos)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return infos, nil
+}
+
+func dump_family(fd int, family uint8, seq uint32,
+	infos map[string]*TCPInfo) error {
+	request := &diag_request_t{
+		header: syscall.NlMsghdr{
+			Len:   uint32(unsafe.Sizeof(diag_request_t{})),
+			Type:  kv_sock_diag_by_family,
+			Flags: syscall.NLM_F_REQUEST | syscall.NLM_F_DUMP,
+			Seq:   seq,
+		},
+		family:   family,
+		protocol: syscall.IPPROTO_TCP,
+		ext:      1 << (kv_inet_diag_info - 1),
+		states:   kv_states,
+	}
+	data := (*[unsafe.Sizeof(diag_request_t{})]byte)(
+		unsafe.Pointer(request))[:]
+	err := syscall.Sendto(fd, data, 0,
+		&syscall.SockaddrNetlink{Family: syscall.AF_NETLINK})
+	if err != nil {
+		return err
+	}
+	buffer := make([]byte, 1<<16)
+	for {
+		count, _, err := syscall.Recvfrom(fd, buffer, 0)
+		if err != nil {
+			return err
+		}
+		messages, err := syscall.ParseNetlinkMessage(buffer[:count])
+		if err != nil {
+			return err
+		}
+		for _, message := range messages {
+			if message.Header.Seq != seq {
+				continue
+			}
+			switch message.Header.Type {
+			case syscall.NLMSG_DONE:
+				return nil
+			case syscall.NLMSG_ERROR:
+				if len(message.Data) < 4 {
+					return errors.New("tcpinfo: truncated netlink error")
+				}
+				code := *(*int32)(unsafe.Pointer(&message.Data[0]))
+				return syscall.Errno(-code)
+			}
+			parse_diag_msg(message.Data, infos)
+		}
+	}
+}
+
+// Parse_diag_msg adds the TCP_INFO of the socket described by `data`, an
+// inet_diag_msg followed by its attributes, to `infos`.
+func parse_diag_msg(data []byte, infos map[string]*TCPInfo) {
+	if len(data) < kv_diag_msg_size {
+		return
+	}
+	// The ports are in network byte order, and the addresses are 16
+	// bytes long, of which IPv4 uses the first four
+	size := net.IPv6len
+	if data[0] == syscall.AF_INET {
+		size = net.IPv4len
+	}
+	local_port := int(binary.BigEndian.Uint16(data[4:6]))
+	remote_port := int(binary.BigEndian.Uint16(data[6:8]))
+	local_ip := net.IP(append([]byte{}, data[8:8+size]...))
+	remote_ip := net.IP(append([]byte{}, data[24:24+size]...))
+	for attrs := data[kv_diag_msg_size:]; len(attrs) >= 4; {
+		length := int(*(*uint16)(unsafe.Pointer(&attrs[0])))
+		kind := *(*uint16)(unsafe.Pointer(&attrs[2]))
+		if length < 4 || length > len(attrs) {
+			return
+		}
+		if kind == kv_inet_diag_info {
+			info := &TCPInfo{}
+			raw := (*[unsafe.Sizeof(TCPInfo{})]byte)(
+				unsafe.Pointer(info))[:]
+			copy(raw, attrs[4:length])
+			infos[key(local_ip, local_port, remote_ip, remote_port)] = info
+			return
+		}
+		aligned := (length + 3) &^ 3
+		if aligned > len(attrs) {
+			return
+		}
+		attrs = attrs[aligned:]
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package tcpinfo
+
+// Dump returns the TCP_INFO of all the TCP connections, by Key.
+func Dump() (map[string]*TCPInfo, error) {
+	return nil, ErrUnsupported
+}
@@ -0,0 +1,15 @@
+//go:build linux && !386
+// +build linux,!386
+
+package tcpinfo
+
+import "syscall"
+
+// Getsockopt calls getsockopt(2) on `fd`, with `value` and `length`
+// pointing to the buffer and to its length.
+func getsockopt(fd uintptr, level, name int, value,
+	length uintptr) syscall.Errno {
+	_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd,
+		uintptr(level), uintptr(name), value, length, 0)
+	return errno
+}
@@ -0,0 +1,23 @@
+//go:build linux && 386
+// +build linux,386
+
+package tcpinfo
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// On linux/386, the socket system calls are multiplexed by socketcall(2),
+// which takes the number of the call and a pointer to its arguments.
+const kv_sys_getsockopt = 15
+
+// Getsockopt calls getsockopt(2) on `fd`, with `value` and `length`
+// pointing to the buffer and to its length.
+func getsockopt(fd uintptr, level, name int, value,
+	length uintptr) syscall.Errno {
+	args := [5]uintptr{fd, uintptr(level), uintptr(name), value, length}
+	_, _, errno := syscall.Syscall(syscall.SYS_SOCKETCALL, kv_sys_getsockopt,
+		uintptr(unsafe.Pointer(&args[0])), 0)
+	return errno
+}
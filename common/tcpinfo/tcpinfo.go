@@ -0,0 +1,129 @@
+package tcpinfo
+
+// Kernel level statistics of TCP connections. We read TCP_INFO on Linux,
+// TCP_CONNECTION_INFO on macOS and SIO_TCP_INFO on Windows, and convert
+// what they provide to the Linux format. On other systems, Get and Outq
+// fail with ErrUnsupported and callers rely on application level data.
+// On Linux, Dump also reads the TCP_INFO of all connections at once, with
+// a netlink query, which is cheaper than Get when there are many of them.
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"syscall"
+)
+
+// ErrUnsupported is returned on systems where we cannot read TCP_INFO.
+var ErrUnsupported = errors.New("tcpinfo: not supported on this system")
+
+// Linux TCP states, which we use on every system.
+const (
+	kv_state_established = 1
+	kv_state_syn_sent    = 2
+	kv_state_syn_recv    = 3
+	kv_state_fin_wait1   = 4
+	kv_state_fin_wait2   = 5
+	kv_state_time_wait   = 6
+	kv_state_close       = 7
+	kv_state_close_wait  = 8
+	kv_state_last_ack    = 9
+	kv_state_listen      = 10
+	kv_state_closing     = 11
+)
+
+// Key returns the key of `conn` in the map returned by Dump.
+func Key(conn net.Conn) string {
+	local, ok := conn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return ""
+	}
+	remote, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return ""
+	}
+	return key(local.IP, local.Port, remote.IP, remote.Port)
+}
+
+// Key returns the key of the connection between the given endpoints, where
+// we ignore the zone of IPv6 addresses, which Dump does not know.
+func key(local_ip net.IP, local_port int, remote_ip net.IP,
+	remote_port int) string {
+	return net.JoinHostPort(local_ip.String(), strconv.Itoa(local_port)) +
+		" " + net.JoinHostPort(remote_ip.String(), strconv.Itoa(remote_port))
+}
+
+// Control runs `function` with the file descriptor of `conn`, which must
+// be a TCP connection.
+func control(conn net.Conn, function func(fd uintptr)) error {
+	sysconn, ok := conn.(syscall.Conn)
+	if !ok {
+		return ErrUnsupported
+	}
+	rawconn, err := sysconn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	return rawconn.Control(function)
+}
+
+// TCPInfo mirrors Linux's `struct tcp_info`. Times are in microseconds
+// (except the Last* fields, which are in milliseconds) and rates are in
+// bytes per second. Fields not supported by the running kernel, or not
+// available on the running system, are zero.
+type TCPInfo struct {
+	State         uint8
+	CAState       uint8
+	Retransmits   uint8
+	Probes        uint8
+	Backoff       uint8
+	Options       uint8
+	WScale        uint8
+	AppLimited    uint8
+	RTO           uint32
+	ATO           uint32
+	SndMSS        uint32
+	RcvMSS        uint32
+	Unacked       uint32
+	Sacked        uint32
+	Lost          uint32
+	Retrans       uint32
+	Fackets       uint32
+	LastDataSent  uint32
+	LastAckSent   uint32
+	LastDataRecv  uint32
+	LastAckRecv   uint32
+	PMTU          uint32
+	RcvSsThresh   uint32
+	RTT           uint32
+	RTTVar        uint32
+	SndSsThresh   uint32
+	SndCwnd       uint32
+	AdvMSS        uint32
+	Reordering    uint32
+	RcvRTT        uint32
+	RcvSpace      uint32
+	TotalRetrans  uint32
+	PacingRate    uint64
+	MaxPacingRate uint64
+	BytesAcked    uint64
+	BytesReceived uint64
+	SegsOut       uint32
+	SegsIn        uint32
+	NotsentBytes  uint32
+	MinRTT        uint32
+	DataSegsIn    uint32
+	DataSegsOut   uint32
+	DeliveryRate  uint64
+	BusyTime      uint64
+	RWndLimited   uint64
+	SndBufLimited uint64
+	Delivered     uint32
+	DeliveredCE   uint32
+	BytesSent     uint64
+	BytesRetrans  uint64
+	DSackDups     uint32
+	ReordSeen     uint32
+	RcvOooPack    uint32
+	SndWnd        uint32
+}
@@ -0,0 +1,109 @@
+//go:build darwin
+// +build darwin
+
+package tcpinfo
+
+import (
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+const kv_tcp_connection_info = 0x106
+const kv_so_nwrite = 0x1024
+
+// Mirrors `struct tcp_connection_info`. Times are in milliseconds and
+// the congestion window is in bytes.
+type connection_info_t struct {
+	State               uint8
+	SndWScale           uint8
+	RcvWScale           uint8
+	_                   uint8
+	Options             uint32
+	Flags               uint32
+	RTO                 uint32
+	MaxSeg              uint32
+	SndSsThresh         uint32
+	SndCwnd             uint32
+	SndWnd              uint32
+	SndSbBytes          uint32
+	RcvWnd              uint32
+	RTTCur              uint32
+	SRTT                uint32
+	RTTVar              uint32
+	TFOFlags            uint32 // bit field
+	TxPackets           uint64
+	TxBytes             uint64
+	TxRetransmitBytes   uint64
+	RxPackets           uint64
+	RxBytes             uint64
+	RxOutOfOrderBytes   uint64
+	TxRetransmitPackets uint64
+}
+
+// Maps the BSD TCP states to the Linux ones.
+var kv_states = []uint8{
+	kv_state_close, kv_state_listen, kv_state_syn_sent, kv_state_syn_recv,
+	kv_state_established, kv_state_close_wait, kv_state_fin_wait1,
+	kv_state_closing, kv_state_last_ack, kv_state_fin_wait2,
+	kv_state_time_wait,
+}
+
+// Get returns the TCP_INFO of `conn`, which must be a TCP connection. We
+// cannot tell the bytes acknowledged from those in flight, hence we count
+// as acknowledged all the bytes sent once.
+func Get(conn net.Conn) (*TCPInfo, error) {
+	raw := &connection_info_t{}
+	var errno syscall.Errno
+	err := control(conn, func(fd uintptr) {
+		length := uint32(unsafe.Sizeof(*raw))
+		_, _, errno = syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd,
+			syscall.IPPROTO_TCP, kv_tcp_connection_info,
+			uintptr(unsafe.Pointer(raw)), uintptr(unsafe.Pointer(&length)), 0)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if errno != 0 {
+		return nil, errno
+	}
+	info := &TCPInfo{
+		WScale:        raw.SndWScale&0x0f | raw.RcvWScale<<4,
+		RTO:           raw.RTO * 1000,
+		SndMSS:        raw.MaxSeg,
+		RTT:           raw.SRTT * 1000,
+		RTTVar:        raw.RTTVar * 1000,
+		SndSsThresh:   raw.SndSsThresh,
+		SndCwnd:       raw.SndCwnd,
+		TotalRetrans:  uint32(raw.TxRetransmitPackets),
+		BytesAcked:    raw.TxBytes - raw.TxRetransmitBytes,
+		BytesReceived: raw.RxBytes,
+		SegsOut:       uint32(raw.TxPackets),
+		SegsIn:        uint32(raw.RxPackets),
+		BytesSent:     raw.TxBytes,
+		BytesRetrans:  raw.TxRetransmitBytes,
+		SndWnd:        raw.SndWnd,
+	}
+	if int(raw.State) < len(kv_states) {
+		info.State = kv_states[raw.State]
+	}
+	if raw.MaxSeg > 0 {
+		info.SndCwnd = raw.SndCwnd / raw.MaxSeg // Linux uses segments
+	}
+	return info, nil
+}
+
+// Outq returns the number of bytes in the send queue of `conn`, which
+// have not been sent or acknowledged yet (SO_NWRITE).
+func Outq(conn net.Conn) (int, error) {
+	var outq int
+	var sockerr error
+	err := control(conn, func(fd uintptr) {
+		outq, sockerr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET,
+			kv_so_nwrite)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return outq, sockerr
+}
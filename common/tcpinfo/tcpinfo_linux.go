@@ -0,0 +1,46 @@
+//go:build linux
+// +build linux
+
+package tcpinfo
+
+import (
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// Get returns the TCP_INFO of `conn`, which must be a TCP connection.
+func Get(conn net.Conn) (*TCPInfo, error) {
+	info := &TCPInfo{}
+	var errno syscall.Errno
+	err := control(conn, func(fd uintptr) {
+		length := uint32(unsafe.Sizeof(*info))
+		errno = getsockopt(fd, syscall.IPPROTO_TCP, syscall.TCP_INFO,
+			uintptr(unsafe.Pointer(info)), uintptr(unsafe.Pointer(&length)))
+	})
+	if err != nil {
+		return nil, err
+	}
+	if errno != 0 {
+		return nil, errno
+	}
+	return info, nil
+}
+
+// Outq returns the number of bytes in the send queue of `conn`, which
+// have not been sent or acknowledged yet (SIOCOUTQ).
+func Outq(conn net.Conn) (int, error) {
+	var outq int32
+	var errno syscall.Errno
+	err := control(conn, func(fd uintptr) {
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd,
+			syscall.TIOCOUTQ, uintptr(unsafe.Pointer(&outq)))
+	})
+	if err != nil {
+		return 0, err
+	}
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(outq), nil
+}
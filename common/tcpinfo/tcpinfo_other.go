@@ -0,0 +1,19 @@
+//go:build !linux && !darwin && !windows
+// +build !linux,!darwin,!windows
+
+package tcpinfo
+
+import (
+	"net"
+)
+
+// Get returns the TCP_INFO of `conn`, which must be a TCP connection.
+func Get(conn net.Conn) (*TCPInfo, error) {
+	return nil, ErrUnsupported
+}
+
+// Outq returns the number of bytes in the send queue of `conn`, which
+// have not been sent or acknowledged yet (SIOCOUTQ).
+func Outq(conn net.Conn) (int, error) {
+	return 0, ErrUnsupported
+}
@@ -0,0 +1,107 @@
+//go:build windows
+// +build windows
+
+package tcpinfo
+
+import (
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+const kv_sio_tcp_info = 0xd8000027
+
+// Mirrors `TCP_INFO_v0`. The congestion window is in bytes.
+type info_v0_t struct {
+	State             uint32
+	Mss               uint32
+	ConnectionTimeMs  uint64
+	TimestampsEnabled uint8
+	RttUs             uint32
+	MinRttUs          uint32
+	BytesInFlight     uint32
+	Cwnd              uint32
+	SndWnd            uint32
+	RcvWnd            uint32
+	RcvBuf            uint32
+	BytesOut          uint64
+	BytesIn           uint64
+	BytesReordered    uint32
+	BytesRetrans      uint32
+	FastRetrans       uint32
+	DupAcksIn         uint32
+	TimeoutEpisodes   uint32
+	SynRetrans        uint8
+}
+
+// Maps the Windows TCP states to the Linux ones.
+var kv_states = []uint8{
+	kv_state_close, kv_state_listen, kv_state_syn_sent, kv_state_syn_recv,
+	kv_state_established, kv_state_fin_wait1, kv_state_fin_wait2,
+	kv_state_close_wait, kv_state_closing, kv_state_last_ack,
+	kv_state_time_wait,
+}
+
+func get_v0(conn net.Conn) (*info_v0_t, error) {
+	raw := &info_v0_t{}
+	version := uint32(0)
+	var returned uint32
+	var ioctl_err error
+	err := control(conn, func(fd uintptr) {
+		ioctl_err = syscall.WSAIoctl(syscall.Handle(fd), kv_sio_tcp_info,
+			(*byte)(unsafe.Pointer(&version)), uint32(unsafe.Sizeof(version)),
+			(*byte)(unsafe.Pointer(raw)), uint32(unsafe.Sizeof(*raw)),
+			&returned, nil, 0)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if ioctl_err != nil {
+		return nil, ioctl_err
+	}
+	return raw, nil
+}
+
+// Get returns the TCP_INFO of `conn`, which must be a TCP connection.
+func Get(conn net.Conn) (*TCPInfo, error) {
+	raw, err := get_v0(conn)
+	if err != nil {
+		return nil, err
+	}
+	info := &TCPInfo{
+		SndMSS:  raw.Mss,
+		Unacked: raw.BytesInFlight / max_uint32(raw.Mss, 1),
+		RTT:     raw.RttUs,
+		MinRTT:  raw.MinRttUs,
+		SndCwnd: raw.Cwnd / max_uint32(raw.Mss, 1),
+		BytesAcked: raw.BytesOut - uint64(raw.BytesRetrans) -
+			uint64(raw.BytesInFlight),
+		BytesReceived: raw.BytesIn,
+		BytesSent:     raw.BytesOut,
+		BytesRetrans:  uint64(raw.BytesRetrans),
+		SndWnd:        raw.SndWnd,
+		TotalRetrans:  raw.FastRetrans + raw.TimeoutEpisodes,
+	}
+	if int(raw.State) < len(kv_states) {
+		info.State = kv_states[raw.State]
+	}
+	return info, nil
+}
+
+// Outq returns the number of bytes in the send queue of `conn`. Windows
+// does not tell how many of them have not been sent yet, hence we only
+// count those sent but not acknowledged yet.
+func Outq(conn net.Conn) (int, error) {
+	raw, err := get_v0(conn)
+	if err != nil {
+		return 0, err
+	}
+	return int(raw.BytesInFlight), nil
+}
+
+func max_uint32(a uint32, b uint32) uint32 {
+	if a > b {
+		return a
+	}
+	return b
+}
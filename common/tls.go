@@ -0,0 +1,221 @@
+package common
+
+// TLS configuration of the listeners serving browsers. Since measurement
+// servers are internet facing, the defaults only allow TLS 1.2 or newer,
+// with the cipher suites and the curves that Go considers secure, and
+// operators can restrict them further. Optionally, we staple the OCSP
+// response about our certificate, which we refresh in the background.
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/neubot/botticelli/common/ocsp"
+)
+
+// TLSCertFile and TLSKeyFile are the PEM encoded certificate chain and
+// private key. When empty, TLS is disabled.
+var TLSCertFile = ""
+var TLSKeyFile = ""
+
+// TLSMinVersion is the minimum TLS version, i.e., 1.0, 1.1, 1.2 or 1.3.
+var TLSMinVersion = "1.2"
+
+// TLSCipherSuites is a comma separated list of the names of the allowed
+// TLS 1.0-1.2 cipher suites (e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256).
+// When empty, Go's secure defaults are used. TLS 1.3 suites are not
+// configurable.
+var TLSCipherSuites = ""
+
+// TLSCurves is a comma separated list of the key exchange curves, by
+// order of preference, among X25519, P256, P384 and P521. When empty,
+// Go's defaults are used.
+var TLSCurves = ""
+
+// TLSOCSPStapling enables stapling the OCSP response about the certificate,
+// whose chain must then include the issuer.
+var TLSOCSPStapling = false
+
+// We refresh the OCSP response halfway through its validity, within these
+// bounds, and retry after kv_ocsp_retry when we cannot fetch it.
+const kv_ocsp_retry = 5 * time.Minute
+const kv_ocsp_max_refresh = 24 * time.Hour
+const kv_ocsp_default_refresh = 1 * time.Hour
+
+var kv_tls_versions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var kv_tls_curves = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P256":   tls.CurveP256,
+	"P384":   tls.CurveP384,
+	"P521":   tls.CurveP521,
+}
+
+var kv_tls_config *tls.Config
+
+var kv_tls_certificate *tls.Certificate
+var kv_tls_stapled *tls.Certificate
+var kv_tls_stapled_until time.Time
+var kv_tls_mutex sync.Mutex
+
+// Split_list splits a comma separated list, skipping empty items.
+func split_list(value string) []string {
+	items := []string{}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// LoadTLS builds the TLS configuration, if TLS is enabled.
+func LoadTLS() error {
+	if TLSCertFile == "" && TLSKeyFile == "" {
+		return nil
+	}
+	certificate, err := tls.LoadX509KeyPair(TLSCertFile, TLSKeyFile)
+	if err != nil {
+		return err
+	}
+	kv_tls_certificate = &certificate
+	config := &tls.Config{
+		GetCertificate: get_certificate,
+		NextProtos:     []string{"http/1.1"},
+	}
+	version, found := kv_tls_versions[TLSMinVersion]
+	if !found {
+		return errors.New("common: invalid TLS version: " + TLSMinVersion)
+	}
+	config.MinVersion = version
+	suites := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		suites[suite.Name] = suite.ID
+	}
+	for _, name := range split_list(TLSCipherSuites) {
+		id, found := suites[name]
+		if !found {
+			return errors.New("common: unknown or insecure TLS cipher " +
+				"suite: " + name)
+		}
+		config.CipherSuites = append(config.CipherSuites, id)
+	}
+	for _, name := range split_list(TLSCurves) {
+		curve, found := kv_tls_curves[name]
+		if !found {
+			return errors.New("common: unknown TLS curve: " + name)
+		}
+		config.CurvePreferences = append(config.CurvePreferences, curve)
+	}
+	if TLSOCSPStapling {
+		if len(certificate.Certificate) < 2 {
+			return errors.New("common: OCSP stapling requires the " +
+				"issuer in the certificate chain")
+		}
+		leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+		if err != nil {
+			return err
+		}
+		issuer, err := x509.ParseCertificate(certificate.Certificate[1])
+		if err != nil {
+			return err
+		}
+		go run_ocsp_stapler(leaf, issuer)
+	}
+	kv_tls_config = config
+	log.Printf("common: TLS enabled with minimum version %s", TLSMinVersion)
+	return nil
+}
+
+// Get_certificate returns the certificate with the OCSP staple, if we
+// have a valid one, and the plain certificate otherwise.
+func get_certificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	kv_tls_mutex.Lock()
+	defer kv_tls_mutex.Unlock()
+	if kv_tls_stapled != nil && time.Now().Before(kv_tls_stapled_until) {
+		return kv_tls_stapled, nil
+	}
+	return kv_tls_certificate, nil
+}
+
+// Ocsp_staple refreshes the OCSP staple and returns when to refresh it
+// again.
+func ocsp_staple(leaf *x509.Certificate, issuer *x509.Certificate) (
+	time.Duration, error) {
+	response, err := ocsp.Fetch(leaf, issuer)
+	if err != nil {
+		return kv_ocsp_retry, err
+	}
+	if response.Status != ocsp.Good {
+		kv_tls_mutex.Lock()
+		kv_tls_stapled = nil
+		kv_tls_mutex.Unlock()
+		return kv_ocsp_retry, errors.New("common: the OCSP status of our " +
+			"certificate is not good")
+	}
+	until := response.NextUpdate
+	refresh := kv_ocsp_default_refresh
+	if !until.IsZero() {
+		refresh = time.Until(until) / 2
+	} else {
+		until = time.Now().Add(2 * kv_ocsp_default_refresh)
+	}
+	if refresh < kv_ocsp_retry {
+		refresh = kv_ocsp_retry
+	}
+	if refresh > kv_ocsp_max_refresh {
+		refresh = kv_ocsp_max_refresh
+	}
+	stapled := *kv_tls_certificate
+	stapled.OCSPStaple = response.Raw
+	kv_tls_mutex.Lock()
+	kv_tls_stapled = &stapled
+	kv_tls_stapled_until = until
+	kv_tls_mutex.Unlock()
+	return refresh, nil
+}
+
+func run_ocsp_stapler(leaf *x509.Certificate, issuer *x509.Certificate) {
+	for {
+		refresh, err := ocsp_staple(leaf, issuer)
+		if err != nil {
+			log.Printf("common: cannot refresh the OCSP staple: %s", err)
+		} else {
+			Debugf("common: ocsp", "common: refreshed the OCSP staple; "+
+				"next refresh in %s", refresh)
+		}
+		time.Sleep(refresh)
+	}
+}
+
+// TLSConfig returns a copy of the TLS configuration, negotiating `protos`
+// with ALPN, or nil if TLS is disabled.
+func TLSConfig(protos ...string) *tls.Config {
+	if kv_tls_config == nil {
+		return nil
+	}
+	config := kv_tls_config.Clone()
+	config.NextProtos = protos
+	return config
+}
+
+// TLSListener returns a listener wrapping `listener` with TLS, if TLS is
+// enabled, and `listener` otherwise.
+func TLSListener(listener net.Listener) net.Listener {
+	if kv_tls_config == nil {
+		return listener
+	}
+	return tls.NewListener(listener, kv_tls_config)
+}
@@ -0,0 +1,33 @@
+package traceroute
+
+// Bounded UDP traceroute, which does not require privileges. We send UDP
+// probes with increasing TTL from a single socket, such that, as in Paris
+// traceroute, all the probes belong to the same flow and follow the same
+// path through load balancers, and we read the ICMP errors they trigger
+// from the error queue of the socket. Since we cannot tell which probe an
+// error refers to, we send one probe at a time and discard the errors that
+// arrive late. Only Linux has the error queue: on other systems, Trace
+// fails with ErrUnsupported.
+
+import (
+	"errors"
+)
+
+// ErrUnsupported is returned on systems where we cannot trace routes.
+var ErrUnsupported = errors.New("traceroute: not supported on this system")
+
+// Hop is the router, or the destination, that replied to the probe sent
+// with TTL. Address is empty if no one replied. RTT is in milliseconds.
+type Hop struct {
+	TTL     int
+	Address string
+	RTT     float64
+}
+
+// The destination port of the probes, as in the classic traceroute.
+const kv_port = 33434
+
+// We stop after this many consecutive hops did not reply.
+const kv_max_silent = 3
+
+var kv_payload = []byte("botticelli traceroute")
@@ -0,0 +1,174 @@
+//go:build linux
+// +build linux
+
+package traceroute
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"time"
+)
+
+// Struct sock_extended_err, followed by the address of the offender.
+const kv_extended_err_size = 16
+const kv_origin_icmp = 2
+const kv_origin_icmp6 = 3
+const kv_icmp_unreachable = 3
+const kv_icmp6_unreachable = 1
+
+var kv_error_unexpected = errors.New("traceroute: unexpected error message")
+
+// Trace traces the route to `address`, up to `max_hops`, waiting for each
+// reply up to `timeout`. It stops when the destination, or a router that
+// cannot reach it, replies, or when too many hops in a row are silent.
+func Trace(address string, max_hops int, timeout time.Duration) ([]*Hop,
+	error) {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return nil, errors.New("traceroute: invalid address: " + address)
+	}
+	network, level := "udp4", syscall.IPPROTO_IP
+	ttl_option, recverr_option := syscall.IP_TTL, syscall.IP_RECVERR
+	if ip.To4() == nil {
+		network, level = "udp6", syscall.IPPROTO_IPV6
+		ttl_option = syscall.IPV6_UNICAST_HOPS
+		recverr_option = syscall.IPV6_RECVERR
+	}
+	conn, err := net.ListenUDP(network, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	rawconn, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	err = setsockopt(rawconn, level, recverr_option, 1)
+	if err != nil {
+		return nil, err
+	}
+	destination := &net.UDPAddr{IP: ip, Port: kv_port}
+	hops := []*Hop{}
+	for ttl, silent := 1, 0; ttl <= max_hops && silent < kv_max_silent; ttl++ {
+		err = setsockopt(rawconn, level, ttl_option, ttl)
+		if err != nil {
+			return hops, err
+		}
+		// Discarding the late errors also clears the pending error,
+		// which would otherwise make sending fail
+		drain(rawconn)
+		sent := time.Now()
+		_, err = conn.WriteTo(kv_payload, destination)
+		if err != nil {
+			return hops, err
+		}
+		hop := &Hop{TTL: ttl}
+		hops = append(hops, hop)
+		offender, reached, err := read_error(conn, rawconn,
+			sent.Add(timeout))
+		var net_error net.Error
+		if errors.As(err, &net_error) && net_error.Timeout() {
+			silent += 1
+			continue
+		}
+		if err != nil {
+			return hops, err
+		}
+		silent = 0
+		hop.Address = offender.String()
+		hop.RTT = time.Since(sent).Seconds() * 1000.0
+		if reached {
+			break
+		}
+	}
+	// The silent hops at the end do not tell anything
+	for len(hops) > 0 && hops[len(hops)-1].Address == "" {
+		hops = hops[:len(hops)-1]
+	}
+	return hops, nil
+}
+
+func setsockopt(rawconn syscall.RawConn, level, option, value int) error {
+	var err error
+	control_err := rawconn.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), level, option, value)
+	})
+	if control_err != nil {
+		return control_err
+	}
+	return err
+}
+
+// Drain discards the errors queued on the socket.
+func drain(rawconn syscall.RawConn) {
+	buffer, oob := make([]byte, 512), make([]byte, 512)
+	rawconn.Control(func(fd uintptr) {
+		for {
+			_, _, _, _, err := syscall.Recvmsg(int(fd), buffer, oob,
+				syscall.MSG_ERRQUEUE|syscall.MSG_DONTWAIT)
+			if err != nil {
+				return
+			}
+		}
+	})
+}
+
+// Read_error waits until `deadline` for an error on the socket and returns
+// who sent it, and whether the trace should stop there.
+func read_error(conn *net.UDPConn, rawconn syscall.RawConn,
+	deadline time.Time) (net.IP, bool, error) {
+	err := conn.SetReadDeadline(deadline)
+	if err != nil {
+		return nil, false, err
+	}
+	buffer, oob := make([]byte, 512), make([]byte, 512)
+	var oobn int
+	var recv_err error
+	// The poller wakes us up when an error is queued, as if the socket
+	// were readable. The ordinary datagrams, if any, are left queued.
+	err = rawconn.Read(func(fd uintptr) bool {
+		_, oobn, _, _, recv_err = syscall.Recvmsg(int(fd), buffer, oob,
+			syscall.MSG_ERRQUEUE)
+		return recv_err != syscall.EAGAIN
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	if recv_err != nil {
+		return nil, false, recv_err
+	}
+	return parse_error(oob[:oobn])
+}
+
+// Parse_error returns the offender of the error in the control message
+// `oob`, and whether it is an unreachable error, which ends the trace.
+func parse_error(oob []byte) (net.IP, bool, error) {
+	messages, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, false, err
+	}
+	for _, message := range messages {
+		data := message.Data
+		if len(data) < kv_extended_err_size {
+			continue
+		}
+		origin, icmp_type := data[4], data[5]
+		// The offender is a sockaddr_in or a sockaddr_in6, whose
+		// address follows the family, the port, and, for IPv6, the
+		// flow information
+		switch {
+		case message.Header.Level == syscall.IPPROTO_IP &&
+			message.Header.Type == syscall.IP_RECVERR &&
+			origin == kv_origin_icmp && len(data) >= 24:
+			return net.IP(append([]byte{}, data[20:24]...)),
+				icmp_type == kv_icmp_unreachable, nil
+		case message.Header.Level == syscall.IPPROTO_IPV6 &&
+			message.Header.Type == syscall.IPV6_RECVERR &&
+			origin == kv_origin_icmp6 && len(data) >= 40:
+			return net.IP(append([]byte{}, data[24:40]...)),
+				icmp_type == kv_icmp6_unreachable, nil
+		}
+	}
+	return nil, false, kv_error_unexpected
+}
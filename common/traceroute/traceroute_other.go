@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package traceroute
+
+import (
+	"time"
+)
+
+// Trace traces the route to `address`, up to `max_hops`, waiting for each
+// reply up to `timeout`.
+func Trace(address string, max_hops int, timeout time.Duration) ([]*Hop,
+	error) {
+	return nil, ErrUnsupported
+}
@@ -0,0 +1,19 @@
+package common
+
+import (
+	"crypto/rand"
+	"fmt"
+)
+
+// NewUUID returns a new random (version 4) UUID.
+func NewUUID() (string, error) {
+	buff := make([]byte, 16)
+	_, err := rand.Read(buff)
+	if err != nil {
+		return "", err
+	}
+	buff[6] = (buff[6] & 0x0f) | 0x40
+	buff[8] = (buff[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", buff[0:4], buff[4:6], buff[6:8],
+		buff[8:10], buff[10:16]), nil
+}
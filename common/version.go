@@ -1,4 +1,85 @@
 package common
 
-const Version = "0.0.6"
-const Product = "botticelli/" + Version
+// Build metadata. Release builds set it at link time, e.g.:
+//
+//	go build -ldflags "-X github.com/neubot/botticelli/common.Commit=abc"
+//
+// Otherwise Commit and BuildDate are taken from the VCS information that
+// the Go toolchain embeds in the binary, when available.
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/neubot/botticelli/common/metrics"
+)
+
+var Version = "0.0.6"
+var Commit = ""
+var BuildDate = ""
+
+var Product = "botticelli/" + Version
+
+var kv_build_info = metrics.NewGaugeVec("botticelli_build_info",
+	"Always one; labels describe the running build.",
+	"version", "commit", "build_date", "go_version")
+
+func init() {
+	info, ok := debug.ReadBuildInfo()
+	if ok {
+		modified := false
+		revision := ""
+		vcs_time := ""
+		for _, setting := range info.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				revision = setting.Value
+			case "vcs.time":
+				vcs_time = setting.Value
+			case "vcs.modified":
+				modified = setting.Value == "true"
+			}
+		}
+		if Commit == "" && revision != "" {
+			Commit = revision
+			if modified {
+				Commit += "-dirty"
+			}
+		}
+		if BuildDate == "" {
+			BuildDate = vcs_time
+		}
+	}
+	kv_build_info.Set(1, Version, Commit, BuildDate, runtime.Version())
+}
+
+// BuildString returns a human readable description of the build.
+func BuildString() string {
+	build := Version
+	if Commit != "" {
+		build += " (commit " + Commit
+		if BuildDate != "" {
+			build += ", built " + BuildDate
+		}
+		build += ")"
+	}
+	return build + " " + runtime.Version()
+}
+
+// ServeVersion is an HTTP handler exporting the build metadata.
+func ServeVersion(w http.ResponseWriter, r *http.Request) {
+	data, err := json.Marshal(map[string]string{
+		"version":    Version,
+		"commit":     Commit,
+		"build_date": BuildDate,
+		"go_version": runtime.Version(),
+	})
+	if err != nil {
+		w.WriteHeader(500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
@@ -1,49 +1,501 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
 	"github.com/neubot/bernini"
 	"github.com/neubot/botticelli/common"
+	"github.com/neubot/botticelli/common/admin"
+	"github.com/neubot/botticelli/common/admin/adminpb"
+	"github.com/neubot/botticelli/common/asn"
+	"github.com/neubot/botticelli/common/events"
+	"github.com/neubot/botticelli/common/hostload"
+	"github.com/neubot/botticelli/common/metrics"
 	"github.com/neubot/botticelli/common/negotiate"
+	"github.com/neubot/botticelli/common/results"
 	//"github.com/neubot/botticelli/nettests/bittorrent"
 	"github.com/neubot/botticelli/nettests/dash"
 	"github.com/neubot/botticelli/nettests/ndt"
 	//"github.com/neubot/botticelli/nettests/raw"
 	"github.com/neubot/botticelli/nettests/speedtest"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 )
 
-const usage = `usage: botticelli [--help]
-       botticelli [--version]`
+const usage = `usage: botticelli [--help] [--version] [-q|-v|-vv] [options]
+       botticelli [-q|-v|-vv] [options] selftest
+       botticelli [-q|-v|-vv] [options] benchmark
+
+Each option can also be set using the corresponding BOTTICELLI_* environment
+variable (e.g. BOTTICELLI_NDT_WS_ADDRESS for -ndt-ws-address). Options given
+on the command line take precedence over the environment.`
+
+// Options that perform an action rather than configuring the server, which
+// hence cannot be set using the environment.
+var kv_action_flags = map[string]bool{
+	"print-row-schema": true,
+	"version":          true,
+}
+
+// Environment_variable returns the name of the environment variable that
+// may be used to set the option called `name`.
+func environment_variable(name string) string {
+	return "BOTTICELLI_" + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// Apply_environment sets the options from the environment. It must be
+// called before flag.Parse, such that the command line wins.
+func apply_environment() {
+	flag.VisitAll(func(f *flag.Flag) {
+		if kv_action_flags[f.Name] {
+			return
+		}
+		value, found := os.LookupEnv(environment_variable(f.Name))
+		if !found {
+			return
+		}
+		err := flag.Set(f.Name, value)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid value %q for %s: %s\n", value,
+				environment_variable(f.Name), err)
+			os.Exit(1)
+		}
+	})
+}
+
+// Drain_on_signal waits for SIGINT or SIGTERM, then lets the live
+// sessions terminate, refusing new ones, and exits. On SIGHUP, it first
+// hands off the listeners to a new instance of the server.
+func drain_on_signal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := range signals {
+		log.Printf("received %s", sig)
+		if sig != syscall.SIGHUP {
+			break
+		}
+		err := common.Upgrade()
+		if err == nil {
+			break
+		}
+		log.Printf("cannot upgrade: %s", err)
+	}
+	log.Printf("draining sessions")
+	go func() {
+		for sig := range signals {
+			if sig != syscall.SIGHUP {
+				log.Fatal("received second signal; exiting now")
+			}
+		}
+	}()
+	remaining := ndt.Drain(ndt.DrainTimeout)
+	if remaining > 0 {
+		log.Printf("exiting with %d sessions still alive", remaining)
+	}
+	results.Close()
+	common.ReleaseSuccessor()
+	os.Exit(0)
+}
 
 func main() {
 	bernini.InitLogger()
 	bernini.InitRng()
 
-	bernini.GetoptVersionAndHelp(common.Version, usage)
+	version := flag.Bool("version", false, "Print version and exit")
+	verbose := flag.Bool("v", false, "Verbose: also log protocol details")
+	very_verbose := flag.Bool("vv", false,
+		"Very verbose: log all protocol details, without rate limiting")
+	quiet := flag.Bool("q", false,
+		"Quiet: only log errors and session summaries")
+	flag.DurationVar(&ndt.DrainTimeout, "drain-timeout", ndt.DrainTimeout,
+		"How long to wait for sessions to terminate when shutting down")
+	flag.DurationVar(&ndt.Cooldown, "ndt-cooldown", ndt.Cooldown,
+		"Minimum time between two NDT tests from the same IP")
+	flag.StringVar(&ndt.CooldownRedis, "ndt-cooldown-redis",
+		ndt.CooldownRedis,
+		"Redis address where to share the cooldown state (empty: local)")
+	flag.BoolVar(&common.AnonymizeAddresses, "anonymize",
+		common.AnonymizeAddresses,
+		"Truncate client addresses in logs and results (/24 and /48)")
+	flag.StringVar(&common.AllowedOrigins, "allowed-origins",
+		common.AllowedOrigins,
+		"Comma separated origins allowed to run browser tests (*: any)")
+	flag.BoolVar(&common.ReverseDNS, "reverse-dns", common.ReverseDNS,
+		"Add the client PTR record to the stored results")
+	flag.StringVar(&common.ServerMetadata, "server-metadata",
+		common.ServerMetadata,
+		"Comma separated key=value pairs added to results and metrics")
+	flag.StringVar(&asn.File, "asn-file", asn.File,
+		"RouteViews prefix to AS dump used to add the client ASN to results")
+	flag.StringVar(&results.Datadir, "datadir", results.Datadir,
+		"Directory where to save results (empty: do not save)")
+	flag.StringVar(&results.Format, "results-format", results.Format,
+		"Results format: json (one file each) or jsonl.gz (hourly archives)")
+	flag.DurationVar(&results.Retention, "results-retention",
+		results.Retention, "Delete results older than this (0: never)")
+	flag.DurationVar(&results.CompressAfter, "results-compress-after",
+		results.CompressAfter, "Compress results older than this (0: never)")
+	flag.StringVar(&results.UploadURL, "results-upload-url",
+		results.UploadURL, "S3/GCS bucket URL where to upload results")
+	flag.StringVar(&results.UploadRegion, "results-upload-region",
+		results.UploadRegion, "Region used to sign upload requests")
+	flag.BoolVar(&results.ExportRows, "results-export-rows",
+		results.ExportRows, "Also export results as flat rows for BigQuery")
+	print_schema := flag.Bool("print-row-schema", false,
+		"Print the schema of the exported rows and exit")
+	flag.StringVar(&events.NatsURL, "events-nats-url", events.NatsURL,
+		"URL of the NATS server where to publish test events")
+	flag.StringVar(&events.Subject, "events-subject", events.Subject,
+		"Prefix of the subjects on which test events are published")
+	flag.StringVar(&events.WebhookURLs, "events-webhooks", events.WebhookURLs,
+		"Comma separated URLs to POST results to when sessions complete")
+	flag.StringVar(&admin.Address, "admin-address", admin.Address,
+		"Address where the admin server listens (empty: disabled)")
+	flag.StringVar(&admin.GRPCAddress, "admin-grpc-address",
+		admin.GRPCAddress,
+		"Address where the gRPC admin server listens (empty: disabled)")
+	flag.StringVar(&common.BindDevice, "bind-device", common.BindDevice,
+		"Device to which to bind the sockets of the tests (Linux only)")
+	flag.StringVar(&ndt.Address, "ndt-address", ndt.Address,
+		"Address where to accept legacy NDT clients (host may be an interface)")
+	flag.StringVar(&ndt.WebSocketAddress, "ndt-ws-address",
+		ndt.WebSocketAddress,
+		"Address where to accept NDT over WebSocket (empty: disabled)")
+	flag.StringVar(&ndt.QUICAddress, "ndt-quic-address", ndt.QUICAddress,
+		"Address of the experimental QUIC endpoint (empty: disabled)")
+	flag.StringVar(&ndt.WebTransportAddress, "ndt-webtransport-address",
+		ndt.WebTransportAddress,
+		"Address of the ndt7 WebTransport endpoint (empty: disabled)")
+	flag.StringVar(&ndt.UDPAddress, "ndt-udp-address", ndt.UDPAddress,
+		"Address where to echo UDP probes of the clients (empty: disabled)")
+	flag.BoolVar(&ndt.Traceroute, "ndt-traceroute", ndt.Traceroute,
+		"Trace the route to the clients after the tests")
+	flag.BoolVar(&ndt.PacketCapture, "ndt-pcap", ndt.PacketCapture,
+		"Capture the packets of each test next to the results")
+	flag.Int64Var(&ndt.PacketCaptureMaxSize, "ndt-pcap-max-size",
+		ndt.PacketCaptureMaxSize, "Maximum size of each capture in bytes")
+	flag.BoolVar(&ndt.FlowStats, "ndt-flowstats", ndt.FlowStats,
+		"Collect the TCP statistics of the tests with eBPF (Linux)")
+	flag.BoolVar(&ndt.DiagStats, "ndt-netlink-stats", ndt.DiagStats,
+		"Collect the TCP statistics of the tests with netlink (Linux)")
+	flag.BoolVar(&ndt.WebSocketCompression, "ndt-ws-compression",
+		ndt.WebSocketCompression,
+		"Enable WebSocket compression (skews results; for experiments)")
+	flag.StringVar(&common.TLSCertFile, "tls-cert", common.TLSCertFile,
+		"PEM certificate chain of the WebSocket listeners (empty: no TLS)")
+	flag.StringVar(&common.TLSKeyFile, "tls-key", common.TLSKeyFile,
+		"PEM private key of the WebSocket listeners (empty: no TLS)")
+	flag.StringVar(&common.TLSMinVersion, "tls-min-version",
+		common.TLSMinVersion, "Minimum TLS version (1.0, 1.1, 1.2 or 1.3)")
+	flag.StringVar(&common.TLSCipherSuites, "tls-cipher-suites",
+		common.TLSCipherSuites,
+		"Comma separated TLS 1.2 cipher suites (empty: secure defaults)")
+	flag.StringVar(&common.TLSCurves, "tls-curves", common.TLSCurves,
+		"Comma separated TLS curves, by preference (empty: defaults)")
+	flag.BoolVar(&common.TLSOCSPStapling, "tls-ocsp-stapling",
+		common.TLSOCSPStapling,
+		"Staple the OCSP response about the TLS certificate")
+	flag.StringVar(&common.ProtocolLogFile, "protocol-log",
+		common.ProtocolLogFile,
+		"File where to write the full protocol trace (empty: debug log)")
+	flag.Int64Var(&common.ProtocolLogMaxSize, "protocol-log-max-size",
+		common.ProtocolLogMaxSize,
+		"Size in bytes above which the protocol trace file is rotated")
+	flag.StringVar(&ndt.ClusterPeers, "ndt-cluster-peers", ndt.ClusterPeers,
+		"Comma separated admin addresses of the other cluster instances")
+	flag.IntVar(&ndt.ClusterMaxTests, "ndt-cluster-max-tests",
+		ndt.ClusterMaxTests,
+		"Maximum concurrent tests in the cluster (0: one per instance)")
+	flag.IntVar(&ndt.QueueMaxLength, "ndt-queue-max-length",
+		ndt.QueueMaxLength,
+		"Maximum number of clients waiting in the queue (0: no limit)")
+	flag.StringVar(&ndt.QueuePriorities, "ndt-queue-priorities",
+		ndt.QueuePriorities,
+		"Comma separated subnet=priority lanes of the admission queue")
+	flag.StringVar(&ndt.Tenant, "ndt-tenant", ndt.Tenant,
+		"Tenant of the default NDT listeners (empty: none)")
+	flag.StringVar(&ndt.TenantListeners, "ndt-tenant-listeners",
+		ndt.TenantListeners,
+		"Comma separated tenant=address additional NDT listeners")
+	flag.StringVar(&ndt.TenantWebSocketListeners, "ndt-tenant-ws-listeners",
+		ndt.TenantWebSocketListeners,
+		"Comma separated tenant=address additional WebSocket listeners")
+	flag.StringVar(&ndt.ProtocolVersion, "ndt-protocol-version",
+		ndt.ProtocolVersion, "NDT protocol version advertised to clients")
+	flag.StringVar(&ndt.Product, "ndt-product", ndt.Product,
+		"Server product advertised to clients")
+	flag.BoolVar(&ndt.Web100cltQuirks, "ndt-web100clt-quirks",
+		ndt.Web100cltQuirks, "Behave as expected by the web100clt client")
+	flag.StringVar(&ndt.Conformance, "conformance", ndt.Conformance,
+		"How to treat clients deviating from the spec: lenient or strict")
+	flag.BoolVar(&ndt.Hexdump, "ndt-hexdump", ndt.Hexdump,
+		"Hexdump the traffic of NDT control connections (debugging)")
+	flag.StringVar(&ndt.AccessTokensFile, "ndt-access-tokens",
+		ndt.AccessTokensFile,
+		"File with access tokens moving clients to the front of the queue")
+	flag.StringVar(&ndt.TokenPublicKeyFile, "ndt-token-public-key",
+		ndt.TokenPublicKeyFile,
+		"File with the Ed25519 public key of the JWT access tokens issuer")
+	flag.StringVar(&ndt.TokenAudience, "ndt-token-audience",
+		ndt.TokenAudience, "Required audience of JWT access tokens")
+	flag.BoolVar(&ndt.TokenRequired, "ndt-token-required",
+		ndt.TokenRequired, "Refuse clients without a valid access token")
+	flag.DurationVar(&ndt.TokenMaxLifetime, "ndt-token-max-lifetime",
+		ndt.TokenMaxLifetime, "Maximum validity of JWT access tokens")
+	flag.IntVar(&hostload.GOMAXPROCS, "go-max-procs", hostload.GOMAXPROCS,
+		"Threads running Go code at the same time (0: number of CPUs)")
+	flag.IntVar(&hostload.GCPercent, "gc-percent", hostload.GCPercent,
+		"Heap growth in percent triggering a GC (0: GOGC or 400, -1: off)")
+	flag.Int64Var(&hostload.MemoryLimit, "memory-limit", hostload.MemoryLimit,
+		"Soft memory limit in bytes (0: GOMEMLIMIT or 90% of the "+
+			"container limit)")
+	flag.Float64Var(&hostload.MaxCPU, "host-max-cpu", hostload.MaxCPU,
+		"CPU utilization (0-1) above which tests are refused (0: ignore)")
+	flag.StringVar(&hostload.Interface, "host-interface", hostload.Interface,
+		"Network interface used by tests (default: autodetect)")
+	flag.Float64Var(&hostload.InterfaceSpeed, "host-interface-speed",
+		hostload.InterfaceSpeed,
+		"Capacity of the interface in Mbit/s (default: autodetect)")
+	flag.Float64Var(&hostload.MaxNIC, "host-max-nic", hostload.MaxNIC,
+		"Interface utilization (0-1) above which tests are refused (0: ignore)")
+	flag.Int64Var(&hostload.DailyBudget, "host-daily-budget",
+		hostload.DailyBudget,
+		"Bytes the host may send each day before refusing tests (0: no limit)")
+	flag.Int64Var(&hostload.MonthlyBudget, "host-monthly-budget",
+		hostload.MonthlyBudget,
+		"Bytes the host may send each month before refusing tests (0: no limit)")
+	flag.StringVar(&hostload.BudgetFile, "host-budget-file",
+		hostload.BudgetFile,
+		"File where to save the bytes sent in the current budget periods")
+	flag.StringVar(&hostload.MaintenanceWindows, "host-maintenance-windows",
+		hostload.MaintenanceWindows,
+		"Comma separated UTC windows refusing tests (e.g. 'sun 02:00-03:00')")
+	flag.Float64Var(&ndt.ClientSpeedDivergence,
+		"ndt-client-speed-divergence", ndt.ClientSpeedDivergence,
+		"Relative difference above which client and server speeds diverge")
+	flag.StringVar(&ndt.HTTPRedirect, "ndt-http-redirect", ndt.HTTPRedirect,
+		"Where to redirect HTTP requests to the NDT port (empty: small page)")
+	flag.StringVar(&ndt.ResultsVariables, "ndt-results-variables",
+		ndt.ResultsVariables,
+		"Comma separated patterns of the MSG_RESULTS variables to send and store")
+	flag.BoolVar(&ndt.DuplexTest, "ndt-duplex", ndt.DuplexTest,
+		"Enable the non-standard ndt7 duplex test")
+	flag.StringVar(&ndt.SameIP, "ndt-same-ip", ndt.SameIP,
+		"Concurrent sessions from the same IP: allow, reject, or queue")
+	flag.IntVar(&ndt.MaxClients, "ndt-max-clients", ndt.MaxClients,
+		"Concurrent sessions the default memory budget is sized for")
+	flag.Int64Var(&ndt.MemoryBudget, "ndt-memory-budget", ndt.MemoryBudget,
+		"Bytes the buffers of the sessions may use (0: from max clients)")
+	flag.Float64Var(&ndt.MaxSendShare, "ndt-max-send-share",
+		ndt.MaxSendShare,
+		"Share (0-1) of the interface speed S2C tests may use (0: ignore)")
+	flag.StringVar(&ndt.Payload, "ndt-payload", ndt.Payload,
+		"Payload mode: buffer (repeat a random buffer), pool or chacha8")
+	flag.StringVar(&ndt.PinCPUs, "ndt-pin-cpus", ndt.PinCPUs,
+		"CPUs to pin the senders to, e.g. 2-5,8 (empty: no pinning)")
+	flag.IntVar(&ndt.SendBatch, "ndt-send-batch", ndt.SendBatch,
+		"Messages S2C streams write with each system call (1: no writev)")
+	flag.IntVar(&ndt.PayloadPoolSize, "ndt-payload-pool-size",
+		ndt.PayloadPoolSize, "Size in bytes of the random pool of the pool"+
+			" payload mode")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "%s\n\noptions:\n", usage)
+		flag.PrintDefaults()
+	}
+	apply_environment()
+	flag.Parse()
+	if *version {
+		fmt.Printf("%s\n", common.BuildString())
+		os.Exit(0)
+	}
+	if *print_schema {
+		data, err := json.MarshalIndent(results.RowSchema(), "", "  ")
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("%s\n", data)
+		os.Exit(0)
+	}
+	selftest := flag.NArg() == 1 && flag.Arg(0) == "selftest"
+	benchmark := flag.NArg() == 1 && flag.Arg(0) == "benchmark"
+	if flag.NArg() != 0 && !selftest && !benchmark {
+		flag.Usage()
+		os.Exit(1)
+	}
+	if *quiet {
+		common.LogLevel = common.LogQuiet
+	}
+	if *verbose {
+		common.LogLevel = common.LogDebug
+	}
+	if *very_verbose {
+		common.LogLevel = common.LogTrace
+	}
+	if selftest {
+		// Log on the standard error and do not pollute the results
+		results.Datadir = ""
+		err := ndt.Selftest()
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("selftest: all tests passed")
+		os.Exit(0)
+	}
+	if benchmark {
+		err := ndt.Benchmark()
+		if err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(0)
+	}
+
 	bernini.UseSyslogOrDie("botticelli")
 
-	log.Printf("botticelli server %s starting up", common.Version)
+	err := common.OpenProtocolLog()
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = common.LoadServerMetadata()
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = asn.Load()
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = common.LoadTLS()
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = ndt.LoadAccessTokens()
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = ndt.LoadQueuePriorities()
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = ndt.LoadConformance()
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = ndt.LoadClientSpeedDivergence()
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = ndt.LoadResultsVariables()
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = ndt.LoadHTTPRedirect()
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = ndt.LoadMemoryBudget()
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = ndt.LoadSameIP()
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = ndt.LoadPayload()
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = ndt.LoadSendBatch()
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = ndt.LoadPinCPUs()
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = ndt.LoadCluster()
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = hostload.LoadMaintenanceWindows()
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = hostload.LoadRuntimeTuning()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("botticelli server %s starting up", common.BuildString())
 
-	ndt.Start(":3007")
+	admin.HandleFunc("/metrics", metrics.Handler)
+	admin.HandleFunc("/progress", events.ServeProgress)
+	admin.HandleFunc("/ready", hostload.ServeReady)
+	admin.HandleFunc("/drain", hostload.ServeDrain)
+	admin.HandleFunc("/capabilities", hostload.ServeCapabilities)
+	admin.HandleFunc("/version", common.ServeVersion)
+	admin.HandleFunc("/cluster/state", ndt.ServeClusterState)
+	admin.HandleFunc("/sessions", ndt.ServeSessions)
+	admin.HandleFunc("/sessions/kill", ndt.ServeKillSession)
+	admin.HandleFunc("/loglevel", common.ServeLogLevel)
+	admin.RegisterService(&adminpb.Admin_ServiceDesc, &ndt.AdminService{})
+	admin.Start()
+	events.Start()
+	hostload.DetectInterface()
+	hostload.DetectEnvironment()
+	hostload.TuneRuntime()
+	hostload.Start()
+	hostload.StartBudget()
+	ndt.StartCluster()
+	ndt.StartLimiter()
+	results.StartJanitor()
+	results.StartUploader()
 
-	http.HandleFunc("/dash/download", dash.Download)
-	http.HandleFunc("/dash/download/", dash.Download)
+	err = ndt.StartTenants()
+	if err != nil {
+		log.Fatal(err)
+	}
+	ndt.StartWebSocket()
+	ndt.StartUDP()
+	ndt.StartQUIC()
+	ndt.StartWebTransport()
+	ndt.StartFlowStats()
+	ndt.StartDiagStats()
 
-	http.HandleFunc("/collect/", negotiate.Collect)
-	http.HandleFunc("/negotiate/", negotiate.Negotiate)
+	http.HandleFunc("/dash/download", common.CORS(dash.Download))
+	http.HandleFunc("/dash/download/", common.CORS(dash.Download))
 
-	http.HandleFunc("/speedtest/collect", speedtest.Collect)
-	http.HandleFunc("/speedtest/latency", speedtest.Latency)
-	http.HandleFunc("/speedtest/negotiate", speedtest.Negotiate)
-	http.HandleFunc("/speedtest/download", speedtest.Download)
-	http.HandleFunc("/speedtest/upload", speedtest.Upload)
+	http.HandleFunc("/collect/", common.CORS(negotiate.Collect))
+	http.HandleFunc("/negotiate/", common.CORS(negotiate.Negotiate))
+
+	http.HandleFunc("/speedtest/collect", common.CORS(speedtest.Collect))
+	http.HandleFunc("/speedtest/latency", common.CORS(speedtest.Latency))
+	http.HandleFunc("/speedtest/negotiate", common.CORS(speedtest.Negotiate))
+	http.HandleFunc("/speedtest/download", common.CORS(speedtest.Download))
+	http.HandleFunc("/speedtest/upload", common.CORS(speedtest.Upload))
 
 	http.HandleFunc("/", http.NotFound)
 
-	server := &http.Server{Addr: ":8080", Handler: nil}
-	err := server.ListenAndServe()
+	// Ndt.Start never returns, hence we serve the HTTP tests in the
+	// background, from a listener we may hand off when upgrading.
+	listener, err := common.Listen(":8080")
 	if err != nil {
 		log.Fatal(err)
 	}
+	go func() {
+		server := &http.Server{Handler: nil}
+		err := server.Serve(listener)
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			log.Fatal(err)
+		}
+	}()
+
+	go drain_on_signal()
+	go log_level_on_signal()
+	ndt.Start(ndt.Address)
 }
@@ -0,0 +1,107 @@
+package ndt
+
+// Implementation of the gRPC admin service, which exposes the registry of
+// the live sessions, the drain mode and the configuration, like the admin
+// HTTP endpoints do.
+
+import (
+	"context"
+	"flag"
+	"net/url"
+	"strings"
+
+	"github.com/neubot/botticelli/common"
+	"github.com/neubot/botticelli/common/admin/adminpb"
+	"github.com/neubot/botticelli/common/hostload"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// AdminService implements the gRPC admin service.
+type AdminService struct {
+	adminpb.UnimplementedAdminServer
+}
+
+func (*AdminService) ListSessions(context.Context,
+	*adminpb.ListSessionsRequest) (*adminpb.ListSessionsResponse, error) {
+	response := &adminpb.ListSessionsResponse{}
+	for _, info := range live_sessions() {
+		response.Sessions = append(response.Sessions, &adminpb.Session{
+			Uuid:          info.UUID,
+			Protocol:      info.Protocol,
+			Transport:     info.Transport,
+			Tenant:        info.Tenant,
+			ClientAddress: info.ClientAddress,
+			Phase:         info.Phase,
+			StartTime:     timestamppb.New(info.StartTime),
+			Age:           info.Age,
+			BytesSent:     info.BytesSent,
+			BytesReceived: info.BytesReceived,
+		})
+	}
+	return response, nil
+}
+
+func (*AdminService) KillSessions(ctx context.Context,
+	request *adminpb.KillSessionsRequest) (*adminpb.KillSessionsResponse,
+	error) {
+	if request.Uuid == "" && request.Ip == "" {
+		return nil, status.Error(codes.InvalidArgument, "missing uuid or ip")
+	}
+	count := kill_sessions(request.Uuid, request.Ip)
+	if count == 0 {
+		return nil, status.Error(codes.NotFound, "no such session")
+	}
+	return &adminpb.KillSessionsResponse{Killed: int32(count)}, nil
+}
+
+// Drain_state returns whether the host is draining, and how many sessions
+// are still alive.
+func drain_state() *adminpb.DrainState {
+	kv_sessions_mutex.Lock()
+	count := len(kv_sessions)
+	kv_sessions_mutex.Unlock()
+	return &adminpb.DrainState{
+		Draining:     hostload.Draining(),
+		LiveSessions: int32(count),
+	}
+}
+
+func (*AdminService) GetDrain(context.Context,
+	*adminpb.GetDrainRequest) (*adminpb.DrainState, error) {
+	return drain_state(), nil
+}
+
+func (*AdminService) SetDrain(ctx context.Context,
+	request *adminpb.SetDrainRequest) (*adminpb.DrainState, error) {
+	hostload.SetDrainMode(request.Enabled)
+	return drain_state(), nil
+}
+
+// Redact_urls replaces the passwords in the URLs of the comma separated
+// list `value`, such as those of Redis or of the webhooks.
+func redact_urls(value string) string {
+	items := strings.Split(value, ",")
+	for i, item := range items {
+		parsed, err := url.Parse(item)
+		if err == nil && parsed.User != nil {
+			items[i] = parsed.Redacted()
+		}
+	}
+	return strings.Join(items, ",")
+}
+
+func (*AdminService) GetConfig(context.Context,
+	*adminpb.GetConfigRequest) (*adminpb.Config, error) {
+	config := &adminpb.Config{Version: common.BuildString()}
+	flag.VisitAll(func(f *flag.Flag) {
+		config.Settings = append(config.Settings, &adminpb.Setting{
+			Name:         f.Name,
+			Value:        redact_urls(f.Value.String()),
+			DefaultValue: redact_urls(f.DefValue),
+			Usage:        f.Usage,
+		})
+	})
+	return config, nil
+}
@@ -0,0 +1,116 @@
+package ndt
+
+// Admission of the clients of the protocols without queue messages, i.e.,
+// ndt7, over WebSocket or WebTransport, and our QUIC endpoint. They go
+// through the same checks as ndt5 clients: the host load, the access token
+// and the policy of the tenant, the per-IP cooldown, the single session per
+// IP policy, the admission queue and the memory budget. Since we cannot
+// tell these clients their position in the queue, they only wait for the
+// test slot for a short time, and are otherwise refused, such that they
+// come back later. As for ndt5 clients, we charge the cooldown and the
+// interval of the tenant only once the client is admitted.
+
+import (
+	"github.com/neubot/botticelli/common"
+	"github.com/neubot/botticelli/common/hostload"
+	"github.com/neubot/botticelli/common/metrics"
+)
+
+// Refusal_t is the reason why we refused a client.
+type refusal_t struct {
+	status int    // the HTTP status code telling the client why
+	label  string // the label of the reason in the metrics
+	reason string
+}
+
+func (refusal *refusal_t) Error() string {
+	return "ndt: " + refusal.reason
+}
+
+var kv_refused_overloaded = &refusal_t{503, "overloaded",
+	"host is overloaded"}
+var kv_refused_budget = &refusal_t{503, "budget", "egress budget exceeded"}
+var kv_refused_token = &refusal_t{401, "token",
+	"missing or invalid access token"}
+var kv_refused_tenant = &refusal_t{429, "tenant",
+	"too many tests for this tenant"}
+var kv_refused_cooldown = &refusal_t{429, "cooldown",
+	"this IP is still cooling down"}
+var kv_refused_same_ip = &refusal_t{429, "same_ip",
+	"another test from this IP is running"}
+var kv_refused_busy = &refusal_t{503, "busy", "too many tests are running"}
+var kv_refused_memory = &refusal_t{503, "memory", "not enough memory"}
+
+var kv_admission_refused = metrics.NewCounterVec(
+	"ndt_admission_refused_total",
+	"Clients without queue messages refused at admission.",
+	"protocol", "reason")
+
+// Admit checks whether the client with `ip`, holding `access_token`, may
+// run a test of `protocol`, whose buffers need `memory` bytes, waiting
+// for a short time, unless `done` is closed, if the test slot is taken.
+// It returns the policy to apply and the function releasing what we
+// reserved for the test, or why we refused the client.
+func admit(protocol string, ip string, access_token string, memory int64,
+	done <-chan struct{}) (*policy_t, func(), *refusal_t) {
+	policy, release, refusal := admit_checks(protocol, ip, access_token,
+		memory, done)
+	if refusal != nil {
+		common.Infof("ndt: refusing %s client %s: %s", protocol,
+			common.AnonymizeIP(ip), refusal.reason)
+		kv_admission_refused.Inc(protocol, refusal.label)
+	}
+	return policy, release, refusal
+}
+
+func admit_checks(protocol string, ip string, access_token string,
+	memory int64, done <-chan struct{}) (*policy_t, func(), *refusal_t) {
+	if hostload.Degraded() || hostload.Draining() || !send_allow() {
+		return nil, nil, kv_refused_overloaded
+	}
+	if hostload.BudgetExceeded() {
+		return nil, nil, kv_refused_budget
+	}
+	policy, has_token := access_policy(access_token)
+	if TokenRequired && !has_token {
+		return nil, nil, kv_refused_token
+	}
+	if policy_recent(policy) {
+		return nil, nil, kv_refused_tenant
+	}
+	if cooldown_recent(ip) {
+		return nil, nil, kv_refused_cooldown
+	}
+	release_ip := same_ip_wait_briefly(ip, protocol, done)
+	if release_ip == nil {
+		return nil, nil, kv_refused_same_ip
+	}
+	release_slot := queue_wait_briefly(ip, policy, has_token, done)
+	if release_slot == nil {
+		release_ip()
+		return nil, nil, kv_refused_busy
+	}
+	release := func() {
+		release_slot()
+		release_ip()
+	}
+	release_memory := memory_reserve(protocol, memory)
+	if release_memory == nil {
+		release()
+		return nil, nil, kv_refused_memory
+	}
+	if !cooldown_allow(ip) {
+		release_memory()
+		release()
+		return nil, nil, kv_refused_cooldown
+	}
+	if !policy_allow(policy) {
+		release_memory()
+		release()
+		return nil, nil, kv_refused_tenant
+	}
+	return policy, func() {
+		release_memory()
+		release()
+	}, nil
+}
@@ -0,0 +1,196 @@
+package ndt
+
+// Benchmark suite, measuring what the sender options cost on this host, such
+// that operators can choose them knowingly. For each option, we measure how
+// fast we generate the data to send and how fast we send it over loopback,
+// which is an upper bound to the speed of the tests we can serve. As for the
+// self test, this is not a measurement tool.
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/neubot/botticelli/common"
+	"github.com/neubot/botticelli/common/gso"
+)
+
+const kv_benchmark_duration = 2 * time.Second
+const kv_benchmark_message_size = 1 << 20
+
+type benchmark_t struct {
+	name string
+	run  func() (float64, error) // returns the bytes per second
+}
+
+// Benchmark runs the benchmarks and logs their results.
+func Benchmark() error {
+	err := LoadPayload()
+	if err != nil {
+		return err
+	}
+	benchmarks := []benchmark_t{}
+	for _, mode := range []string{kv_payload_buffer, kv_payload_pool,
+		kv_payload_chacha8} {
+		mode := mode
+		benchmarks = append(benchmarks, benchmark_t{
+			name: "payload_" + mode + "_generate",
+			run: func() (float64, error) {
+				return benchmark_generate(mode), nil
+			},
+		}, benchmark_t{
+			name: "payload_" + mode + "_loopback",
+			run: func() (float64, error) {
+				return benchmark_loopback(payload_sender(mode))
+			},
+		})
+	}
+	for _, batch := range []int{1, 4, 16, 64} {
+		batch := batch
+		benchmarks = append(benchmarks, benchmark_t{
+			name: "s2c_batch_" + strconv.Itoa(batch) + "_loopback",
+			run: func() (float64, error) {
+				return benchmark_loopback(s2c_sender(batch))
+			},
+		})
+	}
+	for _, use_gso := range []bool{false, true} {
+		use_gso := use_gso
+		name := "udp_train_loop"
+		if use_gso {
+			name = "udp_train_gso"
+		}
+		benchmarks = append(benchmarks, benchmark_t{
+			name: name,
+			run: func() (float64, error) {
+				return benchmark_udp_train(use_gso)
+			},
+		})
+	}
+	for _, benchmark := range benchmarks {
+		speed, err := benchmark.run()
+		if err == gso.ErrUnsupported {
+			log.Printf("benchmark: %s: not supported", benchmark.name)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		log.Printf("benchmark: %s: %.2f Gbit/s", benchmark.name,
+			8.0*speed/1e9)
+	}
+	return nil
+}
+
+// Benchmark_generate returns how many bytes per second the payload of
+// `mode` generates.
+func benchmark_generate(mode string) float64 {
+	payload := new_payload(mode, kv_benchmark_message_size)
+	start := time.Now()
+	count := 0
+	for time.Since(start) < kv_benchmark_duration {
+		count += len(payload.next())
+	}
+	return float64(count) / time.Since(start).Seconds()
+}
+
+// Payload_sender returns the function creating the sender that writes the
+// payload of `mode` on a connection.
+func payload_sender(mode string) func(net.Conn) func() error {
+	return func(conn net.Conn) func() error {
+		payload := new_payload(mode, kv_benchmark_message_size)
+		return func() error {
+			_, err := conn.Write(payload.next())
+			return err
+		}
+	}
+}
+
+// S2c_sender returns the function creating the sender that writes the
+// messages of S2C on a connection, `batch` at a time.
+func s2c_sender(batch int) func(net.Conn) func() error {
+	return func(conn net.Conn) func() error {
+		counting := common.NewCountingConn(conn)
+		payload := new_payload(kv_payload_buffer, buflen)
+		return func() error {
+			if batch > 1 {
+				return write_batch(counting, payload.batch(batch))
+			}
+			_, err := counting.Write(payload.next())
+			return err
+		}
+	}
+}
+
+// Benchmark_loopback returns how many bytes per second we send over a
+// loopback connection, calling the function that `new_sender` returns for
+// the connection until kv_benchmark_duration elapses.
+func benchmark_loopback(new_sender func(net.Conn) func() error) (float64,
+	error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer listener.Close()
+	received := make(chan int64, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			received <- 0
+			return
+		}
+		defer conn.Close()
+		count, _ := io.Copy(ioutil.Discard, conn)
+		received <- count
+	}()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		return 0, err
+	}
+	send := new_sender(conn)
+	start := time.Now()
+	for err == nil && time.Since(start) < kv_benchmark_duration {
+		err = send()
+	}
+	conn.Close()
+	count := <-received
+	return float64(count) / time.Since(start).Seconds(), err
+}
+
+// Benchmark_udp_train returns how many bytes per second we send in trains
+// of UDP datagrams, of the size of the UDP probes, over loopback, with or
+// without GSO. We do not read them, since we only measure the sender.
+func benchmark_udp_train(use_gso bool) (float64, error) {
+	loopback := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	sink, err := net.ListenUDP("udp", loopback)
+	if err != nil {
+		return 0, err
+	}
+	defer sink.Close()
+	conn, err := net.ListenUDP("udp", loopback)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	writer := gso.NewWriter(conn)
+	if !use_gso {
+		writer.DisableGSO()
+	} else if !writer.GSO() {
+		return 0, gso.ErrUnsupported
+	}
+	train := new_payload(kv_payload_buffer, 64*kv_udp_max_size).next()
+	address := sink.LocalAddr().(*net.UDPAddr)
+	count := 0
+	start := time.Now()
+	for time.Since(start) < kv_benchmark_duration {
+		sent, err := writer.WriteTrain(train, kv_udp_max_size, address)
+		count += sent
+		if err != nil {
+			return 0, err
+		}
+	}
+	return float64(count) / time.Since(start).Seconds(), nil
+}
@@ -0,0 +1,55 @@
+package ndt
+
+// Optional packet capture of the data connections of each test, saved as
+// UUID.TEST.pcap next to the results, for debugging anomalous measurements.
+// Capturing requires the CAP_NET_RAW capability: without it, or on systems
+// where capturing is not supported, we log and run the test anyway.
+
+import (
+	"log"
+	"net"
+	"os"
+
+	"github.com/neubot/botticelli/common/capture"
+	"github.com/neubot/botticelli/common/results"
+)
+
+// PacketCapture enables capturing the packets of the tests.
+var PacketCapture = false
+
+// PacketCaptureMaxSize is the maximum size of each capture file in bytes.
+var PacketCaptureMaxSize int64 = 64 << 20
+
+// Start_capture starts capturing the packets of `conns`, the data
+// connections of `test`, if enabled, and returns the function stopping it.
+func (result *result_t) start_capture(test string, conns []net.Conn) func() {
+	if !PacketCapture {
+		return func() {}
+	}
+	flows := []*capture.Flow{}
+	for _, conn := range conns {
+		flow := capture.NewFlow(conn)
+		if flow != nil {
+			flows = append(flows, flow)
+		}
+	}
+	file, err := results.CreateAttachment(result.Tenant, result.UUID,
+		test+".pcap")
+	if err != nil {
+		log.Printf("ndt: cannot create capture file: %s", err)
+		return func() {}
+	}
+	running, err := capture.Start(flows, file, PacketCaptureMaxSize)
+	if err != nil {
+		log.Printf("ndt: cannot capture packets: %s", err)
+		file.Close()
+		os.Remove(file.Name())
+		return func() {}
+	}
+	return func() {
+		err := running.Stop()
+		if err != nil {
+			log.Printf("ndt: packet capture failed: %s", err)
+		}
+	}
+}
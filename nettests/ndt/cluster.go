@@ -0,0 +1,241 @@
+package ndt
+
+// Cluster mode. Sites running several instances behind one name may
+// configure each of them with the admin addresses of the others, such
+// that the instances periodically exchange their admission state. With
+// it, the queue position, the maximum number of concurrent tests and the
+// per-IP cooldown are enforced fleet-wide rather than per process. The
+// state is eventually consistent, hence enforcement is best effort. Each
+// instance serves its own queue in order, and only admits its first client
+// when the tests running in the whole cluster leave room for it: ordering
+// the clients fleet-wide would depend on the clocks of the instances being
+// in sync and would make idle instances wait for the clients of busy ones.
+// The instances authenticate each other using a shared secret, read from
+// $BOTTICELLI_CLUSTER_SECRET, and exchange the IPs that are cooling down
+// as keyed hashes, such that the state does not disclose them.
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/neubot/botticelli/common"
+)
+
+// ClusterPeers is a comma separated list of the admin addresses of the
+// other instances of the cluster. When empty, cluster mode is disabled.
+var ClusterPeers = ""
+
+// ClusterMaxTests is the maximum number of tests running at the same time
+// in the whole cluster. Zero means one for each live instance.
+var ClusterMaxTests = 0
+
+const kv_cluster_path = "/cluster/state"
+const kv_cluster_secret_env = "BOTTICELLI_CLUSTER_SECRET"
+const kv_cluster_interval = time.Second
+
+// The state of a peer that we could not refresh for this long is stale,
+// and we ignore it, assuming that the peer is down.
+const kv_cluster_stale = 3 * kv_cluster_interval
+
+// Admission state exchanged by the instances. Recent maps the keyed hashes
+// of the IPs to when they last ran a test, in nanoseconds since the epoch.
+type cluster_state_t struct {
+	Running int              `json:"running"`
+	Recent  map[string]int64 `json:"recent"`
+}
+
+type cluster_peer_t struct {
+	state *cluster_state_t
+	when  time.Time
+}
+
+var kv_cluster_peers = make(map[string]*cluster_peer_t)
+var kv_cluster_mutex sync.Mutex
+
+var kv_cluster_client = &http.Client{Timeout: kv_cluster_interval}
+
+var kv_cluster_secret []byte
+
+func cluster_enabled() bool {
+	return ClusterPeers != ""
+}
+
+// LoadCluster reads the secret shared by the instances, which cluster mode
+// requires.
+func LoadCluster() error {
+	if !cluster_enabled() {
+		return nil
+	}
+	kv_cluster_secret = []byte(os.Getenv(kv_cluster_secret_env))
+	if len(kv_cluster_secret) == 0 {
+		return errors.New("ndt: cluster mode requires $" +
+			kv_cluster_secret_env)
+	}
+	return nil
+}
+
+// Cluster_hash_ip returns the keyed hash of `ip` that we exchange with the
+// peers in place of `ip`.
+func cluster_hash_ip(ip string) string {
+	mac := hmac.New(sha256.New, kv_cluster_secret)
+	mac.Write([]byte(ip))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Cluster_live_peers returns the state of the peers that are not stale.
+// Must be called with the cluster mutex held.
+func cluster_live_peers_locked() []*cluster_state_t {
+	states := []*cluster_state_t{}
+	for _, peer := range kv_cluster_peers {
+		if time.Since(peer.when) < kv_cluster_stale {
+			states = append(states, peer.state)
+		}
+	}
+	return states
+}
+
+// Cluster_admit returns whether this instance may start one more test, as
+// far as the rest of the cluster is concerned, i.e., whether the tests that
+// the peers are running leave room for it.
+func cluster_admit() bool {
+	if !cluster_enabled() {
+		return true
+	}
+	kv_cluster_mutex.Lock()
+	defer kv_cluster_mutex.Unlock()
+	running := 0
+	peers := cluster_live_peers_locked()
+	for _, state := range peers {
+		running += state.Running
+	}
+	capacity := ClusterMaxTests
+	if capacity <= 0 {
+		capacity = len(peers) + 1
+	}
+	return running < capacity
+}
+
+// Cluster_recent returns true if any peer recently ran a test for `ip`,
+// such that the client is still cooling down.
+func cluster_recent(ip string) bool {
+	if !cluster_enabled() || Cooldown <= 0 {
+		return false
+	}
+	key := cluster_hash_ip(ip)
+	kv_cluster_mutex.Lock()
+	defer kv_cluster_mutex.Unlock()
+	for _, state := range cluster_live_peers_locked() {
+		when, found := state.Recent[key]
+		if found && time.Since(time.Unix(0, when)) < Cooldown {
+			return true
+		}
+	}
+	return false
+}
+
+// Cluster_local_state returns the admission state of this instance.
+func cluster_local_state() *cluster_state_t {
+	state := &cluster_state_t{Recent: make(map[string]int64)}
+	kv_test_pending_mutex.Lock()
+	if kv_test_pending {
+		state.Running = 1
+	}
+	kv_test_pending_mutex.Unlock()
+	kv_cooldown_mutex.Lock()
+	for ip, when := range kv_cooldown_last_test {
+		if time.Since(when) < Cooldown {
+			state.Recent[cluster_hash_ip(ip)] = when.UnixNano()
+		}
+	}
+	kv_cooldown_mutex.Unlock()
+	return state
+}
+
+// Cluster_authorized returns whether `r` carries the shared secret.
+func cluster_authorized(r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return len(kv_cluster_secret) > 0 &&
+		subtle.ConstantTimeCompare([]byte(token), kv_cluster_secret) == 1
+}
+
+// ServeClusterState is an HTTP handler exporting the admission state of
+// this instance to its peers, which must present the shared secret.
+func ServeClusterState(w http.ResponseWriter, r *http.Request) {
+	if !cluster_authorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	data, err := json.Marshal(cluster_local_state())
+	if err != nil {
+		w.WriteHeader(500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+func cluster_poll(peer string) {
+	request, err := http.NewRequest("GET", "http://"+peer+kv_cluster_path,
+		nil)
+	if err != nil {
+		log.Printf("ndt: cluster peer %s: %s", peer, err)
+		return
+	}
+	request.Header.Set("Authorization", "Bearer "+string(kv_cluster_secret))
+	response, err := kv_cluster_client.Do(request)
+	if err != nil {
+		common.Debugf("ndt: cluster", "ndt: cluster peer %s: %s", peer,
+			err)
+		return
+	}
+	defer response.Body.Close()
+	if response.StatusCode != 200 {
+		log.Printf("ndt: cluster peer %s: HTTP status %d", peer,
+			response.StatusCode)
+		return
+	}
+	state := &cluster_state_t{}
+	err = json.NewDecoder(response.Body).Decode(state)
+	if err != nil {
+		common.Debugf("ndt: cluster", "ndt: cluster peer %s: %s", peer,
+			err)
+		return
+	}
+	kv_cluster_mutex.Lock()
+	kv_cluster_peers[peer] = &cluster_peer_t{state: state, when: time.Now()}
+	kv_cluster_mutex.Unlock()
+}
+
+// StartCluster starts polling the peers in the background, if cluster
+// mode is enabled.
+func StartCluster() {
+	if !cluster_enabled() {
+		return
+	}
+	peers := []string{}
+	for _, peer := range strings.Split(ClusterPeers, ",") {
+		peer = strings.TrimSpace(peer)
+		if peer != "" {
+			peers = append(peers, peer)
+		}
+	}
+	log.Printf("ndt: cluster mode with peers %s", strings.Join(peers, " "))
+	for _, peer := range peers {
+		go func(peer string) {
+			for {
+				cluster_poll(peer)
+				time.Sleep(kv_cluster_interval)
+			}
+		}(peer)
+	}
+}
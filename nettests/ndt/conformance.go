@@ -0,0 +1,51 @@
+package ndt
+
+// Conformance modes. In lenient mode, which is the default and is meant
+// for production, we tolerate the deviations from the spec of old clients
+// and may apply the compatibility shims they need (see quirks.go). In
+// strict mode, which is meant for validating clients, any deviation from
+// the spec is a protocol error. In both modes we count the deviations.
+
+import (
+	"errors"
+
+	"github.com/neubot/botticelli/common"
+	"github.com/neubot/botticelli/common/metrics"
+)
+
+// Conformance is either "lenient" or "strict".
+var Conformance = "lenient"
+
+var kv_strict = false
+
+var kv_deviations_total = metrics.NewCounterVec("ndt_deviations_total",
+	"Number of deviations from the spec by NDT clients.", "kind")
+
+// LoadConformance validates Conformance.
+func LoadConformance() error {
+	switch Conformance {
+	case "lenient":
+		kv_strict = false
+	case "strict":
+		if Web100cltQuirks {
+			return errors.New("ndt: web100clt quirks require lenient " +
+				"conformance")
+		}
+		kv_strict = true
+	default:
+		return errors.New("ndt: invalid conformance mode: " + Conformance)
+	}
+	return nil
+}
+
+// Deviation records that the client deviated from the spec as described
+// by `kind`. It returns an error in strict mode and nil otherwise.
+func deviation(kind string) error {
+	kv_deviations_total.Inc(kind)
+	if kv_strict {
+		return protocol_error_t("ndt: client deviates from the spec: " + kind)
+	}
+	common.Debugf("ndt: deviation", "ndt: tolerating client deviation "+
+		"from the spec: %s", kind)
+	return nil
+}
@@ -0,0 +1,142 @@
+package ndt
+
+import (
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/neubot/botticelli/common"
+	"github.com/neubot/botticelli/common/redis"
+)
+
+// Cooldown is the minimum time that must elapse between two tests run
+// by the same client IP. Zero means that no cooldown is enforced.
+var Cooldown time.Duration = 0
+
+var kv_cooldown_last_test = make(map[string]time.Time)
+var kv_cooldown_mutex sync.Mutex
+
+// Client_ip returns the IP address of the peer of `conn`.
+func client_ip(conn net.Conn) string {
+	addr := conn.RemoteAddr().String()
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// Limiters remember which IPs recently ran a test. The memory limiter is
+// local to the process, while the Redis limiter shares its state among
+// all the instances using the same Redis server.
+type limiter_t interface {
+	// Allow returns true if `ip` may run a test at `now`, in which
+	// case it also records that it did so.
+	allow(ip string, now time.Time) bool
+
+	// Recent returns true if `ip` ran a test less than Cooldown
+	// before `now`, without recording anything.
+	recent(ip string, now time.Time) bool
+}
+
+type memory_limiter_t struct{}
+
+func (memory_limiter_t) recent(ip string, now time.Time) bool {
+	kv_cooldown_mutex.Lock()
+	defer kv_cooldown_mutex.Unlock()
+	when, found := kv_cooldown_last_test[ip]
+	return found && now.Sub(when) < Cooldown
+}
+
+func (memory_limiter_t) allow(ip string, now time.Time) bool {
+	kv_cooldown_mutex.Lock()
+	defer kv_cooldown_mutex.Unlock()
+	for key, when := range kv_cooldown_last_test {
+		if now.Sub(when) >= Cooldown {
+			delete(kv_cooldown_last_test, key)
+		}
+	}
+	if _, found := kv_cooldown_last_test[ip]; found {
+		return false
+	}
+	kv_cooldown_last_test[ip] = now
+	return true
+}
+
+const kv_cooldown_redis_prefix = "botticelli:cooldown:"
+
+// The Redis limiter sets a key for each IP that expires after Cooldown,
+// unless the key already exists. If Redis is unreachable, we fall back
+// to the memory limiter rather than refusing all the tests.
+type redis_limiter_t struct {
+	client *redis.Client
+}
+
+func (limiter *redis_limiter_t) allow(ip string, now time.Time) bool {
+	reply, err := limiter.client.Do("SET", kv_cooldown_redis_prefix+ip,
+		strconv.FormatInt(now.Unix(), 10), "NX", "PX",
+		strconv.FormatInt(int64(Cooldown/time.Millisecond), 10))
+	if err != nil {
+		common.Debugf("ndt: redis", "ndt: redis limiter: %s", err)
+		return memory_limiter_t{}.allow(ip, now)
+	}
+	return reply != nil
+}
+
+func (limiter *redis_limiter_t) recent(ip string, now time.Time) bool {
+	reply, err := limiter.client.Do("EXISTS", kv_cooldown_redis_prefix+ip)
+	if err != nil {
+		common.Debugf("ndt: redis", "ndt: redis limiter: %s", err)
+		return memory_limiter_t{}.recent(ip, now)
+	}
+	count, _ := reply.(int64)
+	return count > 0
+}
+
+// CooldownRedis is the address of the Redis server used to share the
+// cooldown state among instances. When empty, the state is local. The
+// password, if any, is read from $BOTTICELLI_REDIS_PASSWORD.
+var CooldownRedis = ""
+
+var kv_limiter limiter_t = memory_limiter_t{}
+
+// StartLimiter selects the limiter enforcing the cooldown policy.
+func StartLimiter() {
+	if CooldownRedis == "" {
+		return
+	}
+	client := redis.NewClient(CooldownRedis,
+		os.Getenv("BOTTICELLI_REDIS_PASSWORD"))
+	_, err := client.Do("PING")
+	if err != nil {
+		log.Printf("ndt: redis limiter: %s (will retry)", err)
+	}
+	kv_limiter = &redis_limiter_t{client: client}
+}
+
+// Cooldown_recent returns true if the client with IP `ip` is still cooling
+// down, such that we can refuse it before queueing it. It records nothing,
+// since we only charge the cooldown to the clients we admit.
+func cooldown_recent(ip string) bool {
+	if Cooldown <= 0 {
+		return false
+	}
+	return cluster_recent(ip) || kv_limiter.recent(ip, time.Now())
+}
+
+// Cooldown_allow returns true if the client with IP `ip` is allowed to
+// run a test now, in which case it also records that it did so. We call
+// it once the client is admitted, such that the clients that we refuse
+// for other reasons are not locked out.
+func cooldown_allow(ip string) bool {
+	if Cooldown <= 0 {
+		return true
+	}
+	if cluster_recent(ip) {
+		return false
+	}
+	return kv_limiter.allow(ip, time.Now())
+}
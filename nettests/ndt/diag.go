@@ -0,0 +1,102 @@
+package ndt
+
+// Optional collection of the snapshots with netlink, where one INET_DIAG
+// query returns the TCP_INFO of all the connections at once. Measurers
+// share the result of the last query, for up to kv_diag_max_age, such that
+// the number of queries does not grow with the number of tests. When the
+// query fails, or does not include a connection, we fall back to getsockopt.
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/neubot/botticelli/common/metrics"
+	"github.com/neubot/botticelli/common/tcpinfo"
+)
+
+// DiagStats enables collecting the snapshots with netlink.
+var DiagStats = false
+
+const kv_diag_max_age = 20 * time.Millisecond
+
+var kv_error_diag_missing = errors.New("ndt: connection not in the dump")
+
+var kv_diag_queries = metrics.NewCounterVec("ndt_diag_queries_total",
+	"Netlink queries of the TCP statistics, by outcome.", "outcome")
+
+var kv_diag = struct {
+	mutex sync.Mutex
+	when  time.Time
+	infos map[string]*tcpinfo.TCPInfo
+	err   error
+}{}
+
+// StartDiagStats checks that we can query the TCP statistics with netlink,
+// if enabled. On failure, it logs and disables the collection.
+func StartDiagStats() {
+	if !DiagStats {
+		return
+	}
+	_, err := tcpinfo.Dump()
+	if err != nil {
+		log.Printf("ndt: cannot collect TCP stats with netlink: %s", err)
+		DiagStats = false
+		return
+	}
+	log.Printf("ndt: collecting TCP stats with netlink")
+}
+
+// Diag_get returns the TCP_INFO of the connection with `key`, querying
+// the kernel when the last result is too old. Concurrent callers wait for
+// the same query.
+func diag_get(key string) (*tcpinfo.TCPInfo, error) {
+	kv_diag.mutex.Lock()
+	defer kv_diag.mutex.Unlock()
+	if time.Since(kv_diag.when) > kv_diag_max_age {
+		kv_diag.infos, kv_diag.err = tcpinfo.Dump()
+		kv_diag.when = time.Now()
+		if kv_diag.err != nil {
+			kv_diag_queries.Inc("failure")
+		} else {
+			kv_diag_queries.Inc("success")
+		}
+	}
+	if kv_diag.err != nil {
+		return nil, kv_diag.err
+	}
+	info, found := kv_diag.infos[key]
+	if !found {
+		return nil, kv_error_diag_missing
+	}
+	return info, nil
+}
+
+type diag_measurer_t struct {
+	conn net.Conn
+	key  string
+}
+
+// New_diag_measurer returns the netlink measurer of `conn`, or nil.
+func new_diag_measurer(conn net.Conn) measurer_t {
+	if !DiagStats {
+		return nil
+	}
+	key := tcpinfo.Key(conn)
+	if key == "" {
+		return nil
+	}
+	return &diag_measurer_t{conn: conn, key: key}
+}
+
+func (measurer *diag_measurer_t) measure() (*tcpinfo.TCPInfo, error) {
+	info, err := diag_get(measurer.key)
+	if err != nil {
+		return tcpinfo.Get(measurer.conn)
+	}
+	return info, nil
+}
+
+func (measurer *diag_measurer_t) close() {}
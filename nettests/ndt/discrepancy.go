@@ -0,0 +1,49 @@
+package ndt
+
+// Comparison between the speed measured by the client, which it sends us
+// at the end of the S2C test, and the speed we measured. Since both count
+// the same bytes over about the same time, they should agree. When they
+// diverge, it is likely that a middlebox interfered with the test (e.g.,
+// a proxy terminating the connections) or that the client is buggy.
+
+import (
+	"errors"
+	"math"
+
+	"github.com/neubot/botticelli/common"
+	"github.com/neubot/botticelli/common/metrics"
+)
+
+// ClientSpeedDivergence is the relative difference between the speeds
+// measured by the client and by the server above which we flag the test.
+var ClientSpeedDivergence = 0.25
+
+var kv_client_speed_divergent_total = metrics.NewCounterVec(
+	"ndt_client_speed_divergent_total",
+	"Number of NDT tests where the client and server speeds diverge.",
+	"test", "tenant")
+
+// LoadClientSpeedDivergence validates ClientSpeedDivergence.
+func LoadClientSpeedDivergence() error {
+	if ClientSpeedDivergence <= 0 {
+		return errors.New("ndt: client speed divergence must be positive")
+	}
+	return nil
+}
+
+// Compare_client_speed records how much `speed`, in kbit/s, measured by
+// the client, differs from the speed we measured, and whether they
+// diverge.
+func (test *test_result_t) compare_client_speed(speed float64) {
+	if test.SpeedKbits <= 0 {
+		return
+	}
+	test.ClientDifference = (speed - test.SpeedKbits) / test.SpeedKbits
+	test.ClientDivergent = math.Abs(test.ClientDifference) >
+		ClientSpeedDivergence
+	if test.ClientDivergent {
+		common.Infof("ndt: session %s: client speed %.0f diverges from ours %.0f",
+			test.uuid, speed, test.SpeedKbits)
+		kv_client_speed_divergent_total.Inc(test.Name, test.tenant)
+	}
+}
@@ -0,0 +1,122 @@
+package ndt
+
+// Duplex test, a non-standard ndt7 extension measuring download and upload
+// at the same time over the same connection, such that we see how the link
+// behaves when loaded in both directions, e.g. when a half-duplex medium
+// or the ACKs of one direction limit the other. The client uses the ndt7
+// subprotocol on kv_ndt7_duplex_path and sends binary messages while it
+// receives ours, until we close the connection after the test duration.
+// We send the measurements of both directions, distinguished by their test
+// field. The results are marked as duplex, since they are not comparable
+// with the standard ones, and are not part of the throughput metrics.
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/neubot/botticelli/common/results"
+)
+
+// DuplexTest enables the duplex test.
+var DuplexTest = false
+
+const kv_ndt7_duplex = "duplex"
+
+func handle_ndt7_duplex(w http.ResponseWriter, r *http.Request) {
+	defer track_goroutine("session")()
+	conn, policy, release := ndt7_upgrade(w, r, kv_ndt7_duplex)
+	if conn == nil {
+		return
+	}
+	defer release()
+	defer conn.Close()
+
+	result, download := ndt7_new_result(conn, r, results.Download, policy)
+	download.Duplex = true
+	upload := result.new_test(results.Upload, results.Upload)
+	upload.NumStreams = 1
+	upload.Duplex = true
+	defer result.start_capture(kv_ndt7_duplex,
+		[]net.Conn{ws_net_conn(conn)})()
+	defer register_session(result, &ws_conn_t{conn: conn})()
+	result.set_lifetime(2*policy.duration + kv_session_overhead)
+	defer result.log_summary()
+	defer result.save()
+	result.phase(kv_ndt7_duplex)
+
+	// We send and receive in two goroutines. The sender is the only one
+	// writing on `conn`, and also sends the measurements. If any of them
+	// fails, we close `conn` to interrupt the other one.
+
+	conns := []net.Conn{ws_net_conn(conn)}
+	start := time.Now()
+	download_counter := data_counter(conns, results.Download)
+	upload_counter := data_counter(conns, results.Upload)
+	download_kernel := &kernel_counter_t{}
+	upload_kernel := &kernel_counter_t{}
+	download_done := make(chan bool)
+	upload_done := make(chan bool)
+	group := new_group()
+	group.close_on_failure(ws_net_conn(conn))
+	snapshots := start_snapshotter(group, ws_net_conn(conn), start,
+		kv_ndt7_measurement_interval)
+	rtt := ndt7_start_pinger(group, conn, download, start)
+	measure := func(snapshot *snapshot_t) []*websocket.PreparedMessage {
+		return []*websocket.PreparedMessage{
+			ndt7_measurement(snapshot, results.Download, download_counter()),
+			ndt7_measurement(snapshot, results.Upload, upload_counter()),
+		}
+	}
+	group.spawn("stream", func(ctx context.Context) error {
+		stop_kernel := download_kernel.measure(ws_net_conn(conn),
+			results.Download)
+		err := ndt7_sender_loop(ctx, conn, start, policy.duration,
+			download_counter, snapshots, measure)
+		stop_kernel()
+		download_done <- true
+		return err
+	})
+	group.spawn("ndt7_receiver", func(ctx context.Context) error {
+		stop_kernel := upload_kernel.measure(ws_net_conn(conn),
+			results.Upload)
+		err := ndt7_receiver_loop(conn, start.Add(policy.duration))
+		stop_kernel()
+		upload_done <- true
+		return err
+	})
+
+	collected := make(chan bool)
+	go func() {
+		upload.Bytes = collect_streams(upload_done, conns, start, upload,
+			upload_counter)
+		close(collected)
+	}()
+	download.Bytes = collect_streams(download_done, conns, start, download,
+		download_counter)
+	<-collected
+	finish := func(test *test_result_t, kernel *kernel_counter_t) {
+		elapsed := kernel.elapsed(start) // without the drain
+		test.Elapsed = elapsed.Seconds()
+		test.SpeedKbits = (8.0 * float64(test.Bytes)) / 1000.0 / test.Elapsed
+		test.set_kernel_rate(kernel, elapsed)
+		test.set_min_rtt(rtt)
+		test.set_bufferbloat()
+	}
+	finish(download, download_kernel)
+	finish(upload, upload_kernel)
+	group.stop()
+	err := group.wait()
+	ndt7_close(conn)
+	if err != nil {
+		result.fail(kv_ndt7_duplex, err)
+		return
+	}
+	result.publish_test(download)
+	result.publish_test(upload)
+	kv_tests_total.Inc(kv_ndt7_duplex, result.Tenant)
+	result.Outcome = "success"
+	result.phase("done")
+}
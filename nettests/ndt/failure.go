@@ -0,0 +1,88 @@
+package ndt
+
+// Classification of the reasons why sessions fail, such that operators
+// can tell clients going away apart from our own bugs.
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/neubot/botticelli/common/metrics"
+)
+
+var kv_session_failures_total = metrics.NewCounterVec(
+	"ndt_session_failures_total", "Number of failed NDT sessions.",
+	"stage", "reason")
+
+// Protocol_error_t is the error of a client that violates the protocol.
+type protocol_error_t string
+
+func (e protocol_error_t) Error() string {
+	return string(e)
+}
+
+// Reasons why the server forcibly terminates a session.
+const (
+	kv_kill_lifetime = 1
+	kv_kill_operator = 2
+)
+
+// Classify_failure maps `err` to a coarse reason. When the session was
+// forcibly terminated, `killed` tells why.
+func classify_failure(err error, killed int32) string {
+	var net_error net.Error
+	var syntax_error *json.SyntaxError
+	var type_error *json.UnmarshalTypeError
+	var num_error *strconv.NumError
+	var protocol_error protocol_error_t
+	switch {
+	case killed == kv_kill_operator:
+		return "killed_by_operator"
+	case killed == kv_kill_lifetime && errors.Is(err, net.ErrClosed):
+		return "lifetime_exceeded"
+	case err == kv_error_accept_timeout:
+		return "data_connect_timeout"
+	case err == kv_error_queue_too_long:
+		return "queue_too_long"
+	case err == kv_error_missing_token:
+		return "unauthorized"
+	case err == kv_error_tls_on_plaintext:
+		return "tls_on_plaintext"
+	case err == kv_error_http_on_plaintext:
+		return "http_request"
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE):
+		return "client_disconnect"
+	case err == kv_error_message_timeout,
+		errors.As(err, &net_error) && net_error.Timeout():
+		return "timeout"
+	case errors.As(err, &syntax_error), errors.As(err, &type_error),
+		errors.As(err, &num_error), errors.As(err, &protocol_error):
+		return "protocol_error"
+	default:
+		return "io_error"
+	}
+}
+
+// Kill marks the session as forcibly terminated by the server because of
+// `why`. Only the first reason is recorded.
+func (result *result_t) kill(why int32) {
+	atomic.CompareAndSwapInt32(&result.killed, 0, why)
+}
+
+// Fail records that the session failed at `stage` because of `err`.
+func (result *result_t) fail(stage string, err error) {
+	reason := classify_failure(err, atomic.LoadInt32(&result.killed))
+	log.Printf("ndt: session %s failed at %s: %s (%s)", result.UUID, stage,
+		reason, err)
+	kv_session_failures_total.Inc(stage, reason)
+	result.Outcome = "failure"
+	result.FailureStage = stage
+	result.FailureReason = reason
+}
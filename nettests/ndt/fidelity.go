@@ -0,0 +1,115 @@
+package ndt
+
+// Measurements degrade gracefully when the kernel does not provide TCP
+// statistics (see common/tcpinfo). In such case, we estimate the rate in
+// the steady state, when the socket buffers are already full and hence the
+// bytes moved by the application are close to the bytes delivered, and we
+// measure the RTT by pinging the client over the control channel, where
+// the protocol allows it (i.e., ndt7). Such RTT includes the time spent
+// queued behind the data, hence it is an upper bound. The fidelity of each
+// measurement tells which method we used.
+
+import (
+	"context"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/neubot/botticelli/common/results"
+	"github.com/neubot/botticelli/common/tcpinfo"
+)
+
+const kv_ndt7_ping_interval = time.Second
+
+// Number of bytes moved by the application at a given time of a test.
+type sample_t struct {
+	elapsed time.Duration
+	bytes   int
+}
+
+// Minimum RTT observed so far, safe for concurrent use.
+type min_rtt_t struct {
+	value int64
+}
+
+func (rtt *min_rtt_t) observe(value time.Duration) {
+	for {
+		current := atomic.LoadInt64(&rtt.value)
+		if value <= 0 || (current > 0 && current <= int64(value)) {
+			return
+		}
+		if atomic.CompareAndSwapInt64(&rtt.value, current, int64(value)) {
+			return
+		}
+	}
+}
+
+func (rtt *min_rtt_t) get() time.Duration {
+	return time.Duration(atomic.LoadInt64(&rtt.value))
+}
+
+// Set_min_rtt records `rtt` as the minimum RTT of the test, unless we
+// already know it.
+func (test *test_result_t) set_min_rtt(rtt *min_rtt_t) {
+	if test.MinRTT <= 0 && rtt.get() > 0 {
+		test.MinRTT = rtt.get().Seconds() * 1000.0
+	}
+}
+
+// Set_application_rate records the rate in the second half of the test,
+// which lasted `elapsed`, according to the application counters.
+func (test *test_result_t) set_application_rate(elapsed time.Duration) {
+	test.Fidelity = results.FidelityApplication
+	for _, sample := range test.samples {
+		if sample.elapsed < elapsed/2 {
+			continue
+		}
+		if interval := elapsed - sample.elapsed; interval > 0 {
+			test.SteadySpeedKbits = (8.0 * float64(test.Bytes-sample.bytes)) /
+				1000.0 / interval.Seconds()
+		}
+		return
+	}
+}
+
+// Ndt7_start_pinger periodically pings the client over `conn`, unless the
+// kernel can tell us the RTT, until `group` is stopped, and returns the
+// minimum RTT. The RTTs after the warmup of `test`, which started at
+// `start`, are the RTT under load. Pongs are only processed while someone
+// reads from `conn`.
+func ndt7_start_pinger(group *group_t, conn *websocket.Conn,
+	test *test_result_t, start time.Time) *min_rtt_t {
+	rtt := &min_rtt_t{}
+	if _, err := tcpinfo.Get(ws_net_conn(conn)); err == nil {
+		return rtt
+	}
+	conn.SetPongHandler(func(data string) error {
+		sent, err := strconv.ParseInt(data, 10, 64)
+		if err == nil {
+			rtt.observe(time.Since(time.Unix(0, sent)))
+			if time.Unix(0, sent).Sub(start) >= kv_loaded_rtt_warmup {
+				test.loaded.observe(time.Since(time.Unix(0, sent)))
+			}
+		}
+		return nil
+	})
+	group.spawn("ndt7_pinger", func(ctx context.Context) error {
+		ticker := time.NewTicker(kv_ndt7_ping_interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				payload := strconv.FormatInt(time.Now().UnixNano(), 10)
+				err := conn.WriteControl(websocket.PingMessage,
+					[]byte(payload), time.Now().Add(kv_ndt7_io_timeout))
+				if err != nil {
+					return nil // the other goroutines will notice
+				}
+			case <-ctx.Done():
+				return nil
+			}
+		}
+	})
+	return rtt
+}
@@ -0,0 +1,79 @@
+package ndt
+
+// Optional collection of the snapshots with eBPF, where the kernel updates
+// the statistics of each flow on every segment, such that we can take the
+// snapshots without a getsockopt each. The statistics are partial, as the
+// programs only see the fields of the tcp_probe and tcp_retransmit_skb
+// tracepoints, and MinRTT is the minimum of the smoothed RTT. When eBPF is
+// not available, or a flow cannot be tracked, we fall back to getsockopt.
+
+import (
+	"log"
+	"net"
+
+	"github.com/neubot/botticelli/common"
+	"github.com/neubot/botticelli/common/flowstats"
+	"github.com/neubot/botticelli/common/tcpinfo"
+)
+
+// FlowStats enables collecting the snapshots with eBPF.
+var FlowStats = false
+
+// StartFlowStats loads the eBPF programs, if enabled. On failure, it logs
+// and disables the collection.
+func StartFlowStats() {
+	if !FlowStats {
+		return
+	}
+	err := flowstats.Start()
+	if err != nil {
+		log.Printf("ndt: cannot collect flow stats with eBPF: %s", err)
+		FlowStats = false
+		return
+	}
+	log.Printf("ndt: collecting flow stats with eBPF")
+}
+
+type flowstats_measurer_t struct {
+	conn     net.Conn
+	untrack  func()
+	previous *flowstats.Stats
+}
+
+// New_flowstats_measurer returns the eBPF measurer of `conn`, or nil.
+func new_flowstats_measurer(conn net.Conn) measurer_t {
+	if !FlowStats {
+		return nil
+	}
+	untrack, err := flowstats.Track(conn)
+	if err != nil {
+		common.Infof("ndt: cannot track flow with eBPF: %s", err)
+		return nil
+	}
+	return &flowstats_measurer_t{conn: conn, untrack: untrack}
+}
+
+func (measurer *flowstats_measurer_t) measure() (*tcpinfo.TCPInfo, error) {
+	stats, err := flowstats.Get(measurer.conn)
+	if err != nil {
+		return nil, err
+	}
+	info := &tcpinfo.TCPInfo{
+		RTT:           stats.SRTT,
+		MinRTT:        stats.MinSRTT,
+		SndCwnd:       stats.SndCwnd,
+		TotalRetrans:  uint32(stats.Retransmits),
+		BytesAcked:    stats.Acked,
+		BytesReceived: stats.Received,
+		SegsIn:        uint32(stats.Samples),
+	}
+	if measurer.previous != nil {
+		info.DeliveryRate = flowstats.DeliveryRate(measurer.previous, stats)
+	}
+	measurer.previous = stats
+	return info, nil
+}
+
+func (measurer *flowstats_measurer_t) close() {
+	measurer.untrack()
+}
@@ -0,0 +1,83 @@
+package ndt
+
+// Group of goroutines cooperating to run a test (e.g. the streams, the
+// snapshotter and the measurements reporter). The first goroutine that
+// fails cancels the context shared by all of them and runs the failure
+// hooks (e.g. closing the connections, to interrupt pending I/O), such
+// that the others stop cleanly; its error is the error of the group.
+
+import (
+	"context"
+	"net"
+	"sync"
+)
+
+type group_t struct {
+	ctx        context.Context
+	cancel     context.CancelFunc
+	wg         sync.WaitGroup
+	once       sync.Once
+	err        error
+	on_failure []func()
+}
+
+func new_group() *group_t {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &group_t{ctx: ctx, cancel: cancel}
+}
+
+// Fail_with records that the group failed because of `err`, unless it
+// had already failed, and cancels it.
+func (group *group_t) fail_with(err error) {
+	group.once.Do(func() {
+		group.err = err
+		group.cancel()
+		for _, hook := range group.on_failure {
+			hook()
+		}
+	})
+}
+
+// Add_failure_hook registers `hook` to run when the group fails.
+func (group *group_t) add_failure_hook(hook func()) {
+	group.on_failure = append(group.on_failure, hook)
+}
+
+// Close_on_failure closes `conns` when the group fails, to interrupt the
+// I/O pending on them.
+func (group *group_t) close_on_failure(conns ...net.Conn) {
+	group.add_failure_hook(func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	})
+}
+
+// Spawn runs `task` in a new goroutine of the group. The failure hooks
+// must have been registered before calling spawn.
+func (group *group_t) spawn(subsystem string,
+	task func(ctx context.Context) error) {
+	group.wg.Add(1)
+	go func() {
+		defer group.wg.Done()
+		defer track_goroutine(subsystem)()
+		err := task(group.ctx)
+		if err != nil {
+			group.fail_with(err)
+		}
+	}()
+}
+
+// Stop cancels the context of the group without failing it, to tell
+// the goroutines running until cancelled that they are done.
+func (group *group_t) stop() {
+	group.cancel()
+}
+
+// Wait waits for all the goroutines of the group and returns the error
+// of the first one that failed, if any.
+func (group *group_t) wait() error {
+	group.wg.Wait()
+	group.cancel()
+	return group.err
+}
@@ -0,0 +1,55 @@
+package ndt
+
+// Hexdump mode, logging the raw bytes read and written on the control
+// connection, which is invaluable when debugging framing issues with
+// clients whose source code is not available.
+
+import (
+	"encoding/hex"
+	"net"
+
+	"github.com/neubot/botticelli/common"
+)
+
+// Hexdump controls whether the control connection traffic is hexdumped.
+var Hexdump = false
+
+type hexdump_conn_t struct {
+	net.Conn
+	uuid         string
+	read_offset  int64
+	write_offset int64
+}
+
+func (conn *hexdump_conn_t) Read(data []byte) (int, error) {
+	count, err := conn.Conn.Read(data)
+	if count > 0 {
+		hexdump(conn.uuid, "<-", conn.read_offset, data[:count])
+		conn.read_offset += int64(count)
+	}
+	return count, err
+}
+
+func (conn *hexdump_conn_t) Write(data []byte) (int, error) {
+	count, err := conn.Conn.Write(data)
+	if count > 0 {
+		hexdump(conn.uuid, "->", conn.write_offset, data[:count])
+		conn.write_offset += int64(count)
+	}
+	return count, err
+}
+
+// Hexdump logs `data`, transferred in `direction` at `offset`.
+func hexdump(uuid string, direction string, offset int64, data []byte) {
+	common.Protocolf("ndt: hexdump %s %s offset=%d length=%d\n%s", uuid,
+		direction, offset, len(data), hex.Dump(data))
+}
+
+// Maybe_hexdump returns `cc` wrapped such that its traffic is hexdumped
+// when Hexdump is enabled, and `cc` otherwise.
+func maybe_hexdump(cc net.Conn, uuid string) net.Conn {
+	if !Hexdump {
+		return cc
+	}
+	return &hexdump_conn_t{Conn: cc, uuid: uuid}
+}
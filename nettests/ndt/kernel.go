@@ -0,0 +1,145 @@
+package ndt
+
+// Comparison between the rate measured by the application, i.e. how fast
+// we wrote into (or read from) the sockets, and the rate measured by the
+// kernel, i.e. how many bytes have actually been delivered according to
+// TCP_INFO. Significant divergence means the measurement is suspect. When
+// a download ends, the kernel still has to deliver what is queued in the
+// socket, hence we wait for it before taking the last sample, and account
+// for the time we waited.
+
+import (
+	"math"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/neubot/botticelli/common/results"
+	"github.com/neubot/botticelli/common/tcpinfo"
+)
+
+// Relative difference between the application and kernel rates above
+// which we flag the measurement.
+const kv_rate_divergence = 0.1
+
+// How long we wait, at most, for the send queue to drain at the end of a
+// download, and how often we check it.
+const kv_kernel_drain_timeout = 2 * time.Second
+const kv_kernel_drain_interval = 10 * time.Millisecond
+
+// Accumulates the bytes delivered over all the streams of a test,
+// according to the kernel.
+type kernel_counter_t struct {
+	bytes   int64
+	drain   int64 // the longest time a stream waited to drain, in ns
+	stopped int64 // when the last stream stopped, in ns since the epoch
+	missing int32
+	rtt     min_rtt_t
+	losses  loss_counter_t
+}
+
+// Delivered_bytes returns the bytes delivered in `direction` according
+// to `info`.
+func delivered_bytes(info *tcpinfo.TCPInfo, direction string) int64 {
+	if direction == results.Upload {
+		return int64(info.BytesReceived)
+	}
+	return int64(info.BytesAcked)
+}
+
+// Info_rtt returns the minimum RTT in `info` or, where the kernel does
+// not track it, the smoothed RTT.
+func info_rtt(info *tcpinfo.TCPInfo) time.Duration {
+	rtt := time.Duration(info.MinRTT) * time.Microsecond
+	if rtt <= 0 {
+		rtt = time.Duration(info.RTT) * time.Microsecond // not all systems
+	}
+	return rtt
+}
+
+// Wait_drained waits until the send queue of `conn` is empty, i.e., the
+// peer acknowledged all we sent, for up to kv_kernel_drain_timeout, and
+// returns how long it waited.
+func wait_drained(conn net.Conn) time.Duration {
+	start := time.Now()
+	for time.Since(start) < kv_kernel_drain_timeout {
+		outq, err := tcpinfo.Outq(conn)
+		if err != nil || outq <= 0 {
+			break
+		}
+		time.Sleep(kv_kernel_drain_interval)
+	}
+	return time.Since(start)
+}
+
+// Atomic_max sets `*address` to `value`, if larger.
+func atomic_max(address *int64, value int64) {
+	for {
+		current := atomic.LoadInt64(address)
+		if value <= current ||
+			atomic.CompareAndSwapInt64(address, current, value) {
+			return
+		}
+	}
+}
+
+// Measure starts measuring the bytes delivered on `conn`. The returned
+// function must be called, as soon as the stream stops sending or
+// receiving, before closing `conn`, to stop measuring and, for downloads,
+// waits for the send queue to drain.
+func (counter *kernel_counter_t) measure(conn net.Conn,
+	direction string) func() {
+	before, err := tcpinfo.Get(conn)
+	return func() {
+		atomic_max(&counter.stopped, time.Now().UnixNano())
+		if err == nil && direction == results.Download {
+			atomic_max(&counter.drain, int64(wait_drained(conn)))
+		}
+		after, err_after := tcpinfo.Get(conn)
+		if err_after == nil {
+			counter.rtt.observe(info_rtt(after))
+		}
+		if err != nil || err_after != nil {
+			atomic.AddInt32(&counter.missing, 1)
+			return
+		}
+		atomic.AddInt64(&counter.bytes, delivered_bytes(after, direction)-
+			delivered_bytes(before, direction))
+		counter.losses.add(before, after)
+	}
+}
+
+// Elapsed returns the time from `start` until the last stream stopped
+// sending or receiving, which excludes the time the send queue took to
+// drain, or until now, if no stream stopped.
+func (counter *kernel_counter_t) elapsed(start time.Time) time.Duration {
+	stopped := atomic.LoadInt64(&counter.stopped)
+	if stopped == 0 {
+		return time.Since(start)
+	}
+	return time.Unix(0, stopped).Sub(start)
+}
+
+// Set_kernel_rate records the kernel rate measured by `counter`, over the
+// test `elapsed` time (see elapsed) plus the time the send queue took to
+// drain, such that we only count the drain here, and
+// whether it diverges from the application rate. Without kernel data, it
+// falls back to the application rate in the steady state.
+func (test *test_result_t) set_kernel_rate(counter *kernel_counter_t,
+	elapsed time.Duration) {
+	test.set_min_rtt(&counter.rtt)
+	if atomic.LoadInt32(&counter.missing) != 0 || elapsed <= 0 {
+		test.set_application_rate(elapsed)
+		return
+	}
+	test.Fidelity = results.FidelityKernel
+	test.set_losses(&counter.losses)
+	bytes := atomic.LoadInt64(&counter.bytes)
+	elapsed += time.Duration(atomic.LoadInt64(&counter.drain))
+	test.KernelSpeedKbits = (8.0 * float64(bytes)) / 1000.0 / elapsed.Seconds()
+	if test.SpeedKbits > 0 {
+		difference := math.Abs(test.SpeedKbits-test.KernelSpeedKbits) /
+			test.SpeedKbits
+		test.RateDivergent = difference > kv_rate_divergence
+	}
+}
@@ -0,0 +1,162 @@
+package ndt
+
+// Goroutine leak check, in the spirit of goleak, which the self test runs
+// after each test, such that refactoring the session handling cannot
+// silently leave senders, snapshotters or listeners behind. We snapshot
+// the goroutines before the test and, after it, wait for the registry of
+// the live sessions to become empty, for the count of the goroutines of
+// each subsystem to return to its previous value and for all goroutines
+// created in the meantime to terminate, failing with their description
+// otherwise.
+
+import (
+	"bytes"
+	"errors"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const kv_leak_check_timeout = 10 * time.Second
+const kv_leak_check_interval = 50 * time.Millisecond
+
+// Goroutines that legitimately outlive the test that started them, which
+// we identify by a function in their stack: those the first session starts
+// and those the process starts at startup, i.e., the background loops and
+// the servers, including the ones quic-go starts for each UDP socket.
+var kv_leak_check_ignored = []string{
+	// Started by the first session
+	"github.com/neubot/botticelli/nettests/ndt.run_watchdog",
+	"github.com/neubot/botticelli/nettests/ndt.run_send_rate_sampler",
+	"github.com/neubot/botticelli/common/results.run_rotation",
+	// Started at startup
+	"github.com/neubot/botticelli/common.run_ocsp_stapler",
+	"github.com/neubot/botticelli/common.wait_predecessor",
+	"github.com/neubot/botticelli/common/admin.Start.func1",
+	"github.com/neubot/botticelli/common/admin.Start.func2",
+	"github.com/neubot/botticelli/common/events.Start.func1",
+	"github.com/neubot/botticelli/common/events.publish_loop.func1",
+	"github.com/neubot/botticelli/common/hostload.run_watchdog",
+	"github.com/neubot/botticelli/common/hostload.run_budget",
+	"github.com/neubot/botticelli/common/results.StartJanitor.func1",
+	"github.com/neubot/botticelli/common/results.StartUploader.func1",
+	"github.com/neubot/botticelli/nettests/ndt.StartCluster.func1",
+	"github.com/neubot/botticelli/nettests/ndt.StartWebTransport.func2",
+	"github.com/neubot/botticelli/nettests/ndt.serve",
+	"github.com/neubot/botticelli/nettests/ndt.serve_websocket",
+	"github.com/neubot/botticelli/nettests/ndt.serve_udp",
+	"github.com/neubot/botticelli/nettests/ndt.serve_quic",
+	"github.com/quic-go/quic-go.(*Transport).listen",
+	"github.com/quic-go/quic-go.(*Transport).runSendQueue",
+	"github.com/quic-go/quic-go.(*baseServer).run",
+	"github.com/quic-go/quic-go.(*baseServer).runSendQueue",
+}
+
+// The counts of the goroutines of each subsystem, which track_goroutine
+// keeps alongside the kv_goroutines gauge, since we cannot read it.
+var kv_goroutines_count = make(map[string]int)
+var kv_goroutines_mutex sync.Mutex
+
+type goroutines_t struct {
+	tracked map[string]int    // subsystem -> count
+	stacks  map[string]string // ID -> stack
+}
+
+// Goroutines_snapshot returns the goroutines running now.
+func goroutines_snapshot() *goroutines_t {
+	snapshot := &goroutines_t{
+		tracked: make(map[string]int),
+		stacks:  make(map[string]string),
+	}
+	kv_goroutines_mutex.Lock()
+	for subsystem, count := range kv_goroutines_count {
+		snapshot.tracked[subsystem] = count
+	}
+	kv_goroutines_mutex.Unlock()
+	buffer := make([]byte, 1<<20)
+	for {
+		count := runtime.Stack(buffer, true)
+		if count < len(buffer) {
+			buffer = buffer[:count]
+			break
+		}
+		buffer = make([]byte, 2*len(buffer))
+	}
+	for _, stack := range bytes.Split(buffer, []byte("\n\n")) {
+		fields := strings.Fields(string(stack))
+		if len(fields) >= 2 && fields[0] == "goroutine" {
+			snapshot.stacks[fields[1]] = string(stack)
+		}
+	}
+	return snapshot
+}
+
+// Leak_ignored returns whether the goroutine with `stack` is one of those
+// in kv_leak_check_ignored.
+func leak_ignored(stack string) bool {
+	for _, function := range kv_leak_check_ignored {
+		if strings.Contains(stack, "\n"+function+"(") {
+			return true
+		}
+	}
+	return false
+}
+
+// Goroutine_summary returns the header of `stack` and the function on top
+// of it, e.g., "goroutine 42 [IO wait]: net.(*conn).Read".
+func goroutine_summary(stack string) string {
+	lines := strings.SplitN(stack, "\n", 3)
+	if len(lines) < 2 {
+		return lines[0]
+	}
+	function := lines[1]
+	if index := strings.LastIndex(function, "("); index > 0 {
+		function = function[:index]
+	}
+	return lines[0] + " " + function
+}
+
+// Leaks returns the description of the goroutines running now that were
+// not running at the time of the `before` snapshot.
+func (before *goroutines_t) leaks() []string {
+	after := goroutines_snapshot()
+	leaks := []string{}
+	kv_sessions_mutex.Lock()
+	if count := len(kv_sessions); count > 0 {
+		leaks = append(leaks, strconv.Itoa(count)+" live sessions")
+	}
+	kv_sessions_mutex.Unlock()
+	for subsystem, count := range after.tracked {
+		if count > before.tracked[subsystem] {
+			leaks = append(leaks, strconv.Itoa(count-
+				before.tracked[subsystem])+" "+subsystem+" goroutines")
+		}
+	}
+	for id, stack := range after.stacks {
+		if _, found := before.stacks[id]; !found && !leak_ignored(stack) {
+			leaks = append(leaks, goroutine_summary(stack))
+		}
+	}
+	sort.Strings(leaks)
+	return leaks
+}
+
+// Check_leaks waits until the goroutines started after the `before`
+// snapshot terminate and returns an error describing those which did
+// not terminate within kv_leak_check_timeout.
+func (before *goroutines_t) check_leaks() error {
+	deadline := time.Now().Add(kv_leak_check_timeout)
+	for {
+		leaks := before.leaks()
+		if len(leaks) == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return errors.New("ndt: leaked " + strings.Join(leaks, "; "))
+		}
+		time.Sleep(kv_leak_check_interval)
+	}
+}
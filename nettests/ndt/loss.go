@@ -0,0 +1,90 @@
+package ndt
+
+// Retransmissions and losses, computed from the difference between the
+// TCP_INFO of each stream at the beginning and at the end of a test, and
+// reported along with the throughput, which cannot be interpreted without
+// them (see results.Losses).
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/neubot/botticelli/common/results"
+	"github.com/neubot/botticelli/common/tcpinfo"
+)
+
+// Accumulates the retransmissions and losses over all the streams of a
+// test, according to the kernel.
+type loss_counter_t struct {
+	segments_out  int64
+	segments_in   int64
+	retransmits   int64
+	out_of_order  int64
+	bytes_sent    int64
+	bytes_retrans int64
+}
+
+// Add accumulates the difference between `before` and `after`, which
+// are the TCP_INFO of the same stream. Subtracting unsigned counters
+// gives the right difference even if they wrapped around.
+func (losses *loss_counter_t) add(before *tcpinfo.TCPInfo,
+	after *tcpinfo.TCPInfo) {
+	atomic.AddInt64(&losses.segments_out, int64(after.SegsOut-before.SegsOut))
+	atomic.AddInt64(&losses.segments_in, int64(after.SegsIn-before.SegsIn))
+	atomic.AddInt64(&losses.retransmits,
+		int64(after.TotalRetrans-before.TotalRetrans))
+	atomic.AddInt64(&losses.out_of_order,
+		int64(after.RcvOooPack-before.RcvOooPack))
+	atomic.AddInt64(&losses.bytes_sent,
+		int64(after.BytesSent-before.BytesSent))
+	atomic.AddInt64(&losses.bytes_retrans,
+		int64(after.BytesRetrans-before.BytesRetrans))
+}
+
+// Set_losses records the retransmissions and losses in `losses`. Kernels
+// not tracking the bytes sent and retransmitted (e.g., Linux before 4.19)
+// still count segments, from which we estimate the loss rate.
+func (test *test_result_t) set_losses(losses *loss_counter_t) {
+	test.Losses = &results.Losses{
+		SegmentsOut: atomic.LoadInt64(&losses.segments_out),
+		SegmentsIn:  atomic.LoadInt64(&losses.segments_in),
+		Retransmits: atomic.LoadInt64(&losses.retransmits),
+		OutOfOrder:  atomic.LoadInt64(&losses.out_of_order),
+	}
+	if test.Direction == results.Upload {
+		return
+	}
+	rate := 0.0
+	if sent := atomic.LoadInt64(&losses.bytes_sent); sent > 0 {
+		rate = float64(atomic.LoadInt64(&losses.bytes_retrans)) /
+			float64(sent)
+	} else if test.Losses.SegmentsOut > 0 {
+		rate = float64(test.Losses.Retransmits) /
+			float64(test.Losses.SegmentsOut)
+	} else {
+		return
+	}
+	test.Losses.LossRate = &rate
+}
+
+// Loss_variables formats the retransmissions and losses of `test`, if we
+// know them, as `name: value` lines, like the web100 variables.
+func loss_variables(test *results.Measurement) string {
+	losses := test.Losses
+	if losses == nil {
+		return ""
+	}
+	if test.Direction == results.Upload {
+		return fmt.Sprintf("%s_segments_in: %d\n%s_out_of_order: %d\n",
+			test.Name, losses.SegmentsIn, test.Name, losses.OutOfOrder)
+	}
+	variables := fmt.Sprintf("%s_segments_out: %d\n", test.Name,
+		losses.SegmentsOut)
+	variables += fmt.Sprintf("%s_retransmits: %d\n", test.Name,
+		losses.Retransmits)
+	if losses.LossRate != nil {
+		variables += fmt.Sprintf("%s_loss_rate: %f\n", test.Name,
+			*losses.LossRate)
+	}
+	return variables
+}
@@ -0,0 +1,119 @@
+package ndt
+
+// Memory budget for the buffers of the running tests. Each test allocates
+// payload and message buffers, i.e. the sink buffers of the uploads and, in
+// ndt7 downloads, messages that grow up to kv_ndt7_max_message_size. We
+// reserve the worst case when admitting a session and release it when the
+// session ends, refusing the sessions that would exceed the budget, such
+// that a flood of connections cannot drive the server out of memory.
+// Queued sessions only hold the buffers of their control connection, which
+// we do not reserve, since the length of the queue bounds them.
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/neubot/botticelli/common"
+	"github.com/neubot/botticelli/common/metrics"
+	"github.com/neubot/botticelli/common/results"
+)
+
+// MaxClients is the number of concurrent sessions the memory budget is
+// sized for, when MemoryBudget is zero.
+var MaxClients = 64
+
+// MemoryBudget is the maximum number of bytes that the buffers of the
+// running sessions may use. Zero means MaxClients times kv_memory_chunk.
+var MemoryBudget int64 = 0
+
+// The largest amount of memory a single stream may use, i.e. a ndt7 message
+// of the maximum size plus the frame gorilla/websocket prepares from it.
+const kv_memory_chunk = 2 * kv_ndt7_max_message_size
+
+// The size of the buffers of bufio.NewReader and bufio.NewWriter.
+const kv_bufio_size = 4096
+
+var kv_memory_mutex sync.Mutex
+var kv_memory_reserved int64
+
+var kv_memory_refused = metrics.NewCounterVec("ndt_memory_refused_total",
+	"Sessions refused because their buffers would exceed the memory budget.",
+	"protocol")
+
+func init() {
+	metrics.NewGaugeFunc("ndt_memory_reserved_bytes",
+		"Memory reserved for the buffers of the running sessions.",
+		func() float64 {
+			kv_memory_mutex.Lock()
+			defer kv_memory_mutex.Unlock()
+			return float64(kv_memory_reserved)
+		})
+}
+
+// LoadMemoryBudget validates MaxClients and MemoryBudget, and derives the
+// latter from the former if needed.
+func LoadMemoryBudget() error {
+	if MaxClients <= 0 {
+		return errors.New("ndt: max clients must be positive")
+	}
+	if MemoryBudget < 0 {
+		return errors.New("ndt: memory budget must not be negative")
+	}
+	if MemoryBudget == 0 {
+		MemoryBudget = int64(MaxClients) * kv_memory_chunk
+	}
+	if MemoryBudget < kv_memory_chunk {
+		return errors.New("ndt: memory budget cannot fit a single session")
+	}
+	return nil
+}
+
+// Ndt5_memory returns the memory that a ndt5 session, running its tests
+// with `policy`, needs in the worst case, i.e. the buffered reader and
+// writer of the control connection plus, for each stream, the C2S sink
+// buffer and the S2C payload, batch and buffered writer, which may all be
+// alive at once, since the collector may not reclaim the C2S buffers
+// before the S2C test starts.
+func ndt5_memory(policy *policy_t) int64 {
+	streams := 1
+	if policy.streams > streams {
+		streams = policy.streams
+	}
+	s2c := int64(buflen + SendBatch*buflen + kv_bufio_size)
+	return 2*kv_bufio_size + int64(streams)*(kv_sink_buffer_size+s2c)
+}
+
+// Ndt7_memory returns the memory that a ndt7 `test` needs in the worst
+// case.
+func ndt7_memory(test string) int64 {
+	switch test {
+	case results.Upload:
+		return kv_ndt7_max_read_size + kv_sink_buffer_size
+	case kv_ndt7_duplex:
+		return kv_memory_chunk + kv_ndt7_max_read_size + kv_sink_buffer_size
+	}
+	return kv_memory_chunk
+}
+
+// Memory_reserve reserves `size` bytes of the budget for a session of
+// `protocol`. It returns the function releasing them, or nil if the budget
+// would be exceeded.
+func memory_reserve(protocol string, size int64) func() {
+	kv_memory_mutex.Lock()
+	defer kv_memory_mutex.Unlock()
+	if MemoryBudget > 0 && kv_memory_reserved+size > MemoryBudget {
+		common.Infof("ndt: cannot reserve %d bytes: %d of %d in use",
+			size, kv_memory_reserved, MemoryBudget)
+		kv_memory_refused.Inc(protocol)
+		return nil
+	}
+	kv_memory_reserved += size
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			kv_memory_mutex.Lock()
+			kv_memory_reserved -= size
+			kv_memory_mutex.Unlock()
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package ndt
+
+import (
+	"net"
+
+	"github.com/neubot/botticelli/common/metrics"
+	"github.com/neubot/botticelli/common/results"
+)
+
+var kv_tests_total = metrics.NewCounterVec("ndt_tests_total",
+	"Number of NDT tests run.", "test", "tenant")
+
+var kv_throughput_kbits = metrics.NewHistogramVec("ndt_throughput_kbits",
+	"Throughput measured by the server during NDT tests, in kbit/s.",
+	metrics.ExponentialBuckets(100, 3, 12),
+	"direction", "family", "transport", "tenant")
+
+var kv_loss_rate = metrics.NewHistogramVec("ndt_loss_rate",
+	"Fraction of the data retransmitted during NDT downloads.",
+	[]float64{0.0001, 0.0003, 0.001, 0.003, 0.01, 0.03, 0.1, 0.3},
+	"family", "transport", "tenant")
+
+var kv_bloat_ratio = metrics.NewHistogramVec("ndt_bloat_ratio",
+	"RTT under load divided by the baseline RTT during NDT tests.",
+	metrics.ExponentialBuckets(1, 2, 10),
+	"direction", "family", "transport", "tenant")
+
+var kv_setup_seconds = metrics.NewHistogramVec("ndt_setup_seconds",
+	"Time spent setting up NDT sessions: until login, waiting in the "+
+		"queue, and setting up each test.",
+	metrics.ExponentialBuckets(0.005, 2, 14), "stage")
+
+// Ip_family returns "ipv4" or "ipv6" depending on `ip`.
+func ip_family(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed != nil && parsed.To4() == nil {
+		return "ipv6"
+	}
+	return "ipv4"
+}
+
+// Observe_test updates the metrics with the results of `test`.
+func observe_test(cc net.Conn, test *test_result_t) {
+	direction := "s2c"
+	if test.Direction == results.Upload {
+		direction = "c2s"
+	}
+	kv_tests_total.Inc(test.Name, test.tenant)
+	kv_throughput_kbits.Observe(test.SpeedKbits, direction,
+		ip_family(client_ip(cc)), test.transport, test.tenant)
+	if test.BloatRatio > 0 {
+		kv_bloat_ratio.Observe(test.BloatRatio, direction,
+			ip_family(client_ip(cc)), test.transport, test.tenant)
+	}
+	if test.Losses != nil && test.Losses.LossRate != nil {
+		kv_loss_rate.Observe(*test.Losses.LossRate,
+			ip_family(client_ip(cc)), test.transport, test.tenant)
+	}
+}
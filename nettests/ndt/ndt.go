@@ -2,18 +2,23 @@ package ndt
 
 import (
 	"bufio"
+	"context"
 	"encoding/binary"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net"
 	"strconv"
-	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/neubot/bernini"
 	"github.com/neubot/botticelli/common"
+	"github.com/neubot/botticelli/common/hostload"
+	"github.com/neubot/botticelli/common/results"
+	"github.com/neubot/botticelli/common/tcpinfo"
 )
 
 const kv_comm_failure byte = 0
@@ -45,8 +50,23 @@ const kv_srv_queue_server_busy_60s string = "9999"
 
 const kv_parallel_streams int = 3
 
+const kv_test_duration = 10.0 * time.Second
+const kv_meta_duration = 5.0 * time.Second
+const kv_session_overhead = 30.0 * time.Second
+
 const buflen = 8192
 
+// The login banner advertises the protocol version and the product. Both
+// may be overridden to identify deployments or to test how clients react
+// to different banners.
+var ProtocolVersion = "v3.7.0"
+var Product = common.Product
+
+// Banner returns the server version string sent to clients at login.
+func banner() string {
+	return ProtocolVersion + " (" + Product + ")"
+}
+
 /*
  __  __
 |  \/  | ___  ___ ___  __ _  __ _  ___  ___
@@ -58,37 +78,74 @@ const buflen = 8192
 	Message serialization and deserialization.
 */
 
+// Control messages must be received at a minimum rate, such that a
+// client trickling bytes cannot hold a session slot. The header (type
+// and length) must arrive within kv_control_header_timeout, and then
+// we allow the body kv_control_min_rate bytes per second on top of that.
+const kv_control_header_timeout = 10.0 * time.Second
+const kv_control_min_rate = 1024
+
+func read_full_before(cc net.Conn, reader io.Reader, data []byte,
+	deadline time.Time) error {
+	err := cc.SetReadDeadline(deadline)
+	if err != nil {
+		return err
+	}
+	_, err = io.ReadFull(reader, data)
+	if err != nil {
+		return err
+	}
+	return cc.SetReadDeadline(time.Time{})
+}
+
+// Returned when no message at all arrives within the header timeout, which
+// is different from a message arriving too slowly.
+var kv_error_message_timeout = errors.New("ndt: timed out waiting for message")
+
 func read_message_internal(cc net.Conn, reader io.Reader) (
 	byte, []byte, error) {
+	return read_message_within(cc, reader, kv_control_header_timeout)
+}
+
+func read_message_within(cc net.Conn, reader io.Reader,
+	header_timeout time.Duration) (byte, []byte, error) {
+
+	deadline := time.Now().Add(header_timeout)
 
 	// 1. read type
 
 	type_buff := make([]byte, 1)
-	_, err := bernini.IoReadFull(cc, reader, type_buff)
+	err := read_full_before(cc, reader, type_buff, deadline)
 	if err != nil {
+		var net_error net.Error
+		if errors.As(err, &net_error) && net_error.Timeout() {
+			cc.SetReadDeadline(time.Time{})
+			err = kv_error_message_timeout
+		}
 		return 0, nil, err
 	}
 	msg_type := type_buff[0]
-	log.Printf("ndt: message type: %d", msg_type)
 
 	// 2. read length
 
 	len_buff := make([]byte, 2)
-	_, err = bernini.IoReadFull(cc, reader, len_buff)
+	err = read_full_before(cc, reader, len_buff, deadline)
 	if err != nil {
 		return 0, nil, err
 	}
 	msg_length := binary.BigEndian.Uint16(len_buff)
-	log.Printf("ndt: message length: %d", msg_length)
 
 	// 3. read body
 
+	deadline = deadline.Add(time.Duration(msg_length) * time.Second /
+		kv_control_min_rate)
 	msg_body := make([]byte, msg_length)
-	_, err = bernini.IoReadFull(cc, reader, msg_body)
+	err = read_full_before(cc, reader, msg_body, deadline)
 	if err != nil {
 		return 0, nil, err
 	}
-	log.Printf("ndt: message body: '%s'\n", msg_body)
+	common.Tracef("ndt: read", "ndt: read message: type=%d length=%d "+
+		"body='%s'", msg_type, msg_length, msg_body)
 
 	return msg_type, msg_body, nil
 }
@@ -99,7 +156,14 @@ type standard_message_t struct {
 
 func read_standard_message(cc net.Conn, reader io.Reader) (
 	byte, string, error) {
-	msg_type, msg_buff, err := read_message_internal(cc, reader)
+	return read_standard_message_within(cc, reader,
+		kv_control_header_timeout)
+}
+
+func read_standard_message_within(cc net.Conn, reader io.Reader,
+	header_timeout time.Duration) (byte, string, error) {
+	msg_type, msg_buff, err := read_message_within(cc, reader,
+		header_timeout)
 	if err != nil {
 		return 0, "", err
 	}
@@ -109,7 +173,7 @@ func read_standard_message(cc net.Conn, reader io.Reader) (
 		return 0, "", err
 	}
 	if s_msg == nil {
-		return 0, "", errors.New("ndt: received literal 'null'")
+		return 0, "", protocol_error_t("ndt: received literal 'null'")
 	}
 	return msg_type, s_msg.Msg, nil
 }
@@ -117,9 +181,8 @@ func read_standard_message(cc net.Conn, reader io.Reader) (
 func write_message_internal(cc net.Conn, writer *bufio.Writer,
 	message_type byte, encoded_body []byte) error {
 
-	log.Printf("ndt: write any message: type=%d\n", message_type)
-	log.Printf("ndt: write any message: length=%d\n", len(encoded_body))
-	log.Printf("ndt: write any message: body='%s'\n", string(encoded_body))
+	common.Tracef("ndt: write", "ndt: write message: type=%d length=%d "+
+		"body='%s'", message_type, len(encoded_body), encoded_body)
 
 	// 1. write type
 
@@ -131,7 +194,7 @@ func write_message_internal(cc net.Conn, writer *bufio.Writer,
 	// 2. write length
 
 	if len(encoded_body) > 65535 {
-		return errors.New("ndt: encoded_body is too long")
+		return protocol_error_t("ndt: encoded_body is too long")
 	}
 	encoded_len := make([]byte, 2)
 	binary.BigEndian.PutUint16(encoded_len, uint16(len(encoded_body)))
@@ -155,8 +218,6 @@ func write_standard_message(cc net.Conn, writer *bufio.Writer,
 	s_msg := &standard_message_t{
 		Msg: message_body,
 	}
-	log.Printf("ndt: sending standard message: type=%d", message_type)
-	log.Printf("ndt: sending standard message: body='%s'", message_body)
 	data, err := json.Marshal(s_msg)
 	if err != nil {
 		return err
@@ -165,9 +226,10 @@ func write_standard_message(cc net.Conn, writer *bufio.Writer,
 }
 
 type extended_login_message_t struct {
-	Msg      string `json:"msg"`
-	TestsStr string `json:"tests"`
-	Tests    int
+	Msg         string `json:"msg"`
+	TestsStr    string `json:"tests"`
+	AccessToken string `json:"access_token"`
+	Tests       int
 }
 
 func read_extended_login(cc net.Conn, reader io.Reader) (
@@ -180,7 +242,7 @@ func read_extended_login(cc net.Conn, reader io.Reader) (
 		return nil, err
 	}
 	if msg_type != kv_msg_extended_login {
-		return nil, errors.New("ndt: received invalid message")
+		return nil, protocol_error_t("ndt: received invalid message")
 	}
 
 	// Process input as JSON message and validate its fields
@@ -191,24 +253,30 @@ func read_extended_login(cc net.Conn, reader io.Reader) (
 		return nil, err
 	}
 	if el_msg == nil {
-		return nil, errors.New("ndt: received literal 'null'")
+		return nil, protocol_error_t("ndt: received literal 'null'")
 	}
-	log.Printf("ndt: client version: %s", el_msg.Msg)
-	log.Printf("ndt: test suite: %s", el_msg.TestsStr)
+	common.Infof("ndt: client version: %s", el_msg.Msg)
+	common.Infof("ndt: test suite: %s", el_msg.TestsStr)
 	el_msg.Tests, err = strconv.Atoi(el_msg.TestsStr)
 	if err != nil {
 		return nil, err
 	}
-	log.Printf("ndt: test suite as int: %d", el_msg.Tests)
+	common.Infof("ndt: test suite as int: %d", el_msg.Tests)
 	if (el_msg.Tests & kv_test_status) == 0 {
-		return nil, errors.New("ndt: client does not support TEST_STATUS")
+		return nil, protocol_error_t("ndt: client does not support TEST_STATUS")
+	}
+	if el_msg.Tests < 0 || el_msg.Tests > 0xff {
+		err = deviation("unknown_tests")
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	return el_msg, nil
 }
 
 func write_raw_string(cc net.Conn, writer *bufio.Writer, str string) error {
-	log.Printf("ndt: write raw string: '%s'", str)
+	common.Tracef("ndt: write", "ndt: write raw string: '%s'", str)
 	_, err := bernini.IoWriteString(cc, writer, str)
 	if err != nil {
 		return err
@@ -220,17 +288,21 @@ func write_raw_string(cc net.Conn, writer *bufio.Writer, str string) error {
 // the client.
 // TODO: choose a random port instead than an hardcoded port
 func init_throughput_test(cc net.Conn, writer *bufio.Writer,
-	is_extended bool) (net.Listener, error) {
-	listener, err := net.Listen("tcp", ":3017")
+	is_extended bool, result *test_result_t) (net.Listener, error) {
+	listener, err := listen_data(result.transport,
+		common.PinnedAddress(cc, "3017"))
 	if err != nil {
 		return nil, err
 	}
 
 	msg := "3017"
 	if is_extended {
-		msg += " 10000.0 1 500.0 0.0 "
-		msg += strconv.Itoa(kv_parallel_streams)
+		msg += " " + strconv.FormatFloat(float64(
+			result.policy.duration/time.Millisecond), 'f', 1, 64)
+		msg += " 1 500.0 0.0 "
+		msg += strconv.Itoa(result.policy.streams)
 	}
+	result.session.mark(results.EventTestPrepare, result.Name)
 	err = write_standard_message(cc, writer, kv_test_prepare, msg)
 	if err != nil {
 		return nil, err
@@ -239,6 +311,53 @@ func init_throughput_test(cc net.Conn, writer *bufio.Writer,
 	return listener, nil
 }
 
+// All data connections must be established within this time, otherwise
+// the test fails (e.g. because a firewall blocks the test port).
+const kv_accept_timeout = 15.0 * time.Second
+
+var kv_error_accept_timeout = errors.New(
+	"ndt: timed out waiting for the data connection(s)")
+
+// Accept_data_conns accepts `nstreams` data connections from `listener`,
+// wrapped with common.CountingConn. On failure, the connections accepted
+// so far are closed.
+func accept_data_conns(listener net.Listener, nstreams int) (
+	[]net.Conn, error) {
+	deadliner, ok := listener.(interface {
+		SetDeadline(time.Time) error
+	})
+	if ok {
+		err := deadliner.SetDeadline(time.Now().Add(kv_accept_timeout))
+		if err != nil {
+			return nil, err
+		}
+	}
+	conns := []net.Conn{}
+	for len(conns) < nstreams {
+		conn, err := listener.Accept()
+		if err != nil {
+			close_data_conns(conns)
+			var net_error net.Error
+			if errors.As(err, &net_error) && net_error.Timeout() {
+				err = kv_error_accept_timeout
+			}
+			return nil, err
+		}
+		conns = append(conns, common.NewCountingConn(conn))
+		kv_active_data_conns.Add(1)
+	}
+	return conns, nil
+}
+
+// Close_data_conns closes data connections that were accepted but that
+// are not going to be served by a stream goroutine.
+func close_data_conns(conns []net.Conn) {
+	for _, conn := range conns {
+		conn.Close()
+		kv_active_data_conns.Add(-1)
+	}
+}
+
 /*
  ____ ____   ____
 / ___|___ \ / ___|
@@ -248,16 +367,42 @@ func init_throughput_test(cc net.Conn, writer *bufio.Writer,
 
 */
 
+// Time we wait for the client to send us the speed it measured.
+const kv_client_speed_timeout = 5.0 * time.Second
+
 type s2c_message_t struct {
 	ThroughputValue  string
 	UnsentDataAmount string
 	TotalSentByte    string
 }
 
+// Read_client_message reads a message that the client of the session
+// `result` sends during a test, within `timeout`. If the speed measured by
+// the client in a previous S2C test did not arrive in time, it may still
+// arrive, before anything else, hence we discard it, rather than mistaking
+// it for the message we are waiting for.
+func read_client_message(cc net.Conn, reader *bufio.Reader,
+	result *result_t, timeout time.Duration) (byte, string, error) {
+	for {
+		msg_type, msg_body, err := read_standard_message_within(cc,
+			reader, timeout)
+		if err != nil || result.late_speeds <= 0 {
+			return msg_type, msg_body, err
+		}
+		_, parse_err := strconv.ParseFloat(msg_body, 64)
+		if msg_type != kv_test_msg || parse_err != nil {
+			result.late_speeds = 0 // they will never arrive
+			return msg_type, msg_body, nil
+		}
+		common.Infof("ndt: discarding late client speed: %s", msg_body)
+		result.late_speeds -= 1
+	}
+}
+
 func run_s2c_test(cc net.Conn, reader *bufio.Reader, writer *bufio.Writer,
-	is_extended bool) error {
+	is_extended bool, result *test_result_t) error {
 
-	listener, err := init_throughput_test(cc, writer, is_extended)
+	listener, err := init_throughput_test(cc, writer, is_extended, result)
 	if err != nil {
 		return err
 	}
@@ -268,88 +413,112 @@ func run_s2c_test(cc net.Conn, reader *bufio.Reader, writer *bufio.Writer,
 
 	nstreams := 1
 	if is_extended {
-		nstreams = kv_parallel_streams
+		nstreams = result.policy.streams
 	}
+	result.NumStreams = nstreams
 
-	conns := make([]net.Conn, nstreams)
-	for idx := 0; idx < len(conns); idx += 1 {
-		conn, err := bernini.IoAccept(listener)
-		if err != nil {
-			return err
-		}
-		conns[idx] = conn
+	conns, err := accept_data_conns(listener, nstreams)
+	if err != nil {
+		return err
 	}
+	result.session.add_data_conns(conns)
+	defer result.session.start_capture(result.Name, conns)()
 
 	// Send empty TEST_START message to tell the client to start
 
+	result.session.mark(results.EventTestStart, result.Name)
 	err = write_standard_message(cc, writer, kv_test_start, "")
 	if err != nil {
+		close_data_conns(conns)
 		return err
 	}
 
 	// Run the N streams in parallel
 
-	channel := make(chan int)
+	done := make(chan bool)
 
-	output_buff := bernini.RandAsciiRemainder(buflen)
 	start := time.Now()
+	var unsent int64
+	kernel := &kernel_counter_t{}
+	infos := make(chan *tcpinfo.TCPInfo, 1)
+
+	// If any stream fails, we close all the connections such that the
+	// other streams stop as well
+
+	group := new_group()
+	group.close_on_failure(conns...)
 
 	for idx := 0; idx < len(conns); idx += 1 {
-		log.Printf("ndt: start stream with id %d\n", idx)
+		common.Infof("ndt: start stream with id %d", idx)
 
 		// Note: rather than creating and destroying the goroutine
 		// always it would be more considerate to just have a few
 		// already active goroutines to which to dispatch the message
 		// that there is a specific connection to be served
 
-		go func(conn net.Conn) {
+		conn := conns[idx]
+		first := idx == 0
+		group.spawn("stream", func(ctx context.Context) error {
+			defer kv_active_data_conns.Add(-1)
 			// Send the buffer to the client for about ten seconds
-			// TODO: here we should take `web100` snapshots
 
 			conn_writer := bufio.NewWriter(conn)
 			defer conn.Close()
+			payload := new_payload(Payload, buflen)
+			stop_kernel := kernel.measure(conn, results.Download)
 
-			for {
-				_, err = bernini.IoWrite(conn, conn_writer, output_buff)
-				if err != nil {
-					log.Println("ndt: failed to write to client")
-					break
+			err := sender_loop(ctx, func() error {
+				if SendBatch > 1 {
+					return write_batch(conn, payload.batch(SendBatch))
 				}
-				err = bernini.IoFlush(conn, conn_writer)
+				_, err := bernini.IoWrite(conn, conn_writer,
+					payload.next())
 				if err != nil {
-					log.Println("ndt: cannot flush connection with client")
-					break
+					return err
 				}
-				channel <- len(output_buff)
-				if time.Since(start).Seconds() > 10.0 {
-					log.Println("ndt: enough time elapsed")
-					break
+				return bernini.IoFlush(conn, conn_writer)
+			}, start, result.policy.duration)
+
+			// Sample what is still queued, which legacy clients use to
+			// correct their throughput estimate, before waiting for it
+			// to drain
+			outq, outq_err := tcpinfo.Outq(conn)
+			if outq_err == nil {
+				atomic.AddInt64(&unsent, int64(outq))
+			}
+			stop_kernel()
+			if first {
+				info, info_err := tcpinfo.Get(conn)
+				if info_err == nil {
+					infos <- info
 				}
 			}
 
-			conn.Close()  // Explicit to notify the client we're done
-			channel <- -1 // Tell the controller we're done
-		}(conns[idx])
+			conn.Close() // Explicit to notify the client we're done
+			done <- true // Tell the controller we're done
+			return err
+		})
 	}
 
-	bytes_sent := 0
-	for num_complete := 0; num_complete < len(conns); {
-		count := <-channel
-		if count < 0 {
-			log.Printf("ndt: a stream just terminated...")
-			num_complete += 1
-			continue
-		}
-		bytes_sent += count
+	bytes_sent := collect_streams(done, conns, start, result,
+		data_counter(conns, results.Download))
+	elapsed := kernel.elapsed(start) // without the drain
+	err = group.wait()
+	if err != nil {
+		return err
 	}
-	elapsed := time.Since(start)
 
 	// Send message containing what we measured
 
 	speed_kbits := (8.0 * float64(bytes_sent)) / 1000.0 / elapsed.Seconds()
+	result.Bytes = bytes_sent
+	result.Elapsed = elapsed.Seconds()
+	result.SpeedKbits = speed_kbits
+	result.set_kernel_rate(kernel, elapsed)
+	result.set_bufferbloat()
 	message := &s2c_message_t{
 		ThroughputValue:  strconv.FormatFloat(speed_kbits, 'f', -1, 64),
-		UnsentDataAmount: "0", // XXX
+		UnsentDataAmount: strconv.FormatInt(atomic.LoadInt64(&unsent), 10),
 		TotalSentByte:    strconv.Itoa(bytes_sent),
 	}
 	data, err := json.Marshal(message)
@@ -361,26 +530,61 @@ func run_s2c_test(cc net.Conn, reader *bufio.Reader, writer *bufio.Writer,
 		return err
 	}
 
-	// Receive message from client containing its measured speed
+	// Receive message from client containing its measured speed. If the
+	// client does not send it in time, we finalize the test anyway, and
+	// discard the speed if it arrives later.
 
-	msg_type, msg_body, err := read_standard_message(cc, reader)
-	if err != nil {
+	msg_type, msg_body, err := read_client_message(cc, reader,
+		result.session, kv_client_speed_timeout)
+	if err == kv_error_message_timeout {
+		common.Infof("ndt: client speed unknown")
+		result.ClientSpeedUnknown = true
+		result.session.late_speeds += 1
+		err = deviation("missing_client_speed")
+		if err != nil {
+			return err
+		}
+	} else if err != nil {
 		return err
+	} else if msg_type != kv_test_msg {
+		return protocol_error_t("ndt: received unexpected message from client")
+	} else {
+		common.Infof("ndt: client measured speed: %s", msg_body)
+		result.ClientSpeed = msg_body
+		client_speed, parse_err := strconv.ParseFloat(msg_body, 64)
+		if parse_err != nil {
+			err = deviation("invalid_client_speed")
+			if err != nil {
+				return err
+			}
+		} else {
+			result.compare_client_speed(client_speed)
+		}
 	}
-	if msg_type != kv_test_msg {
-		return errors.New("ndt: received unexpected message from client")
-	}
-	log.Printf("ndt: client measured speed: %s", msg_body)
 
-	// FIXME: here we should send the web100 variables
+	// Send the web100 variables, which only web100clt expects here
+
+	select {
+	case info := <-infos:
+		result.web100 = filter_variables(web100_variables(info, elapsed))
+	default:
+	}
+	if Web100cltQuirks && result.web100 != "" {
+		err = write_standard_message(cc, writer, kv_test_msg, result.web100)
+		if err != nil {
+			return err
+		}
+	}
 
 	// Send the TEST_FINALIZE message that concludes the test
 
+	result.session.mark(results.EventTestFinalize, result.Name)
 	return write_standard_message(cc, writer, kv_test_finalize, "")
 }
 
-func run_c2s_test(cc net.Conn, reader *bufio.Reader, writer *bufio.Writer, is_extended bool) error {
-	listener, err := init_throughput_test(cc, writer, is_extended)
+func run_c2s_test(cc net.Conn, reader *bufio.Reader, writer *bufio.Writer,
+	is_extended bool, result *test_result_t) error {
+	listener, err := init_throughput_test(cc, writer, is_extended, result)
 	if err != nil {
 		return err
 	}
@@ -391,79 +595,93 @@ func run_c2s_test(cc net.Conn, reader *bufio.Reader, writer *bufio.Writer, is_ex
 
 	nstreams := 1
 	if is_extended {
-		nstreams = kv_parallel_streams
+		nstreams = result.policy.streams
 	}
+	result.NumStreams = nstreams
 
-	conns := make([]net.Conn, nstreams)
-	for idx := 0; idx < len(conns); idx += 1 {
-		conn, err := bernini.IoAccept(listener)
-		if err != nil {
-			return err
-		}
-		conns[idx] = conn
+	conns, err := accept_data_conns(listener, nstreams)
+	if err != nil {
+		return err
 	}
+	result.session.add_data_conns(conns)
+	defer result.session.start_capture(result.Name, conns)()
 
 	// Send empty TEST_START message to tell the client to start
 
+	// Without kernel statistics, the time until the first data arrives
+	// estimates the idle RTT
+	result.session.mark(results.EventTestStart, result.Name)
+	started := time.Now()
 	err = write_standard_message(cc, writer, kv_test_start, "")
 	if err != nil {
+		close_data_conns(conns)
 		return err
 	}
 
 	// Run the N streams in parallel
 
-	channel := make(chan int)
+	done := make(chan bool)
 
-	input_buff := make([]byte, buflen)
 	start := time.Now()
+	kernel := &kernel_counter_t{}
+	var first_read int64
+
+	// If any stream fails, we close all the connections such that the
+	// other streams stop as well
+
+	group := new_group()
+	group.close_on_failure(conns...)
 
 	for idx := 0; idx < len(conns); idx += 1 {
-		log.Printf("ndt: start stream with id %d\n", idx)
+		common.Infof("ndt: start stream with id %d", idx)
 
 		// Note: rather than creating and destroying the goroutine
 		// always it would be more considerate to just have a few
 		// already active goroutines to which to dispatch the message
 		// that there is a specific connection to be served
 
-		go func(conn net.Conn) {
-			// Send the buffer to the client for about ten seconds
+		conn := conns[idx]
+		group.spawn("stream", func(ctx context.Context) error {
+			defer kv_active_data_conns.Add(-1)
+			// Receive from the client for about ten seconds
 			// TODO: here we should take `web100` snapshots
-			conn_reader := bufio.NewReader(conn)
 			defer conn.Close()
-
-			for {
-				_, err = bernini.IoReadFull(conn, conn_reader, input_buff)
-				if err != nil {
-					log.Println("ndt: failed to read from client")
-					break
-				}
-				channel <- int(len(input_buff))
-				if time.Since(start).Seconds() > 10.0 {
-					log.Println("ndt: enough time elapsed")
-					break
-				}
+			stop_kernel := kernel.measure(conn, results.Upload)
+
+			err := sink(conn, start.Add(result.policy.duration), func() {
+				atomic.CompareAndSwapInt64(&first_read, 0,
+					time.Now().UnixNano())
+			})
+			if err != nil {
+				log.Println("ndt: failed to read from client")
 			}
+			stop_kernel()
 
-			conn.Close()  // Explicit to notify the client we're done
-			channel <- -1 // Tell the controller we're done
-		}(conns[idx])
+			conn.Close() // Explicit to notify the client we're done
+			done <- true // Tell the controller we're done
+			return err
+		})
 	}
 
-	bytes_received := 0
-	for num_complete := 0; num_complete < len(conns); {
-		count := <-channel
-		if count < 0 {
-			log.Printf("ndt: a stream just terminated...")
-			num_complete += 1
-			continue
-		}
-		bytes_received += count
-	}
+	bytes_received := collect_streams(done, conns, start, result,
+		data_counter(conns, results.Upload))
 	elapsed := time.Since(start)
+	if when := atomic.LoadInt64(&first_read); when > 0 {
+		result.session.set_idle_rtt(time.Unix(0, when).Sub(started))
+	}
+	err = group.wait()
+	if err != nil {
+		return err
+	}
 
 	// Send message containing what we measured
 
 	speed_kbits := (8.0 * float64(bytes_received)) / 1000.0 / elapsed.Seconds()
+	result.Bytes = bytes_received
+	result.Elapsed = elapsed.Seconds()
+	result.SpeedKbits = speed_kbits
+	result.set_kernel_rate(kernel, elapsed)
+	result.set_bufferbloat()
 	message := strconv.FormatFloat(speed_kbits, 'f', -1, 64)
 	err = write_standard_message(cc, writer, kv_test_msg, message)
 	if err != nil {
@@ -472,6 +690,7 @@ func run_c2s_test(cc net.Conn, reader *bufio.Reader, writer *bufio.Writer, is_ex
 
 	// Send the TEST_FINALIZE message that concludes the test
 
+	result.session.mark(results.EventTestFinalize, result.Name)
 	return write_standard_message(cc, writer, kv_test_finalize, "")
 
 }
@@ -486,37 +705,49 @@ func run_c2s_test(cc net.Conn, reader *bufio.Reader, writer *bufio.Writer, is_ex
 */
 
 func run_meta_test(cc net.Conn, reader *bufio.Reader,
-	writer *bufio.Writer) error {
+	writer *bufio.Writer, result *result_t) error {
 
 	// Send empty TEST_PREPARE and TEST_START messages to the client
 
+	result.mark(results.EventTestPrepare, "meta")
 	err := write_standard_message(cc, writer, kv_test_prepare, "")
 	if err != nil {
 		return err
 	}
+	result.mark(results.EventTestStart, "meta")
+	started := time.Now()
 	err = write_standard_message(cc, writer, kv_test_start, "")
 	if err != nil {
 		return err
 	}
 
-	// Read a sequence of TEST_MSGs from client
+	// Read a sequence of TEST_MSGs from client. Without kernel statistics,
+	// the time until the first one estimates the idle RTT.
 
 	for {
-		msg_type, msg_body, err := read_standard_message(cc, reader)
+		msg_type, msg_body, err := read_client_message(cc, reader, result,
+			kv_control_header_timeout)
 		if err != nil {
 			return err
 		}
+		result.set_idle_rtt(time.Since(started))
 		if msg_type != kv_test_msg {
-			return errors.New("ndt: expected TEST_MSG from client")
+			return protocol_error_t("ndt: expected TEST_MSG from client")
 		}
 		if msg_body == "" {
 			break
 		}
-		log.Printf("ndt: metadata from client: %s", msg_body)
+		common.Tracef("ndt: meta", "ndt: metadata from client: %s",
+			msg_body)
+		err = result.add_meta(msg_body)
+		if err != nil {
+			return err
+		}
 	}
 
 	// Send empty TEST_FINALIZE to client
 
+	result.mark(results.EventTestFinalize, "meta")
 	return write_standard_message(cc, writer, kv_test_finalize, "")
 }
 
@@ -529,163 +760,312 @@ func run_meta_test(cc net.Conn, reader *bufio.Reader,
 
 */
 
-func update_queue_pos(cc net.Conn, reader *bufio.Reader, writer *bufio.Writer,
+// Write_queue_position tells a queued client its `position` in the queue,
+// i.e., one plus the number of clients that will be served before it.
+func write_queue_position(cc net.Conn, writer *bufio.Writer,
 	position int) error {
 	err := write_standard_message(cc, writer, kv_srv_queue,
 		strconv.Itoa(position))
 	if err != nil {
-		return errors.New("ndt: cannot write SRV_QUEUE message")
+		return fmt.Errorf("ndt: cannot write SRV_QUEUE message: %w", err)
 	}
-	err = write_standard_message(cc, writer, kv_srv_queue,
+	return nil
+}
+
+// Queue_heartbeat sends a heartbeat to a queued client, which must reply
+// with MSG_WAITING to show that it is still there.
+func queue_heartbeat(cc net.Conn, reader *bufio.Reader,
+	writer *bufio.Writer) error {
+	err := write_standard_message(cc, writer, kv_srv_queue,
 		kv_srv_queue_heartbeat)
 	if err != nil {
-		return errors.New("ndt: cannot write SRV_QUEUE heartbeat message")
+		return fmt.Errorf("ndt: cannot write SRV_QUEUE heartbeat "+
+			"message: %w", err)
 	}
 	msg_type, _, err := read_standard_message(cc, reader)
 	if err != nil {
-		return errors.New("ndt: cannot read MSG_WAITING message")
+		return fmt.Errorf("ndt: cannot read MSG_WAITING message: %w", err)
 	}
 	if msg_type != kv_msg_waiting {
-		return errors.New("ndt: received unexpected message from client")
+		return protocol_error_t("ndt: expected MSG_WAITING from queued client")
 	}
 	return nil
 }
 
-var kv_test_pending bool = false
-var kv_test_pending_mutex sync.Mutex
+// Session_lifetime returns the maximum wall-clock time a session that
+// requested the tests in the `tests` bitmask may last. We allow for twice
+// the time required by the granted tests plus a fixed overhead, which
+// should be plenty for any well behaving client.
+func session_lifetime(tests int) time.Duration {
+	granted := time.Duration(0)
+	if (tests & kv_test_s2c_ext) != 0 {
+		granted += kv_test_duration
+	}
+	if (tests & kv_test_s2c) != 0 {
+		granted += kv_test_duration
+	}
+	if (tests & kv_test_c2s_ext) != 0 {
+		granted += kv_test_duration
+	}
+	if (tests & kv_test_c2s) != 0 {
+		granted += kv_test_duration
+	}
+	if (tests & kv_test_meta) != 0 {
+		granted += kv_meta_duration
+	}
+	return 2*granted + kv_session_overhead
+}
+
+// Run_test runs the test with ID `test`, returning the stage at which
+// it failed along with the error, if any.
+func run_test(cc net.Conn, reader *bufio.Reader, writer *bufio.Writer,
+	result *result_t, test int) (string, error) {
+	if test == kv_test_meta {
+		result.phase("meta")
+		return "meta", run_meta_test(cc, reader, writer, result)
+	}
+	var test_result *test_result_t
+	var err error
+	switch test {
+	case kv_test_s2c_ext, kv_test_s2c:
+		name := "s2c"
+		if test == kv_test_s2c_ext {
+			name = "s2c_ext"
+		}
+		result.phase(name)
+		test_result = result.new_test(name, results.Download)
+		err = run_s2c_test(cc, reader, writer, test == kv_test_s2c_ext,
+			test_result)
+		result.web100 = test_result.web100
+	case kv_test_c2s_ext, kv_test_c2s:
+		name := "c2s"
+		if test == kv_test_c2s_ext {
+			name = "c2s_ext"
+		}
+		result.phase(name)
+		test_result = result.new_test(name, results.Upload)
+		err = run_c2s_test(cc, reader, writer, test == kv_test_c2s_ext,
+			test_result)
+	default:
+		return "login", protocol_error_t("ndt: unsupported test")
+	}
+	if err != nil {
+		return test_result.Name, err
+	}
+	result.publish_test(test_result)
+	observe_test(cc, test_result)
+	return "", nil
+}
 
-func handle_connection(cc net.Conn) {
+func handle_connection(cc net.Conn, transport string, tenant string,
+	access_token string) {
 	defer cc.Close()
+	defer track_goroutine("session")()
+
+	result := new_result(cc, transport, tenant)
+	common.Infof("ndt: new session %s from %s", result.UUID,
+		result.ClientAddress)
+	defer result.log_summary()
+	result.control_conn = wire_counter(cc)
+	defer result.account_traffic()
+	defer register_session(result, cc)()
 
+	cc = maybe_hexdump(cc, result.UUID)
 	reader := bufio.NewReader(cc)
 	writer := bufio.NewWriter(cc)
 
-	// Read extended login message
+	// Read extended login message, unless the client speaks another
+	// protocol by mistake
 
+	if transport == kv_transport_raw {
+		err := sniff_protocol(cc, reader, result)
+		if err != nil {
+			result.fail("login", err)
+			return
+		}
+	}
 	login_msg, err := read_extended_login(cc, reader)
 	if err != nil {
-		log.Println("ndt: cannot read extended login")
+		result.fail("login", err)
+		return
+	}
+	result.ClientVersion = login_msg.Msg
+	if login_msg.AccessToken != "" {
+		access_token = login_msg.AccessToken
+	}
+	result.Tests = login_msg.Tests
+	result.mark(results.EventLogin, "")
+	if result.control_conn != nil {
+		result.set_kernel_idle_rtt(result.control_conn)
+	}
+	defer result.save()
+	result.phase("login")
+
+	// Enforce a hard cap on the session lifetime. Closing the control
+	// connection causes any pending I/O on it to fail, thus forcing the
+	// session to terminate, whatever the client is doing.
+
+	// The time spent in the queue is bounded separately, hence we only
+	// start counting the lifetime once the client is admitted.
+
+	lifetime := session_lifetime(login_msg.Tests)
+	common.Infof("ndt: maximum session lifetime: %s", lifetime)
+	lifetime_timer := time.AfterFunc(lifetime+kv_queue_max_wait, func() {
+		log.Printf("ndt: session %s exceeded its maximum lifetime",
+			result.UUID)
+		result.kill(kv_kill_lifetime)
+		cc.Close()
+	})
+	defer lifetime_timer.Stop()
+	result.set_lifetime(lifetime + kv_queue_max_wait)
+
+	// Write kickoff message. It is only meant for legacy clients using
+	// raw TCP, and WebSocket clients do not expect it.
+
+	if transport == kv_transport_raw {
+		err = write_raw_string(cc, writer, "123456 654321")
+		if err != nil {
+			result.fail("kickoff", err)
+			return
+		}
+	}
+
+	// Enforce the per-IP cooldown policy. We only charge the cooldown
+	// once the client is admitted, below.
+
+	if cooldown_recent(client_ip(cc)) {
+		common.Infof("ndt: %s is still cooling down; telling it "+
+			"we're busy", result.ClientAddress)
+		write_standard_message(cc, writer, kv_srv_queue,
+			kv_srv_queue_server_busy)
+		result.Outcome = "busy"
 		return
 	}
 
-	// Write kickoff message
+	// Enforce the single session per IP policy
 
-	err = write_raw_string(cc, writer, "123456 654321")
+	release_ip, err := same_ip_wait(cc, reader, writer)
+	if err == kv_error_same_ip {
+		result.Outcome = "busy"
+		return
+	}
 	if err != nil {
-		log.Println("ndt: cannot write kickoff message")
+		result.fail("queue", err)
 		return
 	}
+	defer release_ip()
 
-	// Queue management
-	// XXX The current implementation of queue management is minimal, and
-	// possibly also very ugly and stupid. Must be improved.
-	//
-	// Moreover the lock/unlock dance with the mutex is not idiomatic
-	// golang and it would be better to use messages and channels.
+	// Do not admit new tests while the host is overloaded or draining,
+	// or the link is already saturated by other tests
 
-	for {
-		kv_test_pending_mutex.Lock()
-		if !kv_test_pending {
-			kv_test_pending = true
-			kv_test_pending_mutex.Unlock()
-			break
-		}
-		kv_test_pending_mutex.Unlock()
-		err = update_queue_pos(cc, reader, writer, 1)
-		if err != nil {
-			log.Println("ndt: failed to update client of its queue position")
-			return
-		}
-		time.Sleep(3.0 * time.Second)
+	if hostload.Degraded() || hostload.Draining() || !send_allow() {
+		common.Infof("ndt: host is overloaded or draining; telling " +
+			"the client we're busy")
+		write_standard_message(cc, writer, kv_srv_queue,
+			kv_srv_queue_server_busy)
+		result.Outcome = "busy"
+		return
 	}
-	log.Println("ndt: this test is now running")
-	defer func() {
-		log.Println("ndt: test complete; allowing another test to run")
-		kv_test_pending_mutex.Lock()
-		kv_test_pending = false
-		kv_test_pending_mutex.Unlock()
-	}()
+
+	// Access control and queue management
+
+	policy, has_token := access_policy(access_token)
+	if TokenRequired && !has_token {
+		result.fail("login", kv_error_missing_token)
+		return
+	}
+	if policy_recent(policy) {
+		common.Infof("ndt: tenant %s is rate limited; telling it "+
+			"we're busy", policy.tenant)
+		write_standard_message(cc, writer, kv_srv_queue,
+			kv_srv_queue_server_busy)
+		result.Outcome = "busy"
+		return
+	}
+	result.policy = policy
+	result.set_tenant(session_tenant(tenant, policy))
+	result.mark(results.EventQueue, "")
+	release, err := queue_wait(cc, reader, writer, policy, has_token)
+	if err == kv_error_queue_full {
+		result.Outcome = "busy"
+		return
+	}
+	if err != nil {
+		result.fail("queue", err)
+		return
+	}
+	defer release()
+	// Reserve the memory only once admitted, such that queued clients do
+	// not hold it while waiting.
+	release_memory := memory_reserve("ndt5", ndt5_memory(policy))
+	if release_memory == nil {
+		write_standard_message(cc, writer, kv_srv_queue,
+			kv_srv_queue_server_busy)
+		result.Outcome = "busy"
+		return
+	}
+	defer release_memory()
+	if !cooldown_allow(client_ip(cc)) {
+		common.Infof("ndt: %s is still cooling down; telling it "+
+			"we're busy", result.ClientAddress)
+		write_standard_message(cc, writer, kv_srv_queue,
+			kv_srv_queue_server_busy)
+		result.Outcome = "busy"
+		return
+	}
+	if !policy_allow(policy) {
+		common.Infof("ndt: tenant %s is rate limited; telling it "+
+			"we're busy", policy.tenant)
+		write_standard_message(cc, writer, kv_srv_queue,
+			kv_srv_queue_server_busy)
+		result.Outcome = "busy"
+		return
+	}
+	result.mark(results.EventAdmitted, "")
+	lifetime_timer.Reset(lifetime)
+	common.Infof("ndt: this test is now running")
+	result.phase("running")
 
 	// Write queue empty message
 
 	err = write_standard_message(cc, writer, kv_srv_queue, "0")
 	if err != nil {
-		log.Println("ndt: cannot write SRV_QUEUE message")
+		result.fail("queue", err)
 		return
 	}
 
 	// Write server version to client
 
-	err = write_standard_message(cc, writer, kv_msg_login,
-		"v3.7.0 ("+common.Product+")")
+	err = write_standard_message(cc, writer, kv_msg_login, banner())
 	if err != nil {
-		log.Println("ndt: cannot send our version to client")
+		result.fail("login", err)
 		return
 	}
 
 	// Send list of encoded tests IDs
 
 	status := login_msg.Tests
-	tests_message := ""
-	if (status & kv_test_s2c_ext) != 0 {
-		tests_message += strconv.Itoa(kv_test_s2c_ext)
-		tests_message += " "
-	}
-	if (status & kv_test_s2c) != 0 {
-		tests_message += strconv.Itoa(kv_test_s2c)
-		tests_message += " "
-	}
-	if (status & kv_test_c2s_ext) != 0 {
-		tests_message += strconv.Itoa(kv_test_c2s_ext)
-		tests_message += " "
-	}
-	if (status & kv_test_c2s) != 0 {
-		tests_message += strconv.Itoa(kv_test_c2s)
-		tests_message += " "
+	if hostload.BudgetExceeded() {
+		common.Infof("ndt: egress budget exceeded; only granting META")
+		status &= kv_test_meta | kv_test_status
 	}
-	if (status & kv_test_meta) != 0 {
-		tests_message += strconv.Itoa(kv_test_meta)
-	}
-	err = write_standard_message(cc, writer, kv_msg_login, tests_message)
+	order := tests_order()
+	err = write_standard_message(cc, writer, kv_msg_login,
+		tests_list(order, status))
 	if err != nil {
-		log.Println("ndt: cannot send the list of tests to client")
+		result.fail("login", err)
 		return
 	}
 
 	// Run tests
 
-	if (status & kv_test_s2c_ext) != 0 {
-		err = run_s2c_test(cc, reader, writer, true)
-		if err != nil {
-			log.Println("ndt: failure to run s2c_ext test")
-			return
-		}
-	}
-	if (status & kv_test_s2c) != 0 {
-		err = run_s2c_test(cc, reader, writer, false)
-		if err != nil {
-			log.Println("ndt: failure running s2c test")
-			return
-		}
-	}
-	if (status & kv_test_c2s_ext) != 0 {
-		err = run_c2s_test(cc, reader, writer, true)
-		if err != nil {
-			log.Println("ndt: failure running c2s test")
-			return
+	for _, test := range order {
+		if (status & test) == 0 {
+			continue
 		}
-	}
-	if (status & kv_test_c2s) != 0 {
-		err = run_c2s_test(cc, reader, writer, false)
+		stage, err := run_test(cc, reader, writer, result, test)
 		if err != nil {
-			log.Println("ndt: failure running c2s test")
-			return
-		}
-	}
-	if (status & kv_test_meta) != 0 {
-		err = run_meta_test(cc, reader, writer)
-		if err != nil {
-			log.Println("ndt: failure running meta test")
+			result.fail(stage, err)
 			return
 		}
 	}
@@ -693,24 +1073,38 @@ func handle_connection(cc net.Conn) {
 	// Send MSG_RESULTS to the client
 
 	/*
-	 * TODO: Here we should actually send results but to do that we need
-	 * first to implement reading Web100 variables from /proc/web100.
-	 *
-	 * Until we reach this point, send back a variable that NDT client
-	 * will ignore but that is consistent with what it would expect.
+	 * We send the retransmissions, the losses, the bufferbloat and the
+	 * web100 variables, when we know them, in the `name: value` format
+	 * clients expect. Otherwise, we send back a variable that NDT clients
+	 * will ignore but that is consistent with what they would expect.
+	 * Web100clt only wants the web100 variables. We also store what we
+	 * send, except for the placeholder.
 	 */
-	err = write_standard_message(cc, writer, kv_msg_results,
-		"botticelli_does_not_yet_collect_web100_data_sorry: 1\n")
+	results_message := result.results_variables() + result.web100
+	if Web100cltQuirks && result.web100 != "" {
+		results_message = result.web100
+	}
+	if results_message != "" {
+		result.Variables = variables_map(results_message)
+	} else {
+		results_message = "botticelli_does_not_yet_collect_web100_data_sorry: 1\n"
+	}
+	err = write_standard_message(cc, writer, kv_msg_results, results_message)
 	if err != nil {
+		result.fail("results", err)
 		return
 	}
 
 	// Send empty MSG_LOGOUT to client
 
+	result.mark(results.EventLogout, "")
 	err = write_standard_message(cc, writer, kv_msg_logout, "")
 	if err != nil {
+		result.fail("logout", err)
 		return
 	}
+	result.Outcome = "success"
+	result.phase("done")
 }
 
 /*
@@ -722,17 +1116,54 @@ func handle_connection(cc net.Conn) {
 
 */
 
+// Address is the endpoint where we accept legacy NDT clients.
+var Address = ":3007"
+
+// Start serves legacy NDT clients on `endpoint`. Since it is the last
+// listener main starts, it also tells the previous instance of the server,
+// if any, that we are ready. It does not return, even after we handed off
+// the listener to a new instance, because we are then draining.
 func Start(endpoint string) {
-	listener, err := net.Listen("tcp", endpoint)
+	listener, err := common.ListenTest(endpoint)
 	if err != nil {
 		log.Fatal(err)
 	}
+	common.Ready()
+	serve(listener, Tenant)
+	select {}
+}
+
+// When accept() fails (e.g. because we ran out of file descriptors), we
+// wait before retrying, doubling the delay up to kv_accept_max_backoff, so
+// that we do not spin while the condition persists.
+const kv_accept_min_backoff = 5 * time.Millisecond
+const kv_accept_max_backoff = 1 * time.Second
+
+// Serve accepts legacy NDT clients of `tenant` from `listener` until it
+// is closed.
+func serve(listener net.Listener, tenant string) {
+	backoff := time.Duration(0)
 	for {
 		cc, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
 		if err != nil {
-			log.Println("ndt: accept() failed")
+			if backoff == 0 {
+				backoff = kv_accept_min_backoff
+			} else {
+				backoff *= 2
+			}
+			if backoff > kv_accept_max_backoff {
+				backoff = kv_accept_max_backoff
+			}
+			log.Printf("ndt: accept() failed: %s; retrying in %s", err,
+				backoff)
+			time.Sleep(backoff)
 			continue
 		}
-		go handle_connection(cc)
+		backoff = 0
+		go handle_connection(common.NewCountingConn(cc), kv_transport_raw,
+			tenant, "")
 	}
 }
@@ -0,0 +1,389 @@
+package ndt
+
+// The ndt7 protocol <https://github.com/m-lab/ndt-server/blob/master/spec/ndt7-protocol.md>.
+// Data is sent using binary WebSocket messages, while measurements are
+// sent using textual WebSocket messages containing JSON.
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/neubot/botticelli/common"
+	"github.com/neubot/botticelli/common/results"
+	"github.com/neubot/botticelli/common/tcpinfo"
+)
+
+const kv_ndt7_subprotocol = "net.measurementlab.ndt.v7"
+const kv_ndt7_download_path = "/ndt/v7/download"
+const kv_ndt7_upload_path = "/ndt/v7/upload"
+const kv_ndt7_duplex_path = "/ndt/v7/duplex"
+
+const kv_ndt7_min_message_size = 1 << 13
+const kv_ndt7_max_message_size = 1 << 24
+const kv_ndt7_scaling_fraction = 16
+const kv_ndt7_max_read_size = 1 << 17
+const kv_ndt7_measurement_interval = 250 * time.Millisecond
+const kv_ndt7_io_timeout = 7 * time.Second
+
+var kv_ndt7_upgrader = websocket.Upgrader{
+	Subprotocols:    []string{kv_ndt7_subprotocol},
+	ReadBufferSize:  kv_ndt7_min_message_size,
+	WriteBufferSize: kv_ndt7_min_message_size,
+	CheckOrigin:     common.OriginAllowed,
+}
+
+type ndt7_app_info_t struct {
+	ElapsedTime int64
+	NumBytes    int64
+}
+
+type ndt7_measurement_t struct {
+	AppInfo *ndt7_app_info_t `json:",omitempty"`
+	Origin  string           `json:",omitempty"`
+	Test    string           `json:",omitempty"`
+	TCPInfo *tcpinfo.TCPInfo `json:",omitempty"`
+
+	// Over WebTransport, the statistics of the QUIC connection replace
+	// those of the TCP connection.
+	QUICInfo *quic_metrics_t `json:",omitempty"`
+}
+
+// Ndt7_upgrade upgrades the connection to WebSocket, after checking that
+// the client is allowed to run `test`, and returns the policy to apply and
+// the function releasing the memory reserved for the test. On failure, it
+// takes care of replying to the client and returns nil.
+func ndt7_upgrade(w http.ResponseWriter, r *http.Request,
+	test string) (*websocket.Conn, *policy_t, func()) {
+	if !websocket.IsWebSocketUpgrade(r) ||
+		r.Header.Get("Sec-WebSocket-Protocol") != kv_ndt7_subprotocol {
+		http.Error(w, "ndt7: missing or invalid subprotocol", 400)
+		return nil, nil, nil
+	}
+	policy, release := ndt7_admit(w, r, "ndt7", test)
+	if policy == nil {
+		return nil, nil, nil
+	}
+	conn, err := ws_upgrade(&kv_ndt7_upgrader, w, r)
+	if err != nil {
+		log.Printf("ndt7: cannot upgrade: %s", err)
+		release()
+		return nil, nil, nil
+	}
+	conn.SetReadLimit(kv_ndt7_max_read_size)
+	return conn, policy, release
+}
+
+// Ndt7_admit checks whether the client is allowed to run `test` over
+// `protocol`, through the common admission (see admit), and returns the
+// policy to apply and the function releasing what we reserved for the
+// test. Otherwise, it replies to the client and returns nil.
+func ndt7_admit(w http.ResponseWriter, r *http.Request, protocol string,
+	test string) (*policy_t, func()) {
+	policy, release, refusal := admit(protocol, request_ip(r),
+		r.URL.Query().Get("access_token"), ndt7_memory(test),
+		r.Context().Done())
+	if refusal != nil {
+		http.Error(w, "ndt7: "+refusal.reason, refusal.status)
+		return nil, nil
+	}
+	return policy, release
+}
+
+// Ndt7_new_result creates the result of a ndt7 session.
+func ndt7_new_result(conn *websocket.Conn, r *http.Request, name string,
+	policy *policy_t) (*result_t, *test_result_t) {
+	result := new_result(&ws_conn_t{conn: conn}, kv_transport_ws,
+		session_tenant(request_tenant(r), policy))
+	result.policy = policy
+	result.Protocol = "ndt7"
+	result.ClientVersion = r.Header.Get("User-Agent")
+	result.add_data_conns([]net.Conn{&ws_conn_t{conn: conn}})
+	result.set_kernel_idle_rtt(ws_net_conn(conn))
+	test := result.new_test(name, name)
+	test.NumStreams = 1
+	common.Infof("ndt7: new session %s from %s", result.UUID,
+		result.ClientAddress)
+	return result, test
+}
+
+// Ndt7_measurement returns a measurement message built from `snapshot`
+// and from the `total` number of bytes transferred so far.
+func ndt7_measurement(snapshot *snapshot_t, test string,
+	total int) *websocket.PreparedMessage {
+	measurement := &ndt7_measurement_t{
+		AppInfo: &ndt7_app_info_t{
+			ElapsedTime: int64(snapshot.elapsed / time.Microsecond),
+			NumBytes:    int64(total),
+		},
+		Origin:  "server",
+		Test:    test,
+		TCPInfo: snapshot.info,
+	}
+	data, err := json.Marshal(measurement)
+	if err != nil {
+		return nil
+	}
+	message, err := websocket.NewPreparedMessage(websocket.TextMessage, data)
+	if err != nil {
+		return nil
+	}
+	return message
+}
+
+// Ndt7_drain reads and discards the messages sent by the client, which is
+// also required for the WebSocket library to process control messages.
+func ndt7_drain(conn *websocket.Conn) {
+	defer track_goroutine("ndt7_reader")()
+	for {
+		_, _, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Ndt7_close performs the WebSocket closing handshake and closes `conn`.
+func ndt7_close(conn *websocket.Conn) {
+	conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+		time.Now().Add(kv_ndt7_io_timeout))
+	conn.Close()
+}
+
+// Ndt7_sender_loop sends binary messages to the client until `duration`
+// has elapsed since `start`, using the sender engine shared with legacy
+// S2C, interleaved with the measurements that `measure` builds from the
+// `snapshots`. As suggested by the spec, we make the binary messages bigger
+// as the amount of data sent, according to `counter`, grows.
+func ndt7_sender_loop(ctx context.Context, conn *websocket.Conn,
+	start time.Time, duration time.Duration, counter func() int,
+	snapshots <-chan *snapshot_t,
+	measure func(*snapshot_t) []*websocket.PreparedMessage) error {
+	payload := new_payload(Payload, kv_ndt7_min_message_size)
+	return sender_loop(ctx, func() error {
+		conn.SetWriteDeadline(time.Now().Add(kv_ndt7_io_timeout))
+		select {
+		case snapshot := <-snapshots:
+			for _, measurement := range measure(snapshot) {
+				if measurement == nil {
+					continue
+				}
+				err := conn.WritePreparedMessage(measurement)
+				if err != nil {
+					return err
+				}
+			}
+		default:
+		}
+		err := conn.WriteMessage(websocket.BinaryMessage, payload.next())
+		if err != nil {
+			return err
+		}
+		count := payload.size()
+		if count < kv_ndt7_max_message_size &&
+			counter() >= kv_ndt7_scaling_fraction*count {
+			payload.resize(2 * count)
+		}
+		return nil
+	}, start, duration)
+}
+
+/*
+ ____                      _                 _
+|  _ \  _____      ___ __ | | ___   __ _  __| |
+| | | |/ _ \ \ /\ / / '_ \| |/ _ \ / _` |/ _` |
+| |_| | (_) \ V  V /| | | | | (_) | (_| | (_| |
+|____/ \___/ \_/\_/ |_| |_|_|\___/ \__,_|\__,_|
+
+*/
+
+func handle_ndt7_download(w http.ResponseWriter, r *http.Request) {
+	defer track_goroutine("session")()
+	conn, policy, release := ndt7_upgrade(w, r, results.Download)
+	if conn == nil {
+		return
+	}
+	defer release()
+	defer conn.Close()
+
+	result, test := ndt7_new_result(conn, r, results.Download,
+		policy)
+	defer result.start_capture(test.Name,
+		[]net.Conn{ws_net_conn(conn)})()
+	defer register_session(result, &ws_conn_t{conn: conn})()
+	result.set_lifetime(2*policy.duration + kv_session_overhead)
+	defer result.log_summary()
+	defer result.save()
+	result.phase("download")
+
+	go ndt7_drain(conn)
+
+	done := make(chan bool)
+	start := time.Now()
+	counter := data_counter([]net.Conn{ws_net_conn(conn)},
+		results.Download)
+	kernel := &kernel_counter_t{}
+	group := new_group()
+	snapshots := start_snapshotter(group, ws_net_conn(conn), start,
+		kv_ndt7_measurement_interval)
+	rtt := ndt7_start_pinger(group, conn, test, start)
+	measure := func(snapshot *snapshot_t) []*websocket.PreparedMessage {
+		return []*websocket.PreparedMessage{
+			ndt7_measurement(snapshot, "download", counter()),
+		}
+	}
+	group.spawn("stream", func(ctx context.Context) error {
+		stop_kernel := kernel.measure(ws_net_conn(conn), results.Download)
+		err := ndt7_sender_loop(ctx, conn, start, test.policy.duration,
+			counter, snapshots, measure)
+		stop_kernel()
+		done <- true
+		return err
+	})
+
+	test.Bytes = collect_streams(done, []net.Conn{ws_net_conn(conn)}, start,
+		test, counter)
+	elapsed := kernel.elapsed(start) // without the drain
+	test.Elapsed = elapsed.Seconds()
+	test.SpeedKbits = (8.0 * float64(test.Bytes)) / 1000.0 / test.Elapsed
+	test.set_kernel_rate(kernel, elapsed)
+	test.set_min_rtt(rtt)
+	test.set_bufferbloat()
+	group.stop()
+	err := group.wait()
+	ndt7_close(conn)
+	if err != nil {
+		result.fail("download", err)
+		return
+	}
+	result.publish_test(test)
+	observe_test(&ws_conn_t{conn: conn}, test)
+	result.Outcome = "success"
+	result.phase("done")
+}
+
+/*
+ _   _       _                 _
+| | | |_ __ | | ___   __ _  __| |
+| | | | '_ \| |/ _ \ / _` |/ _` |
+| |_| | |_) | | (_) | (_| | (_| |
+ \___/| .__/|_|\___/ \__,_|\__,_|
+      |_|
+*/
+
+// The upload lasts about the test duration, but we allow the client a
+// little more time before giving up on it.
+const kv_ndt7_upload_grace = 5 * time.Second
+
+// Ndt7_receiver_loop reads messages from the client until it closes the
+// connection or `deadline` expires. The bytes received are counted by the
+// underlying connection.
+func ndt7_receiver_loop(conn *websocket.Conn, deadline time.Time) error {
+	conn.SetReadLimit(kv_ndt7_max_message_size)
+	err := conn.SetReadDeadline(deadline)
+	if err != nil {
+		return err
+	}
+	for {
+		_, reader, err := conn.NextReader()
+		if err == nil {
+			err = discard(reader)
+		}
+		if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+			return nil
+		}
+		var net_error net.Error
+		if errors.As(err, &net_error) && net_error.Timeout() {
+			common.Infof("ndt7: upload deadline expired; stopping it")
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func handle_ndt7_upload(w http.ResponseWriter, r *http.Request) {
+	defer track_goroutine("session")()
+	conn, policy, release := ndt7_upgrade(w, r, results.Upload)
+	if conn == nil {
+		return
+	}
+	defer release()
+	defer conn.Close()
+
+	result, test := ndt7_new_result(conn, r, results.Upload, policy)
+	defer result.start_capture(test.Name,
+		[]net.Conn{ws_net_conn(conn)})()
+	defer register_session(result, &ws_conn_t{conn: conn})()
+	result.set_lifetime(2*policy.duration + kv_session_overhead)
+	defer result.log_summary()
+	defer result.save()
+	result.phase("upload")
+
+	// Receive in a goroutine, while we periodically send measurements
+	// from another one, which is the only one writing on `conn`. If any
+	// of them fails, we close `conn` to interrupt the other one.
+
+	done := make(chan bool)
+	start := time.Now()
+	counter := data_counter([]net.Conn{ws_net_conn(conn)}, results.Upload)
+	kernel := &kernel_counter_t{}
+	group := new_group()
+	group.close_on_failure(ws_net_conn(conn))
+	rtt := ndt7_start_pinger(group, conn, test, start)
+	group.spawn("stream", func(ctx context.Context) error {
+		stop_kernel := kernel.measure(ws_net_conn(conn), results.Upload)
+		err := ndt7_receiver_loop(conn,
+			start.Add(test.policy.duration+kv_ndt7_upload_grace))
+		stop_kernel()
+		done <- true
+		return err
+	})
+
+	snapshots := start_snapshotter(group, ws_net_conn(conn), start,
+		kv_ndt7_measurement_interval)
+	group.spawn("ndt7_measurer", func(ctx context.Context) error {
+		for snapshot := range snapshots {
+			measurement := ndt7_measurement(snapshot, "upload", counter())
+			if measurement == nil {
+				continue
+			}
+			conn.SetWriteDeadline(time.Now().Add(kv_ndt7_io_timeout))
+			err := conn.WritePreparedMessage(measurement)
+			if err == websocket.ErrCloseSent {
+				return nil // the client has just closed the upload
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	test.Bytes = collect_streams(done, []net.Conn{ws_net_conn(conn)}, start,
+		test, counter)
+	elapsed := time.Since(start)
+	test.Elapsed = elapsed.Seconds()
+	test.SpeedKbits = (8.0 * float64(test.Bytes)) / 1000.0 / test.Elapsed
+	test.set_kernel_rate(kernel, elapsed)
+	test.set_min_rtt(rtt)
+	test.set_bufferbloat()
+	group.stop()
+	err := group.wait()
+	ndt7_close(conn)
+	if err != nil {
+		result.fail("upload", err)
+		return
+	}
+	result.publish_test(test)
+	observe_test(&ws_conn_t{conn: conn}, test)
+	result.Outcome = "success"
+	result.phase("done")
+}
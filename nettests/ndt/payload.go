@@ -0,0 +1,161 @@
+package ndt
+
+// Payload of the data we send. By default, we send the same random buffer
+// over and over, which costs nothing but repeats with the period of the
+// buffer, such that middleboxes compressing or deduplicating the traffic
+// could inflate the measured speed. Research deployments can instead send
+// the keystream of ChaCha8, keyed at random for each stream, which never
+// repeats and cannot be compressed, at the cost of generating it before
+// each write. In between, we can generate a large random pool at startup
+// and send rotating slices of it, starting at random offsets, such that
+// the data repeats with the period of the pool, which is larger than the
+// windows of the compressors, while the hot loop never generates data.
+// Run `botticelli benchmark` to see what each mode costs on a host.
+
+import (
+	crand "crypto/rand"
+	"errors"
+	"math/rand/v2"
+	"net"
+	"sync"
+
+	"github.com/neubot/bernini"
+)
+
+// Payload is the payload mode, i.e., "buffer", "pool" or "chacha8".
+var Payload = "buffer"
+
+// PayloadPoolSize is the size of the random pool of the pool mode.
+var PayloadPoolSize = 64 << 20
+
+const kv_payload_buffer = "buffer"
+const kv_payload_pool = "pool"
+const kv_payload_chacha8 = "chacha8"
+
+var kv_payload_pool_data []byte
+var kv_payload_pool_once sync.Once
+
+// LoadPayload validates Payload and PayloadPoolSize, and generates the
+// random pool, if needed.
+func LoadPayload() error {
+	if Payload != kv_payload_buffer && Payload != kv_payload_pool &&
+		Payload != kv_payload_chacha8 {
+		return errors.New("ndt: invalid payload mode: " + Payload)
+	}
+	if PayloadPoolSize < kv_ndt7_max_message_size {
+		return errors.New("ndt: the payload pool cannot fit the largest " +
+			"message")
+	}
+	if Payload == kv_payload_pool {
+		payload_pool()
+	}
+	return nil
+}
+
+// New_chacha8 returns a ChaCha8 keystream with a random key.
+func new_chacha8() *rand.ChaCha8 {
+	var key [32]byte
+	crand.Read(key[:])
+	return rand.NewChaCha8(key)
+}
+
+// Payload_pool returns the random pool, generating it the first time.
+func payload_pool() []byte {
+	kv_payload_pool_once.Do(func() {
+		kv_payload_pool_data = make([]byte, PayloadPoolSize)
+		new_chacha8().Read(kv_payload_pool_data)
+	})
+	return kv_payload_pool_data
+}
+
+// Payload_t yields the messages a stream sends. It is not safe for
+// concurrent use, hence each stream needs its own.
+type payload_t struct {
+	buffer []byte        // nil in the pool mode
+	stream *rand.ChaCha8 // nil unless in the chacha8 mode
+	pool   []byte        // nil unless in the pool mode
+	offset int           // of the next message in the pool
+	length int           // of the messages in the pool mode
+
+	// The messages of the last batch and, in the chacha8 mode, the
+	// buffer backing them
+	batch_buffers net.Buffers
+	batch_buffer  []byte
+}
+
+// New_payload returns the payload of a stream sending messages of `size`
+// bytes, according to the `mode`.
+func new_payload(mode string, size int) *payload_t {
+	payload := &payload_t{}
+	switch mode {
+	case kv_payload_chacha8:
+		payload.stream = new_chacha8()
+	case kv_payload_pool:
+		payload.pool = payload_pool()
+		payload.offset = rand.IntN(len(payload.pool))
+	}
+	payload.resize(size)
+	return payload
+}
+
+// Resize changes the size of the next messages to `size`.
+func (payload *payload_t) resize(size int) {
+	switch {
+	case payload.pool != nil:
+		payload.length = size
+	case payload.stream != nil:
+		payload.buffer = make([]byte, size)
+	default:
+		payload.buffer = bernini.RandAsciiRemainder(size)
+	}
+}
+
+// Size returns the size of the messages.
+func (payload *payload_t) size() int {
+	if payload.pool != nil {
+		return payload.length
+	}
+	return len(payload.buffer)
+}
+
+// Next returns the next message, which is valid until the next call and
+// must not be modified, since in the pool mode it is shared.
+func (payload *payload_t) next() []byte {
+	if payload.pool != nil {
+		if payload.offset+payload.length > len(payload.pool) {
+			payload.offset = rand.IntN(len(payload.pool) -
+				payload.length + 1)
+		}
+		message := payload.pool[payload.offset:][:payload.length]
+		payload.offset += payload.length
+		return message
+	}
+	if payload.stream != nil {
+		payload.stream.Read(payload.buffer)
+	}
+	return payload.buffer
+}
+
+// Batch returns the next `count` messages, which are valid until the next
+// call and must not be modified, such that we can write them with a single
+// system call.
+func (payload *payload_t) batch(count int) net.Buffers {
+	payload.batch_buffers = payload.batch_buffers[:0]
+	if payload.stream != nil {
+		size := len(payload.buffer)
+		if len(payload.batch_buffer) != count*size {
+			payload.batch_buffer = make([]byte, count*size)
+		}
+		payload.stream.Read(payload.batch_buffer)
+		for i := 0; i < count; i++ {
+			payload.batch_buffers = append(payload.batch_buffers,
+				payload.batch_buffer[i*size:][:size])
+		}
+		return payload.batch_buffers
+	}
+	for i := 0; i < count; i++ {
+		payload.batch_buffers = append(payload.batch_buffers,
+			payload.next())
+	}
+	return payload.batch_buffers
+}
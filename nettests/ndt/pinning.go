@@ -0,0 +1,96 @@
+package ndt
+
+// Pinning of the data path. Optionally, we lock each goroutine sending the
+// data of a test to an OS thread, which we pin to one of PinCPUs, chosen
+// round robin, such that the Go and the kernel schedulers do not migrate
+// it, which reduces the jitter of the interval measurements on busy hosts.
+// Operators should keep the other processes away from those CPUs. Only
+// Linux supports pinning.
+
+import (
+	"errors"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/neubot/botticelli/common"
+)
+
+// PinCPUs is the list of the CPUs to pin the senders to, e.g. "2-5,8".
+// When empty, the senders are not pinned.
+var PinCPUs = ""
+
+var kv_pin_cpus []int
+var kv_pin_next uint32
+
+var kv_error_pin_cpus = errors.New("ndt: invalid list of CPUs: " +
+	"expected e.g. 2-5,8")
+
+// Parse_cpus parses the list of CPUs `value`, whose items are CPUs or
+// ranges of CPUs.
+func parse_cpus(value string) ([]int, error) {
+	cpus := []int{}
+	for _, item := range strings.Split(value, ",") {
+		bounds := strings.SplitN(strings.TrimSpace(item), "-", 2)
+		first, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return nil, kv_error_pin_cpus
+		}
+		last := first
+		if len(bounds) == 2 {
+			last, err = strconv.Atoi(bounds[1])
+			if err != nil || last < first {
+				return nil, kv_error_pin_cpus
+			}
+		}
+		for cpu := first; cpu <= last; cpu++ {
+			cpus = append(cpus, cpu)
+		}
+	}
+	return cpus, nil
+}
+
+// LoadPinCPUs parses PinCPUs and checks that we can pin to each CPU.
+func LoadPinCPUs() error {
+	if PinCPUs == "" {
+		return nil
+	}
+	cpus, err := parse_cpus(PinCPUs)
+	if err != nil {
+		return err
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	for _, cpu := range cpus {
+		restore, err := common.PinThread(cpu)
+		if err != nil {
+			return errors.New("ndt: cannot pin to CPU " +
+				strconv.Itoa(cpu) + ": " + err.Error())
+		}
+		restore()
+	}
+	kv_pin_cpus = cpus
+	return nil
+}
+
+// Pin_sender locks the calling goroutine to its thread and pins it to the
+// next CPU, if pinning is enabled, and returns the function undoing that.
+func pin_sender() func() {
+	if len(kv_pin_cpus) == 0 {
+		return func() {}
+	}
+	next := atomic.AddUint32(&kv_pin_next, 1)
+	cpu := kv_pin_cpus[int(next)%len(kv_pin_cpus)]
+	runtime.LockOSThread()
+	restore, err := common.PinThread(cpu)
+	if err != nil {
+		runtime.UnlockOSThread()
+		common.Infof("ndt: cannot pin sender to CPU %d: %s", cpu, err)
+		return func() {}
+	}
+	return func() {
+		restore()
+		runtime.UnlockOSThread()
+	}
+}
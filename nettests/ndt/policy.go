@@ -0,0 +1,104 @@
+package ndt
+
+// Policies attached to access tokens, allowing the scheduler to grant
+// differentiated service to different client populations. A policy can
+// only restrict what the server would grant anyway.
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+)
+
+type policy_t struct {
+	tenant   string        // who the policy applies to
+	duration time.Duration // duration of each throughput test
+	streams  int           // number of streams of extended tests
+	interval time.Duration // minimum time between tests of the tenant
+	priority int           // priority lane in the admission queue
+}
+
+// Policy claims that a JWT access token may carry, besides the standard
+// ones. Durations are expressed in seconds.
+type policy_claims_t struct {
+	Subject     string  `json:"sub"`
+	Tenant      string  `json:"tenant"`
+	MaxDuration float64 `json:"max_duration"`
+	MaxStreams  int     `json:"max_streams"`
+	MinInterval float64 `json:"min_interval"`
+	Priority    int     `json:"priority"`
+}
+
+// Default_policy returns the policy of clients without a token policy.
+func default_policy() *policy_t {
+	return &policy_t{
+		duration: kv_test_duration,
+		streams:  kv_parallel_streams,
+	}
+}
+
+// New_policy builds the policy described by the claims in `payload`.
+func new_policy(payload []byte) *policy_t {
+	policy := default_policy()
+	var claims policy_claims_t
+	err := json.Unmarshal(payload, &claims)
+	if err != nil {
+		log.Printf("ndt: cannot parse policy claims: %s", err)
+		return policy
+	}
+	policy.tenant = claims.Tenant
+	if policy.tenant == "" {
+		policy.tenant = claims.Subject
+	}
+	duration := time.Duration(claims.MaxDuration * float64(time.Second))
+	if duration > 0 && duration < policy.duration {
+		policy.duration = duration
+	}
+	if claims.MaxStreams > 0 && claims.MaxStreams < policy.streams {
+		policy.streams = claims.MaxStreams
+	}
+	policy.interval = time.Duration(claims.MinInterval * float64(time.Second))
+	policy.priority = claims.Priority
+	return policy
+}
+
+var kv_policy_next_test = make(map[string]time.Time)
+var kv_policy_mutex sync.Mutex
+
+// Policy_recent returns true if the tenant of `policy` ran a test less
+// than its interval ago, such that we can refuse it before queueing it. It
+// records nothing, since we only charge the interval to the clients we
+// admit.
+func policy_recent(policy *policy_t) bool {
+	if policy.tenant == "" || policy.interval <= 0 {
+		return false
+	}
+	now := time.Now()
+	kv_policy_mutex.Lock()
+	defer kv_policy_mutex.Unlock()
+	return now.Before(kv_policy_next_test[policy.tenant])
+}
+
+// Policy_allow returns true if the tenant of `policy` is allowed to run
+// a test now, in which case it also records that it did so. We call it
+// once the client is admitted, such that the clients that we refuse for
+// other reasons do not use up the interval of their tenant.
+func policy_allow(policy *policy_t) bool {
+	if policy.tenant == "" || policy.interval <= 0 {
+		return true
+	}
+	now := time.Now()
+	kv_policy_mutex.Lock()
+	defer kv_policy_mutex.Unlock()
+	for key, when := range kv_policy_next_test {
+		if !now.Before(when) {
+			delete(kv_policy_next_test, key)
+		}
+	}
+	if _, found := kv_policy_next_test[policy.tenant]; found {
+		return false
+	}
+	kv_policy_next_test[policy.tenant] = now.Add(policy.interval)
+	return true
+}
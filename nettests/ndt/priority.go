@@ -0,0 +1,84 @@
+package ndt
+
+// Priority lanes of the admission queue. Clients in a higher priority
+// lane are always served before those in lower ones (e.g. monitoring
+// probes before anonymous users), while fairness across IPs applies
+// within each lane. The lane of a client is the highest between the
+// priority claim of its access token and that of its source subnet, while
+// a token without a priority claim selects the highest lane.
+
+import (
+	"errors"
+	"log"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// QueuePriorities is a comma separated list of `subnet=priority` pairs,
+// where the subnet is in CIDR notation and the priority is an integer.
+// Clients not matching any subnet have priority zero.
+var QueuePriorities = ""
+
+type priority_subnet_t struct {
+	network  *net.IPNet
+	priority int
+}
+
+var kv_priority_subnets []priority_subnet_t
+
+// LoadQueuePriorities parses QueuePriorities.
+func LoadQueuePriorities() error {
+	subnets := []priority_subnet_t{}
+	for _, pair := range strings.Split(QueuePriorities, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		fields := strings.SplitN(pair, "=", 2)
+		if len(fields) != 2 {
+			return errors.New("ndt: invalid queue priority: " + pair)
+		}
+		_, network, err := net.ParseCIDR(fields[0])
+		if err != nil {
+			return errors.New("ndt: invalid queue priority: " + pair)
+		}
+		priority, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return errors.New("ndt: invalid queue priority: " + pair)
+		}
+		subnets = append(subnets, priority_subnet_t{
+			network:  network,
+			priority: priority,
+		})
+	}
+	if len(subnets) > 0 {
+		log.Printf("ndt: loaded %d queue priority subnets", len(subnets))
+	}
+	kv_priority_subnets = subnets
+	return nil
+}
+
+// The lane of the clients holding a token without a priority claim, which
+// is ahead of all the others.
+const kv_token_priority = math.MaxInt32
+
+// Queue_priority returns the priority lane of a client with `ip` to which
+// `policy` applies, holding a token if `has_token`.
+func queue_priority(ip string, policy *policy_t, has_token bool) int {
+	if has_token && policy.priority == 0 {
+		return kv_token_priority
+	}
+	priority := policy.priority
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return priority
+	}
+	for _, subnet := range kv_priority_subnets {
+		if subnet.network.Contains(parsed) && subnet.priority > priority {
+			priority = subnet.priority
+		}
+	}
+	return priority
+}
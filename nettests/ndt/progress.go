@@ -0,0 +1,127 @@
+package ndt
+
+import (
+	"log"
+	"net"
+	"time"
+
+	"github.com/neubot/botticelli/common"
+	"github.com/neubot/botticelli/common/events"
+	"github.com/neubot/botticelli/common/results"
+)
+
+const kv_progress_interval = 250 * time.Millisecond
+
+// Phase records that the session entered the `phase` phase.
+func (result *result_t) phase(phase string) {
+	common.Infof("ndt: session %s: phase %s", result.UUID, phase)
+	result.update_session(func(session *session_t) {
+		session.phase = phase
+	})
+	events.PublishProgress(&events.Progress{
+		UUID:  result.UUID,
+		Kind:  "phase",
+		Phase: phase,
+	})
+}
+
+// Mark records that `event` about `test` (empty for session wide events)
+// happened now, and observes how long the setup took.
+func (result *result_t) mark(event string, test string) {
+	elapsed := time.Since(result.StartTime).Seconds()
+	result.Timings = append(result.Timings, &results.Timing{
+		Event:   event,
+		Test:    test,
+		Elapsed: elapsed,
+	})
+	switch event {
+	case results.EventLogin:
+		kv_setup_seconds.Observe(elapsed, "login")
+	case results.EventAdmitted:
+		if queue, found := result.Interval(results.EventQueue, event,
+			""); found {
+			kv_setup_seconds.Observe(queue, "queue")
+		}
+	case results.EventTestStart:
+		if setup, found := result.Interval(results.EventTestPrepare, event,
+			test); found {
+			kv_setup_seconds.Observe(setup, "test")
+		}
+	}
+}
+
+// Data_counter returns a function computing the bytes transferred in
+// `direction` on `conns`, which are common.CountingConn, since the call
+// to data_counter itself.
+func data_counter(conns []net.Conn, direction string) func() int {
+	counting := []*common.CountingConn{}
+	for _, conn := range conns {
+		counting_conn, ok := conn.(*common.CountingConn)
+		if !ok {
+			log.Println("ndt: cannot count bytes of non counting conn")
+			continue
+		}
+		counting = append(counting, counting_conn)
+	}
+	count := func() int64 {
+		total := int64(0)
+		for _, conn := range counting {
+			if direction == results.Upload {
+				total += conn.BytesRead()
+			} else {
+				total += conn.BytesWritten()
+			}
+		}
+		return total
+	}
+	base := count()
+	return func() int {
+		return int(count() - base)
+	}
+}
+
+// Collect_streams waits for the goroutines serving `conns` to tell on
+// `done` that they have terminated, periodically publishing the progress
+// based on `counter`, which returns the bytes transferred so far, and
+// sampling the RTT under load, and returns the total number of bytes
+// transferred.
+func collect_streams(done chan bool, conns []net.Conn, start time.Time,
+	result *test_result_t, counter func() int) int {
+	ticker := time.NewTicker(kv_progress_interval)
+	defer ticker.Stop()
+	last_total := 0
+	last_time := start
+	for num_complete := 0; num_complete < len(conns); {
+		select {
+		case <-done:
+			common.Infof("ndt: a stream just terminated...")
+			num_complete += 1
+		case now := <-ticker.C:
+			total := counter()
+			if result.Direction == results.Download {
+				account_sent(total - last_total)
+			}
+			interval := now.Sub(last_time).Seconds()
+			events.PublishProgress(&events.Progress{
+				UUID:    result.uuid,
+				Kind:    "interval",
+				Phase:   result.Name,
+				Elapsed: now.Sub(start).Seconds(),
+				Bytes:   total,
+				SpeedKbits: (8.0 * float64(total-last_total)) /
+					1000.0 / interval,
+			})
+			result.samples = append(result.samples,
+				sample_t{elapsed: now.Sub(start), bytes: total})
+			result.sample_loaded_rtt(conns, start)
+			last_total = total
+			last_time = now
+		}
+	}
+	total := counter()
+	if result.Direction == results.Download {
+		account_sent(total - last_total)
+	}
+	result.set_loaded_rtt()
+	return total
+}
@@ -0,0 +1,302 @@
+package ndt
+
+// Admission queue. Only one test runs at a time, while the other clients
+// wait in a bounded queue, and clients that find it full are told that the
+// server is busy. Clients are served by priority lane and, within a lane,
+// round robin across the waiting IPs and in FIFO order within each IP, such
+// that a client opening many connections cannot starve everyone else. As
+// the NDT protocol requires, a queued client receives its position whenever
+// it changes, and periodic heartbeats, to which it must reply with
+// MSG_WAITING, while a client whose expected wait is too long is told to
+// come back in a minute rather than being left waiting until it gives up.
+// Between heartbeats, we probe the control connection of the queued
+// clients, such that we evict those that went away rather than granting
+// them the test slot. In cluster mode, the tests running on the other
+// instances also count towards the cluster capacity, and, after an upgrade,
+// the test slot is taken until the previous instance is done with its
+// tests. Clients speaking protocols without queue messages only wait
+// briefly for the test slot.
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/neubot/botticelli/common"
+	"github.com/neubot/botticelli/common/metrics"
+)
+
+// QueueMaxLength is the maximum number of clients waiting in the queue.
+// Zero means no limit.
+var QueueMaxLength = 64
+
+var kv_test_pending bool = false
+var kv_test_pending_mutex sync.Mutex
+
+type waiter_t struct {
+	ip       string
+	priority int
+}
+
+// Queued clients, indexed by their ticket, i.e., the time at which they
+// started waiting, in nanoseconds since the epoch.
+var kv_queue_waiting = make(map[int64]*waiter_t)
+var kv_queue_mutex sync.Mutex
+
+// When each IP was last admitted, in nanoseconds since the epoch, such
+// that IPs that have been waiting to be served go first.
+var kv_queue_last_served = make(map[string]int64)
+
+const kv_queue_poll_interval = 500 * time.Millisecond
+const kv_queue_heartbeat_interval = 3 * time.Second
+const kv_queue_probe_timeout = 10 * time.Millisecond
+
+// Legacy clients estimate that each client ahead of them in the queue
+// needs 45 seconds. We refuse to queue clients whose estimated wait would
+// be longer than kv_queue_max_wait.
+const kv_queue_session_estimate = 45 * time.Second
+const kv_queue_max_wait = 5 * time.Minute
+
+// How long the clients without queue messages, e.g., ndt7 clients, wait for
+// the test slot before being refused. They do not wait long for the upgrade.
+const kv_queue_brief_wait = 10 * time.Second
+
+var kv_error_queue_too_long = errors.New("ndt: the queue is too long")
+var kv_error_queue_full = errors.New("ndt: the queue is full")
+
+func init() {
+	metrics.NewGaugeFunc("ndt_queue_length",
+		"Number of clients waiting in the admission queue.",
+		func() float64 { return float64(len(queue_tickets())) })
+}
+
+// Queue_enqueue adds a waiting client with `ip` in the lane with
+// `priority` and returns its ticket, or an error if the queue is full.
+func queue_enqueue(ip string, priority int) (int64, error) {
+	kv_queue_mutex.Lock()
+	defer kv_queue_mutex.Unlock()
+	if QueueMaxLength > 0 && len(kv_queue_waiting) >= QueueMaxLength {
+		return 0, kv_error_queue_full
+	}
+	ticket := time.Now().UnixNano()
+	for kv_queue_waiting[ticket] != nil {
+		ticket += 1
+	}
+	kv_queue_waiting[ticket] = &waiter_t{ip: ip, priority: priority}
+	return ticket, nil
+}
+
+// Queue_dequeue removes the waiting client with `ticket`.
+func queue_dequeue(ticket int64) {
+	kv_queue_mutex.Lock()
+	defer kv_queue_mutex.Unlock()
+	delete(kv_queue_waiting, ticket)
+}
+
+// Queue_tickets returns the tickets of the waiting clients.
+func queue_tickets() []int64 {
+	kv_queue_mutex.Lock()
+	defer kv_queue_mutex.Unlock()
+	tickets := []int64{}
+	for ticket := range kv_queue_waiting {
+		tickets = append(tickets, ticket)
+	}
+	return tickets
+}
+
+// Queue_before_locked returns true if the client holding `ticket`, which
+// is in `round`, is served before the one holding `other`, in `other_round`.
+// Must be called with the queue mutex held.
+func queue_before_locked(ticket int64, round int, other int64,
+	other_round int) bool {
+	waiter, other_waiter := kv_queue_waiting[ticket], kv_queue_waiting[other]
+	if waiter.priority != other_waiter.priority {
+		return waiter.priority > other_waiter.priority
+	}
+	if round != other_round {
+		return round < other_round
+	}
+	served := kv_queue_last_served[waiter.ip]
+	other_served := kv_queue_last_served[other_waiter.ip]
+	if served != other_served {
+		return served < other_served
+	}
+	return ticket < other
+}
+
+// Queue_ahead returns the number of local clients that will be served
+// before the client holding `ticket`. Higher priority lanes go first.
+// Within a lane, the round in which a client is served is the number of
+// clients with the same IP and priority ahead of it. Within the same
+// round, IPs served less recently go first, and then we use the FIFO
+// order.
+func queue_ahead(ticket int64) int {
+	kv_queue_mutex.Lock()
+	defer kv_queue_mutex.Unlock()
+	by_source := make(map[waiter_t][]int64)
+	for other, waiter := range kv_queue_waiting {
+		by_source[*waiter] = append(by_source[*waiter], other)
+	}
+	rounds := make(map[int64]int)
+	for _, tickets := range by_source {
+		sort.Slice(tickets, func(i, j int) bool {
+			return tickets[i] < tickets[j]
+		})
+		for round, other := range tickets {
+			rounds[other] = round
+		}
+	}
+	ahead := 0
+	for other, other_round := range rounds {
+		if queue_before_locked(other, other_round, ticket, rounds[ticket]) {
+			ahead += 1
+		}
+	}
+	return ahead
+}
+
+// Queue_served records that the client holding `ticket` was admitted.
+func queue_served(ticket int64) {
+	kv_queue_mutex.Lock()
+	defer kv_queue_mutex.Unlock()
+	now := time.Now().UnixNano()
+	for ip, when := range kv_queue_last_served {
+		if time.Duration(now-when) > kv_queue_max_wait {
+			delete(kv_queue_last_served, ip)
+		}
+	}
+	kv_queue_last_served[kv_queue_waiting[ticket].ip] = now
+}
+
+// Queue_probe returns an error if the control connection of a queued
+// client is closed, by trying to read with a short deadline. Whatever the
+// client may have sent is left buffered in `reader`. WebSocket connections
+// cannot survive a read timeout, hence we rely on heartbeats for them.
+func queue_probe(cc net.Conn, reader *bufio.Reader) error {
+	if hexdump, ok := cc.(*hexdump_conn_t); ok {
+		cc = hexdump.Conn
+	}
+	if _, ok := cc.(*ws_conn_t); ok || reader.Buffered() > 0 {
+		return nil
+	}
+	err := cc.SetReadDeadline(time.Now().Add(kv_queue_probe_timeout))
+	if err != nil {
+		return err
+	}
+	_, err = reader.Peek(1)
+	cc.SetReadDeadline(time.Time{})
+	var net_error net.Error
+	if err != nil && !(errors.As(err, &net_error) && net_error.Timeout()) {
+		return err
+	}
+	return nil
+}
+
+// Queue_admit returns whether the client holding `ticket` may start now,
+// in which case it also takes the test slot, and otherwise its position.
+func queue_admit(ticket int64) (bool, int) {
+	ahead := queue_ahead(ticket)
+	kv_test_pending_mutex.Lock()
+	defer kv_test_pending_mutex.Unlock()
+	if ahead == 0 && !kv_test_pending && !common.PredecessorBusy() &&
+		cluster_admit() {
+		kv_test_pending = true
+		return true, 0
+	}
+	return false, ahead + 1
+}
+
+// Queue_wait waits until the client, to which `policy` applies, is allowed
+// to run its tests and returns the function to be called to release the
+// slot when done. Clients holding a token go to the front of the queue
+// (see queue_priority).
+func queue_wait(cc net.Conn, reader *bufio.Reader, writer *bufio.Writer,
+	policy *policy_t, has_token bool) (func(), error) {
+	ip := client_ip(cc)
+	ticket, err := queue_enqueue(ip, queue_priority(ip, policy, has_token))
+	if err != nil {
+		common.Infof("ndt: the queue is full; telling the client " +
+			"we're busy")
+		write_standard_message(cc, writer, kv_srv_queue,
+			kv_srv_queue_server_busy)
+		return nil, err
+	}
+	defer queue_dequeue(ticket)
+	last_position := 0
+	last_heartbeat := time.Now()
+	for {
+		admitted, position := queue_admit(ticket)
+		if admitted {
+			queue_served(ticket)
+			break
+		}
+		if time.Duration(position)*kv_queue_session_estimate >
+			kv_queue_max_wait {
+			common.Infof("ndt: queue position %d is too far back; "+
+				"telling the client to come back later", position)
+			write_standard_message(cc, writer, kv_srv_queue,
+				kv_srv_queue_server_busy_60s)
+			return nil, kv_error_queue_too_long
+		}
+		if position != last_position {
+			err = write_queue_position(cc, writer, position)
+			if err != nil {
+				return nil, err
+			}
+			last_position = position
+		}
+		err = queue_probe(cc, reader)
+		if err != nil {
+			common.Infof("ndt: queued client went away; evicting it")
+			return nil, err
+		}
+		if time.Since(last_heartbeat) >= kv_queue_heartbeat_interval {
+			err = queue_heartbeat(cc, reader, writer)
+			if err != nil {
+				return nil, err
+			}
+			last_heartbeat = time.Now()
+		}
+		time.Sleep(kv_queue_poll_interval)
+	}
+	return queue_release, nil
+}
+
+// Queue_release releases the test slot.
+func queue_release() {
+	common.Infof("ndt: test complete; allowing another test to run")
+	kv_test_pending_mutex.Lock()
+	kv_test_pending = false
+	kv_test_pending_mutex.Unlock()
+}
+
+// Queue_wait_briefly is like queue_wait, for the clients of the protocols
+// without queue messages, which wait up to kv_queue_brief_wait, unless
+// `done` is closed. It returns nil if the client is refused.
+func queue_wait_briefly(ip string, policy *policy_t, has_token bool,
+	done <-chan struct{}) func() {
+	ticket, err := queue_enqueue(ip, queue_priority(ip, policy, has_token))
+	if err != nil {
+		return nil
+	}
+	defer queue_dequeue(ticket)
+	deadline := time.Now().Add(kv_queue_brief_wait)
+	for {
+		admitted, _ := queue_admit(ticket)
+		if admitted {
+			queue_served(ticket)
+			return queue_release
+		}
+		if time.Now().After(deadline) {
+			return nil
+		}
+		select {
+		case <-done:
+			return nil
+		case <-time.After(kv_queue_poll_interval):
+		}
+	}
+}
@@ -0,0 +1,422 @@
+package ndt
+
+// Experimental QUIC endpoint, measuring the goodput of a QUIC stream, such
+// that we can compare it with that of TCP on the same server. The client
+// connects using the kv_quic_alpn protocol, opens a bidirectional stream
+// and sends the name of the test, "download" or "upload", followed by a
+// newline. In the download, we send on that stream until the test duration
+// elapses, then close it. In the upload, we read from it until then. We
+// send the measurements on a unidirectional stream, as newline delimited
+// JSON objects shaped like the qlog recovery:metrics_updated events, with
+// the statistics of the QUIC connection. Results have the "quic" protocol
+// and transport, and count the QUIC packets, and those lost, as segments
+// and retransmits. Since QUIC requires TLS, so does the endpoint.
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/neubot/botticelli/common"
+	"github.com/neubot/botticelli/common/results"
+	"github.com/quic-go/quic-go"
+)
+
+// QUICAddress is the UDP address of the QUIC endpoint. When empty, the
+// endpoint is disabled.
+var QUICAddress = ""
+
+const kv_quic_alpn = "botticelli-quic-v0"
+const kv_transport_quic = "quic"
+const kv_quic_message_size = 1 << 16
+const kv_quic_max_request_size = 64
+const kv_quic_handshake_timeout = 10 * time.Second
+
+// After closing the stream of a download, we wait up to this long for the
+// client to close the connection, since closing it ourselves would discard
+// the data the client did not receive yet.
+const kv_quic_linger = 3 * time.Second
+
+// Application error codes with which we close the connection.
+const (
+	kv_quic_error_none     = 0
+	kv_quic_error_busy     = 1
+	kv_quic_error_protocol = 2
+)
+
+var kv_error_quic_request = protocol_error_t("ndt: invalid QUIC test request")
+
+type quic_metrics_t struct {
+	MinRTT          float64 `json:"min_rtt"`
+	SmoothedRTT     float64 `json:"smoothed_rtt"`
+	LatestRTT       float64 `json:"latest_rtt"`
+	RTTVariance     float64 `json:"rtt_variance"`
+	BytesSent       uint64  `json:"bytes_sent"`
+	PacketsSent     uint64  `json:"packets_sent"`
+	BytesReceived   uint64  `json:"bytes_received"`
+	PacketsReceived uint64  `json:"packets_received"`
+	BytesLost       uint64  `json:"bytes_lost"`
+	PacketsLost     uint64  `json:"packets_lost"`
+}
+
+// Times are in milliseconds, as in qlog. Time is since the test started.
+type quic_measurement_t struct {
+	Time     float64         `json:"time"`
+	Name     string          `json:"name"`
+	Test     string          `json:"test"`
+	NumBytes int64           `json:"num_bytes"`
+	Data     *quic_metrics_t `json:"data"`
+}
+
+// Quic_stream_t is the stream of a test, which is either a QUIC stream or
+// a WebTransport one.
+type quic_stream_t interface {
+	io.ReadWriteCloser
+	SetDeadline(time.Time) error
+	SetReadDeadline(time.Time) error
+	SetWriteDeadline(time.Time) error
+}
+
+// Quic_send_stream_t is the stream on which we send the measurements.
+type quic_send_stream_t interface {
+	io.WriteCloser
+	SetWriteDeadline(time.Time) error
+}
+
+// Quic_conn_t adapts the stream of a test to net.Conn, such that sessions
+// can use it like the other connections. Closing it closes the connection,
+// or the WebTransport session, of the stream.
+type quic_conn_t struct {
+	quic_stream_t
+	local  net.Addr
+	remote net.Addr
+	close  func() error
+}
+
+func (conn *quic_conn_t) Close() error {
+	return conn.close()
+}
+
+func (conn *quic_conn_t) LocalAddr() net.Addr {
+	return conn.local
+}
+
+func (conn *quic_conn_t) RemoteAddr() net.Addr {
+	return conn.remote
+}
+
+// Quic_test_t is a test running on a stream of a QUIC connection. The
+// `measurement` function builds the measurement to send, given the time
+// elapsed since the start, the bytes transferred, and the statistics of
+// the connection. The `closed` channel is closed when the client is gone.
+type quic_test_t struct {
+	conn         *quic.Conn
+	stream       quic_stream_t
+	measurements quic_send_stream_t
+	closed       <-chan struct{}
+	measurement  func(time.Duration, int64, quic.ConnectionStats) interface{}
+}
+
+func milliseconds(duration time.Duration) float64 {
+	return duration.Seconds() * 1000.0
+}
+
+func quic_metrics(stats quic.ConnectionStats) *quic_metrics_t {
+	return &quic_metrics_t{
+		MinRTT:          milliseconds(stats.MinRTT),
+		SmoothedRTT:     milliseconds(stats.SmoothedRTT),
+		LatestRTT:       milliseconds(stats.LatestRTT),
+		RTTVariance:     milliseconds(stats.MeanDeviation),
+		BytesSent:       stats.BytesSent,
+		PacketsSent:     stats.PacketsSent,
+		BytesReceived:   stats.BytesReceived,
+		PacketsReceived: stats.PacketsReceived,
+		BytesLost:       stats.BytesLost,
+		PacketsLost:     stats.PacketsLost,
+	}
+}
+
+// StartQUIC starts the experimental QUIC endpoint in the background, if
+// enabled.
+func StartQUIC() {
+	if QUICAddress == "" {
+		return
+	}
+	tls_config := common.TLSConfig(kv_quic_alpn)
+	if tls_config == nil {
+		log.Fatal("ndt: the QUIC endpoint requires TLS")
+	}
+	address, err := common.ResolveAddress(QUICAddress)
+	if err != nil {
+		log.Fatal(err)
+	}
+	conn, err := common.ListenUDP(address)
+	if err != nil {
+		log.Fatal(err)
+	}
+	listener, err := quic.Listen(conn, tls_config, &quic.Config{
+		HandshakeIdleTimeout: kv_quic_handshake_timeout,
+		MaxIdleTimeout:       kv_ndt7_io_timeout,
+		// Keeps alive the clients waiting for the test slot (see admit).
+		KeepAlivePeriod: kv_ndt7_io_timeout / 2,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("ndt: experimental QUIC endpoint on %s", address)
+	go serve_quic(listener)
+}
+
+func serve_quic(listener *quic.Listener) {
+	for {
+		conn, err := listener.Accept(context.Background())
+		if err != nil {
+			log.Printf("ndt: QUIC listener failed: %s", err)
+			return
+		}
+		go handle_quic(conn)
+	}
+}
+
+// Quic_admit checks whether the client of `conn`, with `ip`, may run a test
+// (see admit) and returns the policy to apply and the function releasing
+// what we reserved for the test. Otherwise, it closes `conn` and returns
+// nil.
+func quic_admit(conn *quic.Conn, ip string) (*policy_t, func()) {
+	if TokenRequired {
+		common.Infof("ndt: refusing %s client %s: access tokens are not "+
+			"supported", kv_transport_quic, common.AnonymizeIP(ip))
+		kv_admission_refused.Inc(kv_transport_quic, kv_refused_token.label)
+		conn.CloseWithError(kv_quic_error_busy,
+			"access tokens are not supported")
+		return nil, nil
+	}
+	policy, release, refusal := admit(kv_transport_quic, ip, "",
+		2*kv_quic_message_size, conn.Context().Done())
+	if refusal != nil {
+		conn.CloseWithError(kv_quic_error_busy, refusal.reason)
+		return nil, nil
+	}
+	return policy, release
+}
+
+// Quic_read_request reads the name of the test from `stream`, one byte at
+// a time, such that we do not consume what follows.
+func quic_read_request(stream quic_stream_t) (string, error) {
+	stream.SetReadDeadline(time.Now().Add(kv_quic_handshake_timeout))
+	defer stream.SetReadDeadline(time.Time{})
+	request := []byte{}
+	buffer := make([]byte, 1)
+	for len(request) < kv_quic_max_request_size {
+		_, err := io.ReadFull(stream, buffer)
+		if err != nil {
+			return "", err
+		}
+		if buffer[0] == '\n' {
+			name := string(request)
+			if name != results.Download && name != results.Upload {
+				return "", kv_error_quic_request
+			}
+			return name, nil
+		}
+		request = append(request, buffer[0])
+	}
+	return "", kv_error_quic_request
+}
+
+func handle_quic(conn *quic.Conn) {
+	defer track_goroutine("session")()
+	defer conn.CloseWithError(kv_quic_error_none, "")
+	ip, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return
+	}
+	policy, release := quic_admit(conn, ip)
+	if policy == nil {
+		return
+	}
+	defer release()
+	ctx, cancel := context.WithTimeout(conn.Context(),
+		kv_quic_handshake_timeout)
+	defer cancel()
+	stream, err := conn.AcceptStream(ctx)
+	if err != nil {
+		common.Infof("ndt: QUIC client did not open a stream: %s", err)
+		return
+	}
+	name, err := quic_read_request(stream)
+	if err != nil {
+		common.Infof("ndt: invalid QUIC request: %s", err)
+		conn.CloseWithError(kv_quic_error_protocol, "invalid request")
+		return
+	}
+	measurements, err := conn.OpenUniStreamSync(ctx)
+	if err != nil {
+		common.Infof("ndt: cannot open QUIC measurement stream: %s", err)
+		return
+	}
+
+	qconn := &quic_conn_t{
+		quic_stream_t: stream,
+		local:         conn.LocalAddr(),
+		remote:        conn.RemoteAddr(),
+		close: func() error {
+			return conn.CloseWithError(kv_quic_error_none, "")
+		},
+	}
+	result := new_result(qconn, kv_transport_quic, Tenant)
+	result.policy = policy
+	result.Protocol = kv_transport_quic
+	test := result.new_test(name, name)
+	test.NumStreams = 1
+	defer register_session(result, qconn)()
+	result.set_lifetime(2*policy.duration + kv_session_overhead)
+	defer result.log_summary()
+	defer result.save()
+	result.phase(name)
+	quic_run(result, test, qconn, &quic_test_t{
+		conn:         conn,
+		stream:       stream,
+		measurements: measurements,
+		closed:       conn.Context().Done(),
+		measurement: func(elapsed time.Duration, count int64,
+			stats quic.ConnectionStats) interface{} {
+			return &quic_measurement_t{
+				Time:     milliseconds(elapsed),
+				Name:     "recovery:metrics_updated",
+				Test:     name,
+				NumBytes: count,
+				Data:     quic_metrics(stats),
+			}
+		},
+	})
+}
+
+// Quic_run runs the `test` of `result` on the stream of `qt`, which `qconn`
+// wraps, and publishes it.
+func quic_run(result *result_t, test *test_result_t, qconn net.Conn,
+	qt *quic_test_t) {
+	name := test.Name
+	var count int64
+	start := time.Now()
+	done := make(chan bool, 1)
+	group := new_group()
+	group.close_on_failure(qconn)
+	group.spawn("quic_measurer", func(ctx context.Context) error {
+		return quic_measure(ctx, qt, start, &count)
+	})
+	group.spawn("stream", func(ctx context.Context) error {
+		var err error
+		if name == results.Download {
+			err = quic_send(ctx, qt.stream, start, result.policy.duration,
+				&count)
+		} else {
+			err = quic_receive(qt.stream,
+				start.Add(result.policy.duration), &count)
+		}
+		done <- true
+		return err
+	})
+	<-done
+	elapsed := time.Since(start)
+	stats := qt.conn.ConnectionStats()
+	group.stop()
+	err := group.wait()
+	if err == nil && name == results.Download {
+		select {
+		case <-qt.closed:
+		case <-time.After(kv_quic_linger):
+		}
+	}
+	if err != nil {
+		result.fail(name, err)
+		return
+	}
+	test.Bytes = int(atomic.LoadInt64(&count))
+	test.Elapsed = elapsed.Seconds()
+	test.SpeedKbits = (8.0 * float64(test.Bytes)) / 1000.0 / test.Elapsed
+	test.MinRTT = milliseconds(stats.MinRTT)
+	test.Losses = &results.Losses{
+		SegmentsOut: int64(stats.PacketsSent),
+		SegmentsIn:  int64(stats.PacketsReceived),
+		Retransmits: int64(stats.PacketsLost),
+	}
+	if name == results.Download && stats.BytesSent > 0 {
+		rate := float64(stats.BytesLost) / float64(stats.BytesSent)
+		test.Losses.LossRate = &rate
+	}
+	result.publish_test(test)
+	kv_tests_total.Inc(result.Transport+"_"+name, result.Tenant)
+	result.Outcome = "success"
+	result.phase("done")
+}
+
+// Quic_send sends on `stream` until `duration` elapses since `start`, then
+// closes it, adding the bytes sent to `count`.
+func quic_send(ctx context.Context, stream quic_stream_t, start time.Time,
+	duration time.Duration, count *int64) error {
+	payload := new_payload(Payload, kv_quic_message_size)
+	err := sender_loop(ctx, func() error {
+		stream.SetWriteDeadline(time.Now().Add(kv_ndt7_io_timeout))
+		written, err := stream.Write(payload.next())
+		atomic.AddInt64(count, int64(written))
+		return err
+	}, start, duration)
+	if err != nil {
+		return err
+	}
+	return stream.Close()
+}
+
+// Quic_receive reads from `stream` until `deadline`, or until the client
+// closes it, adding the bytes received to `count`. We stop reading at the
+// deadline, and the client stops sending when we close the connection.
+func quic_receive(stream quic_stream_t, deadline time.Time,
+	count *int64) error {
+	stream.SetReadDeadline(deadline.Add(kv_ndt7_upload_grace))
+	buffer := make([]byte, kv_quic_message_size)
+	for {
+		read, err := stream.Read(buffer)
+		atomic.AddInt64(count, int64(read))
+		if err == io.EOF {
+			return nil
+		}
+		var net_error net.Error
+		if errors.As(err, &net_error) && net_error.Timeout() {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if time.Now().After(deadline) {
+			return nil
+		}
+	}
+}
+
+// Quic_measure sends the measurements of `qt` until `ctx` is done.
+func quic_measure(ctx context.Context, qt *quic_test_t, start time.Time,
+	count *int64) error {
+	defer qt.measurements.Close()
+	ticker := time.NewTicker(kv_ndt7_measurement_interval)
+	defer ticker.Stop()
+	encoder := json.NewEncoder(qt.measurements)
+	for {
+		select {
+		case now := <-ticker.C:
+			qt.measurements.SetWriteDeadline(now.Add(kv_ndt7_io_timeout))
+			err := encoder.Encode(qt.measurement(now.Sub(start),
+				atomic.LoadInt64(count), qt.conn.ConnectionStats()))
+			if err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
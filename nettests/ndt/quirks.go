@@ -0,0 +1,45 @@
+package ndt
+
+// Compatibility with the quirks of web100clt, the reference command line
+// client, which expects the tests in the order used by the reference
+// server, a trailing space after each test ID in the tests list, and the
+// results of S2C as web100 variables (see web100.go).
+
+import (
+	"strconv"
+)
+
+// Web100cltQuirks enables the behaviours expected by web100clt.
+var Web100cltQuirks = false
+
+// Order in which we run the tests, by default and with web100clt quirks.
+var kv_tests_order = []int{kv_test_s2c_ext, kv_test_s2c, kv_test_c2s_ext,
+	kv_test_c2s, kv_test_meta}
+var kv_web100clt_tests_order = []int{kv_test_c2s_ext, kv_test_c2s,
+	kv_test_s2c_ext, kv_test_s2c, kv_test_meta}
+
+// Tests_order returns the order in which we run the tests.
+func tests_order() []int {
+	if Web100cltQuirks {
+		return kv_web100clt_tests_order
+	}
+	return kv_tests_order
+}
+
+// Tests_list returns the list of the tests in `order` that are included
+// in `status`, to be sent to the client. As the original server did, we
+// follow each test ID but META with a space, while web100clt expects a
+// space after each test ID.
+func tests_list(order []int, status int) string {
+	list := ""
+	for _, test := range order {
+		if (status & test) == 0 {
+			continue
+		}
+		list += strconv.Itoa(test)
+		if test != kv_test_meta || Web100cltQuirks {
+			list += " "
+		}
+	}
+	return list
+}
@@ -0,0 +1,242 @@
+package ndt
+
+// Registry of the live sessions. The admin API exports it, the drain
+// logic waits for it to become empty, and the watchdog uses it to detect
+// sessions outliving their maximum lifetime.
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/neubot/botticelli/common"
+	"github.com/neubot/botticelli/common/hostload"
+)
+
+type session_t struct {
+	conn     net.Conn // the control connection
+	start    time.Time
+	lifetime time.Duration // zero until known
+	phase    string
+	tenant   string
+	reported bool
+}
+
+var kv_sessions = make(map[*result_t]*session_t)
+var kv_sessions_mutex sync.Mutex
+
+// Bytes sent and received by the sessions no longer in the registry.
+var kv_ended_sent, kv_ended_received int64
+
+func init() {
+	hostload.OwnTraffic = own_traffic
+}
+
+// Register_session adds the session of `result`, whose control connection
+// is `conn`, to the registry, and returns the function to be called when
+// the session terminates.
+func register_session(result *result_t, conn net.Conn) func() {
+	kv_watchdog_once.Do(func() { go run_watchdog() })
+	kv_active_sessions.Add(1)
+	kv_sessions_mutex.Lock()
+	kv_sessions[result] = &session_t{
+		conn:   conn,
+		start:  time.Now(),
+		phase:  "new",
+		tenant: result.Tenant,
+	}
+	kv_sessions_mutex.Unlock()
+	return func() {
+		kv_sessions_mutex.Lock()
+		sent, received := result.session_bytes()
+		kv_ended_sent += sent
+		kv_ended_received += received
+		delete(kv_sessions, result)
+		kv_sessions_mutex.Unlock()
+		kv_active_sessions.Add(-1)
+	}
+}
+
+// Session_bytes returns the bytes sent and received so far by the session
+// of `result`. The caller must hold kv_sessions_mutex.
+func (result *result_t) session_bytes() (int64, int64) {
+	var sent, received int64
+	if result.control_conn != nil {
+		sent += result.control_conn.BytesWritten()
+		received += result.control_conn.BytesRead()
+	}
+	for _, conn := range result.data_conns {
+		sent += conn.BytesWritten()
+		received += conn.BytesRead()
+	}
+	return sent, received
+}
+
+// Own_traffic returns the bytes received and sent by all the sessions
+// since we started, including the live ones.
+func own_traffic() (int64, int64) {
+	kv_sessions_mutex.Lock()
+	defer kv_sessions_mutex.Unlock()
+	sent, received := kv_ended_sent, kv_ended_received
+	for result := range kv_sessions {
+		session_sent, session_received := result.session_bytes()
+		sent += session_sent
+		received += session_received
+	}
+	return received, sent
+}
+
+// Update_session applies `update` to the registry entry of `result`, if
+// it is registered.
+func (result *result_t) update_session(update func(*session_t)) {
+	kv_sessions_mutex.Lock()
+	defer kv_sessions_mutex.Unlock()
+	if session, found := kv_sessions[result]; found {
+		update(session)
+	}
+}
+
+// Set_lifetime records that the session should terminate within
+// `lifetime` since it started.
+func (result *result_t) set_lifetime(lifetime time.Duration) {
+	result.update_session(func(session *session_t) {
+		session.lifetime = lifetime
+	})
+}
+
+// Set_tenant changes the tenant of the session.
+func (result *result_t) set_tenant(tenant string) {
+	result.Tenant = tenant
+	result.update_session(func(session *session_t) {
+		session.tenant = tenant
+	})
+}
+
+// Session_info is the description of a live session exported by the
+// admin API. Bytes are from the point of view of the server.
+type session_info_t struct {
+	UUID          string    `json:"uuid"`
+	Protocol      string    `json:"protocol"`
+	Transport     string    `json:"transport"`
+	Tenant        string    `json:"tenant,omitempty"`
+	ClientAddress string    `json:"client_address"`
+	Phase         string    `json:"phase"`
+	StartTime     time.Time `json:"start_time"`
+	Age           float64   `json:"age"`
+	BytesSent     int64     `json:"bytes_sent"`
+	BytesReceived int64     `json:"bytes_received"`
+}
+
+// Live_sessions returns the description of the live sessions, oldest first.
+func live_sessions() []*session_info_t {
+	kv_sessions_mutex.Lock()
+	defer kv_sessions_mutex.Unlock()
+	infos := []*session_info_t{}
+	for result, session := range kv_sessions {
+		info := &session_info_t{
+			UUID:          result.UUID,
+			Protocol:      result.Protocol,
+			Transport:     result.Transport,
+			Tenant:        session.tenant,
+			ClientAddress: result.ClientAddress,
+			Phase:         session.phase,
+			StartTime:     session.start,
+			Age:           time.Since(session.start).Seconds(),
+		}
+		info.BytesSent, info.BytesReceived = result.session_bytes()
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].StartTime.Before(infos[j].StartTime)
+	})
+	return infos
+}
+
+// ServeSessions is an HTTP handler exporting the live sessions.
+func ServeSessions(w http.ResponseWriter, r *http.Request) {
+	data, err := json.Marshal(live_sessions())
+	if err != nil {
+		w.WriteHeader(500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// DrainTimeout is how long we wait for the live sessions to terminate
+// when asked to shut down.
+var DrainTimeout = 60 * time.Second
+
+// Kill_sessions forcibly terminates the sessions with `uuid` or from
+// `ip`, closing their control and data connections, and returns how many
+// they were. Empty arguments do not match any session. Since we match `ip`
+// against the client address as the admin API exports it, when addresses
+// are anonymized `ip` selects all the sessions from its network.
+func kill_sessions(uuid string, ip string) int {
+	kv_sessions_mutex.Lock()
+	defer kv_sessions_mutex.Unlock()
+	if ip != "" {
+		ip = common.AnonymizeIP(ip)
+	}
+	count := 0
+	for result, session := range kv_sessions {
+		if (uuid == "" || result.UUID != uuid) &&
+			(ip == "" || result.ClientAddress != ip) {
+			continue
+		}
+		log.Printf("ndt: session %s killed by the operator", result.UUID)
+		result.kill(kv_kill_operator)
+		session.conn.Close()
+		for _, conn := range result.data_conns {
+			conn.Close()
+		}
+		count += 1
+	}
+	return count
+}
+
+// ServeKillSession is an HTTP handler terminating the sessions selected
+// by the `uuid` or `ip` POST parameter.
+func ServeKillSession(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	uuid, ip := r.FormValue("uuid"), r.FormValue("ip")
+	if uuid == "" && ip == "" {
+		http.Error(w, "missing uuid or ip", http.StatusBadRequest)
+		return
+	}
+	count := kill_sessions(uuid, ip)
+	if count == 0 {
+		http.Error(w, "no such session", http.StatusNotFound)
+		return
+	}
+	data, _ := json.Marshal(map[string]int{"killed": count})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// Drain stops admitting new sessions and waits up to `timeout` for the
+// live ones to terminate and for their results to be stored. It returns
+// the number of sessions still alive or whose results are still pending.
+func Drain(timeout time.Duration) int {
+	hostload.StartDraining()
+	deadline := time.Now().Add(timeout)
+	for {
+		kv_sessions_mutex.Lock()
+		count := len(kv_sessions)
+		kv_sessions_mutex.Unlock()
+		count += int(atomic.LoadInt32(&kv_pending_saves))
+		if count == 0 || !time.Now().Before(deadline) {
+			return count
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
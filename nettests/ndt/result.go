@@ -0,0 +1,192 @@
+package ndt
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/neubot/botticelli/common"
+	"github.com/neubot/botticelli/common/asn"
+	"github.com/neubot/botticelli/common/events"
+	"github.com/neubot/botticelli/common/hostload"
+	"github.com/neubot/botticelli/common/results"
+)
+
+// Results of a single session, saved on disk when it ends. We wrap the
+// protocol independent model to add the state we need internally.
+
+type test_result_t struct {
+	*results.Measurement
+	session   *result_t
+	uuid      string
+	transport string
+	tenant    string
+	policy    *policy_t
+	web100    string
+	samples   []sample_t
+	loaded    rtt_samples_t
+}
+
+type result_t struct {
+	*results.Result
+	client_ip    string
+	killed       int32
+	policy       *policy_t
+	web100       string
+	control_conn *common.CountingConn
+	data_conns   []*common.CountingConn
+	udp          udp_stats_t
+
+	// Client speeds that did not arrive in time, and may arrive later
+	late_speeds int
+}
+
+func new_result(cc net.Conn, transport string, tenant string) *result_t {
+	uuid, err := common.NewUUID()
+	if err != nil {
+		log.Println("ndt: cannot generate UUID for session")
+	}
+	ip := client_ip(cc)
+	return &result_t{Result: &results.Result{
+		UUID:            uuid,
+		Tenant:          tenant,
+		ServerVersion:   common.Version,
+		ServerCommit:    common.Commit,
+		ServerBuildDate: common.BuildDate,
+		ServerMeta:      common.ServerMeta(),
+		Protocol:        "ndt5",
+		ClientAddress:   common.AnonymizeIP(ip),
+		ClientASN:       asn.Lookup(ip),
+		ServerSpeed:     hostload.InterfaceSpeed,
+		Environment:     hostload.Environment,
+		Transport:       transport,
+		StartTime:       time.Now(),
+		Meta:            make(map[string]string),
+	}, client_ip: ip, policy: default_policy()}
+}
+
+// New_test adds a new measurement named `name` to the session.
+func (result *result_t) new_test(name string,
+	direction string) *test_result_t {
+	measurement := &results.Measurement{Name: name, Direction: direction}
+	result.Measurements = append(result.Measurements, measurement)
+	return &test_result_t{
+		Measurement: measurement,
+		session:     result,
+		uuid:        result.UUID,
+		transport:   result.Transport,
+		tenant:      result.Tenant,
+		policy:      result.policy,
+	}
+}
+
+// Add_meta records a `key:value` metadata string sent by the client.
+func (result *result_t) add_meta(message string) error {
+	pair := strings.SplitN(message, ":", 2)
+	if len(pair) != 2 {
+		err := deviation("malformed_metadata")
+		if err == nil {
+			log.Println("ndt: ignoring malformed metadata from client")
+		}
+		return err
+	}
+	result.Meta[strings.TrimSpace(pair[0])] = strings.TrimSpace(pair[1])
+	return nil
+}
+
+// Publish_test publishes a compact event describing a completed test.
+func (result *result_t) publish_test(test *test_result_t) {
+	events.Publish(result.Protocol+"."+test.Name, map[string]interface{}{
+		"uuid":           result.UUID,
+		"tenant":         result.Tenant,
+		"client_address": result.ClientAddress,
+		"protocol":       result.Protocol,
+		"test":           test.Name,
+		"direction":      test.Direction,
+		"speed_kbits":    test.SpeedKbits,
+		"client_speed":   test.ClientSpeed,
+		"time":           time.Now(),
+	})
+}
+
+// Results_variables returns what we tell the client in MSG_RESULTS about
+// the tests of the session, i.e. the retransmissions, the losses and the
+// bufferbloat, as `name: value` lines, filtered by ResultsVariables.
+// Returns an empty string when we do not know anything.
+func (result *result_t) results_variables() string {
+	variables := ""
+	for _, test := range result.Measurements {
+		variables += loss_variables(test)
+		variables += bloat_variables(test)
+	}
+	return filter_variables(variables)
+}
+
+// Log_summary emits a single line summarizing the session, designed to
+// be easy to process with grep and awk.
+func (result *result_t) log_summary() {
+	end_time := result.EndTime
+	if end_time.IsZero() {
+		end_time = time.Now()
+	}
+	outcome := result.Outcome
+	if outcome == "" {
+		outcome = "unknown"
+	}
+	line := fmt.Sprintf("ndt: summary uuid=%s client=%s version=%q tests=%d "+
+		"duration=%.3f", result.UUID, result.ClientAddress,
+		result.ClientVersion, result.Tests,
+		end_time.Sub(result.StartTime).Seconds())
+	for _, test := range result.Measurements {
+		line += fmt.Sprintf(" %s_kbits=%.0f %s_elapsed=%.3f", test.Name,
+			test.SpeedKbits, test.Name, test.Elapsed)
+	}
+	line += " outcome=" + outcome
+	if result.FailureReason != "" {
+		line += " stage=" + result.FailureStage
+		line += " reason=" + result.FailureReason
+	}
+	log.Println(line)
+}
+
+// Number of results that we are still storing in the background, which
+// Drain waits for, such that we do not lose them when shutting down.
+var kv_pending_saves int32
+
+// Save stores the result and notifies the webhooks. With reverse DNS
+// enabled, it does that in the background, after the lookup, such that
+// the lookup does not delay the end of the session.
+func (result *result_t) save() {
+	if result.UUID == "" {
+		return
+	}
+	result.EndTime = time.Now()
+	result.account_traffic()
+	result.UDP = result.udp.summary()
+	rdns := common.ReverseDNS && !common.AnonymizeAddresses
+	if !rdns && !Traceroute {
+		result.store()
+		return
+	}
+	atomic.AddInt32(&kv_pending_saves, 1)
+	go func() {
+		defer atomic.AddInt32(&kv_pending_saves, -1)
+		defer track_goroutine("post_test")()
+		if rdns {
+			result.ClientHostname = common.ReverseLookup(result.client_ip)
+		}
+		result.trace_route()
+		result.store()
+	}()
+}
+
+func (result *result_t) store() {
+	err := results.Save(result.Result)
+	if err != nil {
+		log.Printf("ndt: cannot save results: %s", err)
+	}
+	events.Webhook(result.Result)
+}
@@ -0,0 +1,155 @@
+package ndt
+
+// Round-trip time of the control channel, both when the path is idle,
+// i.e. before the tests, and when a test is loading it. The idle RTT is
+// what the kernel measured on the control connection, or, without kernel
+// statistics, the time between sending TEST_START and receiving the first
+// response of the client. The ndt5 control channel is silent during the
+// tests, hence the loaded RTT is the smoothed RTT of the data streams,
+// which share the bottleneck with it, or, in uploads, the RTT estimated by
+// the receiver. In ndt7, the same connection carries control and data,
+// and without kernel statistics we use the pings. The ratio between the
+// loaded and the idle RTT tells how much the bottleneck queues inflate the
+// latency when the path is busy, i.e. the bufferbloat.
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/neubot/botticelli/common/results"
+	"github.com/neubot/botticelli/common/tcpinfo"
+)
+
+// Before this much time has elapsed, TCP is still in slow start and the
+// queues are not full, hence the path is not loaded yet.
+const kv_loaded_rtt_warmup = time.Second
+
+// The RTT samples observed so far, safe for concurrent use.
+type rtt_samples_t struct {
+	mutex  sync.Mutex
+	values []time.Duration
+}
+
+func (rtt *rtt_samples_t) observe(value time.Duration) {
+	if value > 0 {
+		rtt.mutex.Lock()
+		rtt.values = append(rtt.values, value)
+		rtt.mutex.Unlock()
+	}
+}
+
+// Mean returns the mean of the samples, or zero without samples.
+func (rtt *rtt_samples_t) mean() time.Duration {
+	rtt.mutex.Lock()
+	defer rtt.mutex.Unlock()
+	if len(rtt.values) == 0 {
+		return 0
+	}
+	sum := time.Duration(0)
+	for _, value := range rtt.values {
+		sum += value
+	}
+	return sum / time.Duration(len(rtt.values))
+}
+
+// Percentile returns the `p`-th percentile of the samples, using the
+// nearest rank method, or zero without samples.
+func (rtt *rtt_samples_t) percentile(p float64) time.Duration {
+	rtt.mutex.Lock()
+	defer rtt.mutex.Unlock()
+	if len(rtt.values) == 0 {
+		return 0
+	}
+	sorted := append([]time.Duration{}, rtt.values...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	rank := int(math.Ceil(p/100.0*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return sorted[rank]
+}
+
+// Set_idle_rtt records `rtt` as the idle RTT of the session, unless we
+// already know it.
+func (result *result_t) set_idle_rtt(rtt time.Duration) {
+	if result.IdleRTT <= 0 && rtt > 0 {
+		result.IdleRTT = rtt.Seconds() * 1000.0
+	}
+}
+
+// Set_kernel_idle_rtt records the RTT the kernel measured on `conn`, if
+// any, as the idle RTT of the session. Call it before loading the path.
+func (result *result_t) set_kernel_idle_rtt(conn net.Conn) {
+	if conn == nil {
+		return
+	}
+	info, err := tcpinfo.Get(conn)
+	if err == nil {
+		result.set_idle_rtt(info_rtt(info))
+	}
+}
+
+// Sample_loaded_rtt samples the RTT of `conns`, unless the test, which
+// started at `start`, is still warming up.
+func (test *test_result_t) sample_loaded_rtt(conns []net.Conn,
+	start time.Time) {
+	if time.Since(start) < kv_loaded_rtt_warmup {
+		return
+	}
+	for _, conn := range conns {
+		info, err := tcpinfo.Get(conn)
+		if err != nil {
+			continue
+		}
+		if test.Direction == results.Upload {
+			// We only send ACKs, hence our RTT is stale
+			test.loaded.observe(time.Duration(info.RcvRTT) *
+				time.Microsecond)
+		} else {
+			test.loaded.observe(time.Duration(info.RTT) * time.Microsecond)
+		}
+	}
+}
+
+// Set_loaded_rtt records the mean and the 95th percentile of the RTT
+// observed while the test was running.
+func (test *test_result_t) set_loaded_rtt() {
+	if rtt := test.loaded.mean(); rtt > 0 {
+		test.LoadedRTT = rtt.Seconds() * 1000.0
+		test.LoadedRTTP95 = test.loaded.percentile(95).Seconds() * 1000.0
+	}
+}
+
+// Set_bufferbloat compares the RTT under load with the baseline RTT, i.e.
+// the idle RTT of the session or, if unknown, the minimum RTT of the test.
+// Call it after the minimum RTT is known.
+func (test *test_result_t) set_bufferbloat() {
+	baseline := test.session.IdleRTT
+	if baseline <= 0 {
+		baseline = test.MinRTT
+	}
+	if baseline <= 0 || test.LoadedRTT <= 0 {
+		return
+	}
+	test.BaselineRTT = baseline
+	test.BloatRatio = test.LoadedRTT / baseline
+}
+
+// Bloat_variables formats the bufferbloat figures of `test` as `name:
+// value` lines (see loss_variables).
+func bloat_variables(test *results.Measurement) string {
+	if test.BloatRatio <= 0 {
+		return ""
+	}
+	variables := fmt.Sprintf("%s_baseline_rtt_ms: %f\n", test.Name,
+		test.BaselineRTT)
+	variables += fmt.Sprintf("%s_loaded_rtt_ms: %f\n", test.Name,
+		test.LoadedRTT)
+	variables += fmt.Sprintf("%s_bloat_ratio: %f\n", test.Name,
+		test.BloatRatio)
+	return variables
+}
@@ -0,0 +1,148 @@
+package ndt
+
+// Single session per IP. Tests run in parallel by the same host compete for
+// the same access link and invalidate each other's results, hence we may
+// refuse a session while another one from the same IP is running, or make
+// it wait until the other one is done. A waiting ndt5 client receives
+// queue messages and heartbeats, as in the admission queue, while ndt7
+// clients, which have no queue, wait before upgrading, for a short time.
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/neubot/botticelli/common"
+	"github.com/neubot/botticelli/common/metrics"
+)
+
+// SameIP is the policy for concurrent sessions from the same IP, that is
+// "allow", "reject", or "queue".
+var SameIP = "allow"
+
+// How long a ndt7 client waits for the other session from its IP in queue
+// mode, before being refused. Clients do not wait long for the upgrade.
+const kv_same_ip_brief_wait = 10 * time.Second
+
+var kv_same_ip_sessions = make(map[string]int)
+var kv_same_ip_mutex sync.Mutex
+
+var kv_error_same_ip = errors.New("ndt: another session from this IP")
+
+var kv_same_ip_refused = metrics.NewCounterVec("ndt_same_ip_refused_total",
+	"Sessions refused because another session from the same IP was running.",
+	"protocol")
+
+// LoadSameIP validates SameIP.
+func LoadSameIP() error {
+	switch SameIP {
+	case "allow", "reject", "queue":
+		return nil
+	}
+	return errors.New("ndt: invalid same IP policy: " + SameIP)
+}
+
+// Same_ip_enter registers a session from `ip` and returns the function
+// unregistering it, or nil if the policy does not allow the session to
+// start now.
+func same_ip_enter(ip string) func() {
+	kv_same_ip_mutex.Lock()
+	defer kv_same_ip_mutex.Unlock()
+	if SameIP != "allow" && kv_same_ip_sessions[ip] > 0 {
+		return nil
+	}
+	kv_same_ip_sessions[ip] += 1
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			kv_same_ip_mutex.Lock()
+			kv_same_ip_sessions[ip] -= 1
+			if kv_same_ip_sessions[ip] <= 0 {
+				delete(kv_same_ip_sessions, ip)
+			}
+			kv_same_ip_mutex.Unlock()
+		})
+	}
+}
+
+// Same_ip_wait registers the ndt5 session of the client on `cc`, waiting
+// in queue mode until the other session from its IP is done, and returns
+// the function unregistering it. If the session is refused, it tells the
+// client that we're busy and returns kv_error_same_ip.
+func same_ip_wait(cc net.Conn, reader *bufio.Reader,
+	writer *bufio.Writer) (func(), error) {
+	ip := client_ip(cc)
+	deadline := time.Now().Add(kv_queue_max_wait)
+	last_heartbeat := time.Now()
+	for waiting := false; ; time.Sleep(kv_queue_poll_interval) {
+		release := same_ip_enter(ip)
+		if release != nil {
+			return release, nil
+		}
+		if SameIP != "queue" || time.Now().After(deadline) {
+			common.Infof("ndt: %s is already running a session; telling "+
+				"it we're busy", ip)
+			kv_same_ip_refused.Inc("ndt5")
+			write_standard_message(cc, writer, kv_srv_queue,
+				kv_srv_queue_server_busy)
+			return nil, kv_error_same_ip
+		}
+		if !waiting {
+			common.Infof("ndt: %s is already running a session; "+
+				"waiting for it to complete", ip)
+			err := write_queue_position(cc, writer, 1)
+			if err != nil {
+				return nil, err
+			}
+			waiting = true
+		}
+		err := queue_probe(cc, reader)
+		if err != nil {
+			return nil, err
+		}
+		if time.Since(last_heartbeat) >= kv_queue_heartbeat_interval {
+			err = queue_heartbeat(cc, reader, writer)
+			if err != nil {
+				return nil, err
+			}
+			last_heartbeat = time.Now()
+		}
+	}
+}
+
+// Request_ip returns the IP address of the client that sent `r`.
+func request_ip(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Same_ip_wait_briefly is like same_ip_wait, for the clients of `protocol`
+// that have no queue messages, which only wait for a short time, unless
+// `done` is closed. It returns nil if the session is refused.
+func same_ip_wait_briefly(ip string, protocol string,
+	done <-chan struct{}) func() {
+	deadline := time.Now().Add(kv_same_ip_brief_wait)
+	for {
+		release := same_ip_enter(ip)
+		if release != nil {
+			return release
+		}
+		if SameIP != "queue" || time.Now().After(deadline) {
+			common.Infof("ndt: %s is already running a session",
+				common.AnonymizeIP(ip))
+			kv_same_ip_refused.Inc(protocol)
+			return nil
+		}
+		select {
+		case <-done:
+			return nil
+		case <-time.After(kv_queue_poll_interval):
+		}
+	}
+}
@@ -0,0 +1,540 @@
+package ndt
+
+// Self test. We start the servers on the loopback interface and run the
+// built-in client against them for each supported test, checking that the
+// results are plausible and that, once each test is over, all the goroutines
+// serving it terminate. This is meant as a one-command smoke test for
+// deployments, not as a measurement tool.
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/neubot/bernini"
+	"github.com/neubot/botticelli/common"
+)
+
+const kv_selftest_version = "v3.7.0 (botticelli selftest)"
+
+type selftest_t struct {
+	name string
+	run  func() error
+}
+
+// Selftest_listen starts the legacy NDT and the WebSocket servers on the
+// loopback interface and returns the address of the former, the URL of the
+// latter and the function stopping both.
+func selftest_listen() (string, string, func(), error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", "", nil, err
+	}
+	go serve(listener, "")
+	ws_listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		listener.Close()
+		return "", "", nil, err
+	}
+	go websocket_server("").Serve(
+		&common.CountingListener{Listener: ws_listener})
+	return listener.Addr().String(), "ws://" + ws_listener.Addr().String(),
+		func() {
+			listener.Close()
+			ws_listener.Close()
+		}, nil
+}
+
+// Selftest_tests returns the self tests, which run against the servers
+// listening on `address` and `ws_url` (see selftest_listen).
+func selftest_tests(address string, ws_url string) []selftest_t {
+	tests := []selftest_t{}
+	for _, test := range kv_tests_order {
+		test := test
+		tests = append(tests, selftest_t{
+			name: "ndt5_" + test_name(test),
+			run: func() error {
+				return selftest_ndt5(address, test)
+			},
+		})
+	}
+	tests = append(tests, selftest_t{
+		name: "ndt7_download",
+		run: func() error {
+			return selftest_ndt7_download(ws_url + kv_ndt7_download_path)
+		},
+	}, selftest_t{
+		name: "ndt7_upload",
+		run: func() error {
+			return selftest_ndt7_upload(ws_url + kv_ndt7_upload_path)
+		},
+	})
+	return tests
+}
+
+// Selftest runs each supported test against servers listening on the
+// loopback interface and returns an error if any of them fails.
+func Selftest() error {
+	address, ws_url, stop, err := selftest_listen()
+	if err != nil {
+		return err
+	}
+	defer stop()
+	tests := selftest_tests(address, ws_url)
+	failed := 0
+	for _, test := range tests {
+		log.Printf("selftest: running %s", test.name)
+		before := goroutines_snapshot()
+		err := test.run()
+		if err == nil {
+			err = before.check_leaks()
+		}
+		if err != nil {
+			log.Printf("selftest: %s: FAIL: %s", test.name, err)
+			failed += 1
+			continue
+		}
+		log.Printf("selftest: %s: ok", test.name)
+	}
+	if failed > 0 {
+		return errors.New("ndt: " + strconv.Itoa(failed) + " of " +
+			strconv.Itoa(len(tests)) + " self tests failed")
+	}
+	return nil
+}
+
+// Test_name returns the name of the test with ID `test`.
+func test_name(test int) string {
+	switch test {
+	case kv_test_s2c_ext:
+		return "s2c_ext"
+	case kv_test_s2c:
+		return "s2c"
+	case kv_test_c2s_ext:
+		return "c2s_ext"
+	case kv_test_c2s:
+		return "c2s"
+	case kv_test_meta:
+		return "meta"
+	}
+	return strconv.Itoa(test)
+}
+
+/*
+ _   _ ____ _____ ____
+| \ | |  _ \_   _| ___|
+|  \| | | | || | |___ \
+| |\  | |_| || |  ___) |
+|_| \_|____/ |_| |____/
+
+*/
+
+// Time we wait for each control message, which must also cover the
+// time it takes to run a throughput test.
+const kv_selftest_message_timeout = kv_test_duration + kv_session_overhead
+
+func selftest_read(cc net.Conn, reader *bufio.Reader,
+	expected byte) (string, error) {
+	msg_type, msg_body, err := read_standard_message_within(cc, reader,
+		kv_selftest_message_timeout)
+	if err != nil {
+		return "", err
+	}
+	if msg_type != expected {
+		return "", errors.New("ndt: unexpected message type " +
+			strconv.Itoa(int(msg_type)))
+	}
+	return msg_body, nil
+}
+
+// Selftest_wait_queue reads SRV_QUEUE messages until the server tells us
+// that we can start, answering its heartbeats.
+func selftest_wait_queue(cc net.Conn, reader *bufio.Reader,
+	writer *bufio.Writer) error {
+	for {
+		body, err := selftest_read(cc, reader, kv_srv_queue)
+		if err != nil {
+			return err
+		}
+		switch body {
+		case "0":
+			return nil
+		case kv_srv_queue_heartbeat:
+			err = write_standard_message(cc, writer, kv_msg_waiting, "")
+			if err != nil {
+				return err
+			}
+		case kv_srv_queue_server_fault, kv_srv_queue_server_busy,
+			kv_srv_queue_server_busy_60s:
+			return errors.New("ndt: server is busy or faulty")
+		}
+	}
+}
+
+func selftest_ndt5(address string, test int) error {
+	cc, err := net.Dial("tcp", address)
+	if err != nil {
+		return err
+	}
+	defer cc.Close()
+	reader := bufio.NewReader(cc)
+	writer := bufio.NewWriter(cc)
+
+	data, err := json.Marshal(map[string]string{
+		"msg":   kv_selftest_version,
+		"tests": strconv.Itoa(test | kv_test_status),
+	})
+	if err != nil {
+		return err
+	}
+	err = write_message_internal(cc, writer, kv_msg_extended_login, data)
+	if err != nil {
+		return err
+	}
+	kickoff := make([]byte, len("123456 654321"))
+	_, err = io.ReadFull(reader, kickoff)
+	if err != nil {
+		return err
+	}
+	err = selftest_wait_queue(cc, reader, writer)
+	if err != nil {
+		return err
+	}
+	_, err = selftest_read(cc, reader, kv_msg_login) // banner
+	if err != nil {
+		return err
+	}
+	tests, err := selftest_read(cc, reader, kv_msg_login)
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(tests) != strconv.Itoa(test) {
+		return errors.New("ndt: server did not grant the test")
+	}
+
+	prepare, err := selftest_read(cc, reader, kv_test_prepare)
+	if err != nil {
+		return err
+	}
+	switch test {
+	case kv_test_s2c, kv_test_s2c_ext:
+		err = selftest_s2c(cc, reader, writer, prepare)
+	case kv_test_c2s, kv_test_c2s_ext:
+		err = selftest_c2s(cc, reader, writer, prepare)
+	case kv_test_meta:
+		err = selftest_meta(cc, reader, writer)
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = selftest_read(cc, reader, kv_msg_results)
+	if err != nil {
+		return err
+	}
+	_, err = selftest_read(cc, reader, kv_msg_logout)
+	return err
+}
+
+// Selftest_dial opens the data connections described by the body of the
+// TEST_PREPARE message, i.e., the port optionally followed by the
+// parameters of the extended test, the last of which is the number of
+// streams.
+func selftest_dial(cc net.Conn, prepare string) ([]net.Conn, error) {
+	fields := strings.Fields(prepare)
+	if len(fields) < 1 {
+		return nil, errors.New("ndt: invalid TEST_PREPARE message")
+	}
+	nstreams := 1
+	if len(fields) > 1 {
+		var err error
+		nstreams, err = strconv.Atoi(fields[len(fields)-1])
+		if err != nil {
+			return nil, err
+		}
+	}
+	host, _, err := net.SplitHostPort(cc.RemoteAddr().String())
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(kv_selftest_message_timeout)
+	conns := []net.Conn{}
+	for len(conns) < nstreams {
+		conn, err := net.Dial("tcp", net.JoinHostPort(host, fields[0]))
+		if err != nil {
+			for _, conn := range conns {
+				conn.Close()
+			}
+			return nil, err
+		}
+		conn.SetDeadline(deadline)
+		conns = append(conns, conn)
+	}
+	return conns, nil
+}
+
+func selftest_s2c(cc net.Conn, reader *bufio.Reader, writer *bufio.Writer,
+	prepare string) error {
+	conns, err := selftest_dial(cc, prepare)
+	if err != nil {
+		return err
+	}
+	_, err = selftest_read(cc, reader, kv_test_start)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	var received int64
+	var wg sync.WaitGroup
+	for _, conn := range conns {
+		wg.Add(1)
+		go func(conn net.Conn) {
+			defer wg.Done()
+			defer conn.Close()
+			count, _ := io.Copy(ioutil.Discard, conn)
+			atomic.AddInt64(&received, count)
+		}(conn)
+	}
+
+	msg_type, data, err := read_message_within(cc, reader,
+		kv_selftest_message_timeout)
+	if err != nil {
+		return err
+	}
+	if msg_type != kv_test_msg {
+		return errors.New("ndt: expected TEST_MSG from server")
+	}
+	message := &s2c_message_t{}
+	err = json.Unmarshal(data, message)
+	if err != nil {
+		return err
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	speed, err := strconv.ParseFloat(message.ThroughputValue, 64)
+	if err != nil {
+		return err
+	}
+	if speed <= 0 || received <= 0 {
+		return errors.New("ndt: no data received")
+	}
+	client_speed := 8.0 * float64(received) / 1000.0 / elapsed.Seconds()
+	err = write_standard_message(cc, writer, kv_test_msg,
+		strconv.FormatFloat(client_speed, 'f', -1, 64))
+	if err != nil {
+		return err
+	}
+	log.Printf("selftest: server %.0f kbit/s, client %.0f kbit/s", speed,
+		client_speed)
+
+	// In web100clt quirks mode, the web100 variables precede TEST_FINALIZE
+
+	for {
+		msg_type, _, err := read_standard_message_within(cc, reader,
+			kv_selftest_message_timeout)
+		if err != nil {
+			return err
+		}
+		if msg_type == kv_test_finalize {
+			return nil
+		}
+		if msg_type != kv_test_msg {
+			return errors.New("ndt: expected TEST_FINALIZE from server")
+		}
+	}
+}
+
+func selftest_c2s(cc net.Conn, reader *bufio.Reader, writer *bufio.Writer,
+	prepare string) error {
+	conns, err := selftest_dial(cc, prepare)
+	if err != nil {
+		return err
+	}
+	_, err = selftest_read(cc, reader, kv_test_start)
+	if err != nil {
+		return err
+	}
+
+	// We send until the server closes the data connections
+
+	output_buff := bernini.RandAsciiRemainder(buflen)
+	for _, conn := range conns {
+		go func(conn net.Conn) {
+			defer conn.Close()
+			for {
+				_, err := conn.Write(output_buff)
+				if err != nil {
+					return
+				}
+			}
+		}(conn)
+	}
+
+	body, err := selftest_read(cc, reader, kv_test_msg)
+	if err != nil {
+		return err
+	}
+	speed, err := strconv.ParseFloat(body, 64)
+	if err != nil {
+		return err
+	}
+	if speed <= 0 {
+		return errors.New("ndt: server received no data")
+	}
+	log.Printf("selftest: server %.0f kbit/s", speed)
+	_, err = selftest_read(cc, reader, kv_test_finalize)
+	return err
+}
+
+func selftest_meta(cc net.Conn, reader *bufio.Reader,
+	writer *bufio.Writer) error {
+	_, err := selftest_read(cc, reader, kv_test_start)
+	if err != nil {
+		return err
+	}
+	err = write_standard_message(cc, writer, kv_test_msg,
+		"client.application:botticelli-selftest")
+	if err != nil {
+		return err
+	}
+	err = write_standard_message(cc, writer, kv_test_msg, "")
+	if err != nil {
+		return err
+	}
+	_, err = selftest_read(cc, reader, kv_test_finalize)
+	return err
+}
+
+/*
+ _   _ ____ _____ _____
+| \ | |  _ \_   _|___  |
+|  \| | | | || |    / /
+| |\  | |_| || |   / /
+|_| \_|____/ |_|  /_/
+
+*/
+
+func selftest_ndt7_dial(url string) (*websocket.Conn, error) {
+	dialer := &websocket.Dialer{
+		Subprotocols:     []string{kv_ndt7_subprotocol},
+		HandshakeTimeout: kv_ndt7_io_timeout,
+	}
+	conn, _, err := dialer.Dial(url, nil)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetReadLimit(kv_ndt7_max_message_size)
+	return conn, nil
+}
+
+// Selftest_ndt7_measurement parses a measurement sent by the server and
+// returns the number of bytes it reports.
+func selftest_ndt7_measurement(data []byte) (int64, error) {
+	measurement := &ndt7_measurement_t{}
+	err := json.Unmarshal(data, measurement)
+	if err != nil {
+		return 0, err
+	}
+	if measurement.AppInfo == nil {
+		return 0, errors.New("ndt7: measurement without AppInfo")
+	}
+	return measurement.AppInfo.NumBytes, nil
+}
+
+func selftest_ndt7_download(url string) error {
+	conn, err := selftest_ndt7_dial(url)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(kv_selftest_message_timeout))
+	var received, reported int64
+	for {
+		msg_type, data, err := conn.ReadMessage()
+		if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if msg_type == websocket.BinaryMessage {
+			received += int64(len(data))
+			continue
+		}
+		reported, err = selftest_ndt7_measurement(data)
+		if err != nil {
+			return err
+		}
+	}
+	if received <= 0 || reported <= 0 {
+		return errors.New("ndt7: no data received")
+	}
+	log.Printf("selftest: server sent %d bytes, client received %d bytes",
+		reported, received)
+	return nil
+}
+
+func selftest_ndt7_upload(url string) error {
+	conn, err := selftest_ndt7_dial(url)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(kv_selftest_message_timeout))
+
+	// Read the measurements in the background while we upload
+
+	reported := make(chan int64, 1)
+	go func() {
+		var last int64
+		defer func() { reported <- last }()
+		for {
+			msg_type, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if msg_type != websocket.TextMessage {
+				continue
+			}
+			count, err := selftest_ndt7_measurement(data)
+			if err == nil {
+				last = count
+			}
+		}
+	}()
+
+	message := bernini.RandAsciiRemainder(kv_ndt7_min_message_size)
+	start := time.Now()
+	var sent int64
+	for time.Since(start) < kv_test_duration {
+		conn.SetWriteDeadline(time.Now().Add(kv_ndt7_io_timeout))
+		err = conn.WriteMessage(websocket.BinaryMessage, message)
+		if err != nil {
+			return err
+		}
+		sent += int64(len(message))
+	}
+	err = conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+		time.Now().Add(kv_ndt7_io_timeout))
+	if err != nil {
+		return err
+	}
+	last := <-reported
+	if sent <= 0 || last <= 0 {
+		return errors.New("ndt7: server received no data")
+	}
+	log.Printf("selftest: client sent %d bytes, server received %d bytes",
+		sent, last)
+	return nil
+}
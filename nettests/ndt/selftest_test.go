@@ -0,0 +1,110 @@
+package ndt
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/neubot/botticelli/common/hostload"
+)
+
+// TestMain starts the background goroutines the process starts, runs the
+// tests and checks that, once they are over, only the goroutines that
+// legitimately outlive them (see kv_leak_check_ignored) are left.
+func TestMain(m *testing.M) {
+	before := goroutines_snapshot()
+	hostload.MaxCPU = 1 // runs the watchdog, without refusing tests
+	hostload.Start()
+	code := m.Run()
+	if code == 0 {
+		err := before.check_leaks()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			code = 1
+		}
+	}
+	os.Exit(code)
+}
+
+// TestSessions runs each supported test against the servers listening on
+// the loopback interface, checking the leaks after each of them.
+func TestSessions(t *testing.T) {
+	if testing.Short() {
+		t.Skip("each test runs for ten seconds")
+	}
+	address, ws_url, stop, err := selftest_listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+	for _, test := range selftest_tests(address, ws_url) {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			before := goroutines_snapshot()
+			err := test.run()
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = before.check_leaks()
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// TestSessionsRefused checks that the sessions refused at admission do not
+// leave goroutines behind.
+func TestSessionsRefused(t *testing.T) {
+	address, ws_url, stop, err := selftest_listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+	before := goroutines_snapshot()
+	hostload.SetDrainMode(true)
+	defer hostload.SetDrainMode(false)
+	if selftest_ndt5(address, kv_test_s2c) == nil {
+		t.Fatal("ndt5 session not refused while draining")
+	}
+	if selftest_ndt7_download(ws_url+kv_ndt7_download_path) == nil {
+		t.Fatal("ndt7 session not refused while draining")
+	}
+	err = before.check_leaks()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestLeakCheck checks that the leak check notices a goroutine started
+// after the snapshot and ignores the background ones, such as the host
+// load watchdog, which TestMain starts.
+func TestLeakCheck(t *testing.T) {
+	before := goroutines_snapshot()
+	done := make(chan struct{})
+	go func() {
+		<-done
+	}()
+	if len(before.leaks()) != 1 {
+		t.Fatalf("expected one leak, got %q", before.leaks())
+	}
+	close(done)
+	err := before.check_leaks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	watchdog := "\ngithub.com/neubot/botticelli/common/hostload.run_watchdog("
+	found := false
+	for _, stack := range before.stacks {
+		if strings.Contains(stack, watchdog) {
+			found = true
+			if !leak_ignored(stack) {
+				t.Fatal("host load watchdog not ignored")
+			}
+		}
+	}
+	if !found {
+		t.Fatal("host load watchdog not running")
+	}
+}
@@ -0,0 +1,63 @@
+package ndt
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"time"
+
+	"github.com/neubot/botticelli/common"
+)
+
+// SendBatch is how many messages the S2C streams write with each system
+// call, using vectored writes, which reduces the overhead of the system
+// calls at high rates. One disables vectored writes.
+var SendBatch = 1
+
+// The maximum number of buffers of a writev, i.e. IOV_MAX on Linux.
+const kv_max_send_batch = 1024
+
+// LoadSendBatch validates SendBatch.
+func LoadSendBatch() error {
+	if SendBatch < 1 || SendBatch > kv_max_send_batch {
+		return errors.New("ndt: the send batch must be between 1 and 1024")
+	}
+	return nil
+}
+
+// Write_batch writes `buffers` on `conn`, with a single writev if `conn`
+// is a common.CountingConn wrapping a socket.
+func write_batch(conn net.Conn, buffers net.Buffers) error {
+	if counting, ok := conn.(*common.CountingConn); ok {
+		_, err := counting.WriteBuffers(&buffers)
+		return err
+	}
+	_, err := buffers.WriteTo(conn)
+	return err
+}
+
+// Sender_loop is the engine shared by all the tests sending data to the
+// client. It calls `send` until `duration` has elapsed since `start`,
+// `send` fails or `ctx` is cancelled. The bytes sent are counted by the
+// underlying common.CountingConn. Returns the error that caused `send`
+// to fail, if any. If pinning is enabled, the calling goroutine stays on
+// the same CPU until it returns.
+func sender_loop(ctx context.Context, send func() error, start time.Time,
+	duration time.Duration) error {
+	defer pin_sender()()
+	for {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		err := send()
+		if err != nil {
+			log.Printf("ndt: failed to write to client: %s", err)
+			return err
+		}
+		if time.Since(start) > duration {
+			common.Infof("ndt: enough time elapsed")
+			return nil
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package ndt
+
+// Load shedding based on the aggregate rate at which all the active S2C
+// tests are sending, compared with the capacity of the interface, so that
+// we do not start tests that would oversubscribe the link.
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/neubot/botticelli/common/hostload"
+	"github.com/neubot/botticelli/common/metrics"
+)
+
+// MaxSendShare is the fraction of hostload.InterfaceSpeed that active S2C
+// tests may use before new tests are refused. Zero disables shedding.
+var MaxSendShare = 0.0
+
+const kv_send_rate_interval = time.Second
+
+var kv_sent_bytes int64
+var kv_send_rate uint64 // bits of the float64 rate in bit/s
+var kv_send_rate_once sync.Once
+
+func init() {
+	metrics.NewGaugeFunc("ndt_send_rate_bits",
+		"Aggregate rate at which S2C tests are sending, in bit/s.",
+		send_rate)
+}
+
+// Account_sent records that a S2C test sent `count` bytes.
+func account_sent(count int) {
+	kv_send_rate_once.Do(func() { go run_send_rate_sampler() })
+	atomic.AddInt64(&kv_sent_bytes, int64(count))
+}
+
+func run_send_rate_sampler() {
+	last := atomic.LoadInt64(&kv_sent_bytes)
+	for {
+		time.Sleep(kv_send_rate_interval)
+		current := atomic.LoadInt64(&kv_sent_bytes)
+		rate := 8 * float64(current-last) / kv_send_rate_interval.Seconds()
+		atomic.StoreUint64(&kv_send_rate, math.Float64bits(rate))
+		last = current
+	}
+}
+
+// Send_rate returns the aggregate S2C rate in bit/s.
+func send_rate() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&kv_send_rate))
+}
+
+// Send_allow returns true if there is enough spare capacity on the
+// interface to start a new test.
+func send_allow() bool {
+	if MaxSendShare <= 0 || hostload.InterfaceSpeed <= 0 {
+		return true
+	}
+	return send_rate() < MaxSendShare*hostload.InterfaceSpeed*1e06
+}
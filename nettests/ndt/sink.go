@@ -0,0 +1,70 @@
+package ndt
+
+// Sink for the uploads. We read directly from the connections, without
+// bufio, which would only add a copy, into large buffers recycled across
+// tests, such that reading does not allocate and the server can sink
+// multi-gigabit uploads without becoming the bottleneck. We do not count
+// the bytes here: collect_streams samples the counting connections at
+// each interval.
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const kv_sink_buffer_size = 1 << 20
+
+var kv_sink_buffers = sync.Pool{
+	New: func() interface{} {
+		buffer := make([]byte, kv_sink_buffer_size)
+		return &buffer
+	},
+}
+
+// Sink reads and discards what the client sends on `conn` until EOF or
+// `deadline`, which are not errors. It calls `first_read`, if not nil,
+// as soon as the first data arrives.
+func sink(conn net.Conn, deadline time.Time, first_read func()) error {
+	err := conn.SetReadDeadline(deadline)
+	if err != nil {
+		return err
+	}
+	buffer := kv_sink_buffers.Get().(*[]byte)
+	defer kv_sink_buffers.Put(buffer)
+	for {
+		count, err := conn.Read(*buffer)
+		if count > 0 && first_read != nil {
+			first_read()
+			first_read = nil
+		}
+		var net_error net.Error
+		if errors.As(err, &net_error) && net_error.Timeout() {
+			return nil
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Discard reads and discards what `reader` returns until EOF, which is
+// not an error.
+func discard(reader io.Reader) error {
+	buffer := kv_sink_buffers.Get().(*[]byte)
+	defer kv_sink_buffers.Put(buffer)
+	for {
+		_, err := reader.Read(*buffer)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package ndt
+
+// Collection of TCP statistics in its own goroutine, such that slow
+// getsockopt calls never stall the goroutines moving data and snapshots
+// are taken at consistent intervals. Measurers abstract how we read the
+// statistics, which is getsockopt by default.
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/neubot/botticelli/common/tcpinfo"
+)
+
+type snapshot_t struct {
+	elapsed time.Duration
+	info    *tcpinfo.TCPInfo // nil when not available
+}
+
+// Measurers read the TCP statistics of a connection.
+type measurer_t interface {
+	measure() (*tcpinfo.TCPInfo, error)
+	close()
+}
+
+type sockopt_measurer_t struct {
+	conn net.Conn
+}
+
+func (measurer *sockopt_measurer_t) measure() (*tcpinfo.TCPInfo, error) {
+	return tcpinfo.Get(measurer.conn)
+}
+
+func (measurer *sockopt_measurer_t) close() {}
+
+// New_measurer returns the measurer to use for `conn`, which must be closed
+// when done: the first one enabled, among eBPF and netlink, or getsockopt.
+func new_measurer(conn net.Conn) measurer_t {
+	for _, constructor := range []func(net.Conn) measurer_t{
+		new_flowstats_measurer,
+		new_diag_measurer,
+	} {
+		measurer := constructor(conn)
+		if measurer != nil {
+			return measurer
+		}
+	}
+	return &sockopt_measurer_t{conn: conn}
+}
+
+// Start_snapshotter snapshots the TCP_INFO of `conn` every `interval`
+// and delivers the snapshots on the returned channel, until `group` is
+// stopped, in which case the returned channel is closed as well. If the
+// coordinator is not ready to receive, the snapshot is dropped.
+func start_snapshotter(group *group_t, conn net.Conn, start time.Time,
+	interval time.Duration) <-chan *snapshot_t {
+	snapshots := make(chan *snapshot_t, 1)
+	group.spawn("snapshotter", func(ctx context.Context) error {
+		defer close(snapshots)
+		measurer := new_measurer(conn)
+		defer measurer.close()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				snapshot := &snapshot_t{elapsed: now.Sub(start)}
+				info, err := measurer.measure()
+				if err == nil {
+					snapshot.info = info
+				}
+				select {
+				case snapshots <- snapshot:
+				default:
+				}
+			case <-ctx.Done():
+				return nil
+			}
+		}
+	})
+	return snapshots
+}
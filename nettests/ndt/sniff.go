@@ -0,0 +1,141 @@
+package ndt
+
+// Detection of clients speaking another protocol on the raw NDT port,
+// which would otherwise fail with a confusing error while reading the
+// login message. We peek at the first bytes sent by the client, which,
+// for NDT, are the header of the login message. Browsers and scanners
+// sending HTTP requests get a small page, or a redirect, explaining what
+// this port is for.
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/neubot/botticelli/common"
+	"github.com/neubot/botticelli/common/metrics"
+)
+
+// HTTPRedirect is where we redirect HTTP requests to the raw NDT port
+// (e.g., a page describing the service). When empty, we reply with a
+// small page.
+var HTTPRedirect = ""
+
+var kv_error_tls_on_plaintext = errors.New(
+	"ndt: client speaks TLS on the plaintext port")
+var kv_error_http_on_plaintext = errors.New(
+	"ndt: client speaks HTTP on the NDT port")
+
+// Prefixes of the HTTP requests we recognize, which are as long as the
+// header of NDT messages.
+var kv_http_methods = []string{"GET", "HEA", "POS", "PUT", "OPT", "DEL",
+	"PAT", "CON", "TRA"}
+
+const kv_http_page = `<!DOCTYPE html>
+<html><head><title>NDT server</title></head><body>
+<p>This is the control port of a NDT server, which only speaks the NDT
+protocol. Please, use a NDT client to measure your connection.</p>
+</body></html>
+`
+
+var kv_misdirected_total = metrics.NewCounterVec("ndt_misdirected_total",
+	"Number of connections to the raw NDT port speaking another protocol.",
+	"protocol")
+
+// Fatal handshake_failure alert, which makes TLS clients report a clear
+// error, rather than a connection reset.
+var kv_tls_handshake_failure = []byte{0x15, 0x03, 0x01, 0x00, 0x02, 0x02,
+	0x28}
+
+// Is_tls_client_hello returns true if `header` starts a TLS handshake
+// record, i.e. the ClientHello.
+func is_tls_client_hello(header []byte) bool {
+	return len(header) >= 3 && header[0] == 0x16 && header[1] == 0x03 &&
+		header[2] <= 0x04
+}
+
+// LoadHTTPRedirect validates HTTPRedirect.
+func LoadHTTPRedirect() error {
+	if HTTPRedirect == "" {
+		return nil
+	}
+	parsed, err := url.Parse(HTTPRedirect)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") ||
+		parsed.Host == "" || strings.ContainsAny(HTTPRedirect, "\r\n") {
+		return errors.New("ndt: invalid HTTP redirect: " + HTTPRedirect)
+	}
+	return nil
+}
+
+// Is_http_request returns true if `header` starts an HTTP request.
+func is_http_request(header []byte) bool {
+	for _, method := range kv_http_methods {
+		if string(header) == method {
+			return true
+		}
+	}
+	return false
+}
+
+// Write_http_response reads the HTTP request from `reader`, up to the
+// end of the headers, and replies with the page, omitted if `head` is
+// true, or the redirect.
+func write_http_response(cc net.Conn, reader *bufio.Reader, head bool) {
+	cc.SetReadDeadline(time.Now().Add(kv_control_header_timeout))
+	for {
+		line, err := reader.ReadSlice('\n') // bounded by the buffer size
+		if err != nil || strings.TrimSpace(string(line)) == "" {
+			break
+		}
+	}
+	cc.SetReadDeadline(time.Time{})
+	response := "HTTP/1.1 200 OK\r\n" +
+		"Content-Type: text/html; charset=utf-8\r\n" +
+		fmt.Sprintf("Content-Length: %d\r\n", len(kv_http_page)) +
+		"Connection: close\r\n\r\n"
+	if !head {
+		response += kv_http_page
+	}
+	if HTTPRedirect != "" {
+		response = "HTTP/1.1 302 Found\r\nLocation: " + HTTPRedirect +
+			"\r\nContent-Length: 0\r\nConnection: close\r\n\r\n"
+	}
+	cc.Write([]byte(response))
+}
+
+// Sniff_protocol fails if the client of `result`, which is connected
+// to the raw NDT port, does not speak NDT.
+func sniff_protocol(cc net.Conn, reader *bufio.Reader,
+	result *result_t) error {
+	cc.SetReadDeadline(time.Now().Add(kv_control_header_timeout))
+	header, err := reader.Peek(3)
+	cc.SetReadDeadline(time.Time{})
+	if err != nil {
+		var net_error net.Error
+		if errors.As(err, &net_error) && net_error.Timeout() {
+			return kv_error_message_timeout
+		}
+		return err
+	}
+	if is_tls_client_hello(header) {
+		log.Printf("ndt: session %s: %s sent a TLS ClientHello to the "+
+			"plaintext port; TLS clients must use WebSocket", result.UUID,
+			result.ClientAddress)
+		kv_misdirected_total.Inc("tls")
+		cc.Write(kv_tls_handshake_failure)
+		return kv_error_tls_on_plaintext
+	}
+	if is_http_request(header) {
+		common.Infof("ndt: session %s: %s sent an HTTP request to the NDT "+
+			"port", result.UUID, result.ClientAddress)
+		kv_misdirected_total.Inc("http")
+		write_http_response(cc, reader, string(header) == "HEA")
+		return kv_error_http_on_plaintext
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package ndt
+
+// Tenants allow a single process to serve several logical deployments.
+// Each listener is tagged with a tenant, which the tenant of the access
+// token, if any, overrides. The tenant namespaces the stored results and
+// labels the metrics.
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/neubot/botticelli/common"
+	"github.com/neubot/botticelli/common/results"
+)
+
+// Tenant is the tenant of the default listeners.
+var Tenant = ""
+
+// TenantListeners is a comma separated list of `tenant=address` pairs,
+// each describing an additional listener for legacy NDT clients.
+var TenantListeners = ""
+
+// TenantWebSocketListeners is like TenantListeners, except that it
+// describes additional WebSocket listeners, which also serve ndt7.
+var TenantWebSocketListeners = ""
+
+type tenant_listener_t struct {
+	tenant  string
+	address string
+}
+
+type tenant_key_t struct{}
+
+// Parse_tenant_listeners parses a list of `tenant=address` pairs.
+func parse_tenant_listeners(value string) ([]tenant_listener_t, error) {
+	listeners := []tenant_listener_t{}
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		fields := strings.SplitN(pair, "=", 2)
+		if len(fields) != 2 || fields[0] == "" || fields[1] == "" ||
+			!results.ValidTenant(fields[0]) {
+			return nil, errors.New("ndt: invalid tenant listener: " + pair)
+		}
+		listeners = append(listeners, tenant_listener_t{
+			tenant:  fields[0],
+			address: fields[1],
+		})
+	}
+	return listeners, nil
+}
+
+// Request_tenant returns the tenant of the listener that accepted `r`.
+func request_tenant(r *http.Request) string {
+	tenant, _ := r.Context().Value(tenant_key_t{}).(string)
+	return tenant
+}
+
+// Session_tenant returns the tenant of a session accepted by a listener
+// tagged with `tenant` and to which `policy` applies.
+func session_tenant(tenant string, policy *policy_t) string {
+	if policy.tenant == "" {
+		return tenant
+	}
+	if !results.ValidTenant(policy.tenant) {
+		log.Printf("ndt: ignoring invalid token tenant: %q", policy.tenant)
+		return tenant
+	}
+	return policy.tenant
+}
+
+// Websocket_server returns the server for WebSocket listeners of `tenant`.
+func websocket_server(tenant string) *http.Server {
+	return &http.Server{
+		Handler: websocket_mux(),
+		BaseContext: func(net.Listener) context.Context {
+			return context.WithValue(context.Background(), tenant_key_t{},
+				tenant)
+		},
+	}
+}
+
+// StartTenants validates the tenants configuration and starts in the
+// background the additional listeners of each tenant.
+func StartTenants() error {
+	if !results.ValidTenant(Tenant) {
+		return errors.New("ndt: invalid tenant: " + Tenant)
+	}
+	raw_listeners, err := parse_tenant_listeners(TenantListeners)
+	if err != nil {
+		return err
+	}
+	ws_listeners, err := parse_tenant_listeners(TenantWebSocketListeners)
+	if err != nil {
+		return err
+	}
+	for _, config := range raw_listeners {
+		listener, err := common.ListenTest(config.address)
+		if err != nil {
+			return err
+		}
+		go serve(listener, config.tenant)
+	}
+	for _, config := range ws_listeners {
+		listener, err := common.ListenTest(config.address)
+		if err != nil {
+			return err
+		}
+		go serve_websocket(listener, config.tenant)
+	}
+	return nil
+}
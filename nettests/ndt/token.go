@@ -0,0 +1,110 @@
+package ndt
+
+// Access tokens granted by an external scheduler, either pre-established
+// or signed JWTs. Clients that present a valid token have already been
+// granted a slot and hence go to the front of the admission queue, unless
+// the token assigns them to a priority lane (see queue_priority). They still
+// wait for the running test, if any, since tests cannot run concurrently.
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/neubot/botticelli/common/jwt"
+)
+
+// AccessTokensFile is the file containing the valid access tokens, one
+// per line. When empty, access tokens are not used.
+var AccessTokensFile = ""
+
+// TokenPublicKeyFile is the file containing the public key of the issuer
+// of JWT access tokens. When empty, JWT access tokens are not used.
+var TokenPublicKeyFile = ""
+
+// TokenAudience is the audience that JWT access tokens must be issued for,
+// typically the hostname of this server. When empty, it is not checked.
+var TokenAudience = ""
+
+// TokenRequired controls whether clients without a valid access token are
+// refused, so that capacity is only granted by the scheduler.
+var TokenRequired = false
+
+// TokenMaxLifetime is the maximum time for which a JWT access token may be
+// valid, such that a leaked token cannot be reused forever.
+var TokenMaxLifetime = 1 * time.Hour
+
+var kv_error_missing_token = errors.New("ndt: missing or invalid " +
+	"access token")
+
+var kv_access_tokens = make(map[string]bool)
+var kv_access_tokens_mutex sync.Mutex
+var kv_token_public_key ed25519.PublicKey
+
+// LoadAccessTokens validates TokenMaxLifetime and (re)loads the valid access
+// tokens from AccessTokensFile and the JWT issuer public key from
+// TokenPublicKeyFile.
+func LoadAccessTokens() error {
+	if TokenMaxLifetime <= 0 {
+		return errors.New("ndt: the token max lifetime must be positive")
+	}
+	if TokenPublicKeyFile != "" {
+		key, err := jwt.LoadPublicKey(TokenPublicKeyFile)
+		if err != nil {
+			return err
+		}
+		kv_token_public_key = key
+	}
+	if AccessTokensFile == "" {
+		return nil
+	}
+	file, err := os.Open(AccessTokensFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	tokens := make(map[string]bool)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		token := strings.TrimSpace(scanner.Text())
+		if token != "" && !strings.HasPrefix(token, "#") {
+			tokens[token] = true
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+	kv_access_tokens_mutex.Lock()
+	kv_access_tokens = tokens
+	kv_access_tokens_mutex.Unlock()
+	return nil
+}
+
+// Access_policy returns whether `token` is a valid access token along
+// with the policy attached to it, or the default policy.
+func access_policy(token string) (*policy_t, bool) {
+	if token == "" {
+		return default_policy(), false
+	}
+	kv_access_tokens_mutex.Lock()
+	found := kv_access_tokens[token]
+	kv_access_tokens_mutex.Unlock()
+	if found {
+		return default_policy(), true
+	}
+	if kv_token_public_key == nil {
+		return default_policy(), false
+	}
+	claims, err := jwt.Verify(token, kv_token_public_key, TokenAudience,
+		TokenMaxLifetime, time.Now())
+	if err != nil {
+		log.Printf("ndt: invalid access token: %s", err)
+		return default_policy(), false
+	}
+	return new_policy(claims.Payload), true
+}
@@ -0,0 +1,62 @@
+package ndt
+
+// Traceroute towards the client, after the tests, to diagnose the path. We
+// run it in the background, before saving the results, such that it does
+// not delay the client, and we bound the number of traceroutes running at
+// the same time, skipping the sessions that find no free slot.
+
+import (
+	"log"
+	"time"
+
+	"github.com/neubot/botticelli/common"
+	"github.com/neubot/botticelli/common/metrics"
+	"github.com/neubot/botticelli/common/results"
+	"github.com/neubot/botticelli/common/traceroute"
+)
+
+// Traceroute enables tracing the route to the clients after the tests.
+var Traceroute = false
+
+const kv_traceroute_max_hops = 30
+const kv_traceroute_timeout = time.Second
+
+var kv_traceroute_slots = make(chan bool, 4)
+
+var kv_traceroutes_total = metrics.NewCounterVec("ndt_traceroutes_total",
+	"Traceroutes towards the clients, by outcome.", "outcome")
+
+// Trace_route traces the route to the client, if enabled and if the
+// session ran any test, and records the hops.
+func (result *result_t) trace_route() {
+	if !Traceroute || len(result.Measurements) == 0 {
+		return
+	}
+	select {
+	case kv_traceroute_slots <- true:
+		defer func() { <-kv_traceroute_slots }()
+	default:
+		kv_traceroutes_total.Inc("skipped")
+		return
+	}
+	hops, err := traceroute.Trace(result.client_ip, kv_traceroute_max_hops,
+		kv_traceroute_timeout)
+	if err != nil {
+		log.Printf("ndt: cannot trace route to %s: %s",
+			result.ClientAddress, err)
+		kv_traceroutes_total.Inc("failure")
+	} else {
+		kv_traceroutes_total.Inc("success")
+	}
+	for _, hop := range hops {
+		address := hop.Address
+		if address != "" {
+			address = common.AnonymizeIP(address)
+		}
+		result.Traceroute = append(result.Traceroute, &results.Hop{
+			TTL:     hop.TTL,
+			Address: address,
+			RTT:     hop.RTT,
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package ndt
+
+// Accounting of the bytes exchanged by each session on the control and
+// on the data channels, as seen by the transport layer (i.e., including
+// the WebSocket and TLS overhead), such that operators can reconcile the
+// measurement traffic with their transit bills.
+
+import (
+	"net"
+
+	"github.com/neubot/botticelli/common"
+	"github.com/neubot/botticelli/common/metrics"
+	"github.com/neubot/botticelli/common/results"
+)
+
+var kv_bytes_total = metrics.NewCounterVec("ndt_bytes_total",
+	"Bytes exchanged by NDT sessions, by channel and direction.",
+	"channel", "direction", "transport", "tenant")
+
+// Wire_counter returns the counting connection closest to the wire
+// underlying `conn`, or nil if there is none.
+func wire_counter(conn net.Conn) *common.CountingConn {
+	if counting, ok := conn.(*common.CountingConn); ok {
+		if _, ok := counting.Conn.(*ws_conn_t); !ok {
+			return counting
+		}
+		conn = counting.Conn
+	}
+	if ws, ok := conn.(*ws_conn_t); ok {
+		counting, _ := ws_net_conn(ws.conn).(*common.CountingConn)
+		return counting
+	}
+	return nil
+}
+
+// Add_data_conns records that `conns` are data connections of the session.
+func (result *result_t) add_data_conns(conns []net.Conn) {
+	kv_sessions_mutex.Lock() // the registry reads them concurrently
+	defer kv_sessions_mutex.Unlock()
+	for _, conn := range conns {
+		counting := wire_counter(conn)
+		if counting == nil {
+			continue
+		}
+		result.data_conns = append(result.data_conns, counting)
+	}
+}
+
+// Account_traffic records the bytes exchanged by the session, which must
+// be over, and adds them to the metrics. It only does that once.
+func (result *result_t) account_traffic() {
+	if result.Traffic != nil {
+		return
+	}
+	traffic := &results.Traffic{}
+	if result.control_conn != nil {
+		traffic.ControlSent = result.control_conn.BytesWritten()
+		traffic.ControlReceived = result.control_conn.BytesRead()
+	}
+	for _, conn := range result.data_conns {
+		traffic.DataSent += conn.BytesWritten()
+		traffic.DataReceived += conn.BytesRead()
+	}
+	result.Traffic = traffic
+	for _, entry := range []struct {
+		channel   string
+		direction string
+		count     int64
+	}{
+		{"control", "egress", traffic.ControlSent},
+		{"control", "ingress", traffic.ControlReceived},
+		{"data", "egress", traffic.DataSent},
+		{"data", "ingress", traffic.DataReceived},
+	} {
+		kv_bytes_total.Add(float64(entry.count), entry.channel,
+			entry.direction, result.Transport, result.Tenant)
+	}
+}
@@ -0,0 +1,183 @@
+package ndt
+
+// UDP side-test. Clients may send a train of UDP probes to UDPAddress
+// during the session, which we echo back, such that the client measures
+// the round-trip time, while we measure the loss, the jitter, and the
+// variation of the one-way delay of the path from the client, independently
+// of TCP. We match probes to the live session of the same IP, and ignore
+// the probes of IPs without a session, such that the echo port cannot be
+// used to reflect traffic towards third parties. Each probe starts with
+// a big-endian 64 bit sequence number and a big-endian 64 bit timestamp,
+// in nanoseconds, taken by the client when sending it. The rest is padding.
+
+import (
+	"encoding/binary"
+	"errors"
+	"log"
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/neubot/botticelli/common"
+	"github.com/neubot/botticelli/common/metrics"
+	"github.com/neubot/botticelli/common/results"
+)
+
+// UDPAddress is the address where to echo the UDP probes of the clients.
+// When empty, the UDP side-test is disabled.
+var UDPAddress = ""
+
+const kv_udp_header_size = 16
+const kv_udp_max_size = 1472
+
+// We stop echoing the probes of a session after this many, so that a
+// client cannot use the echo port to load the server.
+const kv_udp_max_packets = 10000
+
+var kv_udp_packets = metrics.NewCounterVec("ndt_udp_packets_total",
+	"UDP probes received, by what we did with them.", "outcome")
+
+// Statistics of the probes of a session, safe for concurrent use. Times
+// are in nanoseconds. The transit time is the difference between when
+// we received the probe and when the client sent it, hence it includes
+// the offset between the clocks, which cancels out in the differences.
+type udp_stats_t struct {
+	mutex        sync.Mutex
+	packets      int64
+	first        uint64
+	last         uint64
+	jitter       float64
+	prev_transit int64
+	min_transit  int64
+	sum_transit  int64
+}
+
+// Observe records the probe with sequence number `seq`, sent at `sent`
+// and received at `received`. It returns false if the session has already
+// sent too many probes.
+func (stats *udp_stats_t) observe(seq uint64, sent, received int64) bool {
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+	if stats.packets >= kv_udp_max_packets {
+		return false
+	}
+	transit := received - sent
+	if stats.packets == 0 {
+		stats.first, stats.last = seq, seq
+		stats.min_transit = transit
+	} else {
+		// Interarrival jitter as defined by RFC 3550
+		delta := math.Abs(float64(transit - stats.prev_transit))
+		stats.jitter += (delta - stats.jitter) / 16
+	}
+	if seq < stats.first {
+		stats.first = seq
+	}
+	if seq > stats.last {
+		stats.last = seq
+	}
+	if transit < stats.min_transit {
+		stats.min_transit = transit
+	}
+	stats.sum_transit += transit
+	stats.prev_transit = transit
+	stats.packets += 1
+	return true
+}
+
+// Summary returns the statistics of the probes, or nil without probes.
+func (stats *udp_stats_t) summary() *results.UDP {
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+	if stats.packets == 0 {
+		return nil
+	}
+	summary := &results.UDP{
+		Packets:  stats.packets,
+		Expected: int64(stats.last-stats.first) + 1,
+		Jitter:   stats.jitter / 1e06,
+		Delay: float64(stats.sum_transit/stats.packets-
+			stats.min_transit) / 1e06,
+	}
+	if summary.Packets < summary.Expected {
+		summary.LossRate = 1 - float64(summary.Packets)/
+			float64(summary.Expected)
+	}
+	return summary
+}
+
+// Session_by_ip returns the session of `ip` that started last, or nil if
+// `ip` has no live session.
+func session_by_ip(ip string) *result_t {
+	kv_sessions_mutex.Lock()
+	defer kv_sessions_mutex.Unlock()
+	var found *result_t
+	for result, session := range kv_sessions {
+		if result.client_ip != ip {
+			continue
+		}
+		if found == nil || session.start.After(kv_sessions[found].start) {
+			found = result
+		}
+	}
+	return found
+}
+
+// StartUDP starts echoing the UDP probes in the background, if enabled.
+func StartUDP() {
+	if UDPAddress == "" {
+		return
+	}
+	address, err := common.ResolveAddress(UDPAddress)
+	if err != nil {
+		log.Fatal(err)
+	}
+	conn, err := common.ListenUDP(address)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("ndt: echoing UDP probes on %s", address)
+	go serve_udp(conn)
+}
+
+func serve_udp(conn net.PacketConn) {
+	buffer := make([]byte, kv_udp_max_size+1)
+	for {
+		count, addr, err := conn.ReadFrom(buffer)
+		if errors.Is(err, net.ErrClosed) {
+			return // handed off to the new instance
+		}
+		if err != nil {
+			log.Printf("ndt: cannot read UDP probe: %s", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		received := time.Now().UnixNano()
+		if count < kv_udp_header_size || count > kv_udp_max_size {
+			kv_udp_packets.Inc("malformed")
+			continue
+		}
+		udp_addr, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		result := session_by_ip(udp_addr.IP.String())
+		if result == nil {
+			kv_udp_packets.Inc("unmatched")
+			continue
+		}
+		seq := binary.BigEndian.Uint64(buffer[0:8])
+		sent := int64(binary.BigEndian.Uint64(buffer[8:16]))
+		if !result.udp.observe(seq, sent, received) {
+			kv_udp_packets.Inc("excess")
+			continue
+		}
+		_, err = conn.WriteTo(buffer[:count], addr)
+		if err != nil {
+			common.Infof("ndt: cannot echo UDP probe: %s", err)
+			continue
+		}
+		kv_udp_packets.Inc("echoed")
+	}
+}
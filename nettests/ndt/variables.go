@@ -0,0 +1,73 @@
+package ndt
+
+// Selection of the variables (i.e., the `name: value` lines) we send in
+// MSG_RESULTS and store in the results. Operators may restrict them, for
+// privacy or to save bandwidth, using patterns such as `s2c_*` or
+// `SndLim*`. By default, we send and store all of them, i.e. the losses
+// and the bufferbloat of each test (see loss.go and rtt.go) and the web100
+// variables (see web100.go). Note that web100clt needs the web100 ones.
+
+import (
+	"errors"
+	"path"
+	"strings"
+)
+
+// ResultsVariables is a comma separated list of patterns, with the syntax
+// of path.Match, of the variables we send and store.
+var ResultsVariables = "*"
+
+var kv_results_variables = []string{"*"}
+
+// LoadResultsVariables parses ResultsVariables.
+func LoadResultsVariables() error {
+	patterns := []string{}
+	for _, pattern := range strings.Split(ResultsVariables, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		_, err := path.Match(pattern, "")
+		if err != nil {
+			return errors.New("ndt: invalid results variable pattern: " +
+				pattern)
+		}
+		patterns = append(patterns, pattern)
+	}
+	kv_results_variables = patterns
+	return nil
+}
+
+// Variable_allowed returns true if we may send and store `name`.
+func variable_allowed(name string) bool {
+	for _, pattern := range kv_results_variables {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Filter_variables returns the lines of `variables` whose name is allowed.
+func filter_variables(variables string) string {
+	filtered := ""
+	for _, line := range strings.SplitAfter(variables, "\n") {
+		fields := strings.SplitN(line, ":", 2)
+		if len(fields) == 2 && variable_allowed(fields[0]) {
+			filtered += line
+		}
+	}
+	return filtered
+}
+
+// Variables_map returns the `name: value` lines of `variables` as map.
+func variables_map(variables string) map[string]string {
+	values := make(map[string]string)
+	for _, line := range strings.Split(variables, "\n") {
+		fields := strings.SplitN(line, ":", 2)
+		if len(fields) == 2 {
+			values[fields[0]] = strings.TrimSpace(fields[1])
+		}
+	}
+	return values
+}
@@ -0,0 +1,71 @@
+package ndt
+
+// Gauges tracking live sessions, data connections and goroutines, plus a
+// watchdog logging registered sessions that outlive their maximum
+// lifetime, which would indicate that we are leaking them.
+
+import (
+	"log"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/neubot/botticelli/common/metrics"
+)
+
+const kv_watchdog_interval = 10 * time.Second
+const kv_watchdog_grace = 30 * time.Second
+
+var kv_active_sessions = metrics.NewGaugeVec("ndt_active_sessions",
+	"Number of NDT sessions currently active.")
+
+var kv_active_data_conns = metrics.NewGaugeVec("ndt_active_data_connections",
+	"Number of NDT data connections currently open.")
+
+var kv_goroutines = metrics.NewGaugeVec("ndt_goroutines",
+	"Number of NDT goroutines currently running.", "subsystem")
+
+var kv_session_leaks_total = metrics.NewCounterVec("ndt_session_leaks_total",
+	"Number of NDT sessions that outlived their maximum lifetime.")
+
+func init() {
+	metrics.NewGaugeFunc("go_goroutines", "Number of goroutines.",
+		func() float64 { return float64(runtime.NumGoroutine()) })
+}
+
+var kv_watchdog_once sync.Once
+
+func run_watchdog() {
+	for {
+		time.Sleep(kv_watchdog_interval)
+		kv_sessions_mutex.Lock()
+		for result, session := range kv_sessions {
+			age := time.Since(session.start)
+			if session.reported || session.lifetime <= 0 ||
+				age < session.lifetime+kv_watchdog_grace {
+				continue
+			}
+			log.Printf("ndt: watchdog: session %s still alive after %s "+
+				"(lifetime %s): possible leak", result.UUID, age,
+				session.lifetime)
+			kv_session_leaks_total.Inc()
+			session.reported = true
+		}
+		kv_sessions_mutex.Unlock()
+	}
+}
+
+// Track_goroutine accounts for a goroutine of `subsystem` and returns the
+// function to be called when the goroutine terminates.
+func track_goroutine(subsystem string) func() {
+	kv_goroutines.Add(1, subsystem)
+	kv_goroutines_mutex.Lock()
+	kv_goroutines_count[subsystem] += 1
+	kv_goroutines_mutex.Unlock()
+	return func() {
+		kv_goroutines_mutex.Lock()
+		kv_goroutines_count[subsystem] -= 1
+		kv_goroutines_mutex.Unlock()
+		kv_goroutines.Add(-1, subsystem)
+	}
+}
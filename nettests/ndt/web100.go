@@ -0,0 +1,194 @@
+package ndt
+
+// Emulation of the web100 variables, which the reference server read from
+// the kernel and sent in MSG_RESULTS, and which legacy clients still parse
+// to analyze the connection. We map each variable to the TCP_INFO fields
+// carrying the same information; the variables without an equivalent are
+// sent anyway, with a value telling that they are unavailable, such that
+// clients can distinguish them from real zeroes. RTTs are in milliseconds,
+// like web100 does, while the other times are in microseconds.
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/neubot/botticelli/common/tcpinfo"
+)
+
+// Value of the variables we cannot emulate.
+const kv_web100_unavailable = "-1"
+
+// Options bits of TCP_INFO.
+const (
+	kv_tcpi_opt_timestamps = 1
+	kv_tcpi_opt_sack       = 2
+	kv_tcpi_opt_ecn        = 8
+)
+
+// Web100_variable_t maps a web100 variable to TCP_INFO, collected at the
+// end of a test that lasted `elapsed`. A nil `value` means unavailable.
+type web100_variable_t struct {
+	name  string
+	value func(info *tcpinfo.TCPInfo, elapsed time.Duration) uint64
+}
+
+func web100_flag(options uint8, bit uint8) uint64 {
+	if options&bit != 0 {
+		return 1
+	}
+	return 0
+}
+
+var kv_web100_variables = []web100_variable_t{
+	{"AckPktsIn", func(info *tcpinfo.TCPInfo, _ time.Duration) uint64 {
+		return uint64(info.SegsIn - info.DataSegsIn)
+	}},
+	{"AckPktsOut", nil},
+	{"BytesRetrans", func(info *tcpinfo.TCPInfo, _ time.Duration) uint64 {
+		return info.BytesRetrans
+	}},
+	{"CongAvoid", nil},
+	{"CongestionOverCount", nil},
+	{"CongestionSignals", nil},
+	{"CountRTT", func(*tcpinfo.TCPInfo, time.Duration) uint64 {
+		return 1 // avoid dividing by zero in web100clt
+	}},
+	{"CurCwnd", func(info *tcpinfo.TCPInfo, _ time.Duration) uint64 {
+		return uint64(info.SndCwnd) * uint64(info.SndMSS)
+	}},
+	{"CurMSS", func(info *tcpinfo.TCPInfo, _ time.Duration) uint64 {
+		return uint64(info.SndMSS)
+	}},
+	{"CurRTO", func(info *tcpinfo.TCPInfo, _ time.Duration) uint64 {
+		return uint64(info.RTO / 1000)
+	}},
+	{"CurRwinRcvd", func(info *tcpinfo.TCPInfo, _ time.Duration) uint64 {
+		return uint64(info.SndWnd)
+	}},
+	{"CurRwinSent", nil},
+	{"CurSsthresh", func(info *tcpinfo.TCPInfo, _ time.Duration) uint64 {
+		return uint64(info.SndSsThresh) * uint64(info.SndMSS)
+	}},
+	{"DSACKDups", func(info *tcpinfo.TCPInfo, _ time.Duration) uint64 {
+		return uint64(info.DSackDups)
+	}},
+	{"DataBytesIn", func(info *tcpinfo.TCPInfo, _ time.Duration) uint64 {
+		return info.BytesReceived
+	}},
+	{"DataBytesOut", func(info *tcpinfo.TCPInfo, _ time.Duration) uint64 {
+		return info.BytesSent
+	}},
+	{"DataPktsIn", func(info *tcpinfo.TCPInfo, _ time.Duration) uint64 {
+		return uint64(info.DataSegsIn)
+	}},
+	{"DataPktsOut", func(info *tcpinfo.TCPInfo, _ time.Duration) uint64 {
+		return uint64(info.DataSegsOut)
+	}},
+	{"DupAcksIn", nil},
+	{"DupAcksOut", nil},
+	{"Duration", func(_ *tcpinfo.TCPInfo, elapsed time.Duration) uint64 {
+		return uint64(elapsed / time.Microsecond)
+	}},
+	{"ECNEnabled", func(info *tcpinfo.TCPInfo, _ time.Duration) uint64 {
+		return web100_flag(info.Options, kv_tcpi_opt_ecn)
+	}},
+	{"FastRetran", nil},
+	{"MaxCwnd", nil},
+	{"MaxMSS", func(info *tcpinfo.TCPInfo, _ time.Duration) uint64 {
+		return uint64(info.AdvMSS)
+	}},
+	{"MaxRTO", nil},
+	{"MaxRTT", nil},
+	{"MaxRwinRcvd", func(info *tcpinfo.TCPInfo, _ time.Duration) uint64 {
+		return uint64(info.SndWnd)
+	}},
+	{"MaxRwinSent", nil},
+	{"MaxSsthresh", nil},
+	{"MinMSS", nil},
+	{"MinRTO", nil},
+	{"MinRTT", func(info *tcpinfo.TCPInfo, _ time.Duration) uint64 {
+		return uint64(info.MinRTT / 1000)
+	}},
+	{"MinRwinRcvd", nil},
+	{"MinRwinSent", nil},
+	{"MinSsthresh", nil},
+	{"NagleEnabled", nil},
+	{"OtherReductions", nil},
+	{"PktsIn", func(info *tcpinfo.TCPInfo, _ time.Duration) uint64 {
+		return uint64(info.SegsIn)
+	}},
+	{"PktsOut", func(info *tcpinfo.TCPInfo, _ time.Duration) uint64 {
+		return uint64(info.SegsOut)
+	}},
+	{"PktsRetrans", func(info *tcpinfo.TCPInfo, _ time.Duration) uint64 {
+		return uint64(info.TotalRetrans)
+	}},
+	{"RcvWinScale", func(info *tcpinfo.TCPInfo, _ time.Duration) uint64 {
+		return uint64(info.WScale >> 4)
+	}},
+	{"SACKEnabled", func(info *tcpinfo.TCPInfo, _ time.Duration) uint64 {
+		return web100_flag(info.Options, kv_tcpi_opt_sack)
+	}},
+	{"SACKsRcvd", nil},
+	{"SampleRTT", func(info *tcpinfo.TCPInfo, _ time.Duration) uint64 {
+		return uint64(info.RTT / 1000)
+	}},
+	{"SendStall", nil},
+	{"SlowStart", nil},
+	{"SmoothedRTT", func(info *tcpinfo.TCPInfo, _ time.Duration) uint64 {
+		return uint64(info.RTT / 1000)
+	}},
+	{"SndLimBytesCwnd", nil},
+	{"SndLimBytesRwin", nil},
+	{"SndLimBytesSender", nil},
+	{"SndLimTimeCwnd", func(info *tcpinfo.TCPInfo, _ time.Duration) uint64 {
+		if info.BusyTime > info.RWndLimited+info.SndBufLimited {
+			return info.BusyTime - info.RWndLimited - info.SndBufLimited
+		}
+		return 0
+	}},
+	{"SndLimTimeRwin", func(info *tcpinfo.TCPInfo, _ time.Duration) uint64 {
+		return info.RWndLimited
+	}},
+	{"SndLimTimeSender", func(info *tcpinfo.TCPInfo,
+		_ time.Duration) uint64 {
+		return info.SndBufLimited
+	}},
+	{"SndLimTransCwnd", nil},
+	{"SndLimTransRwin", nil},
+	{"SndLimTransSender", nil},
+	{"SndWinScale", func(info *tcpinfo.TCPInfo, _ time.Duration) uint64 {
+		return uint64(info.WScale & 0x0f)
+	}},
+	{"SubsequentTimeouts", nil},
+	{"SumRTT", func(info *tcpinfo.TCPInfo, _ time.Duration) uint64 {
+		return uint64(info.RTT / 1000) // consistent with CountRTT
+	}},
+	{"Timeouts", nil},
+	{"TimestampsEnabled", func(info *tcpinfo.TCPInfo,
+		_ time.Duration) uint64 {
+		return web100_flag(info.Options, kv_tcpi_opt_timestamps)
+	}},
+	{"WinScaleRcvd", func(info *tcpinfo.TCPInfo, _ time.Duration) uint64 {
+		return uint64(info.WScale & 0x0f)
+	}},
+	{"WinScaleSent", func(info *tcpinfo.TCPInfo, _ time.Duration) uint64 {
+		return uint64(info.WScale >> 4)
+	}},
+}
+
+// Web100_variables formats `info`, which has been collected at the end of
+// a S2C test that lasted `elapsed`, as web100 variables.
+func web100_variables(info *tcpinfo.TCPInfo, elapsed time.Duration) string {
+	variables := ""
+	for _, variable := range kv_web100_variables {
+		if variable.value == nil {
+			variables += fmt.Sprintf("%s: %s\n", variable.name,
+				kv_web100_unavailable)
+			continue
+		}
+		variables += fmt.Sprintf("%s: %d\n", variable.name,
+			variable.value(info, elapsed))
+	}
+	return variables
+}
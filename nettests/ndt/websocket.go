@@ -0,0 +1,292 @@
+package ndt
+
+// NDT over WebSocket. Each NDT message is carried by a binary WebSocket
+// message, both on the control and on the data connections. To reuse the
+// code written for raw TCP, we expose WebSocket connections as net.Conn
+// and the data connection server as a net.Listener.
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/neubot/botticelli/common"
+)
+
+const kv_transport_raw = "raw"
+const kv_transport_ws = "ws"
+
+const kv_ws_path = "/ndt_protocol"
+
+// WebSocketAddress is the endpoint where we accept NDT clients using the
+// WebSocket transport. When empty, the WebSocket transport is disabled.
+var WebSocketAddress = ""
+
+// WebSocketCompression enables the permessage-deflate extension, when
+// the client offers it. Since test payloads are random, compressing them
+// only wastes CPU and makes the throughput depend on how compressible they
+// are, hence this is only meant for experimentation.
+var WebSocketCompression = false
+
+var kv_ws_upgrader = websocket.Upgrader{
+	Subprotocols: []string{"ndt"},
+	CheckOrigin:  common.OriginAllowed,
+}
+
+// Ws_upgrade upgrades `r` to WebSocket using `upgrader`, enabling the
+// compression only if WebSocketCompression is true.
+func ws_upgrade(upgrader *websocket.Upgrader, w http.ResponseWriter,
+	r *http.Request) (*websocket.Conn, error) {
+	config := *upgrader
+	config.EnableCompression = WebSocketCompression
+	return config.Upgrade(w, r, nil)
+}
+
+// Ws_net_conn returns the network connection underlying `conn`, which is
+// below TLS, if the connection uses it.
+func ws_net_conn(conn *websocket.Conn) net.Conn {
+	underlying := conn.UnderlyingConn()
+	if tls_conn, ok := underlying.(*tls.Conn); ok {
+		return tls_conn.NetConn()
+	}
+	return underlying
+}
+
+/*
+  ____
+ / ___|___  _ __  _ __
+| |   / _ \| '_ \| '_ \
+| |__| (_) | | | | | | |
+ \____\___/|_| |_|_| |_|
+
+*/
+
+type ws_conn_t struct {
+	conn   *websocket.Conn
+	reader io.Reader
+}
+
+func (c *ws_conn_t) Read(data []byte) (int, error) {
+	for {
+		if c.reader == nil {
+			msg_type, reader, err := c.conn.NextReader()
+			if err != nil {
+				return 0, err
+			}
+			if msg_type != websocket.BinaryMessage {
+				return 0, protocol_error_t("ndt: expected binary " +
+					"WebSocket message")
+			}
+			c.reader = reader
+		}
+		count, err := c.reader.Read(data)
+		if err == io.EOF {
+			c.reader = nil
+			if count <= 0 {
+				continue
+			}
+			err = nil
+		}
+		return count, err
+	}
+}
+
+func (c *ws_conn_t) Write(data []byte) (int, error) {
+	err := c.conn.WriteMessage(websocket.BinaryMessage, data)
+	if err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+func (c *ws_conn_t) Close() error {
+	return c.conn.Close()
+}
+
+func (c *ws_conn_t) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *ws_conn_t) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *ws_conn_t) SetDeadline(t time.Time) error {
+	err := c.conn.SetReadDeadline(t)
+	if err != nil {
+		return err
+	}
+	return c.conn.SetWriteDeadline(t)
+}
+
+func (c *ws_conn_t) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *ws_conn_t) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
+
+// SyscallConn exposes the underlying socket, e.g. to read its TCP_INFO.
+func (c *ws_conn_t) SyscallConn() (syscall.RawConn, error) {
+	sysconn, ok := ws_net_conn(c.conn).(syscall.Conn)
+	if !ok {
+		return nil, errors.New("ndt: not a syscall.Conn")
+	}
+	return sysconn.SyscallConn()
+}
+
+/*
+ _     _     _
+| |   (_)___| |_ ___ _ __   ___ _ __
+| |   | / __| __/ _ \ '_ \ / _ \ '__|
+| |___| \__ \ ||  __/ | | |  __/ |
+|_____|_|___/\__\___|_| |_|\___|_|
+
+*/
+
+var kv_error_listener_closed = errors.New("ndt: listener closed")
+
+// Listener accepting data connections over WebSocket. It has a deadline
+// for consistency with *net.TCPListener.
+type ws_listener_t struct {
+	listener net.Listener
+	server   *http.Server
+	conns    chan net.Conn
+	closed   chan bool
+	once     sync.Once
+	deadline time.Time
+}
+
+func listen_ws(endpoint string) (net.Listener, error) {
+	listener, err := common.ListenTCP(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	ws_listener := &ws_listener_t{
+		listener: listener,
+		conns:    make(chan net.Conn),
+		closed:   make(chan bool),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(kv_ws_path, func(w http.ResponseWriter, r *http.Request) {
+		conn, err := ws_upgrade(&kv_ws_upgrader, w, r)
+		if err != nil {
+			log.Printf("ndt: cannot upgrade data connection: %s", err)
+			return
+		}
+		select {
+		case ws_listener.conns <- &ws_conn_t{conn: conn}:
+		case <-ws_listener.closed:
+			conn.Close()
+		}
+	})
+	ws_listener.server = &http.Server{Handler: mux}
+	go ws_listener.server.Serve(common.TLSListener(
+		&common.CountingListener{Listener: listener}))
+	return ws_listener, nil
+}
+
+func (l *ws_listener_t) Accept() (net.Conn, error) {
+	var timeout <-chan time.Time
+	if !l.deadline.IsZero() {
+		timer := time.NewTimer(time.Until(l.deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, kv_error_listener_closed
+	case <-timeout:
+		return nil, kv_error_accept_timeout
+	}
+}
+
+func (l *ws_listener_t) SetDeadline(t time.Time) error {
+	l.deadline = t
+	return nil
+}
+
+// Close stops accepting new connections. Note that the connections that
+// were already accepted are hijacked and hence not affected by this.
+func (l *ws_listener_t) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return l.server.Close()
+}
+
+func (l *ws_listener_t) Addr() net.Addr {
+	return l.listener.Addr()
+}
+
+// Listen_data creates the listener for data connections using `transport`.
+func listen_data(transport string, endpoint string) (net.Listener, error) {
+	if transport == kv_transport_ws {
+		return listen_ws(endpoint)
+	}
+	return common.ListenTCP(endpoint)
+}
+
+/*
+ ____
+/ ___|  ___ _ ____   _____ _ __
+\___ \ / _ \ '__\ \ / / _ \ '__|
+ ___) |  __/ |   \ V /  __/ |
+|____/ \___|_|    \_/ \___|_|
+
+*/
+
+func handle_ws_control(w http.ResponseWriter, r *http.Request) {
+	conn, err := ws_upgrade(&kv_ws_upgrader, w, r)
+	if err != nil {
+		log.Printf("ndt: cannot upgrade control connection: %s", err)
+		return
+	}
+	handle_connection(&ws_conn_t{conn: conn}, kv_transport_ws,
+		request_tenant(r), r.URL.Query().Get("access_token"))
+}
+
+// Websocket_mux returns the handler serving NDT over WebSocket and ndt7.
+func websocket_mux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc(kv_ws_path, handle_ws_control)
+	mux.HandleFunc(kv_ndt7_download_path, handle_ndt7_download)
+	mux.HandleFunc(kv_ndt7_upload_path, handle_ndt7_upload)
+	if DuplexTest {
+		mux.HandleFunc(kv_ndt7_duplex_path, handle_ndt7_duplex)
+	}
+	return mux
+}
+
+// StartWebSocket starts accepting NDT clients using the WebSocket transport
+// in the background, if enabled.
+func StartWebSocket() {
+	if WebSocketAddress == "" {
+		return
+	}
+	// Connections are counting, below TLS, such that ndt7 can read the
+	// bytes it transferred from the hijacked connection.
+	listener, err := common.ListenTest(WebSocketAddress)
+	if err != nil {
+		log.Fatal(err)
+	}
+	go serve_websocket(listener, Tenant)
+}
+
+// Serve_websocket serves WebSocket clients of `tenant` from `listener`
+// until it is closed.
+func serve_websocket(listener net.Listener, tenant string) {
+	err := websocket_server(tenant).Serve(common.TLSListener(
+		&common.CountingListener{Listener: listener}))
+	if err != nil && !errors.Is(err, net.ErrClosed) {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,178 @@
+package ndt
+
+// The ndt7 download and upload over WebTransport, i.e., over HTTP/3, such
+// that clients on networks where QUIC works can measure without TCP. The
+// client opens a WebTransport session on the same paths as ndt7, with the
+// same access token, and then, as with our QUIC endpoint, a bidirectional
+// stream, on which it sends the name of the test followed by a newline. We
+// send, or receive, the data on that stream until the test duration elapses
+// and the measurements on a unidirectional stream, as newline delimited ndt7
+// measurements, where the statistics of the QUIC connection replace those
+// of TCP. Clients go through the same admission as those of ndt7 over
+// WebSocket (see admit), under the "webtransport" protocol in the metrics
+// and logs. Results have the ndt7 protocol and the "webtransport" transport.
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/neubot/botticelli/common"
+	"github.com/neubot/botticelli/common/results"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/webtransport-go"
+)
+
+// WebTransportAddress is the UDP address of the HTTP/3 server of the ndt7
+// WebTransport endpoint. When empty, the endpoint is disabled.
+var WebTransportAddress = ""
+
+const kv_transport_webtransport = "webtransport"
+
+type webtransport_conn_key_t struct{}
+
+// The requests carry their QUIC connection, whose statistics we measure.
+var kv_webtransport_conn_key = webtransport_conn_key_t{}
+
+var kv_webtransport_server *webtransport.Server
+
+// StartWebTransport starts the ndt7 WebTransport endpoint in the
+// background, if enabled.
+func StartWebTransport() {
+	if WebTransportAddress == "" {
+		return
+	}
+	tls_config := common.TLSConfig(http3.NextProtoH3)
+	if tls_config == nil {
+		log.Fatal("ndt: the WebTransport endpoint requires TLS")
+	}
+	address, err := common.ResolveAddress(WebTransportAddress)
+	if err != nil {
+		log.Fatal(err)
+	}
+	conn, err := common.ListenUDP(address)
+	if err != nil {
+		log.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(kv_ndt7_download_path,
+		handle_ndt7_webtransport(results.Download))
+	mux.HandleFunc(kv_ndt7_upload_path,
+		handle_ndt7_webtransport(results.Upload))
+	server := &http3.Server{
+		TLSConfig: tls_config,
+		QUICConfig: &quic.Config{
+			HandshakeIdleTimeout: kv_quic_handshake_timeout,
+			MaxIdleTimeout:       kv_ndt7_io_timeout,
+			// Keeps alive the clients waiting for the test slot.
+			KeepAlivePeriod: kv_ndt7_io_timeout / 2,
+		},
+		Handler: mux,
+		ConnContext: func(ctx context.Context,
+			conn *quic.Conn) context.Context {
+			return context.WithValue(ctx, kv_webtransport_conn_key, conn)
+		},
+	}
+	webtransport.ConfigureHTTP3Server(server)
+	kv_webtransport_server = &webtransport.Server{
+		H3:          server,
+		CheckOrigin: common.OriginAllowed,
+	}
+	log.Printf("ndt7: WebTransport endpoint on %s", address)
+	go func() {
+		err := kv_webtransport_server.Serve(conn)
+		log.Printf("ndt7: WebTransport endpoint failed: %s", err)
+	}()
+}
+
+// Handle_ndt7_webtransport returns the handler of the `name` test.
+func handle_ndt7_webtransport(name string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer track_goroutine("session")()
+		conn, ok := r.Context().Value(kv_webtransport_conn_key).(*quic.Conn)
+		if !ok {
+			http.Error(w, "ndt7: not a QUIC connection", 500)
+			return
+		}
+		policy, release := ndt7_admit(w, r, kv_transport_webtransport,
+			name)
+		if policy == nil {
+			return
+		}
+		defer release()
+		session, err := kv_webtransport_server.Upgrade(w, r)
+		if err != nil {
+			common.Infof("ndt7: cannot upgrade to WebTransport: %s", err)
+			return
+		}
+		defer session.CloseWithError(kv_quic_error_none, "")
+		ctx, cancel := context.WithTimeout(session.Context(),
+			kv_quic_handshake_timeout)
+		defer cancel()
+		stream, err := session.AcceptStream(ctx)
+		if err != nil {
+			common.Infof("ndt7: WebTransport client did not open a "+
+				"stream: %s", err)
+			return
+		}
+		request, err := quic_read_request(stream)
+		if err == nil && request != name {
+			err = kv_error_quic_request
+		}
+		if err != nil {
+			common.Infof("ndt7: invalid WebTransport request: %s", err)
+			session.CloseWithError(kv_quic_error_protocol,
+				"invalid request")
+			return
+		}
+		measurements, err := session.OpenUniStreamSync(ctx)
+		if err != nil {
+			common.Infof("ndt7: cannot open WebTransport measurement "+
+				"stream: %s", err)
+			return
+		}
+
+		wconn := &quic_conn_t{
+			quic_stream_t: stream,
+			local:         session.LocalAddr(),
+			remote:        session.RemoteAddr(),
+			close: func() error {
+				return session.CloseWithError(kv_quic_error_none, "")
+			},
+		}
+		result := new_result(wconn, kv_transport_webtransport,
+			session_tenant(request_tenant(r), policy))
+		result.policy = policy
+		result.Protocol = "ndt7"
+		result.ClientVersion = r.Header.Get("User-Agent")
+		test := result.new_test(name, name)
+		test.NumStreams = 1
+		common.Infof("ndt7: new WebTransport session %s from %s",
+			result.UUID, result.ClientAddress)
+		defer register_session(result, wconn)()
+		result.set_lifetime(2*policy.duration + kv_session_overhead)
+		defer result.log_summary()
+		defer result.save()
+		result.phase(name)
+		quic_run(result, test, wconn, &quic_test_t{
+			conn:         conn,
+			stream:       stream,
+			measurements: measurements,
+			closed:       session.Context().Done(),
+			measurement: func(elapsed time.Duration, count int64,
+				stats quic.ConnectionStats) interface{} {
+				return &ndt7_measurement_t{
+					AppInfo: &ndt7_app_info_t{
+						ElapsedTime: int64(elapsed / time.Microsecond),
+						NumBytes:    count,
+					},
+					Origin:   "server",
+					Test:     name,
+					QUICInfo: quic_metrics(stats),
+				}
+			},
+		})
+	}
+}
@@ -0,0 +1,25 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"github.com/neubot/botticelli/common"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// Log_level_on_signal makes the logs more verbose on SIGUSR1 and less
+// verbose on SIGUSR2.
+func log_level_on_signal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1, syscall.SIGUSR2)
+	for sig := range signals {
+		if sig == syscall.SIGUSR1 {
+			common.SetLogLevel(common.GetLogLevel() + 1)
+		} else {
+			common.SetLogLevel(common.GetLogLevel() - 1)
+		}
+	}
+}
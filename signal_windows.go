@@ -0,0 +1,9 @@
+//go:build windows
+// +build windows
+
+package main
+
+// Log_level_on_signal does nothing, since Windows has no SIGUSR1 and
+// SIGUSR2; use the /loglevel admin endpoint instead.
+func log_level_on_signal() {
+}